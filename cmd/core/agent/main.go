@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -15,9 +21,12 @@ import (
 	"fluidity/internal/core/agent"
 	"fluidity/internal/core/agent/lifecycle"
 	"fluidity/internal/shared/config"
+	"fluidity/internal/shared/keepalive"
 	"fluidity/internal/shared/logging"
+	"fluidity/internal/shared/protocol"
 	"fluidity/internal/shared/secretsmanager"
 	tlsutil "fluidity/internal/shared/tls"
+	"fluidity/internal/shared/version"
 )
 
 var (
@@ -28,6 +37,9 @@ var (
 	certFile   string
 	keyFile    string
 	caCertFile string
+
+	checkServer  string
+	outputFormat string
 )
 
 // getConfigValue returns the first non-empty value
@@ -51,14 +63,37 @@ func main() {
 		Long:  "Fluidity tunnel agent - HTTP proxy that forwards traffic through secure tunnel",
 		RunE:  runAgent,
 	}
+	rootCmd.Version = version.Get().String()
+
+	addConfigFlags(rootCmd)
 
-	rootCmd.Flags().StringVarP(&configFile, "config", "c", "", "Configuration file path")
-	rootCmd.Flags().IntVar(&serverPort, "server-port", 0, "Tunnel server port")
-	rootCmd.Flags().IntVar(&proxyPort, "proxy-port", 0, "Local proxy port")
-	rootCmd.Flags().StringVar(&logLevel, "log-level", "", "Log level (debug, info, warn, error)")
-	rootCmd.Flags().StringVar(&certFile, "cert", "", "Client certificate file")
-	rootCmd.Flags().StringVar(&keyFile, "key", "", "Client private key file")
-	rootCmd.Flags().StringVar(&caCertFile, "ca", "", "CA certificate file")
+	versionCmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print build version and optionally check compatibility with a tunnel server",
+		Args:  cobra.NoArgs,
+		RunE:  runVersion,
+	}
+	versionCmd.Flags().StringVar(&checkServer, "check", "", "Tunnel server address (host:port) to check protocol compatibility with")
+	versionCmd.Flags().StringVarP(&configFile, "config", "c", "", "Configuration file path (for TLS certificates)")
+	rootCmd.AddCommand(versionCmd)
+
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Print the effective configuration, with secrets redacted",
+		Args:  cobra.NoArgs,
+		RunE:  runConfig,
+	}
+	addConfigFlags(configCmd)
+	configCmd.Flags().StringVarP(&outputFormat, "output", "o", "yaml", "Output format (yaml, json)")
+	rootCmd.AddCommand(configCmd)
+
+	hashPasswordCmd := &cobra.Command{
+		Use:   "hash-password",
+		Short: "Read a proxy password from stdin and print its hash for proxy_password_hash",
+		Args:  cobra.NoArgs,
+		RunE:  runHashPassword,
+	}
+	rootCmd.AddCommand(hashPasswordCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -66,10 +101,20 @@ func main() {
 	}
 }
 
-func runAgent(cmd *cobra.Command, args []string) error {
-	// Create logger
-	logger := logging.NewLogger("agent")
+// addConfigFlags registers the configuration file and override flags shared by the run and config commands
+func addConfigFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+	flags.StringVarP(&configFile, "config", "c", "", "Configuration file path")
+	flags.IntVar(&serverPort, "server-port", 0, "Tunnel server port")
+	flags.IntVar(&proxyPort, "proxy-port", 0, "Local proxy port")
+	flags.StringVar(&logLevel, "log-level", "", "Log level (debug, info, warn, error)")
+	flags.StringVar(&certFile, "cert", "", "Client certificate file")
+	flags.StringVar(&keyFile, "key", "", "Client private key file")
+	flags.StringVar(&caCertFile, "ca", "", "CA certificate file")
+}
 
+// loadConfig loads the agent configuration with the CLI flag overrides applied
+func loadConfig() (*agent.Config, error) {
 	// Build configuration overrides from CLI flags
 	overrides := make(map[string]interface{})
 	if serverPort != 0 {
@@ -95,7 +140,23 @@ func runAgent(cmd *cobra.Command, args []string) error {
 	// The deployment script ensures agent.yaml is in the same directory as the binary
 	cfg, err := config.LoadConfig[agent.Config](configFile, overrides)
 	if err != nil {
-		return fmt.Errorf("failed to load configuration: %w", err)
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+func runAgent(cmd *cobra.Command, args []string) error {
+	// Create logger
+	logger := logging.NewLogger("agent")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	// Component overrides apply to every logger, including this one
+	if err := logging.SetComponentLevels(cfg.LogLevels); err != nil {
+		return fmt.Errorf("invalid log_levels: %w", err)
 	}
 
 	// Set log level
@@ -110,20 +171,28 @@ func runAgent(cmd *cobra.Command, args []string) error {
 	{
 		logger.Info("Starting server via lifecycle wake/query")
 
+		// Initial connect retries until the server finishes cold-starting
+		connectTimeout := cfg.InitialConnectTimeout
+		if connectTimeout <= 0 {
+			connectTimeout = 90 * time.Second
+		}
+
 		// Load lifecycle configuration from agent config file
 		lifecycleConfig = &lifecycle.Config{
-			WakeEndpoint:            cfg.WakeEndpoint,
-			QueryEndpoint:           cfg.QueryEndpoint,
-			KillEndpoint:            cfg.KillEndpoint,
-			IAMRoleARN:              cfg.IAMRoleARN,
-			AWSRegion:               cfg.AWSRegion,
-			ClusterName:             "", // Not used in current implementation
-			ServiceName:             "", // Not used in current implementation
-			ConnectionTimeout:       30 * time.Second,
-			ConnectionRetryInterval: 5 * time.Second,
-			HTTPTimeout:             30 * time.Second,
-			MaxRetries:              3,
-			Enabled:                 true,
+			WakeEndpoint:               cfg.WakeEndpoint,
+			QueryEndpoint:              cfg.QueryEndpoint,
+			KillEndpoint:               cfg.KillEndpoint,
+			IAMRoleARN:                 cfg.IAMRoleARN,
+			AWSRegion:                  cfg.AWSRegion,
+			ClusterName:                "", // Not used in current implementation
+			ServiceName:                "", // Not used in current implementation
+			ConnectionTimeout:          connectTimeout,
+			ConnectionRetryInterval:    2 * time.Second,
+			ConnectionRetryMaxInterval: 15 * time.Second,
+			HTTPTimeout:                30 * time.Second,
+			KillTimeout:                cfg.KillTimeout,
+			MaxRetries:                 3,
+			Enabled:                    true,
 		}
 
 		// Lifecycle is disabled if endpoints are not configured
@@ -136,35 +205,49 @@ func runAgent(cmd *cobra.Command, args []string) error {
 			return fmt.Errorf("lifecycle configuration invalid: fix WAKE/QUERY/KILL endpoints or credentials")
 		}
 
-		// Create lifecycle client
-		lifecycleClient, err = lifecycle.NewClient(lifecycleConfig, logger)
-		if err != nil {
-			return fmt.Errorf("failed to create lifecycle client for IP discovery: %w", err)
-		}
+		if cfg.OnDemand {
+			// The server is woken by the first proxied request instead
+			logger.Info("On-demand mode enabled, the server is started when a request needs it", "idle_timeout", cfg.OnDemandIdleTimeout.String())
+		} else {
+			// Create lifecycle client
+			lifecycleClient, err = lifecycle.NewClient(lifecycleConfig, logger)
+			if err != nil {
+				return fmt.Errorf("failed to create lifecycle client for IP discovery: %w", err)
+			}
 
-		// Call wake to get server IP
-		wakeCtx, wakeCancel := context.WithTimeout(context.Background(), 180*time.Second)
-		defer wakeCancel()
+			// Call wake to get server IP
+			wakeCtx, wakeCancel := context.WithTimeout(context.Background(), 180*time.Second)
+			defer wakeCancel()
 
-		if err := lifecycleClient.WakeAndGetIP(wakeCtx, cfg); err != nil {
-			return fmt.Errorf("failed to auto-discover server IP: %w", err)
-		}
+			if err := lifecycleClient.WakeAndGetIP(wakeCtx, cfg); err != nil {
+				return fmt.Errorf("failed to auto-discover server IP: %w", err)
+			}
 
-		logger.Info("Started server via lifecycle", "server_ip", cfg.ServerIP)
+			logger.Info("Started server via lifecycle", "server_ip", cfg.ServerIP)
+		}
 		autoDiscovered = true
 	}
 
-	// Ensure lifecycle Kill is attempted on exit or error
-	defer func() {
-		if lifecycleClient != nil {
-			logger.Info("Ensuring lifecycle Kill on exit")
-			killCtx, killCancel := context.WithTimeout(context.Background(), 30*time.Second)
-			if kerr := lifecycleClient.Kill(killCtx); kerr != nil {
+	// killServer calls the Kill API for the server this agent woke. A lifecycle client only ever calls it
+	// once, so in on-demand mode each wake gets a fresh client.
+	var lifecycleMu sync.Mutex
+	killServer := func() {
+		lifecycleMu.Lock()
+		defer lifecycleMu.Unlock()
+		if lifecycleClient != nil && lifecycleConfig.Enabled {
+			logger.Info("Calling Kill API for ECS service shutdown")
+			if kerr := lifecycleClient.Kill(context.Background()); kerr != nil {
 				logger.Warn("Failed to kill ECS service", "error", kerr.Error())
 			}
-			killCancel()
 		}
-	}()
+		if cfg.OnDemand {
+			lifecycleClient = nil
+		}
+	}
+
+	// Kill the server on every exit, graceful or not, once the tunnels are closed; the lifecycle
+	// client bounds the call by its kill timeout
+	defer killServer()
 
 	logger.Info("Starting Fluidity tunnel agent",
 		"server", cfg.GetServerAddress(),
@@ -213,18 +296,177 @@ func runAgent(cmd *cobra.Command, args []string) error {
 		logger.Info("Lifecycle management enabled, waking ECS service")
 		wakeCtx, wakeCancel := context.WithTimeout(context.Background(), 30*time.Second)
 		_, err := lifecycleClient.Wake(wakeCtx)
-		if err != nil {
+		var apiErr *lifecycle.APIError
+		if errors.As(err, &apiErr) && !apiErr.Retryable() {
+			// Rejected requests (e.g. 403) will not fix themselves; point at the likely cause
+			logger.Warn("Wake request rejected by lifecycle API, check the agent's IAM permissions and endpoint, continuing anyway",
+				"status", apiErr.StatusCode,
+				"error", err.Error())
+		} else if err != nil {
 			// Log warning but continue - fallback to connecting without wake
 			logger.Warn("Failed to wake ECS service, continuing anyway", "error", err.Error())
 		}
 		wakeCancel()
 	}
 
+	// A zero config keeps Go's default TCP keepalive
+	var tcpKeepalive net.KeepAliveConfig
+	if cfg.TCPKeepalive {
+		tcpKeepalive = keepalive.TCPConfig(cfg.TCPKeepaliveIdle, cfg.TCPKeepaliveInterval)
+	}
+
+	// Tunnel state changes are reported to the configured command and webhook, e.g. for a tray notification
+	var stateNotifiers agent.StateNotifiers
+	if len(cfg.StateNotifyCommand) > 0 {
+		notifier, err := agent.NewCommandNotifier(cfg.StateNotifyCommand)
+		if err != nil {
+			return fmt.Errorf("failed to configure state notifications: %w", err)
+		}
+		stateNotifiers = append(stateNotifiers, notifier)
+	}
+	if cfg.StateNotifyWebhook != "" {
+		notifier, err := agent.NewWebhookNotifier(cfg.StateNotifyWebhook)
+		if err != nil {
+			return fmt.Errorf("failed to configure state notifications: %w", err)
+		}
+		stateNotifiers = append(stateNotifiers, notifier)
+	}
+
+	// newClient creates a tunnel client to addr with the agent's connection settings
+	newClient := func(clientTLS *tls.Config, addr string) *agent.Client {
+		c := agent.NewClient(clientTLS, addr, cfg.LogLevel)
+		c.SetStrictCompatibility(cfg.StrictCompatibility)
+		c.SetIAMAuthDisabled(cfg.DisableIAMAuth)
+		c.SetTCPKeepalive(tcpKeepalive)
+		c.SetHeartbeatInterval(cfg.HeartbeatInterval)
+		c.SetRequestTimeout(cfg.RequestTimeout)
+		c.SetLogFullURL(cfg.LogFullURL)
+		if len(stateNotifiers) > 0 {
+			c.SetStateNotifier(stateNotifiers, cfg.StateNotifyTimeout)
+		}
+		c.Logger().SetStreamFilter(cfg.LogStreamID)
+		return c
+	}
+
 	// Create tunnel client
-	tunnelClient := agent.NewClient(tlsConfig, cfg.GetServerAddress(), cfg.LogLevel)
+	tunnelClient := newClient(tlsConfig, cfg.GetServerAddress())
+
+	// Connections to further server tasks share the proxied traffic with the primary one
+	var extraClients []*agent.Client
+	for _, addr := range cfg.AdditionalServers {
+		extraClients = append(extraClients, newClient(tlsConfig, addr))
+	}
+
+	// Named tunnels each connect to their own server and carry only the requests for their hosts
+	var tunnelClients []*agent.Client
+	var tunnelPools []*agent.Pool
+	for i := range cfg.Tunnels {
+		tunnel := &cfg.Tunnels[i]
+		tunnelTLS := tlsConfig
+		if tunnel.CertFile != "" || tunnel.KeyFile != "" || tunnel.CACertFile != "" {
+			tunnelTLS, err = tlsutil.LoadClientTLSConfig(
+				getConfigValue(tunnel.CertFile, cfg.CertFile),
+				getConfigValue(tunnel.KeyFile, cfg.KeyFile),
+				getConfigValue(tunnel.CACertFile, cfg.CACertFile))
+			if err != nil {
+				return fmt.Errorf("failed to load TLS configuration for tunnel %s: %w", tunnel.Name, err)
+			}
+		}
+
+		tunnelLifecycle, err := wakeTunnel(cfg, tunnel, logger)
+		if err != nil {
+			return err
+		}
+		if tunnelLifecycle != nil {
+			defer func() {
+				if kerr := tunnelLifecycle.Kill(context.Background()); kerr != nil {
+					logger.Warn("Failed to kill tunnel server", "tunnel", tunnel.Name, "error", kerr.Error())
+				}
+			}()
+		}
+
+		client := newClient(tunnelTLS, fmt.Sprintf("%s:%d", tunnel.ServerIP, tunnel.ServerPort))
+		pool, err := agent.NewPool([]*agent.Client{client}, "", cfg.LogLevel)
+		if err != nil {
+			return fmt.Errorf("invalid tunnel %s: %w", tunnel.Name, err)
+		}
+		tunnelClients = append(tunnelClients, client)
+		tunnelPools = append(tunnelPools, pool)
+	}
 
 	// Create proxy server
 	proxyServer := agent.NewServer(cfg.LocalProxyPort, tunnelClient, cfg.LogLevel)
+	if cfg.StatusPath != "" {
+		proxyServer.SetStatusPath(cfg.StatusPath)
+	}
+	proxyServer.SetChecksums(cfg.VerifyChecksums)
+	proxyServer.SetAllowedMethods(cfg.AllowedMethods)
+	proxyServer.SetAllowedSchemes(cfg.AllowedSchemes)
+	proxyServer.SetStrictHostValidation(cfg.StrictHostValidation)
+	proxyServer.SetStrictFraming(cfg.StrictFraming)
+	proxyServer.SetStartupWait(cfg.StartupWait)
+	if cfg.OnDemand {
+		startTunnel := func(ctx context.Context) error {
+			wakeLifecycle, err := lifecycle.NewClient(lifecycleConfig, logger)
+			if err != nil {
+				return fmt.Errorf("failed to create lifecycle client: %w", err)
+			}
+			lifecycleMu.Lock()
+			lifecycleClient = wakeLifecycle
+			lifecycleMu.Unlock()
+
+			wakeCtx, wakeCancel := context.WithTimeout(ctx, 180*time.Second)
+			defer wakeCancel()
+			if err := wakeLifecycle.WakeAndGetIP(wakeCtx, cfg); err != nil {
+				return fmt.Errorf("failed to wake server: %w", err)
+			}
+			tunnelClient.UpdateServerAddress(cfg.GetServerAddress())
+			logger.Info("Started server via lifecycle, connecting", "server_ip", cfg.ServerIP)
+			return wakeLifecycle.EstablishConnection(ctx, tunnelClient.Connect)
+		}
+		stopTunnel := func() error {
+			err := tunnelClient.Disconnect()
+			killServer()
+			return err
+		}
+		proxyServer.SetOnDemand(startTunnel, stopTunnel, cfg.OnDemandIdleTimeout)
+	}
+	if err := proxyServer.SetNoProxy(cfg.NoProxy); err != nil {
+		return fmt.Errorf("invalid no_proxy configuration: %w", err)
+	}
+	if len(extraClients) > 0 {
+		pool, err := agent.NewPool(append([]*agent.Client{tunnelClient}, extraClients...), cfg.LoadBalance, cfg.LogLevel)
+		if err != nil {
+			return fmt.Errorf("invalid load balancing configuration: %w", err)
+		}
+		proxyServer.SetPool(pool)
+		logger.Info("Load balancing across server tasks", "servers", len(extraClients)+1, "strategy", cfg.LoadBalance)
+	}
+	for i, tunnel := range cfg.Tunnels {
+		if err := proxyServer.AddTunnel(tunnel.Name, tunnelPools[i], tunnel.Hosts); err != nil {
+			return fmt.Errorf("invalid tunnels configuration: %w", err)
+		}
+		logger.Info("Routing hosts through named tunnel", "tunnel", tunnel.Name, "server_address", tunnelClients[i].ServerAddress(), "hosts", len(tunnel.Hosts))
+	}
+	proxyServer.SetLogFullURL(cfg.LogFullURL)
+	proxyServer.Logger().SetStreamFilter(cfg.LogStreamID)
+	proxyServer.SetMaxResponseBodyBytes(cfg.MaxResponseBodyBytes)
+	proxyServer.SetStreamBodyThreshold(cfg.StreamBodyThresholdBytes)
+	proxyServer.SetPreserveHopByHopHeaders(cfg.PreserveHopByHopHeaders)
+	proxyServer.SetConnectCoalescing(cfg.ConnectCoalesceDelay, cfg.ConnectCoalesceBytes)
+	proxyServer.SetConnectCompression(cfg.ConnectCompressPorts)
+	wsKeepalive := keepalive.Resolve(cfg.WebSocketPingInterval, cfg.WebSocketPongTimeout)
+	proxyServer.SetWebSocketKeepalive(wsKeepalive.Interval, wsKeepalive.Timeout)
+	if cfg.ProxyUsername != "" {
+		if cfg.ProxyPasswordHash != "" {
+			if err := proxyServer.SetProxyAuthHash(cfg.ProxyUsername, cfg.ProxyPasswordHash); err != nil {
+				return fmt.Errorf("invalid proxy authentication configuration: %w", err)
+			}
+		} else if err := proxyServer.SetProxyAuth(cfg.ProxyUsername, cfg.ProxyPassword); err != nil {
+			return fmt.Errorf("invalid proxy authentication configuration: %w", err)
+		}
+		logger.Info("Proxy authentication enabled", "username", cfg.ProxyUsername)
+	}
 
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -239,49 +481,92 @@ func runAgent(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to start proxy server: %w", err)
 	}
 
-	// Connection management goroutine
-	go func() {
-		// Connect to tunnel server (single attempt, no retries)
-		logger.Info("Connecting to tunnel server", "server_ip", cfg.ServerIP, "server_port", cfg.ServerPort, "server_address", cfg.GetServerAddress())
-		logger.Debug("Connection configuration", "tls_min_version", "1.3", "tls_cert_file", cfg.CertFile, "tls_key_file", cfg.KeyFile, "tls_ca_file", cfg.CACertFile)
-		if err := tunnelClient.Connect(); err != nil {
-			logger.Error("Failed to establish tunnel connection to server, exiting", err, "server_ip", cfg.ServerIP, "server_port", cfg.ServerPort)
-			cancel()
-			sigChan <- syscall.SIGTERM
-			return
-		}
+	// Connection management goroutine; in on-demand mode requests bring the tunnel up instead
+	if cfg.OnDemand {
+		logger.Info("Agent ready for receiving proxy requests, the tunnel connects on the first one", "listen_addr", fmt.Sprintf("http://127.0.0.1:%d", cfg.LocalProxyPort))
+	} else {
+		go func() {
+			// Connect to tunnel server, retrying with backoff while the server cold-starts
+			logger.Info("Connecting to tunnel server", "server_ip", cfg.ServerIP, "server_port", cfg.ServerPort, "server_address", cfg.GetServerAddress())
+			logger.Debug("Connection configuration", "tls_min_version", "1.3", "tls_cert_file", cfg.CertFile, "tls_key_file", cfg.KeyFile, "tls_ca_file", cfg.CACertFile)
+			if err := lifecycleClient.EstablishConnection(ctx, tunnelClient.Connect); err != nil {
+				logger.Error("Failed to establish tunnel connection to server, exiting", err, "server_ip", cfg.ServerIP, "server_port", cfg.ServerPort)
+				tunnelClient.NotifyState(agent.StateFailed, err.Error())
+				cancel()
+				sigChan <- syscall.SIGTERM
+				return
+			}
 
-		logger.Info("Successfully connected to tunnel server", "server_ip", cfg.ServerIP)
-		logger.Info("Agent ready for receiving proxy requests", "listen_addr", fmt.Sprintf("http://127.0.0.1:%d", cfg.LocalProxyPort))
-
-		// Wait for disconnection or shutdown
-		select {
-		case <-tunnelClient.ReconnectChannel():
-			logger.Error("Tunnel connection lost, exiting", fmt.Errorf("connection disconnected"))
-			cancel()
-			sigChan <- syscall.SIGTERM
-		case <-ctx.Done():
-			return
-		}
-	}()
+			logger.Info("Successfully connected to tunnel server", "server_ip", cfg.ServerIP)
+			logger.Info("Agent ready for receiving proxy requests", "listen_addr", fmt.Sprintf("http://127.0.0.1:%d", cfg.LocalProxyPort))
+
+			reconnector := agent.NewReconnector(cfg.GetReconnectConfig(), tunnelClient.Connect, logger)
+
+			for {
+				// Wait for disconnection or shutdown
+				select {
+				case <-tunnelClient.ReconnectChannel():
+				case <-ctx.Done():
+					return
+				}
+
+				if !cfg.AutoReconnect {
+					logger.Error("Tunnel connection lost, exiting", fmt.Errorf("connection disconnected"))
+					tunnelClient.NotifyState(agent.StateFailed, "connection lost and auto_reconnect is off")
+					cancel()
+					sigChan <- syscall.SIGTERM
+					return
+				}
+
+				logger.Warn("Tunnel connection lost, reconnecting")
+				tunnelClient.NotifyState(agent.StateReconnecting, "")
+				if err := reconnector.Run(ctx); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	// Keep additional server and named tunnel connections up; losing one only takes it out of its pool
+	for _, extraClient := range append(append([]*agent.Client{}, extraClients...), tunnelClients...) {
+		go func(c *agent.Client) {
+			reconnector := agent.NewReconnector(cfg.GetReconnectConfig(), c.Connect, logger)
+			for {
+				if err := reconnector.Run(ctx); err != nil {
+					return
+				}
+				select {
+				case <-c.ReconnectChannel():
+				case <-ctx.Done():
+					return
+				}
+				logger.Warn("Connection to additional tunnel server lost, reconnecting", "server_address", c.ServerAddress())
+				c.NotifyState(agent.StateReconnecting, "")
+			}
+		}(extraClient)
+	}
+
+	// Shut down when no traffic has been proxied for the configured idle time
+	if cfg.MaxIdleTime > 0 {
+		logger.Info("Idle shutdown enabled", "max_idle_time", cfg.MaxIdleTime.String())
+		idle := proxyServer.IdleChannel(cfg.MaxIdleTime)
+		go func() {
+			select {
+			case <-idle:
+				logger.Info("No proxied traffic within the idle limit, shutting down", "max_idle_time", cfg.MaxIdleTime.String())
+				sigChan <- syscall.SIGTERM
+			case <-ctx.Done():
+			}
+		}()
+	}
 
 	// Wait for shutdown signal
 	<-sigChan
 	logger.Info("Shutdown signal received, stopping agent...")
 
-	// Graceful shutdown
+	// Graceful shutdown; the deferred Kill stops the server once the tunnels are closed
 	cancel()
 
-	// If lifecycle is enabled, call Kill API
-	if lifecycleClient != nil && lifecycleConfig.Enabled {
-		logger.Info("Calling Kill API for graceful ECS service shutdown")
-		killCtx, killCancel := context.WithTimeout(context.Background(), 30*time.Second)
-		if err := lifecycleClient.Kill(killCtx); err != nil {
-			logger.Warn("Failed to kill ECS service", "error", err.Error())
-		}
-		killCancel()
-	}
-
 	// Stop proxy server
 	if err := proxyServer.Stop(); err != nil {
 		logger.Error("Error stopping proxy server", err)
@@ -291,7 +576,146 @@ func runAgent(cmd *cobra.Command, args []string) error {
 	if err := tunnelClient.Disconnect(); err != nil {
 		logger.Error("Error disconnecting tunnel client", err)
 	}
+	for _, extraClient := range extraClients {
+		extraClient.Disconnect()
+	}
+	for _, client := range tunnelClients {
+		client.Disconnect()
+	}
+
+	// Give the state notifier the chance to report the final disconnect or failure
+	flushWait := cfg.StateNotifyTimeout
+	if flushWait <= 0 {
+		flushWait = agent.DefaultStateNotifyTimeout
+	}
+	for _, client := range append(append([]*agent.Client{tunnelClient}, extraClients...), tunnelClients...) {
+		client.FlushStateNotifications(flushWait)
+	}
 
 	logger.Info("Agent stopped")
 	return nil
 }
+
+// wakeTunnel starts a named tunnel's server through its lifecycle endpoints, discovering its address
+// when none is configured, and returns the lifecycle client to kill it with on exit. It returns nil for
+// tunnels without lifecycle endpoints, which connect to their configured address as is.
+func wakeTunnel(cfg *agent.Config, tunnel *agent.TunnelConfig, logger *logging.Logger) (*lifecycle.Client, error) {
+	if tunnel.WakeEndpoint == "" {
+		if tunnel.ServerIP == "" {
+			return nil, fmt.Errorf("tunnel %s needs a server_ip or a wake_endpoint", tunnel.Name)
+		}
+		return nil, nil
+	}
+
+	lifecycleConfig := &lifecycle.Config{
+		WakeEndpoint:               tunnel.WakeEndpoint,
+		QueryEndpoint:              tunnel.QueryEndpoint,
+		KillEndpoint:               tunnel.KillEndpoint,
+		IAMRoleARN:                 cfg.IAMRoleARN,
+		AWSRegion:                  cfg.AWSRegion,
+		ConnectionTimeout:          90 * time.Second,
+		ConnectionRetryInterval:    2 * time.Second,
+		ConnectionRetryMaxInterval: 15 * time.Second,
+		HTTPTimeout:                30 * time.Second,
+		KillTimeout:                cfg.KillTimeout,
+		MaxRetries:                 3,
+		Enabled:                    true,
+	}
+	if err := lifecycleConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("tunnel %s lifecycle configuration invalid: %w", tunnel.Name, err)
+	}
+	lifecycleClient, err := lifecycle.NewClient(lifecycleConfig, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create lifecycle client for tunnel %s: %w", tunnel.Name, err)
+	}
+
+	logger.Info("Starting tunnel server via lifecycle", "tunnel", tunnel.Name)
+	wakeCtx, wakeCancel := context.WithTimeout(context.Background(), 180*time.Second)
+	defer wakeCancel()
+	if tunnel.ServerIP != "" {
+		if _, err := lifecycleClient.Wake(wakeCtx); err != nil {
+			logger.Warn("Failed to wake tunnel server, continuing anyway", "tunnel", tunnel.Name, "error", err.Error())
+		}
+		return lifecycleClient, nil
+	}
+
+	// Discovery reports the address through an agent config
+	discovered := &agent.Config{ServerPort: tunnel.ServerPort}
+	if err := lifecycleClient.WakeAndGetIP(wakeCtx, discovered); err != nil {
+		return nil, fmt.Errorf("failed to discover server IP for tunnel %s: %w", tunnel.Name, err)
+	}
+	tunnel.ServerIP = discovered.ServerIP
+	return lifecycleClient, nil
+}
+
+// runVersion prints build information and, with --check, reports compatibility with a tunnel server
+func runVersion(cmd *cobra.Command, args []string) error {
+	local := protocol.LocalHello()
+	fmt.Printf("fluidity-agent %s\n", version.Get())
+	fmt.Printf("protocol version %d (min %d), features %#x\n", local.ProtocolVersion, local.MinProtocolVersion, local.Features)
+
+	if checkServer == "" {
+		return nil
+	}
+
+	cfg, err := config.LoadConfig[agent.Config](configFile, nil)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	tlsConfig, err := tlsutil.LoadClientTLSConfig(cfg.CertFile, cfg.KeyFile, cfg.CACertFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS configuration: %w", err)
+	}
+
+	tunnelClient := agent.NewClient(tlsConfig, checkServer, "error")
+	if err := tunnelClient.Connect(); err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", checkServer, err)
+	}
+	defer tunnelClient.Disconnect()
+
+	peer := tunnelClient.ServerHello()
+	if peer == nil {
+		fmt.Printf("server %s: legacy build without version handshake\n", checkServer)
+		return nil
+	}
+
+	compat, reason := protocol.CheckCompatibility(local, *peer)
+	fmt.Printf("server %s: %s (commit %s), protocol version %d\n", checkServer, peer.BuildVersion, peer.BuildCommit, peer.ProtocolVersion)
+	fmt.Printf("compatibility: %s\n", compat)
+	if reason != "" {
+		fmt.Printf("reason: %s\n", reason)
+	}
+
+	if compat == protocol.Incompatible {
+		return fmt.Errorf("server %s is incompatible: %s", checkServer, reason)
+	}
+	return nil
+}
+
+// runConfig prints the configuration the agent would run with, for debugging config precedence
+func runConfig(cmd *cobra.Command, args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	return config.Dump(os.Stdout, cfg, outputFormat)
+}
+
+// runHashPassword prints the hash of the password read from the first line of stdin
+func runHashPassword(cmd *cobra.Command, args []string) error {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read password: %w", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return fmt.Errorf("password is empty")
+	}
+	hash, err := agent.HashProxyPassword(password)
+	if err != nil {
+		return err
+	}
+	fmt.Println(hash)
+	return nil
+}
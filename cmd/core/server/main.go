@@ -3,9 +3,7 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"encoding/json"
 	"fmt"
-	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -15,9 +13,12 @@ import (
 
 	"fluidity/internal/core/server"
 	"fluidity/internal/shared/config"
+	"fluidity/internal/shared/keepalive"
 	"fluidity/internal/shared/logging"
+	"fluidity/internal/shared/protocol"
 	"fluidity/internal/shared/secretsmanager"
 	tlsutil "fluidity/internal/shared/tls"
+	"fluidity/internal/shared/version"
 )
 
 var (
@@ -29,6 +30,7 @@ var (
 	certFile       string
 	keyFile        string
 	caCertFile     string
+	outputFormat   string
 )
 
 func main() {
@@ -41,15 +43,19 @@ func main() {
 		Long:  "Fluidity tunnel server - Accepts secure connections from agents and forwards HTTP requests",
 		RunE:  runServer,
 	}
+	rootCmd.Version = version.Get().String()
 
-	rootCmd.Flags().StringVarP(&configFile, "config", "c", "", "Configuration file path")
-	rootCmd.Flags().StringVar(&listenAddr, "listen-addr", "", "Address to listen on")
-	rootCmd.Flags().IntVar(&listenPort, "listen-port", 0, "Port to listen on")
-	rootCmd.Flags().IntVar(&maxConnections, "max-connections", 0, "Maximum number of concurrent connections")
-	rootCmd.Flags().StringVar(&logLevel, "log-level", "", "Log level (debug, info, warn, error)")
-	rootCmd.Flags().StringVar(&certFile, "cert", "", "Server certificate file")
-	rootCmd.Flags().StringVar(&keyFile, "key", "", "Server private key file")
-	rootCmd.Flags().StringVar(&caCertFile, "ca", "", "CA certificate file")
+	addConfigFlags(rootCmd)
+
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Print the effective configuration, with secrets redacted",
+		Args:  cobra.NoArgs,
+		RunE:  runConfig,
+	}
+	addConfigFlags(configCmd)
+	configCmd.Flags().StringVarP(&outputFormat, "output", "o", "yaml", "Output format (yaml, json)")
+	rootCmd.AddCommand(configCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -57,10 +63,21 @@ func main() {
 	}
 }
 
-func runServer(cmd *cobra.Command, args []string) error {
-	// Create logger
-	logger := logging.NewLogger("server")
+// addConfigFlags registers the configuration file and override flags shared by the run and config commands
+func addConfigFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+	flags.StringVarP(&configFile, "config", "c", "", "Configuration file path")
+	flags.StringVar(&listenAddr, "listen-addr", "", "Address to listen on")
+	flags.IntVar(&listenPort, "listen-port", 0, "Port to listen on")
+	flags.IntVar(&maxConnections, "max-connections", 0, "Maximum number of concurrent connections")
+	flags.StringVar(&logLevel, "log-level", "", "Log level (debug, info, warn, error)")
+	flags.StringVar(&certFile, "cert", "", "Server certificate file")
+	flags.StringVar(&keyFile, "key", "", "Server private key file")
+	flags.StringVar(&caCertFile, "ca", "", "CA certificate file")
+}
 
+// loadConfig loads the server configuration with the CLI flag overrides applied
+func loadConfig() (*server.Config, error) {
 	// Build configuration overrides from CLI flags
 	overrides := make(map[string]interface{})
 	if listenAddr != "" {
@@ -88,13 +105,32 @@ func runServer(cmd *cobra.Command, args []string) error {
 	// Load configuration
 	cfg, err := config.LoadConfig[server.Config](configFile, overrides)
 	if err != nil {
-		return fmt.Errorf("failed to load configuration: %w", err)
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+func runServer(cmd *cobra.Command, args []string) error {
+	// Create logger
+	logger := logging.NewLogger("server")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	// Component overrides apply to every logger, including this one
+	if err := logging.SetComponentLevels(cfg.LogLevels); err != nil {
+		return fmt.Errorf("invalid log_levels: %w", err)
 	}
 
 	// Set log level
 	logger.SetLevel(cfg.LogLevel)
 
 	logger.Info("Starting Fluidity tunnel server",
+		"version", version.Version,
+		"commit", version.Commit,
+		"protocol_version", protocol.ProtocolVersion,
 		"listen_addr", cfg.GetListenAddress(),
 		"max_connections", cfg.MaxConnections,
 		"log_level", cfg.LogLevel)
@@ -153,10 +189,114 @@ func runServer(cmd *cobra.Command, args []string) error {
 		"ca_file", cfg.CACertFile)
 
 	// Create tunnel server
-	tunnelServer, err := server.NewServer(tlsConfig, cfg.GetListenAddress(), cfg.MaxConnections, cfg.LogLevel)
+	tunnelServer, err := server.NewServerWithListenOptions(tlsConfig, cfg.GetListenAddress(), cfg.MaxConnections, cfg.LogLevel, server.ListenOptions{
+		ReuseAddr: cfg.ListenReuseAddr,
+		ReusePort: cfg.ListenReusePort,
+		Backlog:   cfg.ListenBacklog,
+	})
 	if err != nil {
 		return fmt.Errorf("failed to create tunnel server: %w", err)
 	}
+	tunnelServer.SetAllowedMethods(cfg.AllowedMethods)
+	tunnelServer.SetAllowedSchemes(cfg.AllowedSchemes)
+	tunnelServer.SetStrictFraming(cfg.StrictFraming)
+	tunnelServer.SetBodySpill(cfg.BodySpillThreshold, cfg.BodySpillDir)
+	inflightBytes := cfg.MaxInflightBytes
+	if inflightBytes == 0 && cfg.MaxInflightMemoryFraction != 0 {
+		inflightBytes, err = server.MemoryBudgetFraction(cfg.MaxInflightMemoryFraction)
+		if err != nil {
+			return fmt.Errorf("invalid memory budget: %w", err)
+		}
+	}
+	tunnelServer.SetMemoryBudget(inflightBytes)
+	if len(cfg.HookCommand) > 0 {
+		hook, err := server.NewCommandHook(cfg.HookCommand)
+		if err != nil {
+			return fmt.Errorf("invalid hook: %w", err)
+		}
+		tunnelServer.SetHook(hook, server.HookOptions{Timeout: cfg.HookTimeout, Bodies: cfg.HookBodies, FailOpen: cfg.HookFailOpen})
+	}
+	tunnelServer.SetStrictCompatibility(cfg.StrictCompatibility)
+	tunnelServer.SetLogFullURL(cfg.LogFullURL)
+	tunnelServer.Logger().SetStreamFilter(cfg.LogStreamID)
+	if cfg.DisableIAMAuth {
+		tunnelServer.SetIAMAuthRequired(false)
+	}
+	tunnelServer.SetMaxRequestDuration(cfg.MaxRequestDuration)
+	if cfg.SlowRequestThreshold != 0 {
+		tunnelServer.SetSlowRequestThreshold(cfg.SlowRequestThreshold)
+	}
+	if cfg.RetryBudgetRatio != 0 {
+		tunnelServer.SetRetryBudget(cfg.RetryBudgetRatio)
+	}
+	tunnelServer.SetMaxConnectionsPerHost(cfg.MaxConnectionsPerHost, cfg.HostQueueWait)
+	tunnelServer.SetHedging(cfg.HedgeDelay, cfg.HedgeHosts, cfg.HedgeBudgetRatio)
+	if cfg.RequestWorkers > 0 {
+		tunnelServer.SetWorkerPool(cfg.RequestWorkers, cfg.RequestQueueDepth)
+	}
+	tunnelServer.SetAffinity(cfg.AffinityMaxPools, cfg.AffinityIdleTimeout)
+	if cfg.TCPKeepalive {
+		tunnelServer.SetTCPKeepalive(keepalive.TCPConfig(cfg.TCPKeepaliveIdle, cfg.TCPKeepaliveInterval))
+	}
+	tunnelServer.SetHeartbeatInterval(cfg.HeartbeatInterval)
+	wsKeepalive := keepalive.Resolve(cfg.WebSocketPingInterval, cfg.WebSocketPongTimeout)
+	tunnelServer.SetWebSocketKeepalive(wsKeepalive.Interval, wsKeepalive.Timeout)
+	if cfg.LoadShedSignal != "" {
+		load, err := tunnelServer.LoadSignal(cfg.LoadShedSignal)
+		if err != nil {
+			return fmt.Errorf("invalid load shedding configuration: %w", err)
+		}
+		fraction := cfg.LoadShedFraction
+		if fraction == 0 {
+			fraction = server.DefaultLoadShedFraction
+		}
+		tunnelServer.SetLoadShedding(load, cfg.LoadShedThreshold, fraction)
+		tunnelServer.SetOverloadPause(cfg.LoadShedPause)
+	}
+	if err := tunnelServer.SetRedirectPolicy(cfg.RedirectPolicy); err != nil {
+		return fmt.Errorf("invalid redirect policy: %w", err)
+	}
+	if err := tunnelServer.SetRequiredHeader(cfg.RequiredHeader, cfg.RequiredHeaderValues); err != nil {
+		return fmt.Errorf("invalid required header: %w", err)
+	}
+	if len(cfg.HostOverrideAllowlist) > 0 {
+		tunnelServer.SetHostOverrideAllowlist(cfg.HostOverrideAllowlist)
+	}
+	tunnelServer.SetIdleReaper(cfg.ReaperInterval, cfg.ReaperMaxIdle)
+	tunnelServer.SetProxyProtocol(cfg.ProxyProtocol)
+	tunnelServer.SetHandshakeTimeout(cfg.HandshakeTimeout)
+	if err := tunnelServer.SetAllowedServerNames(cfg.AllowedServerNames); err != nil {
+		return fmt.Errorf("invalid allowed server names: %w", err)
+	}
+	tunnelServer.SetCertExpiryWarning(cfg.CertExpiryWarning)
+	tunnelServer.SetClientKeyPolicy(server.ClientKeyPolicy{
+		Algorithms:   cfg.ClientKeyAlgorithms,
+		MinRSABits:   cfg.MinClientRSABits,
+		MinECDSABits: cfg.MinClientECDSABits,
+	})
+	tunnelServer.SetMaxConnectionsPerIP(cfg.MaxConnectionsPerIP)
+	tunnelServer.SetAcceptRamp(cfg.AcceptRampRate, cfg.AcceptRampWindow)
+	tunnelServer.SetMaxStreamsPerAgent(cfg.MaxConnectStreamsPerAgent, cfg.MaxWebSocketsPerAgent)
+	tunnelServer.SetConnectCoalescing(cfg.ConnectCoalesceDelay, cfg.ConnectCoalesceBytes)
+	if len(cfg.CircuitBreakerOverrides) > 0 {
+		tunnelServer.SetCircuitBreakerOverrides(cfg.BreakerConfigs())
+	}
+	if len(cfg.PrewarmHosts) > 0 {
+		tunnelServer.SetPrewarmHosts(cfg.PrewarmHosts, cfg.PrewarmInterval)
+	}
+	if cfg.StopGracePeriod > 0 {
+		tunnelServer.SetStopGracePeriod(cfg.StopGracePeriod)
+	}
+	tunnelServer.SetDrainPause(cfg.StopPauseAgents)
+	if cfg.AuditLogPath != "" {
+		auditFile, err := os.OpenFile(cfg.AuditLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+		defer auditFile.Close()
+		tunnelServer.SetAuditLog(auditFile, cfg.AuditLogBuffer)
+		logger.Info("Auditing proxied requests", "path", cfg.AuditLogPath)
+	}
 
 	// Create context for graceful shutdown
 	_, cancel := context.WithCancel(context.Background())
@@ -166,33 +306,13 @@ func runServer(cmd *cobra.Command, args []string) error {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	// Start health check HTTP server (port 8080)
-	healthMux := http.NewServeMux()
-	healthMux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(tunnelServer.GetHealth()); err != nil {
-			logger.Error("Failed to encode health response", err)
-		}
-	})
-
-	healthServer := &http.Server{
-		Addr:         ":8080",
-		Handler:      healthMux,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 5 * time.Second,
-		IdleTimeout:  10 * time.Second,
+	// Start health check HTTP server (optional unless marked required)
+	healthServer, err := server.StartHealthServer(tunnelServer, cfg.HealthPort, cfg.HealthRequired)
+	if err != nil {
+		tunnelServer.Stop()
+		return err
 	}
 
-	healthErrChan := make(chan error, 1)
-	go func() {
-		if err := healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			healthErrChan <- err
-		}
-	}()
-
-	logger.Info("Health check server started on", "addr", "localhost:8080")
-
 	// Start server in a goroutine
 	serverErrChan := make(chan error, 1)
 	go func() {
@@ -209,11 +329,9 @@ func runServer(cmd *cobra.Command, args []string) error {
 		logger.Info("Shutdown signal received, stopping server...")
 	case err := <-serverErrChan:
 		logger.Error("Server error", err)
-		healthServer.Shutdown(context.Background())
-		return err
-	case err := <-healthErrChan:
-		logger.Error("Health server error", err)
-		tunnelServer.Stop()
+		if healthServer != nil {
+			healthServer.Shutdown(context.Background())
+		}
 		return err
 	}
 
@@ -221,11 +339,13 @@ func runServer(cmd *cobra.Command, args []string) error {
 	cancel()
 
 	// Stop health server
-	healthShutdownCtx, healthShutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
-	if err := healthServer.Shutdown(healthShutdownCtx); err != nil {
-		logger.Warn("Error shutting down health server", err)
+	if healthServer != nil {
+		healthShutdownCtx, healthShutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := healthServer.Shutdown(healthShutdownCtx); err != nil {
+			logger.Warn("Error shutting down health server", "error", err.Error())
+		}
+		healthShutdownCancel()
 	}
-	healthShutdownCancel()
 
 	// Stop server
 	if err := tunnelServer.Stop(); err != nil {
@@ -236,3 +356,12 @@ func runServer(cmd *cobra.Command, args []string) error {
 	logger.Info("Server stopped")
 	return nil
 }
+
+// runConfig prints the configuration the server would run with, for debugging config precedence
+func runConfig(cmd *cobra.Command, args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	return config.Dump(os.Stdout, cfg, outputFormat)
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"time"
+	_ "time/tzdata" // Lambda runtimes may lack zoneinfo for SCALE_DOWN_TIMEZONE
 
 	"fluidity/internal/lambdas/sleep"
 
@@ -41,12 +43,33 @@ func main() {
 		}
 	}
 
+	// Get startup grace period (optional, defaults to 10 minutes, 0 disables)
+	minUptime := sleep.DefaultMinUptimeBeforeSleep
+	if minUptimeStr := os.Getenv("MIN_UPTIME_BEFORE_SLEEP_MINUTES"); minUptimeStr != "" {
+		if val, err := strconv.Atoi(minUptimeStr); err == nil && val >= 0 {
+			minUptime = time.Duration(val) * time.Minute
+		}
+	}
+
+	// Get the allowed scale-down window (optional, e.g. "19:00-07:00"; unset allows any time)
+	var window *sleep.ScaleDownWindow
+	if windowStr := os.Getenv("SCALE_DOWN_WINDOW"); windowStr != "" {
+		parsed, err := sleep.ParseScaleDownWindow(windowStr, os.Getenv("SCALE_DOWN_TIMEZONE"))
+		if err != nil {
+			fmt.Printf("Error: invalid SCALE_DOWN_WINDOW: %v\n", err)
+			os.Exit(1)
+		}
+		window = parsed
+	}
+
 	// Initialize handler once at cold start
 	handler, err := sleep.NewHandler(context.Background(), clusterName, serviceName, idleThresholdMins, lookbackPeriodMins)
 	if err != nil {
 		fmt.Printf("Failed to initialize handler: %v\n", err)
 		os.Exit(1)
 	}
+	handler.SetMinUptimeBeforeSleep(minUptime)
+	handler.SetScaleDownWindow(window)
 
 	// Start Lambda runtime
 	lambda.Start(handler.HandleRequest)
@@ -4,12 +4,16 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
+	"fluidity/internal/shared/keepalive"
 	"fluidity/internal/shared/logging"
 	"fluidity/internal/shared/protocol"
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -19,26 +23,56 @@ import (
 	"github.com/sirupsen/logrus"
 ) // Client manages the tunnel connection to server
 type Client struct {
-	config              *tls.Config
-	serverAddr          string
-	conn                *tls.Conn
-	mu                  sync.RWMutex
-	requests            map[string]chan *protocol.Response
-	connectCh           map[string]chan *protocol.ConnectData
-	connectAcks         map[string]chan *protocol.ConnectAck
-	wsCh                map[string]chan *protocol.WebSocketMessage
-	wsAcks              map[string]chan *protocol.WebSocketAck
-	iamAuthResponseCh   chan *protocol.IAMAuthResponse
-	iamAuthRequestID    string
-	logger              *logging.Logger
-	ctx                 context.Context
-	cancel              context.CancelFunc
-	connected           bool
-	reconnectCh         chan bool
-	awsConfig           aws.Config
-	signer              *v4.Signer
+	config            *tls.Config
+	serverAddr        string
+	conn              *tls.Conn
+	encoder           *json.Encoder
+	writeMu           sync.Mutex
+	mu                sync.RWMutex
+	requests          map[string]chan *protocol.Response
+	connectCh         map[string]chan *protocol.ConnectData
+	connectAcks       map[string]chan *protocol.ConnectAck
+	wsCh              map[string]chan *protocol.WebSocketMessage
+	wsAcks            map[string]chan *protocol.WebSocketAck
+	streams           map[string]*responseStream
+	uploads           map[string]chan int // Credit granted for streamed request bodies
+	iamAuthResponseCh chan *protocol.IAMAuthResponse
+	iamAuthRequestID  string
+	logger            *logging.Logger
+	ctx               context.Context
+	cancel            context.CancelFunc
+	connected         bool
+	reconnectCh       chan bool
+	awsConfig         aws.Config
+	signer            *v4.Signer
+	helloCh           chan *protocol.Hello
+	serverHello       *protocol.Hello
+	legacyServers     map[string]bool // Server addresses that did not answer hello, so later connects do not wait for it
+	strictCompat      bool
+	iamDisabled       bool
+	shutdownNotice    *protocol.ServerShutdown
+	certExpiring      *protocol.CertExpiring
+	busyNotice        *protocol.ServerBusy
+	busyCh            chan struct{} // Closed when the server sends server_busy on the current connection
+	tcpKeepalive      net.KeepAliveConfig
+	pauseCh           chan struct{} // Closed when the server lifts its flow_control pause (nil while not paused)
+	pausedUntil       time.Time     // When the server's flow_control pause lapses by itself
+	heartbeat         time.Duration // Idle time after which a ping is sent to the server (0 disables)
+	ready             chan struct{} // Closed once the first Connect completes
+	readyOnce         sync.Once
+	lastWrite         keepalive.Activity
+	notifications     *stateNotifications // Where connection state changes are reported (nil when not)
+	requestTimeout    time.Duration       // How long a request waits for its response
+	logFullURL        bool                // Log full request URLs at debug level
 }
 
+// helloTimeout bounds how long Connect waits for the server's hello before assuming a legacy build
+const helloTimeout = 5 * time.Second
+
+// DefaultRequestTimeout bounds the wait for a response through the tunnel. It outlasts the server's default
+// 5-minute request cap, so a slow request is ended by the server, which answers it with a 504.
+const DefaultRequestTimeout = 6 * time.Minute
+
 // NewClient creates a new tunnel client
 func NewClient(tlsConfig *tls.Config, serverAddr string, logLevel string) *Client {
 	return NewClientWithTestMode(tlsConfig, serverAddr, logLevel, false)
@@ -73,12 +107,18 @@ func NewClientWithTestMode(tlsConfig *tls.Config, serverAddr string, logLevel st
 		connectAcks: make(map[string]chan *protocol.ConnectAck),
 		wsCh:        make(map[string]chan *protocol.WebSocketMessage),
 		wsAcks:      make(map[string]chan *protocol.WebSocketAck),
+		streams:     make(map[string]*responseStream),
+		uploads:     make(map[string]chan int),
 		logger:      logger,
 		ctx:         ctx,
 		cancel:      cancel,
 		reconnectCh: make(chan bool, 1),
 		awsConfig:   awsCfg,
 		signer:      signer,
+		heartbeat:   keepalive.DefaultHeartbeatInterval,
+		ready:       make(chan struct{}),
+
+		requestTimeout: DefaultRequestTimeout,
 	}
 }
 
@@ -98,6 +138,103 @@ func (c *Client) UpdateServerAddress(serverAddr string) {
 	c.logger.Debug("Server address updated", "new_addr", serverAddr)
 }
 
+// ServerAddress returns the address of the tunnel server this client connects to
+func (c *Client) ServerAddress() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.serverAddr
+}
+
+// SetIAMAuthDisabled skips the IAM authentication exchange on connect, for mTLS-only deployments
+func (c *Client) SetIAMAuthDisabled(disabled bool) {
+	c.iamDisabled = disabled
+}
+
+// SetTCPKeepalive applies TCP keepalive to the tunnel connection so a dead server is detected at the TCP
+// layer; a config that does not enable keepalive leaves Go's defaults (takes effect on the next Connect)
+func (c *Client) SetTCPKeepalive(config net.KeepAliveConfig) {
+	c.tcpKeepalive = config
+}
+
+// SetHeartbeatInterval sends a ping to the server whenever the tunnel has written nothing for interval,
+// so load balancers such as an NLB never drop it as idle. 0 uses keepalive.DefaultHeartbeatInterval and
+// a negative interval disables heartbeats (takes effect on the next Connect).
+func (c *Client) SetHeartbeatInterval(interval time.Duration) {
+	c.heartbeat = keepalive.ResolveHeartbeat(interval)
+}
+
+// SetRequestTimeout bounds how long a request waits for its response before the server is told to cancel
+// it; keep it above the server's max_request_duration so the server's cap applies (0 uses
+// DefaultRequestTimeout; call before sending requests)
+func (c *Client) SetRequestTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultRequestTimeout
+	}
+	c.requestTimeout = timeout
+}
+
+// SetLogFullURL adds each request's full URL to the client's debug log; other lines log only the domain
+// (call before sending requests)
+func (c *Client) SetLogFullURL(enabled bool) {
+	c.logFullURL = enabled
+}
+
+// logURL returns a request URL for Debug lines: the full URL when enabled, otherwise only the domain.
+// Info and higher lines log urlDomain, as full URLs may carry sensitive paths and query strings.
+func (c *Client) logURL(rawURL string) string {
+	if c.logFullURL {
+		return rawURL
+	}
+	return urlDomain(rawURL)
+}
+
+// urlDomain returns the host of a request URL without its port (empty if the URL is invalid)
+func urlDomain(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return parsed.Hostname()
+}
+
+// RequestTimeout returns how long a request waits for its response
+func (c *Client) RequestTimeout() time.Duration {
+	return c.requestTimeout
+}
+
+// Logger returns the client's logger so callers can adjust its level, output or stream filter
+func (c *Client) Logger() *logging.Logger {
+	return c.logger
+}
+
+// SetStrictCompatibility makes Connect fail when the server's protocol is incompatible instead of only warning
+func (c *Client) SetStrictCompatibility(strict bool) {
+	c.strictCompat = strict
+}
+
+// ServerHello returns the hello received from the server on the current connection (nil for legacy servers)
+func (c *Client) ServerHello() *protocol.Hello {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.serverHello
+}
+
+// ShutdownNotice returns the server's shutdown notice for the current connection, or nil if none was sent
+func (c *Client) ShutdownNotice() *protocol.ServerShutdown {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.shutdownNotice
+}
+
+// CertExpiring returns the server's advisory that the client certificate expires soon for the current
+// connection, or nil if none was sent. The certificate should be renewed before NotAfter and the client
+// reconnected with it.
+func (c *Client) CertExpiring() *protocol.CertExpiring {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.certExpiring
+}
+
 // Connect establishes mTLS connection to server
 func (c *Client) Connect() error {
 	c.mu.Lock()
@@ -109,6 +246,11 @@ func (c *Client) Connect() error {
 
 	c.logger.Info("Connecting to tunnel server", "addr", c.serverAddr)
 
+	// A previous Disconnect cancels the context; start a fresh one so the response handler runs again
+	if c.ctx.Err() != nil {
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+	}
+
 	// Extract hostname for ServerName
 	host := c.extractHost(c.serverAddr)
 
@@ -129,7 +271,8 @@ func (c *Client) Connect() error {
 	}).Info("TLS config for dial (hostname verification enabled)")
 
 	c.logger.Debug("Starting TCP dial", "addr", c.serverAddr)
-	conn, err := tls.Dial("tcp", c.serverAddr, tlsConfig)
+	dialer := &net.Dialer{KeepAliveConfig: c.tcpKeepalive}
+	conn, err := tls.DialWithDialer(dialer, "tcp", c.serverAddr, tlsConfig)
 	if err != nil {
 		c.logger.Error("TLS dial failed", err, "addr", c.serverAddr, "host", host)
 		c.mu.Unlock()
@@ -140,44 +283,77 @@ func (c *Client) Connect() error {
 	// Log the connection state
 	state := conn.ConnectionState()
 	c.logger.WithFields(logrus.Fields{
-		"version":            state.Version,
-		"cipher_suite":       state.CipherSuite,
-		"peer_certificates":  len(state.PeerCertificates),
-		"local_certificates": len(tlsConfig.Certificates),
+		"version":             state.Version,
+		"cipher_suite":        state.CipherSuite,
+		"peer_certificates":   len(state.PeerCertificates),
+		"local_certificates":  len(tlsConfig.Certificates),
 		"negotiated_protocol": state.NegotiatedProtocol,
 	}).Info("TLS connection established")
 
 	c.conn = conn
+	c.encoder = json.NewEncoder(c.lastWrite.Writer(conn))
+	c.lastWrite.Touch()
 	c.connected = true
+	c.shutdownNotice = nil
+	c.certExpiring = nil
+	c.busyNotice = nil
+	c.busyCh = make(chan struct{})
+	c.liftPause()
+	busyCh := c.busyCh
 	c.logger.Info("Connected to tunnel server", "addr", c.serverAddr)
 
 	// Start handling responses from server in background
-	go c.handleResponses()
+	done := make(chan struct{})
+	go func() {
+		c.handleResponses(conn)
+		close(done)
+	}()
 
 	// Release lock before authentication to avoid deadlock (authenticateWithIAM acquires its own lock)
 	c.mu.Unlock()
 
 	// Perform IAM authentication after response handler is started
-	if err := c.authenticateWithIAM(c.ctx); err != nil {
-		c.logger.Error("IAM authentication failed", err)
+	if err := c.authenticateWithIAM(c.ctx, busyCh); err != nil {
 		c.mu.Lock()
 		conn.Close()
 		c.conn = nil
 		c.connected = false
 		c.mu.Unlock()
+		if busyErr := c.busyError(); busyErr != nil {
+			return busyErr
+		}
+		c.logger.Error("IAM authentication failed", err)
 		return fmt.Errorf("IAM authentication failed: %w", err)
 	}
 
+	// Exchange build and protocol versions to detect drift after partial rollouts
+	if err := c.exchangeHello(busyCh); err != nil {
+		c.mu.Lock()
+		conn.Close()
+		c.conn = nil
+		c.connected = false
+		c.mu.Unlock()
+		if busyErr := c.busyError(); busyErr != nil {
+			return busyErr
+		}
+		c.logger.Error("Protocol compatibility check failed", err)
+		return fmt.Errorf("protocol compatibility check failed: %w", err)
+	}
+
+	c.startHeartbeat(done)
+	c.readyOnce.Do(func() { close(c.ready) })
+
 	c.logger.Info("Connected and authenticated to tunnel server", "addr", c.serverAddr)
+	c.NotifyState(StateConnected, "")
 	return nil
 }
 
 // Disconnect closes the connection to the server
 func (c *Client) Disconnect() error {
 	c.mu.Lock()
-	defer c.mu.Unlock()
 
 	if !c.connected {
+		c.mu.Unlock()
 		return nil
 	}
 
@@ -188,44 +364,72 @@ func (c *Client) Disconnect() error {
 		c.conn.Close()
 		c.conn = nil
 	}
+	c.mu.Unlock()
 
 	c.logger.Info("Disconnected from tunnel server")
+	c.NotifyState(StateDisconnected, "disconnected by the agent")
 	return nil
 }
 
 // SendRequest sends request through tunnel and waits for response
 func (c *Client) SendRequest(req *protocol.Request) (*protocol.Response, error) {
+	return c.sendRequest(req, nil)
+}
+
+// sendRequest sends req, followed by the body read from body in http_request_chunk messages when body
+// is non-nil, and waits for the response
+func (c *Client) sendRequest(req *protocol.Request, body io.Reader) (*protocol.Response, error) {
+	c.waitWhilePaused(req.ID)
+
 	c.mu.RLock()
 	if !c.connected || c.conn == nil {
 		c.mu.RUnlock()
-		return nil, fmt.Errorf("not connected to server")
+		return nil, errNotConnected
 	}
-	conn := c.conn
+	ctx := c.ctx
 	c.mu.RUnlock()
 
 	// Create response channel
 	respChan := make(chan *protocol.Response, 1)
 	c.mu.Lock()
+	if _, exists := c.requests[req.ID]; exists {
+		c.mu.Unlock()
+		c.logger.Error("Rejecting request with an ID already in flight", ErrDuplicateID, "id", req.ID)
+		return nil, fmt.Errorf("request %s: %w", req.ID, ErrDuplicateID)
+	}
 	c.requests[req.ID] = respChan
+	var credits chan int
+	if body != nil {
+		credits = make(chan int, protocol.ChunkWindow)
+		c.uploads[req.ID] = credits
+	}
 	c.mu.Unlock()
 
 	// Cleanup function
 	cleanup := func() {
 		c.mu.Lock()
 		delete(c.requests, req.ID)
+		delete(c.uploads, req.ID)
 		c.mu.Unlock()
 	}
 
 	// Send request wrapped in Envelope
-	encoder := json.NewEncoder(conn)
 	env := protocol.Envelope{Type: "http_request", Payload: req}
-	if err := encoder.Encode(env); err != nil {
+	if err := c.send(env); err != nil {
 		cleanup()
 		c.logger.Error("Failed to send request", err, "id", req.ID)
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return nil, &notSentError{err: err}
 	}
 
-	c.logger.Debug("Sent request through tunnel", "id", req.ID, "url", req.URL)
+	c.logger.Debug("Sent request through tunnel", "id", req.ID, "url", c.logURL(req.URL))
+
+	if body != nil {
+		if err := c.sendBody(req.ID, body, credits); err != nil {
+			cleanup()
+			c.logger.Warn("Failed to stream request body", "id", req.ID, "error", err.Error())
+			return nil, err
+		}
+	}
 
 	// Wait for response with timeout
 	select {
@@ -234,28 +438,96 @@ func (c *Client) SendRequest(req *protocol.Request) (*protocol.Response, error)
 			return nil, fmt.Errorf("response channel closed")
 		}
 		return resp, nil
-	case <-time.After(30 * time.Second):
+	case <-time.After(c.requestTimeout):
 		cleanup()
-		c.logger.Warn("Request timeout", "id", req.ID, "url", req.URL)
-		return nil, fmt.Errorf("request timeout after 30 seconds")
-	case <-c.ctx.Done():
+		c.logger.Warn("Request timeout", "id", req.ID, "domain", urlDomain(req.URL))
+		// The server would otherwise hold the upstream request, its budget and host slot until its own cap
+		c.send(protocol.Envelope{Type: "http_cancel", Payload: &protocol.HTTPCancel{ID: req.ID}})
+		return nil, fmt.Errorf("request timeout after %v", c.requestTimeout)
+	case <-ctx.Done():
 		cleanup()
 		return nil, fmt.Errorf("connection closed")
 	}
 }
 
+// errNotConnected is returned when sending without a connection to the server
+var errNotConnected = errors.New("not connected to server")
+
+// ErrDuplicateID is returned when a request, tunnel or WebSocket is opened with the ID of one still in
+// flight; the existing one keeps its registration so its responses are not delivered to the newcomer
+var ErrDuplicateID = errors.New("ID already in flight")
+
+// notSentError is returned when a request could not be written to the server, so it is safe to retry
+type notSentError struct {
+	err error
+}
+
+func (e *notSentError) Error() string { return "failed to send request: " + e.err.Error() }
+
+func (e *notSentError) Unwrap() error { return e.err }
+
+// send writes an envelope to the server. Writes share the connection's encoder and are serialized so
+// concurrent senders cannot interleave; a failed write closes the connection, which ends the response
+// handler and signals a reconnect.
+func (c *Client) send(env protocol.Envelope) error {
+	c.mu.RLock()
+	if !c.connected || c.conn == nil {
+		c.mu.RUnlock()
+		return errNotConnected
+	}
+	conn := c.conn
+	encoder := c.encoder
+	c.mu.RUnlock()
+
+	c.writeMu.Lock()
+	err := encoder.Encode(env)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.logger.Warn("Write to tunnel server failed, closing connection", "type", env.Type, "error", err.Error())
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
 // handleResponses processes responses from the server
-func (c *Client) handleResponses() {
+func (c *Client) handleResponses(conn *tls.Conn) {
 	defer func() {
 		c.mu.Lock()
+		// A reconnect already replaced this connection; leave the new one alone
+		if c.conn != nil && c.conn != conn {
+			c.mu.Unlock()
+			return
+		}
+		// Disconnect and failed connection attempts have already cleared this
+		wasConnected := c.connected
 		c.connected = false
 		// Close all pending request channels
 		for id, ch := range c.requests {
 			close(ch)
 			delete(c.requests, id)
 		}
+		// End streamed responses; their readers see the stream as truncated. Finished streams are already
+		// closed and stay registered until CloseStream, so the proxy still reads their complete body.
+		for id, stream := range c.streams {
+			if stream.final {
+				continue
+			}
+			stream.final = true
+			close(stream.chunks)
+			delete(c.streams, id)
+		}
+		// Stop streamed request bodies
+		for id, credits := range c.uploads {
+			close(credits)
+			delete(c.uploads, id)
+		}
 		c.mu.Unlock()
 
+		if wasConnected {
+			c.NotifyState(StateDisconnected, "connection to the tunnel server lost")
+		}
+
 		// Signal reconnection needed
 		select {
 		case c.reconnectCh <- true:
@@ -263,11 +535,15 @@ func (c *Client) handleResponses() {
 		}
 	}()
 
-	decoder := json.NewDecoder(c.conn)
+	c.mu.RLock()
+	ctx := c.ctx
+	c.mu.RUnlock()
+
+	decoder := json.NewDecoder(conn)
 
 	for {
 		select {
-		case <-c.ctx.Done():
+		case <-ctx.Done():
 			c.logger.Debug("handleResponses: context cancelled, exiting")
 			return
 		default:
@@ -283,14 +559,23 @@ func (c *Client) handleResponses() {
 
 		// Validate message type
 		validTypes := map[string]bool{
-			"http_response":     true,
-			"connect_ack":       true,
-			"connect_data":      true,
-			"connect_close":     true,
-			"ws_ack":            true,
-			"ws_message":        true,
-			"ws_close":          true,
-			"iam_auth_response": true,
+			"http_response":        true,
+			"http_response_chunk":  true,
+			"http_request_credit":  true,
+			"connect_ack":          true,
+			"connect_data":         true,
+			"connect_close":        true,
+			"connect_half_close":   true,
+			"ws_ack":               true,
+			"ws_message":           true,
+			"ws_close":             true,
+			"iam_auth_response":    true,
+			"hello":                true,
+			"server_shutting_down": true,
+			"server_busy":          true,
+			"cert_expiring":        true,
+			"flow_control":         true,
+			"ping":                 true,
 		}
 		if !validTypes[env.Type] {
 			c.logger.Debug("Received unknown message type from server, ignoring", "type", env.Type)
@@ -312,18 +597,46 @@ func (c *Client) handleResponses() {
 			respChan, exists := c.requests[resp.ID]
 			c.mu.RUnlock()
 			if exists {
+				// Register the stream before the requester sees the response, so no chunk is missed
+				if resp.Stream {
+					c.openStream(resp.ID)
+				}
 				select {
 				case respChan <- &resp:
 				case <-time.After(1 * time.Second):
 					c.logger.Debug("Response channel blocked", "id", resp.ID)
+					if resp.Stream {
+						c.CloseStream(resp.ID)
+					}
 				}
 				c.mu.Lock()
 				delete(c.requests, resp.ID)
 				c.mu.Unlock()
+				c.endUpload(resp.ID)
 			} else {
 				c.logger.Debug("Received response for unknown request", "id", resp.ID)
 			}
 
+		case "http_response_chunk":
+			m, _ := env.Payload.(map[string]any)
+			b, _ := json.Marshal(m)
+			var chunk protocol.Chunk
+			if err := json.Unmarshal(b, &chunk); err != nil {
+				c.logger.Error("Failed to parse http_response_chunk", err)
+				continue
+			}
+			c.deliverChunk(&chunk)
+
+		case "http_request_credit":
+			m, _ := env.Payload.(map[string]any)
+			b, _ := json.Marshal(m)
+			var credit protocol.ChunkCredit
+			if err := json.Unmarshal(b, &credit); err != nil {
+				c.logger.Error("Failed to parse http_request_credit", err)
+				continue
+			}
+			c.grantUploadCredit(&credit)
+
 		case "connect_ack":
 			m, _ := env.Payload.(map[string]any)
 			b, _ := json.Marshal(m)
@@ -376,6 +689,24 @@ func (c *Client) handleResponses() {
 			}
 			c.mu.Unlock()
 
+		case "connect_half_close":
+			m, _ := env.Payload.(map[string]any)
+			b, _ := json.Marshal(m)
+			var half protocol.ConnectHalfClose
+			if err := json.Unmarshal(b, &half); err != nil {
+				continue
+			}
+			c.mu.RLock()
+			ch := c.connectCh[half.ID]
+			c.mu.RUnlock()
+			if ch != nil {
+				select {
+				case ch <- HalfCloseMarker:
+				case <-time.After(5 * time.Second):
+					c.logger.Error("CRITICAL: Connect data channel blocked for 5s, dropping half-close", nil, "id", half.ID)
+				}
+			}
+
 		case "ws_ack":
 			m, _ := env.Payload.(map[string]any)
 			b, _ := json.Marshal(m)
@@ -455,6 +786,84 @@ func (c *Client) handleResponses() {
 				}
 			}
 
+		case "hello":
+			m, _ := env.Payload.(map[string]any)
+			b, _ := json.Marshal(m)
+			var hello protocol.Hello
+			if err := json.Unmarshal(b, &hello); err != nil {
+				c.logger.Error("Failed to parse hello", err)
+				continue
+			}
+			c.mu.Lock()
+			helloCh := c.helloCh
+			if helloCh == nil && c.legacyServers[c.serverAddr] {
+				// A server remembered as legacy answered after all, so it has been upgraded: wait for its
+				// hello again on the next connection
+				c.logger.Info("Server answered hello after being taken for a legacy build", "addr", c.serverAddr)
+				delete(c.legacyServers, c.serverAddr)
+			}
+			c.mu.Unlock()
+			if helloCh != nil {
+				select {
+				case helloCh <- &hello:
+				default:
+					c.logger.Debug("Unexpected hello from server, ignoring")
+				}
+			}
+
+		case "server_shutting_down":
+			m, _ := env.Payload.(map[string]any)
+			b, _ := json.Marshal(m)
+			var notice protocol.ServerShutdown
+			if err := json.Unmarshal(b, &notice); err != nil {
+				c.logger.Error("Failed to parse server_shutting_down", err)
+				continue
+			}
+			c.logger.Warn("Tunnel server is shutting down", "grace_period_ms", notice.GracePeriodMs)
+			c.mu.Lock()
+			c.shutdownNotice = &notice
+			c.mu.Unlock()
+
+		case "cert_expiring":
+			m, _ := env.Payload.(map[string]any)
+			b, _ := json.Marshal(m)
+			var notice protocol.CertExpiring
+			if err := json.Unmarshal(b, &notice); err != nil {
+				c.logger.Error("Failed to parse cert_expiring", err)
+				continue
+			}
+			c.logger.Warn("Client certificate expires soon, renew it and reconnect",
+				"not_after", notice.NotAfter.UTC().Format(time.RFC3339),
+				"remaining_ms", notice.RemainingMs)
+			c.mu.Lock()
+			c.certExpiring = &notice
+			c.mu.Unlock()
+			c.NotifyState(StateCertExpiring, "client certificate expires at "+notice.NotAfter.UTC().Format(time.RFC3339))
+
+		case "server_busy":
+			m, _ := env.Payload.(map[string]any)
+			b, _ := json.Marshal(m)
+			var notice protocol.ServerBusy
+			if err := json.Unmarshal(b, &notice); err != nil {
+				c.logger.Error("Failed to parse server_busy", err)
+				continue
+			}
+			c.logger.Warn("Tunnel server is busy, will retry", "retry_after_ms", notice.RetryAfterMs)
+			c.serverBusy(&notice)
+
+		case "flow_control":
+			m, _ := env.Payload.(map[string]any)
+			b, _ := json.Marshal(m)
+			var msg protocol.FlowControl
+			if err := json.Unmarshal(b, &msg); err != nil {
+				c.logger.Error("Failed to parse flow_control", err)
+				continue
+			}
+			c.flowControl(&msg)
+
+		case "ping":
+			c.logger.Debug("Heartbeat ping received from server")
+
 		default:
 			// Ignore unknown message types
 		}
@@ -468,6 +877,13 @@ func (c *Client) IsConnected() bool {
 	return c.connected
 }
 
+// Ready returns a channel closed once the client first completes Connect, authentication and hello
+// included. It stays closed after later disconnects, so it tells a client that is still starting up
+// from one that has lost its connection.
+func (c *Client) Ready() <-chan struct{} {
+	return c.ready
+}
+
 // ReconnectChannel returns a channel that signals when reconnection is needed
 func (c *Client) ReconnectChannel() <-chan bool {
 	return c.reconnectCh
@@ -484,27 +900,47 @@ func (c *Client) extractHost(addr string) string {
 
 // ConnectOpen requests a TCP tunnel to host:port
 func (c *Client) ConnectOpen(id, address string) (*protocol.ConnectAck, error) {
+	return c.ConnectOpenCompressed(id, address, "")
+}
+
+// ConnectOpenCompressed requests a TCP tunnel to host:port whose connect_data chunks are compressed
+// with compression; the ack's Compression is empty when the server does not agree to it
+func (c *Client) ConnectOpenCompressed(id, address, compression string) (*protocol.ConnectAck, error) {
+	return c.ConnectOpenWith(&protocol.ConnectOpen{ID: id, Address: address, Compression: compression})
+}
+
+// ConnectOpenWith requests the TCP tunnel described by open, which may also carry the client's CONNECT
+// request headers for the server to check
+func (c *Client) ConnectOpenWith(open *protocol.ConnectOpen) (*protocol.ConnectAck, error) {
+	id := open.ID
+	c.waitWhilePaused(id)
+
 	c.mu.RLock()
 	if !c.connected || c.conn == nil {
 		c.mu.RUnlock()
 		return nil, fmt.Errorf("not connected to server")
 	}
-	conn := c.conn
+	ctx := c.ctx
 	c.mu.RUnlock()
 
 	// Prepare channels for this connection
 	ackCh := make(chan *protocol.ConnectAck, 1)
 	c.mu.Lock()
-	c.connectAcks[id] = ackCh
-	if _, exists := c.connectCh[id]; !exists {
-		// Use larger buffer (512 messages @ 32KB = 16MB max buffered per connection)
-		// This prevents packet drops during large responses
-		c.connectCh[id] = make(chan *protocol.ConnectData, 512)
+	_, opening := c.connectAcks[id]
+	_, running := c.connectCh[id]
+	if opening || running {
+		c.mu.Unlock()
+		c.logger.Error("Rejecting tunnel with an ID already in flight", ErrDuplicateID, "id", id)
+		return nil, fmt.Errorf("tunnel %s: %w", id, ErrDuplicateID)
 	}
+	c.connectAcks[id] = ackCh
+	// Use larger buffer (512 messages @ 32KB = 16MB max buffered per connection)
+	// This prevents packet drops during large responses
+	c.connectCh[id] = make(chan *protocol.ConnectData, 512)
 	c.mu.Unlock()
 
-	env := protocol.Envelope{Type: "connect_open", Payload: &protocol.ConnectOpen{ID: id, Address: address}}
-	if err := json.NewEncoder(conn).Encode(env); err != nil {
+	env := protocol.Envelope{Type: "connect_open", Payload: open}
+	if err := c.send(env); err != nil {
 		c.mu.Lock()
 		delete(c.connectAcks, id)
 		delete(c.connectCh, id)
@@ -517,6 +953,10 @@ func (c *Client) ConnectOpen(id, address string) (*protocol.ConnectAck, error) {
 	case ack := <-ackCh:
 		c.mu.Lock()
 		delete(c.connectAcks, id)
+		if !ack.Ok {
+			// A refused tunnel never receives a close, so release its ID here
+			delete(c.connectCh, id)
+		}
 		c.mu.Unlock()
 		return ack, nil
 	case <-time.After(10 * time.Second):
@@ -525,7 +965,7 @@ func (c *Client) ConnectOpen(id, address string) (*protocol.ConnectAck, error) {
 		delete(c.connectCh, id)
 		c.mu.Unlock()
 		return nil, fmt.Errorf("timeout waiting for connect_ack")
-	case <-c.ctx.Done():
+	case <-ctx.Done():
 		c.mu.Lock()
 		delete(c.connectAcks, id)
 		delete(c.connectCh, id)
@@ -536,30 +976,41 @@ func (c *Client) ConnectOpen(id, address string) (*protocol.ConnectAck, error) {
 
 // ConnectSend sends a data chunk over the tunnel
 func (c *Client) ConnectSend(id string, chunk []byte) error {
-	c.mu.RLock()
-	if !c.connected || c.conn == nil {
-		c.mu.RUnlock()
-		return fmt.Errorf("not connected to server")
-	}
-	conn := c.conn
-	c.mu.RUnlock()
 	env := protocol.Envelope{Type: "connect_data", Payload: &protocol.ConnectData{ID: id, Chunk: chunk}}
-	return json.NewEncoder(conn).Encode(env)
+	return c.send(env)
+}
+
+// ConnectSendCompressed sends a data chunk already compressed with the tunnel's negotiated compression
+func (c *Client) ConnectSendCompressed(id string, chunk []byte) error {
+	env := protocol.Envelope{Type: "connect_data", Payload: &protocol.ConnectData{ID: id, Chunk: chunk, Compressed: true}}
+	return c.send(env)
 }
 
 // ConnectClose closes a tunnel stream
 func (c *Client) ConnectClose(id, errMsg string) error {
-	c.mu.RLock()
-	if !c.connected || c.conn == nil {
-		c.mu.RUnlock()
-		return nil
-	}
-	conn := c.conn
-	c.mu.RUnlock()
 	env := protocol.Envelope{Type: "connect_close", Payload: &protocol.ConnectClose{ID: id, Error: errMsg}}
-	return json.NewEncoder(conn).Encode(env)
+	if err := c.send(env); !errors.Is(err, errNotConnected) {
+		return err
+	}
+	return nil // Already closed along with the connection
 }
 
+// ConnectHalfClose signals that the client has finished sending on a TCP tunnel
+func (c *Client) ConnectHalfClose(id string) error {
+	env := protocol.Envelope{Type: "connect_half_close", Payload: &protocol.ConnectHalfClose{ID: id}}
+	return c.send(env)
+}
+
+// SupportsHalfClose reports whether the server advertised connect_half_close support
+func (c *Client) SupportsHalfClose() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.serverHello != nil && c.serverHello.Features&protocol.FeatureHalfClose != 0
+}
+
+// HalfCloseMarker is delivered on a connect data channel when the server has finished sending
+var HalfCloseMarker = &protocol.ConnectData{}
+
 // ConnectDataChannel returns the data channel for a given tunnel id
 func (c *Client) ConnectDataChannel(id string) <-chan *protocol.ConnectData {
 	c.mu.RLock()
@@ -570,25 +1021,32 @@ func (c *Client) ConnectDataChannel(id string) <-chan *protocol.ConnectData {
 
 // WebSocketOpen requests a WebSocket connection to be established
 func (c *Client) WebSocketOpen(req *protocol.WebSocketOpen) (*protocol.WebSocketAck, error) {
+	c.waitWhilePaused(req.ID)
+
 	c.mu.RLock()
 	if !c.connected || c.conn == nil {
 		c.mu.RUnlock()
 		return nil, fmt.Errorf("not connected to server")
 	}
-	conn := c.conn
+	ctx := c.ctx
 	c.mu.RUnlock()
 
 	// Prepare channels for this WebSocket
 	ackCh := make(chan *protocol.WebSocketAck, 1)
 	c.mu.Lock()
-	c.wsAcks[req.ID] = ackCh
-	if _, exists := c.wsCh[req.ID]; !exists {
-		c.wsCh[req.ID] = make(chan *protocol.WebSocketMessage, 64)
+	_, opening := c.wsAcks[req.ID]
+	_, open := c.wsCh[req.ID]
+	if opening || open {
+		c.mu.Unlock()
+		c.logger.Error("Rejecting WebSocket with an ID already in flight", ErrDuplicateID, "id", req.ID)
+		return nil, fmt.Errorf("websocket %s: %w", req.ID, ErrDuplicateID)
 	}
+	c.wsAcks[req.ID] = ackCh
+	c.wsCh[req.ID] = make(chan *protocol.WebSocketMessage, 64)
 	c.mu.Unlock()
 
 	env := protocol.Envelope{Type: "ws_open", Payload: req}
-	if err := json.NewEncoder(conn).Encode(env); err != nil {
+	if err := c.send(env); err != nil {
 		c.mu.Lock()
 		delete(c.wsAcks, req.ID)
 		delete(c.wsCh, req.ID)
@@ -601,6 +1059,9 @@ func (c *Client) WebSocketOpen(req *protocol.WebSocketOpen) (*protocol.WebSocket
 	case ack := <-ackCh:
 		c.mu.Lock()
 		delete(c.wsAcks, req.ID)
+		if !ack.Ok {
+			delete(c.wsCh, req.ID)
+		}
 		c.mu.Unlock()
 		return ack, nil
 	case <-time.After(10 * time.Second):
@@ -609,7 +1070,7 @@ func (c *Client) WebSocketOpen(req *protocol.WebSocketOpen) (*protocol.WebSocket
 		delete(c.wsCh, req.ID)
 		c.mu.Unlock()
 		return nil, fmt.Errorf("timeout waiting for ws_ack")
-	case <-c.ctx.Done():
+	case <-ctx.Done():
 		c.mu.Lock()
 		delete(c.wsAcks, req.ID)
 		delete(c.wsCh, req.ID)
@@ -620,28 +1081,17 @@ func (c *Client) WebSocketOpen(req *protocol.WebSocketOpen) (*protocol.WebSocket
 
 // WebSocketSend sends a WebSocket message through the tunnel
 func (c *Client) WebSocketSend(msg *protocol.WebSocketMessage) error {
-	c.mu.RLock()
-	if !c.connected || c.conn == nil {
-		c.mu.RUnlock()
-		return fmt.Errorf("not connected to server")
-	}
-	conn := c.conn
-	c.mu.RUnlock()
 	env := protocol.Envelope{Type: "ws_message", Payload: msg}
-	return json.NewEncoder(conn).Encode(env)
+	return c.send(env)
 }
 
 // WebSocketClose closes a WebSocket connection
 func (c *Client) WebSocketClose(id string, code int, errMsg string) error {
-	c.mu.RLock()
-	if !c.connected || c.conn == nil {
-		c.mu.RUnlock()
-		return nil
-	}
-	conn := c.conn
-	c.mu.RUnlock()
 	env := protocol.Envelope{Type: "ws_close", Payload: &protocol.WebSocketClose{ID: id, Code: code, Error: errMsg}}
-	return json.NewEncoder(conn).Encode(env)
+	if err := c.send(env); !errors.Is(err, errNotConnected) {
+		return err
+	}
+	return nil // Already closed along with the connection
 }
 
 // WebSocketMessageChannel returns the message channel for a given WebSocket id
@@ -653,7 +1103,12 @@ func (c *Client) WebSocketMessageChannel(id string) <-chan *protocol.WebSocketMe
 }
 
 // authenticateWithIAM performs IAM authentication over the established TLS tunnel
-func (c *Client) authenticateWithIAM(ctx context.Context) error {
+func (c *Client) authenticateWithIAM(ctx context.Context, busy <-chan struct{}) error {
+	if c.iamDisabled {
+		c.logger.Debug("IAM authentication disabled, relying on mTLS only")
+		return nil
+	}
+
 	// Skip IAM auth only in test mode (when AWS config not loaded)
 	if c.awsConfig.Region == "" || c.signer == nil {
 		c.logger.Debug("AWS config not loaded (test mode), skipping IAM authentication")
@@ -706,8 +1161,8 @@ func (c *Client) authenticateWithIAM(ctx context.Context) error {
 	// Extract signature components
 	authReq.Signature = dummyReq.Header.Get("Authorization")
 	authReq.SignedHeaders = dummyReq.Header.Get("X-Amz-SignedHeaders")
-	
-	c.logger.Debug("IAM auth request signed successfully", 
+
+	c.logger.Debug("IAM auth request signed successfully",
 		"signature_prefix", authReq.Signature[:len(authReq.Signature)-20]+"...",
 		"signed_headers", authReq.SignedHeaders)
 
@@ -715,7 +1170,7 @@ func (c *Client) authenticateWithIAM(ctx context.Context) error {
 
 	// Create channel for IAM auth response (outside of lock to avoid deadlock)
 	respChan := make(chan *protocol.IAMAuthResponse, 1)
-	
+
 	// Prepare envelope before acquiring lock
 	envelope := protocol.Envelope{
 		Type:    "iam_auth_request",
@@ -735,20 +1190,20 @@ func (c *Client) authenticateWithIAM(ctx context.Context) error {
 	isConnected := c.connected
 	conn := c.conn
 	c.mu.RUnlock()
-	
+
 	c.logger.Debug("Connection state check", "connected", isConnected, "conn_not_nil", conn != nil)
-	
+
 	if !isConnected || conn == nil {
 		c.logger.Error("Failed to send IAM auth request", fmt.Errorf("not connected to server"))
 		return fmt.Errorf("not connected to server")
 	}
 
 	c.logger.Debug("Sending IAM authentication request", "id", authReqID)
-	if err := json.NewEncoder(conn).Encode(envelope); err != nil {
+	if err := c.send(envelope); err != nil {
 		c.logger.Error("Failed to encode and send IAM auth request", err)
 		return fmt.Errorf("failed to send IAM auth request: %w", err)
 	}
-	
+
 	c.logger.Debug("IAM auth request envelope sent successfully, waiting for response", "id", authReqID, "timeout_seconds", 30)
 
 	// Wait for IAM auth response with timeout
@@ -759,7 +1214,7 @@ func (c *Client) authenticateWithIAM(ctx context.Context) error {
 			c.logger.Info("IAM authentication approved by server")
 			return nil
 		}
-		c.logger.Error("IAM authentication denied by server", fmt.Errorf(resp.Error))
+		c.logger.Error("IAM authentication denied by server", errors.New(resp.Error))
 		return fmt.Errorf("IAM authentication denied: %s", resp.Error)
 	case <-time.After(30 * time.Second):
 		c.logger.Error("IAM authentication timeout waiting for response", fmt.Errorf("no response from server after 30s"), "id", authReqID)
@@ -767,5 +1222,99 @@ func (c *Client) authenticateWithIAM(ctx context.Context) error {
 	case <-ctx.Done():
 		c.logger.Error("IAM authentication cancelled", fmt.Errorf("context cancelled"), "id", authReqID)
 		return fmt.Errorf("IAM authentication cancelled")
+	case <-busy:
+		return fmt.Errorf("server busy")
+	}
+}
+
+// exchangeHello sends this build's hello and checks the server's reply for protocol compatibility. A server
+// address that has already let the hello go unanswered is not waited on again, unless compatibility is strict.
+func (c *Client) exchangeHello(busy <-chan struct{}) error {
+	helloCh := make(chan *protocol.Hello, 1)
+
+	c.mu.Lock()
+	addr := c.serverAddr
+	legacy := c.legacyServers[addr] && !c.strictCompat
+	if !legacy {
+		c.helloCh = helloCh
 	}
+	c.serverHello = nil
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.helloCh = nil
+		c.mu.Unlock()
+	}()
+
+	local := protocol.LocalHello()
+	if err := c.send(protocol.Envelope{Type: "hello", Payload: local}); err != nil {
+		return fmt.Errorf("failed to send hello: %w", err)
+	}
+	if legacy {
+		c.logger.Debug("Not waiting for hello from a legacy server", "addr", addr)
+		return nil
+	}
+
+	var peer *protocol.Hello
+	select {
+	case peer = <-helloCh:
+	case <-busy:
+		return fmt.Errorf("server busy")
+	case <-time.After(helloTimeout):
+		// Servers that predate the handshake ignore the hello
+		if c.strictCompat {
+			return fmt.Errorf("server did not answer hello within %s", helloTimeout)
+		}
+		c.logger.Warn("Server did not answer hello, assuming a legacy build", "timeout", helloTimeout.String())
+		c.mu.Lock()
+		if c.legacyServers == nil {
+			c.legacyServers = make(map[string]bool)
+		}
+		c.legacyServers[addr] = true
+		c.mu.Unlock()
+		return nil
+	}
+
+	c.mu.Lock()
+	c.serverHello = peer
+	c.mu.Unlock()
+
+	compat, reason := protocol.CheckCompatibility(local, *peer)
+	fields := []interface{}{
+		"server_version", peer.BuildVersion,
+		"server_commit", peer.BuildCommit,
+		"server_protocol", peer.ProtocolVersion,
+		"local_version", local.BuildVersion,
+		"local_protocol", local.ProtocolVersion,
+	}
+
+	switch compat {
+	case protocol.Compatible:
+		c.logger.Debug("Server build is compatible", fields...)
+	case protocol.CompatibleWithDrift:
+		c.logger.Warn("Server build differs from agent: "+reason, fields...)
+	case protocol.Incompatible:
+		if c.strictCompat {
+			return fmt.Errorf("server is incompatible: %s", reason)
+		}
+		c.logger.Warn("Server protocol is incompatible, continuing: "+reason, fields...)
+	}
+	return nil
+}
+
+// startHeartbeat pings the server while the connection is idle, until the response handler exits
+// (done). Servers that did not advertise heartbeat support in their hello are not pinged.
+func (c *Client) startHeartbeat(done <-chan struct{}) {
+	c.mu.RLock()
+	peer := c.serverHello
+	c.mu.RUnlock()
+	if c.heartbeat <= 0 || peer == nil || peer.Features&protocol.FeatureHeartbeat == 0 {
+		return
+	}
+
+	go keepalive.Heartbeat(&c.lastWrite, c.heartbeat, done, func() error {
+		c.logger.Debug("Sending heartbeat ping to server")
+		return c.send(protocol.Envelope{Type: "ping"})
+	})
 }
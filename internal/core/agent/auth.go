@@ -0,0 +1,251 @@
+package agent
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// proxyAuthRealm is advertised in Proxy-Authenticate and WWW-Authenticate challenges
+const proxyAuthRealm = "fluidity"
+
+// Proxy password hashes are PBKDF2-SHA256 with a random salt, encoded as
+// "pbkdf2-sha256$<iterations>$<base64 salt>$<base64 key>"
+const (
+	proxyHashScheme     = "pbkdf2-sha256"
+	proxyHashIterations = 600000
+	proxyHashSaltBytes  = 16
+	proxyHashKeyBytes   = 32
+)
+
+// Failed password checks are throttled so that wrong credentials cannot be used to burn CPU on key
+// derivation: a failed header is refused unhashed for proxyAuthFailureWindow, as is every attempt from an
+// address with proxyAuthMaxFailures failures in the window
+const (
+	proxyAuthFailureWindow = time.Minute
+	proxyAuthMaxFailures   = 10
+	proxyAuthMaxTracked    = 1024 // Most failed headers, and addresses, remembered at once
+)
+
+// proxyCredentials holds the Basic credentials required to use the proxy
+type proxyCredentials struct {
+	username   []byte
+	salt       []byte
+	iterations int
+	key        []byte // PBKDF2 key derived from the password
+
+	// SHA-256 of the last Authorization header value that verified, so the slow key derivation runs
+	// once per credential rather than once per request
+	verified atomic.Pointer[[sha256.Size]byte]
+
+	failures authFailures
+}
+
+// authFailures tracks recent failed password checks by header digest and by client address
+type authFailures struct {
+	mu      sync.Mutex
+	headers map[[sha256.Size]byte]time.Time // When each failed header failed
+	addrs   map[string]*addrFailures
+}
+
+// addrFailures counts the failed password checks from one address in the window starting at start
+type addrFailures struct {
+	start time.Time
+	count int
+}
+
+// blocked reports whether a header, or its client address, failed recently enough to be refused unhashed
+func (f *authFailures) blocked(sum [sha256.Size]byte, addr string, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if at, ok := f.headers[sum]; ok && now.Sub(at) < proxyAuthFailureWindow {
+		return true
+	}
+	a := f.addrs[addr]
+	return a != nil && now.Sub(a.start) < proxyAuthFailureWindow && a.count >= proxyAuthMaxFailures
+}
+
+// record notes a failed password check
+func (f *authFailures) record(sum [sha256.Size]byte, addr string, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.headers == nil {
+		f.headers = make(map[[sha256.Size]byte]time.Time)
+		f.addrs = make(map[string]*addrFailures)
+	}
+	if len(f.headers) >= proxyAuthMaxTracked || len(f.addrs) >= proxyAuthMaxTracked {
+		f.prune(now)
+	}
+
+	f.headers[sum] = now
+	a := f.addrs[addr]
+	if a == nil || now.Sub(a.start) >= proxyAuthFailureWindow {
+		a = &addrFailures{start: now}
+		f.addrs[addr] = a
+	}
+	a.count++
+}
+
+// prune drops expired failures, and forgets them all if the tables are still full
+func (f *authFailures) prune(now time.Time) {
+	for sum, at := range f.headers {
+		if now.Sub(at) >= proxyAuthFailureWindow {
+			delete(f.headers, sum)
+		}
+	}
+	for addr, a := range f.addrs {
+		if now.Sub(a.start) >= proxyAuthFailureWindow {
+			delete(f.addrs, addr)
+		}
+	}
+	if len(f.headers) >= proxyAuthMaxTracked {
+		clear(f.headers)
+	}
+	if len(f.addrs) >= proxyAuthMaxTracked {
+		clear(f.addrs)
+	}
+}
+
+// HashProxyPassword returns a salted hash of password for the proxy_password_hash setting
+func HashProxyPassword(password string) (string, error) {
+	salt := make([]byte, proxyHashSaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, proxyHashIterations, proxyHashKeyBytes)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", proxyHashScheme, proxyHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// SetProxyAuth requires Basic proxy credentials on every request, the health check and status page
+// included (call before Start)
+func (p *Server) SetProxyAuth(username, password string) error {
+	hash, err := HashProxyPassword(password)
+	if err != nil {
+		return err
+	}
+	return p.SetProxyAuthHash(username, hash)
+}
+
+// SetProxyAuthHash is like SetProxyAuth but takes a password hash from HashProxyPassword
+func (p *Server) SetProxyAuthHash(username, passwordHash string) error {
+	invalid := fmt.Errorf("proxy password hash must be of the form %s$<iterations>$<salt>$<key>", proxyHashScheme)
+
+	fields := strings.Split(strings.TrimSpace(passwordHash), "$")
+	if len(fields) != 4 || fields[0] != proxyHashScheme {
+		return invalid
+	}
+	iterations, err := strconv.Atoi(fields[1])
+	if err != nil || iterations <= 0 {
+		return invalid
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(fields[2])
+	if err != nil || len(salt) == 0 {
+		return invalid
+	}
+	key, err := base64.RawStdEncoding.DecodeString(fields[3])
+	if err != nil || len(key) == 0 {
+		return invalid
+	}
+
+	p.proxyAuth = &proxyCredentials{
+		username:   []byte(username),
+		salt:       salt,
+		iterations: iterations,
+		key:        key,
+	}
+	return nil
+}
+
+// authorized reports whether the request carries valid credentials (always true when auth is disabled).
+// Proxied requests carry them in Proxy-Authorization; requests addressed to the proxy itself, such as a
+// browser opening the status page, carry them in Authorization.
+func (p *Server) authorized(r *http.Request) bool {
+	creds := p.proxyAuth
+	if creds == nil {
+		return true
+	}
+
+	header := r.Header.Get(p.authHeader(r))
+	scheme, encoded, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(header))
+	if last := creds.verified.Load(); last != nil && subtle.ConstantTimeCompare(sum[:], last[:]) == 1 {
+		return true
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+
+	// Only a matching username is worth the slow key derivation, and only from a client that has not
+	// been failing; both comparisons are constant time
+	if subtle.ConstantTimeCompare([]byte(username), creds.username) != 1 {
+		return false
+	}
+	addr := remoteHost(r)
+	now := time.Now()
+	if creds.failures.blocked(sum, addr, now) {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, creds.salt, creds.iterations, len(creds.key))
+	if err != nil {
+		return false
+	}
+	if subtle.ConstantTimeCompare(key, creds.key) != 1 {
+		creds.failures.record(sum, addr, now)
+		return false
+	}
+	creds.verified.Store(&sum)
+	return true
+}
+
+// remoteHost returns the client address of a request without its port
+func remoteHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// authHeader returns the header carrying the request's credentials
+func (p *Server) authHeader(r *http.Request) string {
+	if p.isDirectRequest(r) {
+		return "Authorization"
+	}
+	return "Proxy-Authorization"
+}
+
+// requireProxyAuth responds with a 407 challenge, or a 401 challenge to requests addressed to the proxy itself
+func (p *Server) requireProxyAuth(w http.ResponseWriter, r *http.Request) {
+	challenge := fmt.Sprintf("Basic realm=%q", proxyAuthRealm)
+	if p.isDirectRequest(r) {
+		w.Header().Set("WWW-Authenticate", challenge)
+		writeError(w, r, http.StatusUnauthorized, ErrCodeProxyAuthRequired, "Authentication required")
+		return
+	}
+	w.Header().Set("Proxy-Authenticate", challenge)
+	writeError(w, r, http.StatusProxyAuthRequired, ErrCodeProxyAuthRequired, "Proxy authentication required")
+}
@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// ServerBusyError is returned by Connect when the server turned the connection away for now, for example
+// while it ramps up after a cold start, and asked the agent to come back after RetryAfter
+type ServerBusyError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ServerBusyError) Error() string {
+	return fmt.Sprintf("server busy, retry after %s", e.RetryAfter)
+}
+
+// retryAfterBusy returns how long the server asked the agent to wait when err reports it busy
+func retryAfterBusy(err error) (time.Duration, bool) {
+	var busy *ServerBusyError
+	if errors.As(err, &busy) {
+		return busy.RetryAfter, true
+	}
+	return 0, false
+}
+
+// serverBusy records a server_busy notice for the current connection and wakes Connect if it is waiting
+func (c *Client) serverBusy(notice *protocol.ServerBusy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.busyNotice != nil {
+		return
+	}
+	c.busyNotice = notice
+	close(c.busyCh)
+}
+
+// busyError returns the ServerBusyError for the current connection, or nil if the server did not send one
+func (c *Client) busyError() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.busyNotice == nil {
+		return nil
+	}
+	return &ServerBusyError{RetryAfter: time.Duration(c.busyNotice.RetryAfterMs) * time.Millisecond}
+}
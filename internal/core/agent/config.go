@@ -1,6 +1,9 @@
 package agent
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // Config holds agent configuration
 type Config struct {
@@ -18,6 +21,136 @@ type Config struct {
 	KillEndpoint       string `mapstructure:"kill_endpoint" yaml:"kill_endpoint"`
 	IAMRoleARN         string `mapstructure:"iam_role_arn" yaml:"iam_role_arn"`
 	AWSRegion          string `mapstructure:"aws_region" yaml:"aws_region"`
+	StatusPath         string `mapstructure:"status_path" yaml:"status_path"` // Local status page path (empty uses /status, "-" disables)
+
+	// InitialConnectTimeout bounds how long the first tunnel connect is retried while the server cold-starts
+	InitialConnectTimeout time.Duration `mapstructure:"initial_connect_timeout" yaml:"initial_connect_timeout"`
+	// KillTimeout bounds the lifecycle Kill call on shutdown, retries included (0 uses the default of 10s)
+	KillTimeout time.Duration `mapstructure:"kill_timeout" yaml:"kill_timeout"`
+
+	// VerifyChecksums enables SHA-256 integrity checks of request and response bodies
+	VerifyChecksums bool `mapstructure:"verify_checksums" yaml:"verify_checksums"`
+
+	// ConnectCoalesceDelay gathers small CONNECT client reads for up to this long into one connect_data (0 sends each read immediately)
+	ConnectCoalesceDelay time.Duration `mapstructure:"connect_coalesce_delay" yaml:"connect_coalesce_delay"`
+	// ConnectCoalesceBytes sends gathered CONNECT data as soon as this much is buffered (0 uses the default of 16KB)
+	ConnectCoalesceBytes int `mapstructure:"connect_coalesce_bytes" yaml:"connect_coalesce_bytes"`
+	// ConnectCompressPorts lists CONNECT target ports whose tunnel data is compressed, for plaintext protocols such as redis (empty compresses none)
+	ConnectCompressPorts []int `mapstructure:"connect_compress_ports" yaml:"connect_compress_ports"`
+
+	// AllowedMethods restricts which HTTP methods the proxy forwards (empty allows all)
+	AllowedMethods []string `mapstructure:"allowed_methods" yaml:"allowed_methods"`
+	// AllowedSchemes restricts which request URL schemes the proxy forwards (empty allows http and https)
+	AllowedSchemes []string `mapstructure:"allowed_schemes" yaml:"allowed_schemes"`
+
+	// NoProxy lists hosts reached directly instead of through the tunnel, as NO_PROXY: domain suffixes, IPs, CIDR blocks, host:port or "*"
+	NoProxy []string `mapstructure:"no_proxy" yaml:"no_proxy"`
+
+	// StrictHostValidation rejects requests whose Host header and URI disagree or whose host is malformed instead of normalizing them
+	StrictHostValidation bool `mapstructure:"strict_host_validation" yaml:"strict_host_validation"`
+	// StrictFraming rejects requests with both Content-Length and Transfer-Encoding or duplicate Content-Length headers instead of removing those headers
+	StrictFraming bool `mapstructure:"strict_framing" yaml:"strict_framing"`
+	// OnDemand leaves the tunnel down, and the server scaled down, until a proxied request needs it, which then wakes the server and connects first
+	OnDemand bool `mapstructure:"on_demand" yaml:"on_demand"`
+	// OnDemandIdleTimeout disconnects an on-demand tunnel and kills its server after this long without traffic (0 keeps it up once started)
+	OnDemandIdleTimeout time.Duration `mapstructure:"on_demand_idle_timeout" yaml:"on_demand_idle_timeout"`
+	// StartupWait holds requests arriving before the tunnel first connects for up to this long (0 uses the default of 10s, negative fails them at once)
+	StartupWait time.Duration `mapstructure:"startup_wait" yaml:"startup_wait"`
+
+	// StrictCompatibility fails the connection when the server's protocol version is incompatible instead of warning
+	StrictCompatibility bool `mapstructure:"strict_compatibility" yaml:"strict_compatibility"`
+
+	// DisableIAMAuth skips the IAM authentication exchange for mTLS-only deployments (the server must not require it)
+	DisableIAMAuth bool `mapstructure:"disable_iam_auth" yaml:"disable_iam_auth"`
+
+	// ProxyUsername enables Basic proxy authentication on the local proxy (empty disables)
+	ProxyUsername string `mapstructure:"proxy_username" yaml:"proxy_username"`
+	// ProxyPassword is the plaintext proxy password (prefer ProxyPasswordHash)
+	ProxyPassword string `mapstructure:"proxy_password" yaml:"proxy_password" secret:"true"`
+	// ProxyPasswordHash is the salted proxy password hash printed by the hash-password command
+	ProxyPasswordHash string `mapstructure:"proxy_password_hash" yaml:"proxy_password_hash" secret:"true"`
+
+	// AutoReconnect re-establishes a lost tunnel instead of exiting
+	AutoReconnect bool `mapstructure:"auto_reconnect" yaml:"auto_reconnect"`
+	// ReconnectInitialDelayMax bounds the random delay before the first reconnect attempt (0 uses the default, negative disables)
+	ReconnectInitialDelayMax time.Duration `mapstructure:"reconnect_initial_delay_max" yaml:"reconnect_initial_delay_max"`
+	// ReconnectMaxDelay caps the backoff between reconnect attempts (0 uses the default)
+	ReconnectMaxDelay time.Duration `mapstructure:"reconnect_max_delay" yaml:"reconnect_max_delay"`
+	// ReconnectJitter is the fraction (0-1) of each backoff that is randomized (0 uses the default, negative disables)
+	ReconnectJitter float64 `mapstructure:"reconnect_jitter" yaml:"reconnect_jitter"`
+	// ReconnectMinInterval is the minimum time between reconnect attempts (0 uses the default)
+	ReconnectMinInterval time.Duration `mapstructure:"reconnect_min_interval" yaml:"reconnect_min_interval"`
+
+	// AdditionalServers lists host:port addresses of further server tasks to spread requests across
+	AdditionalServers []string `mapstructure:"additional_servers" yaml:"additional_servers"`
+	// LoadBalance picks the server for each request: round_robin (default) or least_outstanding
+	LoadBalance string `mapstructure:"load_balance" yaml:"load_balance"`
+	// Tunnels are further named tunnels to their own servers, each carrying the requests for its hosts
+	Tunnels []TunnelConfig `mapstructure:"tunnels" yaml:"tunnels"`
+
+	// WebSocketPingInterval pings proxied client WebSockets this often (0 uses the default of 30s, negative disables)
+	WebSocketPingInterval time.Duration `mapstructure:"websocket_ping_interval" yaml:"websocket_ping_interval"`
+	// WebSocketPongTimeout closes a WebSocket tunnel whose client misses a pong for this long (0 uses the default of 10s)
+	WebSocketPongTimeout time.Duration `mapstructure:"websocket_pong_timeout" yaml:"websocket_pong_timeout"`
+
+	// LogFullURL logs full request URLs at debug level (info logs stay domain-only; URLs may contain sensitive data)
+	LogFullURL bool `mapstructure:"log_full_url" yaml:"log_full_url"`
+	// LogStreamID limits debug logs to the request, tunnel or WebSocket with this ID (empty logs every stream)
+	LogStreamID string `mapstructure:"log_stream_id" yaml:"log_stream_id"`
+	// LogLevels overrides log_level for individual components such as tunnel-client or proxy-server
+	LogLevels map[string]string `mapstructure:"log_levels" yaml:"log_levels"`
+
+	// PreserveHopByHopHeaders forwards hop-by-hop request headers such as Connection instead of stripping them
+	PreserveHopByHopHeaders bool `mapstructure:"preserve_hop_by_hop_headers" yaml:"preserve_hop_by_hop_headers"`
+	// MaxResponseBodyBytes rejects buffered responses and aborts streamed ones larger than this (0 means no limit)
+	MaxResponseBodyBytes int64 `mapstructure:"max_response_body_bytes" yaml:"max_response_body_bytes"`
+	// StreamBodyThresholdBytes streams request bodies larger than this through the tunnel instead of buffering them (0 uses the default of 1MB, negative disables)
+	StreamBodyThresholdBytes int64 `mapstructure:"stream_body_threshold_bytes" yaml:"stream_body_threshold_bytes"`
+
+	// TCPKeepalive enables TCP keepalive probes with the idle and interval below (off keeps Go's defaults)
+	TCPKeepalive bool `mapstructure:"tcp_keepalive" yaml:"tcp_keepalive"`
+	// TCPKeepaliveIdle is the idle time before the first probe (0 uses the default of 15s)
+	TCPKeepaliveIdle time.Duration `mapstructure:"tcp_keepalive_idle" yaml:"tcp_keepalive_idle"`
+	// TCPKeepaliveInterval is the time between probes (0 uses the default of 15s)
+	TCPKeepaliveInterval time.Duration `mapstructure:"tcp_keepalive_interval" yaml:"tcp_keepalive_interval"`
+	// HeartbeatInterval pings the peer after this long without tunnel writes, keeping idle tunnels inside
+	// load balancer idle timeouts such as the NLB's 350s (0 uses the default of 60s, negative disables)
+	HeartbeatInterval time.Duration `mapstructure:"heartbeat_interval" yaml:"heartbeat_interval"`
+
+	// RequestTimeout bounds the wait for a response through the tunnel, after which the server is told to cancel the
+	// request; keep it above the server's max_request_duration (0 uses the default of 6m)
+	RequestTimeout time.Duration `mapstructure:"request_timeout" yaml:"request_timeout"`
+
+	// MaxIdleTime shuts the agent down (calling Kill) after this long without proxied traffic (0 disables)
+	MaxIdleTime time.Duration `mapstructure:"max_idle_time" yaml:"max_idle_time"`
+
+	// StateNotifyCommand is a program and its arguments run on tunnel state changes (connected, disconnected, reconnecting, failed, cert_expiring), with the state as a final argument and the event as JSON on stdin, e.g. to show a desktop notification (empty disables)
+	StateNotifyCommand []string `mapstructure:"state_notify_command" yaml:"state_notify_command"`
+	// StateNotifyWebhook is a URL the state change events are POSTed to as JSON (empty disables)
+	StateNotifyWebhook string `mapstructure:"state_notify_webhook" yaml:"state_notify_webhook"`
+	// StateNotifyTimeout bounds each state notification (0 uses the default of 5s)
+	StateNotifyTimeout time.Duration `mapstructure:"state_notify_timeout" yaml:"state_notify_timeout"`
+}
+
+// TunnelConfig describes a named tunnel to its own server, which carries requests for its hosts
+// instead of the default tunnel
+type TunnelConfig struct {
+	Name       string `mapstructure:"name" yaml:"name"`
+	ServerIP   string `mapstructure:"server_ip" yaml:"server_ip"`
+	ServerPort int    `mapstructure:"server_port" yaml:"server_port"`
+
+	// Hosts routed through this tunnel, in no_proxy form: domain suffixes, IPs, CIDR blocks, host:port or "*"
+	Hosts []string `mapstructure:"hosts" yaml:"hosts"`
+
+	// CertFile, KeyFile and CACertFile are this tunnel's client certificate (empty uses the agent's)
+	CertFile   string `mapstructure:"cert_file" yaml:"cert_file"`
+	KeyFile    string `mapstructure:"key_file" yaml:"key_file"`
+	CACertFile string `mapstructure:"ca_cert_file" yaml:"ca_cert_file"`
+
+	// WakeEndpoint, QueryEndpoint and KillEndpoint manage this tunnel's server lifecycle (empty connects to server_ip without waking it)
+	WakeEndpoint  string `mapstructure:"wake_endpoint" yaml:"wake_endpoint"`
+	QueryEndpoint string `mapstructure:"query_endpoint" yaml:"query_endpoint"`
+	KillEndpoint  string `mapstructure:"kill_endpoint" yaml:"kill_endpoint"`
 }
 
 // GetServerAddress returns the full server address
@@ -29,3 +162,25 @@ func (c *Config) GetServerAddress() string {
 func (c *Config) SetServerIP(ip string) {
 	c.ServerIP = ip
 }
+
+// GetReconnectConfig returns the reconnection settings with defaults applied
+func (c *Config) GetReconnectConfig() ReconnectConfig {
+	rc := DefaultReconnectConfig()
+	if c.ReconnectInitialDelayMax < 0 {
+		rc.InitialDelayMax = 0
+	} else if c.ReconnectInitialDelayMax > 0 {
+		rc.InitialDelayMax = c.ReconnectInitialDelayMax
+	}
+	if c.ReconnectMaxDelay > 0 {
+		rc.MaxDelay = c.ReconnectMaxDelay
+	}
+	if c.ReconnectJitter < 0 {
+		rc.Jitter = 0
+	} else if c.ReconnectJitter > 0 {
+		rc.Jitter = c.ReconnectJitter
+	}
+	if c.ReconnectMinInterval > 0 {
+		rc.MinInterval = c.ReconnectMinInterval
+	}
+	return rc
+}
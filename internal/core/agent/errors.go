@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// Error codes reported in proxy-generated error responses
+const (
+	ErrCodeBadRequest        = protocol.ErrCodeBadRequest
+	ErrCodeMethodNotAllowed  = protocol.ErrCodeMethodNotAllowed
+	ErrCodeInvalidScheme     = protocol.ErrCodeInvalidScheme
+	ErrCodeForbidden         = protocol.ErrCodeForbidden
+	ErrCodeProxyAuthRequired = "proxy_auth_required"
+	ErrCodeTunnelUnavailable = "tunnel_unavailable"
+	ErrCodeTunnelError       = "tunnel_error"
+	ErrCodeTimeout           = protocol.ErrCodeTimeout
+	ErrCodeIntegrity         = protocol.ErrCodeIntegrity
+	ErrCodeResponseTooLarge  = protocol.ErrCodeResponseTooLarge
+	ErrCodeConnectFailed     = "connect_failed"
+	ErrCodeInternal          = protocol.ErrCodeInternal
+	ErrCodeCircuitOpen       = protocol.ErrCodeCircuitOpen
+	ErrCodeLoadShed          = protocol.ErrCodeLoadShed
+	ErrCodeHostBusy          = protocol.ErrCodeHostBusy
+)
+
+// ErrorSourceHeader tells clients whether an error response came from the target or the tunnel: it is
+// ErrorSourceTunnel on errors the proxy or tunnel server generated and ErrorSourceUpstream on target
+// responses with an error status
+const ErrorSourceHeader = "X-Fluidity-Error"
+
+// Values of ErrorSourceHeader
+const (
+	ErrorSourceUpstream = "upstream"
+	ErrorSourceTunnel   = "tunnel"
+)
+
+// errorResponse is the JSON body of a proxy-generated error
+type errorResponse struct {
+	Error errorDetail `json:"error"`
+}
+
+// errorDetail describes a proxy-generated error
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError responds with a proxy-generated error, as JSON when the client accepts it and plain text otherwise
+func writeError(w http.ResponseWriter, r *http.Request, statusCode int, code, message string) {
+	w.Header().Set(ErrorSourceHeader, ErrorSourceTunnel)
+	if !acceptsJSON(r) {
+		http.Error(w, message, statusCode)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(errorResponse{Error: errorDetail{Code: code, Message: message}})
+}
+
+// writeTunnelError relays an error the tunnel server generated, keeping headers such as Retry-After,
+// in the same format as proxy-generated errors
+func writeTunnelError(w http.ResponseWriter, r *http.Request, resp *protocol.Response) {
+	for name, values := range resp.Headers {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	writeError(w, r, resp.StatusCode, resp.ErrorCode, "Tunnel error: "+resp.Error)
+}
+
+// markUpstreamError labels a relayed target response with an error status as such, replacing any
+// label the target sent itself
+func markUpstreamError(header http.Header, statusCode int) {
+	header.Del(ErrorSourceHeader)
+	if statusCode >= http.StatusBadRequest {
+		header.Set(ErrorSourceHeader, ErrorSourceUpstream)
+	}
+}
+
+// acceptsJSON reports whether the request's Accept header explicitly lists a JSON media type
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil || params["q"] == "0" {
+				continue
+			}
+			if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+				return true
+			}
+		}
+	}
+	return false
+}
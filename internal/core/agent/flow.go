@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"time"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// defaultMaxPause bounds a flow_control pause that does not name a limit of its own
+const defaultMaxPause = 30 * time.Second
+
+// flowControl applies a flow_control message from the server
+func (c *Client) flowControl(msg *protocol.FlowControl) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !msg.Pause {
+		c.logger.Info("Tunnel server resumed new requests")
+		c.liftPause()
+		return
+	}
+
+	maxPause := time.Duration(msg.MaxPauseMs) * time.Millisecond
+	if maxPause <= 0 {
+		maxPause = defaultMaxPause
+	}
+	c.logger.Warn("Tunnel server paused new requests", "max_pause_ms", maxPause.Milliseconds())
+	c.pausedUntil = time.Now().Add(maxPause)
+	if c.pauseCh == nil {
+		c.pauseCh = make(chan struct{})
+	}
+}
+
+// liftPause releases work held by a flow_control pause (c.mu must be held)
+func (c *Client) liftPause() {
+	if c.pauseCh != nil {
+		close(c.pauseCh)
+		c.pauseCh = nil
+	}
+	c.pausedUntil = time.Time{}
+}
+
+// Paused reports whether the server has asked this client to hold new requests, tunnels and WebSockets
+func (c *Client) Paused() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.pauseCh != nil && time.Now().Before(c.pausedUntil)
+}
+
+// waitWhilePaused holds new work while the server has paused this client, until the server resumes it,
+// the pause lapses or the connection closes
+func (c *Client) waitWhilePaused(id string) {
+	c.mu.RLock()
+	resumed, until, ctx := c.pauseCh, c.pausedUntil, c.ctx
+	c.mu.RUnlock()
+
+	wait := time.Until(until)
+	if resumed == nil || wait <= 0 {
+		return
+	}
+
+	c.logger.Debug("Holding new work while the tunnel server is paused", "id", id, "max_wait_ms", wait.Milliseconds())
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-resumed:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
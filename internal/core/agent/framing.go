@@ -0,0 +1,33 @@
+package agent
+
+import (
+	"net/http"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// SetStrictFraming rejects requests whose body length is ambiguous, with Content-Length and
+// Transfer-Encoding headers together or more than one Content-Length, instead of removing those headers
+// before forwarding. net/http already refuses differing Content-Length values and frames a chunked
+// request by its chunks, so this mostly guards the headers handed on to the tunnel (call before Start).
+func (p *Server) SetStrictFraming(strict bool) {
+	p.strictFraming = strict
+}
+
+// checkFraming looks for conflicting framing headers on a proxied request, returning an error in strict
+// mode and otherwise removing them so that only the body's actual length is passed on
+func (p *Server) checkFraming(r *http.Request) error {
+	err := protocol.CheckFraming(r.Header)
+	if err == nil && len(r.TransferEncoding) > 0 && r.Header.Get("Content-Length") != "" {
+		err = protocol.ErrLengthWithTransferEncoding
+	}
+	if err == nil {
+		return nil
+	}
+	if p.strictFraming {
+		return err
+	}
+	p.logger.Warn("Removing ambiguous framing headers from request", "method", r.Method, "error", err.Error())
+	protocol.SanitizeFraming(r.Header)
+	return nil
+}
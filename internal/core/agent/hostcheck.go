@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// SetStrictHostValidation rejects requests whose target host is ambiguous instead of normalizing them:
+// a Host header that disagrees with an absolute request URI, user information in the URI, or a host that
+// is not a plain host name or IP address with an optional port (call before Start)
+func (p *Server) SetStrictHostValidation(strict bool) {
+	p.strictHost = strict
+}
+
+// resolveTargetHost settles the host a proxied request is sent to. An absolute request URI decides it,
+// as RFC 9112 requires of proxies, and the Host header is made to match; otherwise the Host header
+// decides it. CONNECT targets are validated separately by connectTarget.
+func (p *Server) resolveTargetHost(r *http.Request) error {
+	if r.URL.IsAbs() {
+		if r.URL.Host == "" {
+			return errors.New("request URI has no host")
+		}
+		if !strings.EqualFold(r.Host, r.URL.Host) {
+			if p.strictHost {
+				return fmt.Errorf("Host header %q does not match request URI host %q", r.Host, r.URL.Host)
+			}
+			p.logger.Debug("Replacing Host header with the request URI host", "host", r.Host, "uri_host", r.URL.Host)
+		}
+		r.Host = r.URL.Host
+	} else if r.Host == "" {
+		return errors.New("request has no Host header")
+	}
+
+	if p.strictHost {
+		if r.URL.User != nil {
+			return errors.New("request URI carries user information")
+		}
+		if _, err := connectTarget(r.Host); err != nil {
+			return fmt.Errorf("invalid host %q: %w", r.Host, err)
+		}
+	}
+
+	r.Host = strings.ToLower(r.Host)
+	if r.URL.Host != "" {
+		r.URL.Host = r.Host
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"time"
+)
+
+// touch records proxied traffic for idle tracking
+func (p *Server) touch() {
+	p.lastActivity.Store(time.Now().UnixNano())
+}
+
+// beginRequest marks an HTTP request as in flight, so the proxy is not idle however long its response takes
+func (p *Server) beginRequest() {
+	p.inflightRequests.Add(1)
+	p.touch()
+}
+
+// endRequest marks an HTTP request as complete; the idle time counts from here
+func (p *Server) endRequest() {
+	p.touch()
+	p.inflightRequests.Add(-1)
+}
+
+// LastActivity returns when the proxy last carried traffic (its start time if it has not yet)
+func (p *Server) LastActivity() time.Time {
+	return time.Unix(0, p.lastActivity.Load())
+}
+
+// idleFor returns how long the proxy has carried no traffic, which is zero while any HTTP request is in flight
+func (p *Server) idleFor() time.Duration {
+	if p.inflightRequests.Load() > 0 {
+		return 0
+	}
+	return time.Since(p.LastActivity())
+}
+
+// IdleChannel returns a channel that is closed once no HTTP, CONNECT or WebSocket traffic has
+// passed through the proxy for maxIdle and no HTTP request is awaiting its response. Traffic
+// resets the timer; the channel is never closed after the proxy stops.
+func (p *Server) IdleChannel(maxIdle time.Duration) <-chan struct{} {
+	idle := make(chan struct{})
+
+	go func() {
+		// Check often enough that shutdown happens close to the deadline
+		interval := maxIdle / 10
+		if interval < 100*time.Millisecond {
+			interval = 100 * time.Millisecond
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-ticker.C:
+				if idleFor := p.idleFor(); idleFor >= maxIdle {
+					p.logger.Info("Proxy idle limit reached", "idle", idleFor.Round(time.Second).String(), "max_idle", maxIdle.String())
+					close(idle)
+					return
+				}
+			}
+		}
+	}()
+
+	return idle
+}
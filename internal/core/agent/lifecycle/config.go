@@ -11,6 +11,9 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 )
 
+// DefaultKillTimeout bounds the Kill call on shutdown when no timeout is configured
+const DefaultKillTimeout = 10 * time.Second
+
 // Config holds lifecycle management configuration
 type Config struct {
 	// WakeEndpoint is the full URL to the Wake Lambda API endpoint
@@ -38,9 +41,16 @@ type Config struct {
 	// ConnectionRetryInterval is the interval between connection retry attempts
 	ConnectionRetryInterval time.Duration
 
+	// ConnectionRetryMaxInterval caps the retry interval as it backs off (0 keeps the interval fixed)
+	ConnectionRetryMaxInterval time.Duration
+
 	// HTTPTimeout is the timeout for HTTP API calls
 	HTTPTimeout time.Duration
 
+	// KillTimeout bounds the Kill call including its retries, so a dead endpoint cannot stall shutdown
+	// (0 uses DefaultKillTimeout)
+	KillTimeout time.Duration
+
 	// MaxRetries is the maximum number of retry attempts for API calls
 	MaxRetries int
 
@@ -51,18 +61,20 @@ type Config struct {
 // LoadConfig loads lifecycle configuration from environment variables
 func LoadConfig() (*Config, error) {
 	config := &Config{
-		WakeEndpoint:            os.Getenv("WAKE_ENDPOINT"),
-		QueryEndpoint:           os.Getenv("QUERY_ENDPOINT"),
-		KillEndpoint:            os.Getenv("KILL_ENDPOINT"),
-		IAMRoleARN:              os.Getenv("IAM_ROLE_ARN"),
-		AWSRegion:               getEnvOrDefault("AWS_REGION", ""),
-		ClusterName:             getEnvOrDefault("ECS_CLUSTER_NAME", ""),
-		ServiceName:             getEnvOrDefault("ECS_SERVICE_NAME", ""),
-		ConnectionTimeout:       getEnvDuration("CONNECTION_TIMEOUT", 90*time.Second),
-		ConnectionRetryInterval: getEnvDuration("CONNECTION_RETRY_INTERVAL", 5*time.Second),
-		HTTPTimeout:             getEnvDuration("HTTP_TIMEOUT", 30*time.Second),
-		MaxRetries:              getEnvInt("MAX_RETRIES", 3),
-		Enabled:                 getEnvBool("LIFECYCLE_ENABLED", true),
+		WakeEndpoint:               os.Getenv("WAKE_ENDPOINT"),
+		QueryEndpoint:              os.Getenv("QUERY_ENDPOINT"),
+		KillEndpoint:               os.Getenv("KILL_ENDPOINT"),
+		IAMRoleARN:                 os.Getenv("IAM_ROLE_ARN"),
+		AWSRegion:                  getEnvOrDefault("AWS_REGION", ""),
+		ClusterName:                getEnvOrDefault("ECS_CLUSTER_NAME", ""),
+		ServiceName:                getEnvOrDefault("ECS_SERVICE_NAME", ""),
+		ConnectionTimeout:          getEnvDuration("CONNECTION_TIMEOUT", 90*time.Second),
+		ConnectionRetryInterval:    getEnvDuration("CONNECTION_RETRY_INTERVAL", 5*time.Second),
+		ConnectionRetryMaxInterval: getEnvDuration("CONNECTION_RETRY_MAX_INTERVAL", 0),
+		HTTPTimeout:                getEnvDuration("HTTP_TIMEOUT", 30*time.Second),
+		KillTimeout:                getEnvDuration("KILL_TIMEOUT", DefaultKillTimeout),
+		MaxRetries:                 getEnvInt("MAX_RETRIES", 3),
+		Enabled:                    getEnvBool("LIFECYCLE_ENABLED", true),
 	}
 
 	// Lifecycle is disabled if endpoints are not configured
@@ -0,0 +1,35 @@
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// APIError is returned when a lifecycle API responds with a non-2xx status
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+// Error implements the error interface
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API returned error status %d: %s", e.StatusCode, e.Body)
+}
+
+// Retryable reports whether the request may succeed if repeated: server errors,
+// timeouts and throttling are transient, other client errors are not
+func (e *APIError) Retryable() bool {
+	return e.StatusCode >= 500 ||
+		e.StatusCode == http.StatusRequestTimeout ||
+		e.StatusCode == http.StatusTooManyRequests
+}
+
+// shouldRetry retries everything except API errors that cannot succeed on repeat
+func shouldRetry(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable()
+	}
+	return true
+}
@@ -10,6 +10,7 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"fluidity/internal/core/agent"
@@ -29,6 +30,8 @@ type Client struct {
 	logger         *logging.Logger
 	awsConfig      aws.Config
 	signer         *v4.Signer
+	killOnce       sync.Once
+	killErr        error
 }
 
 // WakeRequest represents the request to Wake Lambda
@@ -142,7 +145,7 @@ func (c *Client) Wake(ctx context.Context) (*WakeResponse, error) {
 		Multiplier:   2.0,
 	}
 
-	err := retry.Execute(ctx, retryConfig, retry.AlwaysRetry(), func() error {
+	err := retry.Execute(ctx, retryConfig, shouldRetry, func() error {
 		var err error
 		response, err = c.callWakeAPI(ctx, reqBody)
 		return err
@@ -170,17 +173,39 @@ func (c *Client) callWakeAPI(ctx context.Context, reqBody WakeRequest) (*WakeRes
 	return response, nil
 }
 
-// Kill calls the Kill Lambda to stop the ECS service
+// Kill calls the Kill Lambda to stop the ECS service. Only the first call reaches the API, bounded by
+// the configured kill timeout; later calls return its result.
 func (c *Client) Kill(ctx context.Context) error {
 	if !c.config.Enabled {
 		c.logger.Info("Lifecycle management disabled, skipping kill")
 		return nil
 	}
 
+	called := true
+	c.killOnce.Do(func() {
+		called = false
+		c.killErr = c.kill(ctx)
+	})
+	if called {
+		c.logger.Debug("ECS service kill already requested, skipping")
+	}
+	return c.killErr
+}
+
+// kill calls the Kill API with retries, giving up once the kill timeout has passed
+func (c *Client) kill(ctx context.Context) error {
+	timeout := c.config.KillTimeout
+	if timeout <= 0 {
+		timeout = DefaultKillTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
 	c.logger.Info("Killing ECS service",
 		"endpoint", c.config.KillEndpoint,
 		"cluster", c.config.ClusterName,
 		"service", c.config.ServiceName,
+		"timeout", timeout.String(),
 	)
 
 	// Prepare request body
@@ -198,7 +223,7 @@ func (c *Client) Kill(ctx context.Context) error {
 		Multiplier:   2.0,
 	}
 
-	err := retry.Execute(ctx, retryConfig, retry.AlwaysRetry(), func() error {
+	err := retry.Execute(ctx, retryConfig, shouldRetry, func() error {
 		var err error
 		response, err = c.callKillAPI(ctx, reqBody)
 		return err
@@ -242,8 +267,10 @@ func (c *Client) callAPIWithSigV4(ctx context.Context, method, url string, body
 		return fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	// Execute with circuit breaker
+	// Execute with circuit breaker. Non-retryable API errors are the caller's fault rather than
+	// a sign the API is unhealthy, so they are kept out of the breaker's failure count.
 	var response interface{}
+	var clientErr *APIError
 	err = c.circuitBreaker.Execute(func() error {
 		// Create HTTP request
 		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(bodyBytes))
@@ -284,7 +311,12 @@ func (c *Client) callAPIWithSigV4(ctx context.Context, method, url string, body
 
 		// Check status code
 		if resp.StatusCode >= 400 {
-			return fmt.Errorf("API returned error status %d: %s", resp.StatusCode, string(respBody))
+			apiErr := &APIError{StatusCode: resp.StatusCode, Body: string(respBody)}
+			if !apiErr.Retryable() {
+				clientErr = apiErr
+				return nil
+			}
+			return apiErr
 		}
 
 		// Try to parse as direct JSON response first (for SigV4 authenticated calls)
@@ -333,6 +365,9 @@ func (c *Client) callAPIWithSigV4(ctx context.Context, method, url string, body
 	if err != nil {
 		return err
 	}
+	if clientErr != nil {
+		return clientErr
+	}
 
 	// Copy the response to the output parameter
 	switch r := response.(type) {
@@ -408,25 +443,67 @@ func (c *Client) WaitForConnection(ctx context.Context, checkFn func() bool) err
 	c.logger.Info("Waiting for server connection",
 		"timeout", c.config.ConnectionTimeout.String(),
 		"retryInterval", c.config.ConnectionRetryInterval.String(),
+		"maxRetryInterval", c.config.ConnectionRetryMaxInterval.String(),
 	)
 
 	// Create timeout context
 	timeoutCtx, cancel := context.WithTimeout(ctx, c.config.ConnectionTimeout)
 	defer cancel()
 
-	ticker := time.NewTicker(c.config.ConnectionRetryInterval)
-	defer ticker.Stop()
+	interval := c.config.ConnectionRetryInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-timeoutCtx.Done():
 			return fmt.Errorf("connection timeout after %v", c.config.ConnectionTimeout)
-		case <-ticker.C:
+		case <-timer.C:
 			if checkFn() {
 				c.logger.Info("Server connection established")
 				return nil
 			}
-			c.logger.Debug("Connection not ready, retrying...")
+
+			// Back off exponentially when a maximum interval is configured
+			if c.config.ConnectionRetryMaxInterval > interval {
+				interval *= 2
+				if interval > c.config.ConnectionRetryMaxInterval {
+					interval = c.config.ConnectionRetryMaxInterval
+				}
+			}
+			c.logger.Debug("Connection not ready, retrying...", "nextAttemptIn", interval.String())
+			timer.Reset(interval)
 		}
 	}
 }
+
+// EstablishConnection makes an initial connection attempt and, if it fails, keeps
+// retrying via WaitForConnection until connectFn succeeds or the connection timeout elapses
+func (c *Client) EstablishConnection(ctx context.Context, connectFn func() error) error {
+	err := connectFn()
+	if err == nil {
+		return nil
+	}
+
+	if !c.config.Enabled {
+		return err
+	}
+
+	c.logger.Warn("Initial connection attempt failed, retrying", "error", err.Error())
+
+	attempts := 1
+	waitErr := c.WaitForConnection(ctx, func() bool {
+		attempts++
+		if err = connectFn(); err != nil {
+			c.logger.Debug("Connection attempt failed", "attempt", attempts, "error", err.Error())
+			return false
+		}
+		return true
+	})
+	if waitErr != nil {
+		return fmt.Errorf("%w (after %d attempts, last error: %v)", waitErr, attempts, err)
+	}
+
+	c.logger.Info("Connected after retrying", "attempts", attempts)
+	return nil
+}
@@ -3,8 +3,10 @@ package lifecycle
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -370,3 +372,179 @@ func TestWaitForConnection(t *testing.T) {
 		}
 	})
 }
+
+func TestWakeAPIErrorTyped(t *testing.T) {
+	// Static credentials let requests be signed without contacting AWS
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	tests := []struct {
+		name         string
+		status       int
+		wantAttempts int32
+	}{
+		{name: "forbidden is not retried", status: http.StatusForbidden, wantAttempts: 1},
+		{name: "server error is retried", status: http.StatusInternalServerError, wantAttempts: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts.Add(1)
+				w.WriteHeader(tt.status)
+				w.Write([]byte("denied"))
+			}))
+			defer server.Close()
+
+			config := &Config{
+				WakeEndpoint: server.URL,
+				KillEndpoint: server.URL,
+				HTTPTimeout:  10 * time.Second,
+				MaxRetries:   2,
+				Enabled:      true,
+			}
+
+			client, err := NewClient(config, logging.NewLogger("test"))
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+
+			_, err = client.Wake(context.Background())
+			if err == nil {
+				t.Fatal("Wake() expected error, got nil")
+			}
+
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("Wake() error = %v, expected *APIError", err)
+			}
+			if apiErr.StatusCode != tt.status {
+				t.Errorf("StatusCode = %d, expected %d", apiErr.StatusCode, tt.status)
+			}
+			if apiErr.Body != "denied" {
+				t.Errorf("Body = %q, expected %q", apiErr.Body, "denied")
+			}
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("attempts = %d, expected %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestAPIErrorRetryable(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{http.StatusBadRequest, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusForbidden, false},
+		{http.StatusNotFound, false},
+		{http.StatusRequestTimeout, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusServiceUnavailable, true},
+	}
+
+	for _, tt := range tests {
+		err := &APIError{StatusCode: tt.status}
+		if got := err.Retryable(); got != tt.want {
+			t.Errorf("Retryable() for %d = %v, expected %v", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestClientErrorsDoNotOpenCircuit(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	config := &Config{
+		WakeEndpoint: server.URL,
+		HTTPTimeout:  10 * time.Second,
+		MaxRetries:   1,
+		Enabled:      true,
+	}
+
+	client, err := NewClient(config, logging.NewLogger("test"))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+
+	// More rejections than the breaker's failure limit must all still reach the API
+	for i := 0; i < 5; i++ {
+		_, err := client.Wake(context.Background())
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("Wake() call %d error = %v, expected *APIError", i+1, err)
+		}
+	}
+	if got := attempts.Load(); got != 5 {
+		t.Errorf("attempts = %d, expected 5", got)
+	}
+}
+
+func TestKillOnceWithTimeout(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	// A hung Kill endpoint that never answers
+	var attempts atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	config := &Config{
+		WakeEndpoint: server.URL,
+		KillEndpoint: server.URL,
+		HTTPTimeout:  10 * time.Second,
+		KillTimeout:  200 * time.Millisecond,
+		MaxRetries:   1,
+		Enabled:      true,
+	}
+
+	client, err := NewClient(config, logging.NewLogger("test"))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+
+	start := time.Now()
+	if err := client.Kill(context.Background()); err == nil {
+		t.Fatal("Kill() expected a timeout error, got nil")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Kill() took %v, expected the 200ms kill timeout to bound it", elapsed)
+	}
+
+	// A second Kill, as from the deferred shutdown path, returns the first result without calling the API
+	start = time.Now()
+	if err := client.Kill(context.Background()); err == nil {
+		t.Error("second Kill() expected the first call's error, got nil")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("second Kill() took %v, expected it to return at once", elapsed)
+	}
+	if got := attempts.Load(); got != 1 {
+		t.Errorf("Kill API called %d times, expected 1", got)
+	}
+}
@@ -0,0 +1,254 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+)
+
+// directDialTimeout bounds connecting to a host that bypasses the tunnel
+const directDialTimeout = 10 * time.Second
+
+// noProxyRule is one entry of a no-proxy list
+type noProxyRule struct {
+	network        *net.IPNet // CIDR block, e.g. 10.0.0.0/8
+	ip             net.IP     // Single IP address
+	domain         string     // Domain name, lower-case without a leading dot
+	subdomainsOnly bool       // Domain was written with a leading "." or "*." and does not match itself
+	port           string     // Port the rule is limited to (empty matches any port)
+}
+
+// noProxyList decides which hosts bypass the tunnel, with NO_PROXY semantics
+type noProxyList struct {
+	all   bool
+	rules []noProxyRule
+}
+
+// parseNoProxy parses NO_PROXY-style entries, each of which may itself be a comma-separated list. An
+// entry of "*" matches every host; otherwise entries take these forms:
+//
+//	example.com        example.com and its subdomains
+//	.example.com       subdomains of example.com only (as does *.example.com)
+//	10.0.0.0/8         addresses in the CIDR block
+//	192.168.1.10       that address
+//	example.com:8080   any of the above limited to one port
+func parseNoProxy(entries []string) (*noProxyList, error) {
+	list := &noProxyList{}
+	for _, entry := range entries {
+		for _, value := range strings.Split(entry, ",") {
+			value = strings.ToLower(strings.TrimSpace(value))
+			if value == "" {
+				continue
+			}
+			if value == "*" {
+				list.all = true
+				continue
+			}
+			rule, err := parseNoProxyRule(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid no-proxy entry %q: %w", value, err)
+			}
+			list.rules = append(list.rules, rule)
+		}
+	}
+	return list, nil
+}
+
+// parseNoProxyRule parses a single no-proxy entry other than "*"
+func parseNoProxyRule(value string) (noProxyRule, error) {
+	var rule noProxyRule
+	if _, network, err := net.ParseCIDR(value); err == nil {
+		rule.network = network
+		return rule, nil
+	}
+
+	host := value
+	if h, port, err := net.SplitHostPort(value); err == nil {
+		host, rule.port = h, port
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	if ip := net.ParseIP(host); ip != nil {
+		rule.ip = ip
+		return rule, nil
+	}
+
+	switch {
+	case strings.HasPrefix(host, "*."):
+		host, rule.subdomainsOnly = host[2:], true
+	case strings.HasPrefix(host, "."):
+		host, rule.subdomainsOnly = host[1:], true
+	}
+	if !validHostname(host) {
+		return rule, fmt.Errorf("not a host name, IP address or CIDR block")
+	}
+	rule.domain = strings.TrimSuffix(host, ".")
+	return rule, nil
+}
+
+// matches reports whether host (with its port) bypasses the tunnel
+func (l *noProxyList) matches(host, port string) bool {
+	if l.all {
+		return true
+	}
+	host = strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+	ip := net.ParseIP(host)
+	for _, rule := range l.rules {
+		if rule.port != "" && rule.port != port {
+			continue
+		}
+		switch {
+		case rule.network != nil:
+			if ip != nil && rule.network.Contains(ip) {
+				return true
+			}
+		case rule.ip != nil:
+			if ip != nil && rule.ip.Equal(ip) {
+				return true
+			}
+		case ip == nil:
+			if (!rule.subdomainsOnly && host == rule.domain) || strings.HasSuffix(host, "."+rule.domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetNoProxy makes requests for matching hosts bypass the tunnel and connect directly from this machine,
+// following NO_PROXY conventions: domain suffixes, IP addresses, CIDR blocks, optional ports and "*"
+// for every host (empty sends everything through the tunnel; call before Start)
+func (p *Server) SetNoProxy(entries []string) error {
+	list, err := parseNoProxy(entries)
+	if err != nil {
+		return err
+	}
+	if !list.all && len(list.rules) == 0 {
+		p.noProxy = nil
+		return nil
+	}
+	p.noProxy = list
+	p.directProxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {},
+		Transport: &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: directDialTimeout}).DialContext,
+			ForceAttemptHTTP2:   true,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			p.logger.Warn("Direct request failed", "host", r.URL.Host, "error", err.Error())
+			p.stats.recordError(err.Error())
+			writeError(w, r, http.StatusBadGateway, ErrCodeConnectFailed, fmt.Sprintf("Failed to reach %s directly", r.URL.Host))
+		},
+	}
+	return nil
+}
+
+// bypassesTunnel reports whether a proxied request's host is on the no-proxy list
+func (p *Server) bypassesTunnel(r *http.Request) bool {
+	if p.noProxy == nil {
+		return false
+	}
+	host, port, ok := targetHostPort(r)
+	if !ok {
+		return false
+	}
+	return p.noProxy.matches(host, port)
+}
+
+// targetHostPort returns the host and port a proxied request is for. It reports false for requests
+// addressed to the proxy itself, which are never sent elsewhere.
+func targetHostPort(r *http.Request) (host, port string, ok bool) {
+	switch {
+	case r.Method == http.MethodConnect:
+		host, port = r.Host, defaultConnectPort
+		if h, pt, err := net.SplitHostPort(r.Host); err == nil {
+			host, port = h, pt
+		}
+	case r.URL.IsAbs():
+		host, port = r.URL.Hostname(), r.URL.Port()
+		if port == "" {
+			port = "80"
+			if r.URL.Scheme == "https" || r.URL.Scheme == "wss" {
+				port = "443"
+			}
+		}
+	default:
+		return "", "", false
+	}
+	return host, port, true
+}
+
+// serveDirect handles a request for a no-proxy host over a direct connection instead of the tunnel
+func (p *Server) serveDirect(w http.ResponseWriter, r *http.Request) {
+	p.logger.Debug("Serving request directly (no-proxy match)", "method", r.Method, "host", r.Host)
+	if r.Method == http.MethodConnect {
+		p.connectDirect(w, r)
+		return
+	}
+	p.directProxy.ServeHTTP(w, r)
+}
+
+// connectDirect opens a CONNECT tunnel straight to the target and splices it to the client
+func (p *Server) connectDirect(w http.ResponseWriter, r *http.Request) {
+	target, err := connectTarget(r.Host)
+	if err != nil {
+		p.logger.Warn("Rejecting malformed CONNECT target", "host", r.Host, "error", err.Error())
+		writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, fmt.Sprintf("Invalid CONNECT target %q: %v", r.Host, err))
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", target, directDialTimeout)
+	if err != nil {
+		p.logger.Warn("Direct CONNECT failed", "host", target, "error", err.Error())
+		p.stats.recordError(err.Error())
+		writeError(w, r, http.StatusBadGateway, ErrCodeConnectFailed, fmt.Sprintf("Failed to connect to %s directly", target))
+		return
+	}
+	defer upstream.Close()
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "Proxy does not support hijacking")
+		return
+	}
+	clientConn, clientBuf, err := hj.Hijack()
+	if err != nil {
+		p.logger.Error("Hijack failed", err, "host", target)
+		return
+	}
+	defer clientConn.Close()
+
+	if _, err := clientBuf.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+	if err := clientBuf.Flush(); err != nil {
+		return
+	}
+
+	// Anything the client sent straight after the CONNECT request is already buffered
+	if n := clientBuf.Reader.Buffered(); n > 0 {
+		buffered, _ := clientBuf.Reader.Peek(n)
+		if _, err := upstream.Write(buffered); err != nil {
+			return
+		}
+	}
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(upstream, clientConn)
+	go pipe(clientConn, upstream)
+	<-done
+	<-done
+}
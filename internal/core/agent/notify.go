@@ -0,0 +1,239 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultStateNotifyTimeout bounds a single state notification when no timeout is configured
+const DefaultStateNotifyTimeout = 5 * time.Second
+
+// maxPendingStateEvents is how many state changes may wait for the notifier before new ones are dropped
+const maxPendingStateEvents = 32
+
+// Tunnel connection states reported to a StateNotifier
+const (
+	StateConnected    = "connected"     // Connected and authenticated to the tunnel server
+	StateDisconnected = "disconnected"  // The connection was lost or closed
+	StateReconnecting = "reconnecting"  // Trying to connect again after losing the connection
+	StateFailed       = "failed"        // Gave up connecting; the agent is exiting
+	StateCertExpiring = "cert_expiring" // The server advised that the client certificate expires soon
+)
+
+// StateEvent describes a change in a tunnel's connection state
+type StateEvent struct {
+	State  string    `json:"state"`
+	Server string    `json:"server"`
+	Detail string    `json:"detail,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// StateNotifier is told about tunnel connection state changes, e.g. to show a desktop notification
+type StateNotifier interface {
+	Notify(ctx context.Context, event *StateEvent) error
+}
+
+// StateNotifierFunc adapts a function to the StateNotifier interface
+type StateNotifierFunc func(ctx context.Context, event *StateEvent) error
+
+// Notify calls f
+func (f StateNotifierFunc) Notify(ctx context.Context, event *StateEvent) error {
+	return f(ctx, event)
+}
+
+// stateNotifications delivers a client's state events to its notifier in order, off the connection's
+// goroutines, so a slow or failing notifier never holds up the tunnel
+type stateNotifications struct {
+	notifier StateNotifier
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	pending []*StateEvent
+	done    chan struct{} // Closed when the delivery goroutine draining pending exits (nil when none runs)
+}
+
+// SetStateNotifier reports the client's connection state changes to notifier. Each call is bounded by
+// timeout (0 uses DefaultStateNotifyTimeout) and its failures are only logged. A nil notifier removes it.
+func (c *Client) SetStateNotifier(notifier StateNotifier, timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if notifier == nil {
+		c.notifications = nil
+		return
+	}
+	if timeout <= 0 {
+		timeout = DefaultStateNotifyTimeout
+	}
+	c.notifications = &stateNotifications{notifier: notifier, timeout: timeout}
+}
+
+// NotifyState reports a state change to the client's notifier, if it has one, without waiting for it
+func (c *Client) NotifyState(state, detail string) {
+	c.mu.RLock()
+	n := c.notifications
+	server := c.serverAddr
+	c.mu.RUnlock()
+	if n == nil {
+		return
+	}
+
+	event := &StateEvent{State: state, Server: server, Detail: detail, Time: time.Now()}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.pending) >= maxPendingStateEvents {
+		c.logger.Warn("State notifier is falling behind, dropping state change", "state", state, "server", server)
+		return
+	}
+	n.pending = append(n.pending, event)
+	if n.done == nil {
+		n.done = make(chan struct{})
+		go c.deliverStates(n)
+	}
+}
+
+// FlushStateNotifications waits up to timeout for state changes already reported to reach the notifier,
+// so an agent that is exiting does not lose its last notifications
+func (c *Client) FlushStateNotifications(timeout time.Duration) {
+	c.mu.RLock()
+	n := c.notifications
+	c.mu.RUnlock()
+	if n == nil {
+		return
+	}
+
+	n.mu.Lock()
+	done := n.done
+	n.mu.Unlock()
+	if done == nil {
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+}
+
+// deliverStates sends pending events to the notifier one at a time until none are left
+func (c *Client) deliverStates(n *stateNotifications) {
+	for {
+		n.mu.Lock()
+		if len(n.pending) == 0 {
+			close(n.done)
+			n.done = nil
+			n.mu.Unlock()
+			return
+		}
+		event := n.pending[0]
+		n.pending = n.pending[1:]
+		n.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+		if err := n.notifier.Notify(ctx, event); err != nil {
+			c.logger.Warn("State notification failed", "state", event.State, "server", event.Server, "error", err.Error())
+		}
+		cancel()
+	}
+}
+
+// CommandNotifier runs an external program for each state change, with the state appended to its
+// arguments and the StateEvent written to its stdin as JSON. A non-zero exit status is a failure.
+type CommandNotifier struct {
+	path string
+	args []string
+}
+
+// NewCommandNotifier returns a notifier running command, the program followed by its arguments
+func NewCommandNotifier(command []string) (*CommandNotifier, error) {
+	if len(command) == 0 || strings.TrimSpace(command[0]) == "" {
+		return nil, fmt.Errorf("state notify command is empty")
+	}
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		return nil, fmt.Errorf("state notify command %q: %w", command[0], err)
+	}
+	return &CommandNotifier{path: path, args: command[1:]}, nil
+}
+
+// Notify runs the command for event
+func (n *CommandNotifier) Notify(ctx context.Context, event *StateEvent) error {
+	input, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, n.path, append(append([]string{}, n.args...), event.State)...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = 100 * time.Millisecond
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("state notify command timed out: %w", ctx.Err())
+		}
+		if detail := strings.TrimSpace(stderr.String()); detail != "" {
+			return fmt.Errorf("%w: %s", err, detail)
+		}
+		return err
+	}
+	return nil
+}
+
+// WebhookNotifier POSTs each StateEvent as JSON to a URL. A non-2xx response is a failure.
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookNotifier returns a notifier posting to url
+func NewWebhookNotifier(url string) (*WebhookNotifier, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("state notify webhook %q is not an http or https URL", url)
+	}
+	return &WebhookNotifier{url: url, client: &http.Client{}}, nil
+}
+
+// Notify posts event to the webhook
+func (n *WebhookNotifier) Notify(ctx context.Context, event *StateEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("state notify webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// StateNotifiers calls each of notifiers in turn, returning the first failure after trying them all
+type StateNotifiers []StateNotifier
+
+// Notify passes event to every notifier
+func (ns StateNotifiers) Notify(ctx context.Context, event *StateEvent) error {
+	var first error
+	for _, n := range ns {
+		if err := n.Notify(ctx, event); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
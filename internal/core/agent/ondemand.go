@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TunnelStarter wakes the tunnel's server and connects to it, returning once the tunnel is up
+type TunnelStarter func(ctx context.Context) error
+
+// TunnelStopper disconnects the tunnel and lets its server scale down
+type TunnelStopper func() error
+
+// onDemandTunnel starts the default tunnel when a request needs it and stops it again once idle
+type onDemandTunnel struct {
+	start TunnelStarter
+	stop  TunnelStopper
+	idle  time.Duration
+
+	mu      sync.Mutex
+	attempt *startAttempt // Start in progress, shared by every request waiting for it (nil when none is)
+}
+
+// startAttempt is one run of the starter
+type startAttempt struct {
+	done chan struct{}
+	err  error
+}
+
+// SetOnDemand keeps the default tunnel down until a proxied request needs it, trading first-request
+// latency for a server that can stay scaled down while the agent is unused. A request finding the
+// tunnel disconnected calls start, which wakes the server and connects, and waits for it along with
+// any requests arriving meanwhile. Once no traffic has passed for idle, stop is called and the next
+// request starts the tunnel again (0 leaves it up once started). Named tunnels are not affected, and
+// a nil start turns on-demand mode off (call before Start).
+func (p *Server) SetOnDemand(start TunnelStarter, stop TunnelStopper, idle time.Duration) {
+	if start == nil {
+		p.onDemand = nil
+		return
+	}
+	if idle < 0 || stop == nil {
+		idle = 0
+	}
+	p.onDemand = &onDemandTunnel{start: start, stop: stop, idle: idle}
+}
+
+// startOnDemand starts the default tunnel for a request routed through it while it is down. It answers
+// the request with a 503 and returns false when the tunnel cannot be started.
+func (p *Server) startOnDemand(w http.ResponseWriter, r *http.Request) bool {
+	if p.onDemand == nil || p.poolFor(r) != p.pool || p.pool.IsConnected() {
+		return true
+	}
+
+	start := time.Now()
+	p.logger.Info("Starting on-demand tunnel for request", "method", r.Method, "domain", requestDomain(r))
+	err := p.onDemand.connect(r.Context(), p.ctx)
+	if err == nil {
+		p.logger.Info("On-demand tunnel started", "took", time.Since(start).Round(time.Millisecond).String())
+		return true
+	}
+	if r.Context().Err() != nil {
+		return false
+	}
+
+	p.logger.Warn("Failed to start on-demand tunnel", "error", err.Error(), "waited", time.Since(start).String())
+	p.stats.recordError(err.Error())
+	writeError(w, r, http.StatusServiceUnavailable, ErrCodeTunnelUnavailable, fmt.Sprintf("Tunnel could not be started: %v", err))
+	return false
+}
+
+// connect runs the starter, or joins the run already in progress, and waits for it or for ctx. The run
+// itself belongs to base, so a request giving up does not abandon it for the others.
+func (t *onDemandTunnel) connect(ctx, base context.Context) error {
+	t.mu.Lock()
+	attempt := t.attempt
+	if attempt == nil {
+		attempt = &startAttempt{done: make(chan struct{})}
+		t.attempt = attempt
+		go func() {
+			attempt.err = t.start(base)
+			t.mu.Lock()
+			t.attempt = nil
+			t.mu.Unlock()
+			close(attempt.done)
+		}()
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-attempt.done:
+		return attempt.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stopIdleTunnel stops the on-demand tunnel whenever it has carried no traffic for the idle time and no
+// HTTP request is in flight, until the proxy stops
+func (p *Server) stopIdleTunnel() {
+	t := p.onDemand
+	interval := t.idle / 10
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// A request still awaiting its response keeps the tunnel up, however long the upstream takes
+		idleFor := p.idleFor()
+		if idleFor < t.idle || !p.pool.IsConnected() {
+			continue
+		}
+
+		// Hold off new starts while stopping, so a request arriving now waits for a fresh tunnel
+		t.mu.Lock()
+		if t.attempt == nil {
+			p.logger.Info("Stopping idle on-demand tunnel", "idle", idleFor.Round(time.Second).String(), "idle_timeout", t.idle.String())
+			if err := t.stop(); err != nil {
+				p.logger.Warn("Failed to stop idle on-demand tunnel", "error", err.Error())
+			}
+		}
+		t.mu.Unlock()
+	}
+}
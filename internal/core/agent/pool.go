@@ -0,0 +1,224 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fluidity/internal/shared/logging"
+	"fluidity/internal/shared/protocol"
+)
+
+// Load balancing strategies for a Pool
+const (
+	BalanceRoundRobin       = "round_robin"
+	BalanceLeastOutstanding = "least_outstanding"
+)
+
+// Pool spreads proxied traffic across tunnel connections to several server tasks. Requests go to a
+// connected client chosen by the balancing strategy; disconnected clients are skipped until they reconnect.
+type Pool struct {
+	members  []*poolMember
+	strategy string
+	next     atomic.Uint64
+	logger   *logging.Logger
+}
+
+// poolMember is a client and the number of requests and tunnels it is currently carrying
+type poolMember struct {
+	client      *Client
+	outstanding atomic.Int64
+}
+
+// NewPool creates a pool over clients using strategy (empty uses round robin)
+func NewPool(clients []*Client, strategy, logLevel string) (*Pool, error) {
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("pool needs at least one client")
+	}
+	switch strategy {
+	case "":
+		strategy = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastOutstanding:
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy %q", strategy)
+	}
+
+	logger := logging.NewLogger("tunnel-pool")
+	logger.SetLevel(logLevel)
+
+	pool := &Pool{strategy: strategy, logger: logger}
+	for _, c := range clients {
+		pool.members = append(pool.members, &poolMember{client: c})
+	}
+	return pool, nil
+}
+
+// Clients returns the pooled clients in the order they were given
+func (p *Pool) Clients() []*Client {
+	clients := make([]*Client, len(p.members))
+	for i, m := range p.members {
+		clients[i] = m.client
+	}
+	return clients
+}
+
+// IsConnected reports whether any pooled client is connected
+func (p *Pool) IsConnected() bool {
+	for _, m := range p.members {
+		if m.client.IsConnected() {
+			return true
+		}
+	}
+	return false
+}
+
+// Started reports whether any pooled client has completed a connection since the agent started
+func (p *Pool) Started() bool {
+	for _, m := range p.members {
+		select {
+		case <-m.client.Ready():
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+// awaitStart waits up to timeout, or until ctx is done, for the first pooled client to complete its
+// connection, and reports whether one has
+func (p *Pool) awaitStart(ctx context.Context, timeout time.Duration) bool {
+	if p.Started() {
+		return true
+	}
+
+	ready := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	var once sync.Once
+	for _, m := range p.members {
+		go func(c *Client) {
+			select {
+			case <-c.Ready():
+				once.Do(func() { close(ready) })
+			case <-done:
+			}
+		}(m.client)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return p.Started()
+}
+
+// pick chooses a connected member not in skip, or nil when there is none. Members whose server has
+// paused them are only chosen when every other member is paused too.
+func (p *Pool) pick(skip map[*poolMember]bool) *poolMember {
+	if m := p.pickFrom(skip, false); m != nil {
+		return m
+	}
+	return p.pickFrom(skip, true)
+}
+
+// pickFrom chooses a connected member not in skip, passing over paused members unless allowPaused is set
+func (p *Pool) pickFrom(skip map[*poolMember]bool, allowPaused bool) *poolMember {
+	start := int(p.next.Add(1) - 1)
+	var best *poolMember
+	for i := range p.members {
+		m := p.members[(start+i)%len(p.members)]
+		if skip[m] || !m.client.IsConnected() || (!allowPaused && m.client.Paused()) {
+			continue
+		}
+		if p.strategy == BalanceRoundRobin {
+			return m
+		}
+		if best == nil || m.outstanding.Load() < best.outstanding.Load() {
+			best = m
+		}
+	}
+	return best
+}
+
+// Acquire returns a client for a long-lived session such as a CONNECT tunnel, and a function to call
+// when the session ends. When no client is connected it returns the first, whose calls then fail.
+func (p *Pool) Acquire() (*Client, func()) {
+	m := p.pick(nil)
+	if m == nil {
+		m = p.members[0]
+	}
+	m.outstanding.Add(1)
+	return m.client, func() { m.outstanding.Add(-1) }
+}
+
+// SendRequest sends req through a connected client and returns the response with the client that
+// served it, as streamed bodies arrive on that client. A request that could not be written to a
+// server is retried on the next connected client; one that reached a server is never resent.
+func (p *Pool) SendRequest(req *protocol.Request) (*protocol.Response, *Client, error) {
+	return p.send(req, (*Client).SendRequest)
+}
+
+// SendRequestStream sends req with its body streamed from body, as Client.SendRequestStream, through a
+// connected client. The body is only read once the request has reached a server, so a request that
+// could not be written is still retried on the next connected client.
+func (p *Pool) SendRequestStream(req *protocol.Request, body io.Reader) (*protocol.Response, *Client, error) {
+	return p.send(req, func(c *Client, req *protocol.Request) (*protocol.Response, error) {
+		return c.SendRequestStream(req, body)
+	})
+}
+
+// SupportsRequestStreaming reports whether every connected client's server accepts streamed request
+// bodies, and at least one client is connected
+func (p *Pool) SupportsRequestStreaming() bool {
+	connected := false
+	for _, m := range p.members {
+		if !m.client.IsConnected() {
+			continue
+		}
+		if !m.client.SupportsRequestStreaming() {
+			return false
+		}
+		connected = true
+	}
+	return connected
+}
+
+// send sends req with sendVia on connected clients until one reaches a server
+func (p *Pool) send(req *protocol.Request, sendVia func(*Client, *protocol.Request) (*protocol.Response, error)) (*protocol.Response, *Client, error) {
+	tried := make(map[*poolMember]bool)
+	var lastErr error
+	for {
+		m := p.pick(tried)
+		if m == nil {
+			if lastErr == nil {
+				lastErr = errNotConnected
+			}
+			return nil, p.members[0].client, lastErr
+		}
+		tried[m] = true
+
+		m.outstanding.Add(1)
+		resp, err := sendVia(m.client, req)
+		m.outstanding.Add(-1)
+
+		if err == nil || !requestNotSent(err) {
+			return resp, m.client, err
+		}
+		p.logger.Warn("Tunnel send failed, trying another server", "id", req.ID, "server", m.client.ServerAddress(), "error", err.Error())
+		lastErr = err
+	}
+}
+
+// requestNotSent reports whether err means the request never reached the server
+func requestNotSent(err error) bool {
+	var notSent *notSentError
+	return errors.Is(err, errNotConnected) || errors.As(err, &notSent)
+}
@@ -3,32 +3,89 @@ package agent
 import (
 	"context"
 	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"fluidity/internal/shared/coalesce"
+	"fluidity/internal/shared/keepalive"
 	"fluidity/internal/shared/logging"
 	"fluidity/internal/shared/protocol"
 
 	"github.com/gorilla/websocket"
 )
 
+// Request headers a client sets to override the upstream Host header and TLS server name.
+// They are consumed by the proxy and honoured only for hosts on the server's allowlist.
+const (
+	HostOverrideHeader       = "X-Fluidity-Host"
+	ServerNameOverrideHeader = "X-Fluidity-Server-Name"
+)
+
+// AffinityHeader carries a key that pins related requests to the same upstream connection on the
+// server when it has affinity enabled. It is consumed by the proxy.
+const AffinityHeader = "X-Fluidity-Affinity"
+
+// BytesHeader reports the size of the response body the proxy delivered: a header on buffered
+// responses, and a trailer sent once the body is complete on streamed ones
+const BytesHeader = "X-Fluidity-Bytes"
+
+// DefaultStartupWait bounds how long requests wait for the tunnel's first connection
+const DefaultStartupWait = 10 * time.Second
+
+// DefaultStreamBodyThreshold is the request body size above which bodies are streamed through the tunnel
+const DefaultStreamBodyThreshold = 1024 * 1024
+
 // Server handles local HTTP proxy requests
 type Server struct {
-	port       int
-	server     *http.Server
-	tunnelConn *Client
-	logger     *logging.Logger
-	listener   net.Listener
-	ctx        context.Context
-	cancel     context.CancelFunc
-	startTime  time.Time
+	port               int
+	server             *http.Server
+	tunnelConn         *Client
+	pool               *Pool
+	routes             []tunnelRoute
+	wsKeepalive        keepalive.Config
+	logger             *logging.Logger
+	listener           net.Listener
+	ctx                context.Context
+	cancel             context.CancelFunc
+	startTime          time.Time
+	statusPath         string
+	stats              *requestStats
+	checksums          bool
+	allowedMethods     map[string]bool
+	allowedSchemes     map[string]bool
+	proxyAuth          *proxyCredentials
+	logFullURL         bool
+	maxResponseBody    int64
+	streamThreshold    int64
+	preserveHopHeaders bool
+	connectCoalesce    coalesce.Config
+	compressPorts      map[string]bool
+	noProxy            *noProxyList
+	directProxy        *httputil.ReverseProxy
+	strictHost         bool
+	strictFraming      bool
+	startupWait        time.Duration
+	onDemand           *onDemandTunnel
+	lastActivity       atomic.Int64 // Unix nanoseconds of the last proxied traffic
+	inflightRequests   atomic.Int64 // HTTP requests awaiting their response, which keep the proxy from idling
 }
 
+// proxyIOTimeout bounds reading a client's request and writing its response, beyond the time spent
+// waiting on the tunnel for the response
+const proxyIOTimeout = 30 * time.Second
+
 // NewServer creates a new HTTP proxy server
 func NewServer(port int, tunnelConn *Client, logLevel string) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -36,26 +93,175 @@ func NewServer(port int, tunnelConn *Client, logLevel string) *Server {
 	logger := logging.NewLogger("proxy-server")
 	logger.SetLevel(logLevel)
 
+	pool, _ := NewPool([]*Client{tunnelConn}, BalanceRoundRobin, logLevel)
+
 	proxy := &Server{
-		port:       port,
-		tunnelConn: tunnelConn,
-		logger:     logger,
-		ctx:        ctx,
-		cancel:     cancel,
-		startTime:  time.Now(),
+		port:        port,
+		tunnelConn:  tunnelConn,
+		pool:        pool,
+		wsKeepalive: keepalive.DefaultConfig(),
+		logger:      logger,
+		ctx:         ctx,
+		cancel:      cancel,
+		startTime:   time.Now(),
+		statusPath:  "/status",
+		stats:       newRequestStats(),
+		startupWait: DefaultStartupWait,
+
+		streamThreshold: DefaultStreamBodyThreshold,
 	}
+	proxy.touch()
+
+	// gRPC clients pointed at the proxy speak HTTP/2 without TLS (h2c with prior knowledge)
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
 
 	proxy.server = &http.Server{
 		Addr:         fmt.Sprintf(":%d", port),
 		Handler:      proxy,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		ReadTimeout:  proxyIOTimeout,
+		WriteTimeout: proxyIOTimeout,
 		IdleTimeout:  60 * time.Second,
+		Protocols:    &protocols,
 	}
 
 	return proxy
 }
 
+// StatusPathDisabled as the status path turns the local status page off
+const StatusPathDisabled = "-"
+
+// SetStatusPath sets the path of the local status page, /status by default; StatusPathDisabled turns the
+// page off, leaving requests for the path to be proxied (must be called before Start)
+func (p *Server) SetStatusPath(path string) {
+	if path == StatusPathDisabled {
+		path = ""
+	}
+	p.statusPath = path
+}
+
+// SetPool spreads requests across the pool's server connections instead of using only the tunnel
+// connection given to NewServer, which remains the one reported by the health check (call before Start)
+func (p *Server) SetPool(pool *Pool) {
+	p.pool = pool
+}
+
+// SetMaxResponseBodyBytes caps the response body forwarded to clients: larger buffered responses are
+// rejected with a 502, by the server before the body crosses the tunnel, and streamed responses are
+// aborted once they pass the limit (0 means no limit; call before Start)
+func (p *Server) SetMaxResponseBodyBytes(limit int64) {
+	p.maxResponseBody = limit
+}
+
+// SetStreamBodyThreshold streams request bodies larger than threshold bytes through the tunnel as they
+// are read, as bodies of unknown length always are, instead of buffering them whole, so the server can
+// write them to disk without holding them in memory (0 uses DefaultStreamBodyThreshold, negative streams
+// only bodies of unknown length; call before Start)
+func (p *Server) SetStreamBodyThreshold(threshold int64) {
+	switch {
+	case threshold < 0:
+		p.streamThreshold = 0
+	case threshold == 0:
+		p.streamThreshold = DefaultStreamBodyThreshold
+	default:
+		p.streamThreshold = threshold
+	}
+}
+
+// SetPreserveHopByHopHeaders forwards hop-by-hop request headers such as Connection and Keep-Alive to
+// the upstream instead of stripping them, for upstreams that depend on them. Proxy-Authorization is
+// never forwarded (call before Start).
+func (p *Server) SetPreserveHopByHopHeaders(preserve bool) {
+	p.preserveHopHeaders = preserve
+}
+
+// SetLogFullURL adds each request's full URL to the debug log; info logs stay domain-only (call before Start)
+func (p *Server) SetLogFullURL(enabled bool) {
+	p.logFullURL = enabled
+	if enabled {
+		p.logger.Warn("Full request URLs will be logged at debug level; paths and query strings may contain sensitive data")
+	}
+}
+
+// Logger returns the proxy's logger so callers can adjust its level or output
+func (p *Server) Logger() *logging.Logger {
+	return p.logger
+}
+
+// SetWebSocketKeepalive pings client WebSockets every interval and closes tunnels whose client does not
+// answer within timeout (an interval of 0 disables pings; call before Start)
+func (p *Server) SetWebSocketKeepalive(interval, timeout time.Duration) {
+	p.wsKeepalive = keepalive.Config{Interval: interval, Timeout: timeout}
+}
+
+// SetConnectCoalescing gathers small reads from CONNECT clients for up to delay, or until maxBytes are
+// buffered, before sending them through the tunnel as one connect_data. A delay of 0 sends every read
+// immediately (call before Start).
+func (p *Server) SetConnectCoalescing(delay time.Duration, maxBytes int) {
+	p.connectCoalesce = coalesce.Config{Delay: delay, MaxBytes: maxBytes}
+}
+
+// SetConnectCompression compresses the data of CONNECT tunnels to the given target ports, for plaintext
+// protocols such as Redis or unencrypted HTTP that compress well. Most tunnels carry TLS, which does not
+// compress, so none are compressed unless listed (call before Start).
+func (p *Server) SetConnectCompression(ports []int) {
+	p.compressPorts = nil
+	for _, port := range ports {
+		if p.compressPorts == nil {
+			p.compressPorts = make(map[string]bool, len(ports))
+		}
+		p.compressPorts[strconv.Itoa(port)] = true
+	}
+}
+
+// SetChecksums enables end-to-end body checksums on tunneled HTTP requests (must be called before Start)
+func (p *Server) SetChecksums(enabled bool) {
+	p.checksums = enabled
+}
+
+// SetAllowedSchemes restricts the request URL schemes the proxy will forward, refusing others such as
+// file or gopher with invalid_scheme. WebSocket ws and wss URLs count as http and https (empty uses
+// protocol.DefaultAllowedSchemes; call before Start).
+func (p *Server) SetAllowedSchemes(schemes []string) {
+	p.allowedSchemes = nil
+	if len(schemes) == 0 {
+		return
+	}
+	p.allowedSchemes = make(map[string]bool, len(schemes))
+	for _, s := range schemes {
+		p.allowedSchemes[strings.ToLower(strings.TrimSpace(s))] = true
+	}
+}
+
+// schemeAllowed reports whether a request for scheme may be forwarded
+func (p *Server) schemeAllowed(scheme string, websocket bool) bool {
+	if websocket {
+		switch scheme {
+		case "ws":
+			scheme = "http"
+		case "wss":
+			scheme = "https"
+		}
+	}
+	if p.allowedSchemes == nil {
+		return slices.Contains(protocol.DefaultAllowedSchemes, scheme)
+	}
+	return p.allowedSchemes[scheme]
+}
+
+// SetAllowedMethods restricts the HTTP methods the proxy will forward (empty allows all; call before Start)
+func (p *Server) SetAllowedMethods(methods []string) {
+	p.allowedMethods = nil
+	if len(methods) == 0 {
+		return
+	}
+	p.allowedMethods = make(map[string]bool, len(methods))
+	for _, m := range methods {
+		p.allowedMethods[strings.ToUpper(strings.TrimSpace(m))] = true
+	}
+}
+
 // Start begins serving HTTP proxy requests
 func (p *Server) Start() error {
 
@@ -70,6 +276,10 @@ func (p *Server) Start() error {
 		}
 	}()
 
+	if p.onDemand != nil && p.onDemand.idle > 0 {
+		go p.stopIdleTunnel()
+	}
+
 	p.logger.Info("HTTP proxy server started", "addr", p.server.Addr)
 	return nil
 }
@@ -99,17 +309,26 @@ type ProxyHealthStatus struct {
 	ServerAddr    string `json:"server_addr"`
 }
 
-// handleHealthCheck processes health check requests
-func (p *Server) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+// healthStatus returns the current proxy health status
+func (p *Server) healthStatus() ProxyHealthStatus {
 	uptime := int64(time.Since(p.startTime).Seconds())
 
-	health := ProxyHealthStatus{
+	p.tunnelConn.mu.RLock()
+	serverAddr := p.tunnelConn.serverAddr
+	p.tunnelConn.mu.RUnlock()
+
+	return ProxyHealthStatus{
 		Status:        "healthy",
 		Connected:     p.tunnelConn.IsConnected(),
 		UptimeSeconds: uptime,
 		ProxyPort:     p.port,
-		ServerAddr:    p.tunnelConn.serverAddr,
+		ServerAddr:    serverAddr,
 	}
+}
+
+// handleHealthCheck processes health check requests
+func (p *Server) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+	health := p.healthStatus()
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -120,14 +339,92 @@ func (p *Server) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 
 // handleRequest processes incoming HTTP requests
 func (p *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
+	// Require credentials when configured before anything is served: HTTP, CONNECT and WebSocket alike,
+	// and the health check and status page too, as they reveal the tunnel's state
+	if !p.authorized(r) {
+		p.logger.Warn("Rejecting request without valid proxy credentials", "method", r.Method, "remote_addr", r.RemoteAddr)
+		p.requireProxyAuth(w, r)
+		return
+	}
+	// Credentials are for this proxy only and must never reach the upstream
+	r.Header.Del("Proxy-Authorization")
+
 	// Handle health check endpoint
 	if r.URL.Path == "/health" && r.Method == "GET" {
 		p.handleHealthCheck(w, r)
 		return
 	}
 
+	// Serve the status page only to requests addressed to the proxy itself
+	if p.statusPath != "" && r.URL.Path == p.statusPath && r.Method == "GET" && p.isDirectRequest(r) {
+		p.handleStatusPage(w, r)
+		return
+	}
+
 	// Log the request (domain only for privacy)
 	p.logRequest(r)
+	p.stats.recordRequest()
+	// CONNECT and WebSocket tunnels count as activity through their traffic; an HTTP request counts until
+	// its response is complete, however long the upstream takes
+	if r.Method == http.MethodConnect || p.isWebSocketUpgrade(r) {
+		p.touch()
+	} else {
+		p.beginRequest()
+		defer p.endRequest()
+	}
+
+	// Enforce the method allowlist before any tunnel traffic is generated
+	if !protocol.IsValidMethod(r.Method) {
+		p.logger.Warn("Rejecting request with malformed method", "method", fmt.Sprintf("%q", r.Method))
+		writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, "Malformed HTTP method")
+		return
+	}
+	if p.allowedMethods != nil && !p.allowedMethods[r.Method] {
+		p.logger.Warn("Rejecting request with disallowed method", "method", r.Method)
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, fmt.Sprintf("Method %s not allowed", r.Method))
+		return
+	}
+
+	// Only allowed schemes are forwarded; origin-form requests carry none and are sent as http
+	if r.Method != http.MethodConnect && r.URL.Scheme != "" && !p.schemeAllowed(strings.ToLower(r.URL.Scheme), p.isWebSocketUpgrade(r)) {
+		p.logger.Warn("Rejecting request with disallowed scheme", "method", r.Method, "scheme", r.URL.Scheme)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidScheme, fmt.Sprintf("Scheme %s not allowed", r.URL.Scheme))
+		return
+	}
+
+	// Settle which host the request is for before anything routes on it
+	if r.Method != http.MethodConnect {
+		if err := p.resolveTargetHost(r); err != nil {
+			p.logger.Warn("Rejecting request with ambiguous target host", "method", r.Method, "error", err.Error())
+			writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, fmt.Sprintf("Invalid target host: %v", err))
+			return
+		}
+	}
+
+	// Conflicting framing headers could make the upstream see a different request than this proxy did
+	if r.Method != http.MethodConnect {
+		if err := p.checkFraming(r); err != nil {
+			p.logger.Warn("Rejecting request with ambiguous framing headers", "method", r.Method, "error", err.Error())
+			writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, fmt.Sprintf("Invalid request framing: %v", err))
+			return
+		}
+	}
+
+	// Hosts on the no-proxy list are reached directly rather than through the tunnel
+	if p.bypassesTunnel(r) {
+		p.serveDirect(w, r)
+		return
+	}
+
+	// In on-demand mode the tunnel is only brought up once a request needs it
+	if !p.startOnDemand(w, r) {
+		return
+	}
+
+	// Requests arriving while the tunnel is still coming up wait for it instead of failing at once
+	if !p.awaitTunnelStart(w, r) {
+		return
+	}
 
 	// Check if this is a WebSocket upgrade request
 	if p.isWebSocketUpgrade(r) {
@@ -148,16 +445,23 @@ func (p *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 // handleHTTPRequest processes regular HTTP requests
 func (p *Server) handleHTTPRequest(w http.ResponseWriter, r *http.Request) {
 	// Generate request ID
-	reqID := p.generateRequestID()
+	reqID, err := p.generateRequestID()
+	if err != nil {
+		p.logger.Error("Failed to generate request ID", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "Failed to generate request ID")
+		return
+	}
 
-	// Check if tunnel is connected
-	if !p.tunnelConn.IsConnected() {
-		p.logger.Error("Failed to process HTTP request: tunnel not connected", nil, "id", reqID, "method", r.Method, "url", r.URL.String())
-		http.Error(w, "Tunnel connection unavailable. Please ensure the tunnel server is running and try again.", http.StatusServiceUnavailable)
+	// Check if the tunnel carrying this request is connected
+	pool := p.poolFor(r)
+	if !pool.IsConnected() {
+		p.logger.Error("Failed to process HTTP request: tunnel not connected", nil, "id", reqID, "method", r.Method, "domain", requestDomain(r))
+		p.stats.recordError("tunnel not connected")
+		writeError(w, r, http.StatusServiceUnavailable, ErrCodeTunnelUnavailable, "Tunnel connection unavailable. Please ensure the tunnel server is running and try again.")
 		return
 	}
 
-	p.logger.Debug("Processing HTTP request through tunnel", "id", reqID, "method", r.Method, "url", r.URL.String())
+	p.logger.Debug("Processing HTTP request through tunnel", "id", reqID, "method", r.Method, "url", p.logURL(r))
 
 	// Ensure URL is absolute
 	if !r.URL.IsAbs() {
@@ -169,97 +473,276 @@ func (p *Server) handleHTTPRequest(w http.ResponseWriter, r *http.Request) {
 		r.URL.Host = r.Host
 	}
 
-	// Read request body with size limit
-	const maxBodySize = 10 * 1024 * 1024 // 10MB limit
-	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
-	if err != nil {
-		p.logger.Error("Failed to read request body", err, "id", reqID, "method", r.Method, "url", r.URL.String())
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
+	// Bodies of unknown length, such as chunked uploads, and large ones are streamed through the tunnel as
+	// they arrive instead of buffered, so the upstream receives a stream too (checksums need the whole body)
+	largeBody := p.streamThreshold > 0 && r.ContentLength > p.streamThreshold
+	streamBody := (r.ContentLength < 0 || largeBody) && r.Body != nil && r.Body != http.NoBody && !p.checksums && pool.SupportsRequestStreaming()
+
+	var body []byte
+	if !streamBody {
+		// Read request body with size limit
+		const maxBodySize = 10 * 1024 * 1024 // 10MB limit
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+		if err != nil {
+			p.logger.Error("Failed to read request body", err, "id", reqID, "method", r.Method, "domain", requestDomain(r))
+			writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, "Failed to read request body")
+			return
+		}
+		r.Body.Close()
+	}
+
+	// Take any upstream Host/SNI overrides out of the forwarded headers
+	hostOverride := r.Header.Get(HostOverrideHeader)
+	serverNameOverride := r.Header.Get(ServerNameOverrideHeader)
+	r.Header.Del(HostOverrideHeader)
+	r.Header.Del(ServerNameOverrideHeader)
+	affinityKey := r.Header.Get(AffinityHeader)
+	r.Header.Del(AffinityHeader)
+
+	// Headers addressed to this proxy's connection are not the upstream's business
+	if !p.preserveHopHeaders {
+		removeHopByHopHeaders(r.Header)
 	}
-	r.Body.Close()
 
 	// Convert HTTP request to tunnel protocol
 	tunnelReq := &protocol.Request{
-		ID:      reqID,
-		Method:  r.Method,
-		URL:     r.URL.String(),
-		Headers: convertHeaders(r.Header),
-		Body:    body,
+		ID:          reqID,
+		Method:      r.Method,
+		URL:         r.URL.String(),
+		Headers:     convertHeaders(r.Header),
+		Body:        body,
+		HostHeader:  hostOverride,
+		ServerName:  serverNameOverride,
+		AffinityKey: affinityKey,
+		Stream:      true, // Event stream responses are relayed as they arrive
+
+		MaxResponseBytes: p.maxResponseBody,
+	}
+	if p.checksums {
+		tunnelReq.Checksum = protocol.Checksum(body)
 	}
 
 	// Send through tunnel and get response
-	resp, err := p.tunnelConn.SendRequest(tunnelReq)
+	var resp *protocol.Response
+	var tunnel *Client
+	// The response may take as long as the tunnel waits for it, well past the proxy's own timeouts
+	requestTimeout := DefaultRequestTimeout
+	if p.tunnelConn != nil {
+		requestTimeout = p.tunnelConn.RequestTimeout()
+	}
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Now().Add(requestTimeout + proxyIOTimeout))
+	rc.SetWriteDeadline(time.Now().Add(requestTimeout + proxyIOTimeout))
+	if streamBody {
+		if largeBody {
+			tunnelReq.BodyLength = r.ContentLength
+		}
+		resp, tunnel, err = pool.SendRequestStream(tunnelReq, r.Body)
+	} else {
+		resp, tunnel, err = pool.SendRequest(tunnelReq)
+	}
 	if err != nil {
-		p.logger.Error("Failed to send request through tunnel", err, "id", reqID, "url", r.URL.String())
+		p.logger.Error("Failed to send request through tunnel", err, "id", reqID, "domain", requestDomain(r))
+		p.stats.recordError(err.Error())
 
 		// Provide more specific error message
 		errorMsg := "Tunnel error: Unable to forward request"
 		statusCode := http.StatusBadGateway
+		errorCode := ErrCodeTunnelError
 
 		if strings.Contains(err.Error(), "not connected") {
 			errorMsg = "Tunnel connection lost. Attempting to reconnect..."
 			statusCode = http.StatusServiceUnavailable
+			errorCode = ErrCodeTunnelUnavailable
 		} else if strings.Contains(err.Error(), "timeout") {
 			errorMsg = "Request timeout: The server took too long to respond"
 			statusCode = http.StatusGatewayTimeout
+			errorCode = ErrCodeTimeout
 		}
 
-		http.Error(w, errorMsg, statusCode)
+		writeError(w, r, statusCode, errorCode, errorMsg)
+		return
+	}
+
+	// Verify response body integrity before returning it to the client
+	if p.checksums && resp.Error == "" && !resp.Stream {
+		if resp.Checksum == "" {
+			err = fmt.Errorf("response is missing checksum")
+		} else {
+			err = protocol.VerifyChecksum(resp.Body, resp.Checksum)
+		}
+		if err != nil {
+			p.logger.Error("Response integrity check failed", err, "id", reqID, "domain", requestDomain(r))
+			p.stats.recordError(err.Error())
+			writeError(w, r, http.StatusBadGateway, ErrCodeIntegrity, "Tunnel error: response integrity check failed")
+			return
+		}
+	}
+
+	// Errors the tunnel server classified are reported like proxy-generated ones
+	if resp.ErrorCode != "" {
+		writeTunnelError(w, r, resp)
+		return
+	}
+
+	// Event streams are relayed chunk by chunk as the server receives them
+	if resp.Stream {
+		p.writeStream(w, r, tunnel, resp)
+		return
+	}
+
+	// The server refuses oversized bodies before relaying them; this catches servers that predate the limit
+	if p.maxResponseBody > 0 && int64(len(resp.Body)) > p.maxResponseBody {
+		p.logger.Warn("Response body exceeds the limit, rejecting", "id", reqID, "bytes", len(resp.Body), "limit", p.maxResponseBody)
+		p.stats.recordError(errResponseTooLarge.Error())
+		writeError(w, r, http.StatusBadGateway, ErrCodeResponseTooLarge,
+			fmt.Sprintf("Response body of %d bytes exceeds the proxy's %d byte limit", len(resp.Body), p.maxResponseBody))
 		return
 	}
 
 	// Write response back to client
-	p.writeResponse(w, resp)
+	size := p.writeResponse(w, resp)
+	p.logger.Debug("Response delivered", "id", reqID, "status", resp.StatusCode, "bytes", size)
+}
+
+// defaultConnectPort is assumed for CONNECT authorities without a port, as CONNECT is almost always used for HTTPS
+const defaultConnectPort = "443"
+
+// connectTarget validates a CONNECT authority and normalizes it to host:port
+func connectTarget(authority string) (string, error) {
+	if authority == "" {
+		return "", fmt.Errorf("missing authority")
+	}
+	if strings.Contains(authority, "://") || strings.ContainsAny(authority, "/@?# \t") {
+		return "", fmt.Errorf("authority must be host:port")
+	}
+
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		// A bare host (or bracketed IPv6 address) without a port
+		host, port = authority, defaultConnectPort
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+			if net.ParseIP(host) == nil {
+				return "", fmt.Errorf("invalid IPv6 address")
+			}
+		} else if strings.Contains(host, ":") {
+			return "", fmt.Errorf("invalid port or unbracketed IPv6 address")
+		}
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	if net.ParseIP(host) == nil && !validHostname(host) {
+		return "", fmt.Errorf("invalid host %q", host)
+	}
+
+	return net.JoinHostPort(strings.ToLower(host), port), nil
+}
+
+// validHostname reports whether host is a syntactically valid DNS name
+func validHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 // handleConnect handles HTTPS CONNECT requests for tunneling
 func (p *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 	// Establish a TCP tunnel via the server using our protocol
-	reqID := p.generateRequestID()
+	reqID, err := p.generateRequestID()
+	if err != nil {
+		p.logger.Error("Failed to generate request ID", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "Failed to generate request ID")
+		return
+	}
 
 	p.logger.Debug("CONNECT starting", "id", reqID, "host", r.Host)
 
+	target, err := connectTarget(r.Host)
+	if err != nil {
+		p.logger.Warn("Rejecting malformed CONNECT target", "id", reqID, "host", r.Host, "error", err.Error())
+		writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, fmt.Sprintf("Invalid CONNECT target %q: %v", r.Host, err))
+		return
+	}
+
+	// The whole tunnel runs over one server connection
+	tunnel, release := p.poolFor(r).Acquire()
+	defer release()
+
 	// Check if tunnel is connected
-	if !p.tunnelConn.IsConnected() {
+	if !tunnel.IsConnected() {
 		p.logger.Error("Tunnel not connected for CONNECT", nil, "id", reqID, "host", r.Host)
-		http.Error(w, "Tunnel connection unavailable", http.StatusServiceUnavailable)
+		p.stats.recordError("tunnel not connected")
+		writeError(w, r, http.StatusServiceUnavailable, ErrCodeTunnelUnavailable, "Tunnel connection unavailable")
 		return
 	}
 
-	// Ask tunnel to open remote connection
-	ack, err := p.tunnelConn.ConnectOpen(reqID, r.Host)
+	// Ask tunnel to open remote connection, compressed when the target's protocol is likely to compress
+	compression := ""
+	if _, port, _ := net.SplitHostPort(target); p.compressPorts[port] {
+		compression = protocol.CompressionGzip
+	}
+	// The request's headers go along for the server's checks, such as a required gate header
+	ack, err := tunnel.ConnectOpenWith(&protocol.ConnectOpen{ID: reqID, Address: target, Compression: compression, Headers: convertHeaders(r.Header)})
 	if err != nil || !ack.Ok {
 		if err == nil {
-			err = fmt.Errorf(ack.Error)
+			err = errors.New(ack.Error)
+		}
+		p.logger.Error("CONNECT open failed", err, "host", target, "id", reqID)
+		p.stats.recordError(err.Error())
+
+		if ack != nil && ack.ErrorCode == ErrCodeForbidden {
+			writeError(w, r, http.StatusForbidden, ErrCodeForbidden, "Tunnel CONNECT refused by the server")
+			return
+		}
+		if ack != nil && ack.ErrorCode == ErrCodeLoadShed {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, ErrCodeLoadShed, "Tunnel server is overloaded. Please try again shortly.")
+			return
 		}
-		p.logger.Error("CONNECT open failed", err, "host", r.Host, "id", reqID)
 
 		// Provide more specific error message
 		errorMsg := "Tunnel CONNECT failed"
+		errorCode := ErrCodeConnectFailed
 		if strings.Contains(err.Error(), "timeout") {
 			errorMsg = "Connection timeout"
+			errorCode = ErrCodeTimeout
 		} else if strings.Contains(err.Error(), "refused") {
 			errorMsg = "Connection refused by target"
 		}
 
-		http.Error(w, errorMsg, http.StatusBadGateway)
+		writeError(w, r, http.StatusBadGateway, errorCode, errorMsg)
 		return
 	}
 
-	p.logger.Debug("CONNECT opened successfully", "id", reqID)
+	compress := ack.Compression == protocol.CompressionGzip
+	p.logger.Debug("CONNECT opened successfully", "id", reqID, "compressed", compress)
 
 	// Hijack client connection to get raw TCP
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		p.logger.Error("Proxy does not support hijacking", nil, "id", reqID)
-		http.Error(w, "Proxy does not support hijacking", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "Proxy does not support hijacking")
 		return
 	}
 	clientConn, clientBuf, err := hj.Hijack()
 	if err != nil {
 		p.logger.Error("Hijack failed", err, "id", reqID)
-		_ = p.tunnelConn.ConnectClose(reqID, "hijack failed")
+		_ = tunnel.ConnectClose(reqID, "hijack failed")
 		return
 	}
 
@@ -269,40 +752,73 @@ func (p *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 	_, writeErr := clientBuf.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n")
 	if writeErr != nil {
 		p.logger.Error("Failed to send 200 response", writeErr, "id", reqID)
-		_ = p.tunnelConn.ConnectClose(reqID, "failed to send 200")
+		_ = tunnel.ConnectClose(reqID, "failed to send 200")
 		clientConn.Close()
 		return
 	}
 
 	if flushErr := clientBuf.Flush(); flushErr != nil {
 		p.logger.Error("Failed to flush 200 response", flushErr, "id", reqID)
-		_ = p.tunnelConn.ConnectClose(reqID, "failed to flush 200")
+		_ = tunnel.ConnectClose(reqID, "failed to flush 200")
 		clientConn.Close()
 		return
 	}
 
 	p.logger.Debug("CONNECT sent 200 to client", "id", reqID)
 
+	// Half-close lets protocols that signal end-of-request with EOF keep reading the reply
+	halfClose := tunnel.SupportsHalfClose()
+
+	// Whichever pump ends first tears down both directions and the server's upstream connection
+	// at once, rather than leaving the other to notice through a read error
+	done := make(chan struct{})
+	var teardownOnce sync.Once
+	teardown := func(closeUpstream bool) {
+		teardownOnce.Do(func() {
+			close(done)
+			if closeUpstream {
+				_ = tunnel.ConnectClose(reqID, "")
+			}
+			clientConn.Close()
+		})
+	}
+
 	// Start pump: client->server
 	go func() {
+		clientEOF := false
 		defer func() {
 			p.logger.Debug("CONNECT client->server pump exiting", "id", reqID)
-			_ = p.tunnelConn.ConnectClose(reqID, "")
-			clientConn.Close()
+			if clientEOF && halfClose {
+				if err := tunnel.ConnectHalfClose(reqID); err == nil {
+					return
+				}
+			}
+			teardown(true)
 		}()
 		p.logger.Debug("CONNECT client->server pump started", "id", reqID)
 		buf := make([]byte, 32*1024)
+		reader := coalesce.NewReader(clientConn, p.connectCoalesce)
 		for {
-			n, err := clientConn.Read(buf)
+			n, err := reader.Read(buf)
 			if n > 0 {
 				p.logger.Debug("CONNECT read from client", "id", reqID, "bytes", n)
-				if sendErr := p.tunnelConn.ConnectSend(reqID, buf[:n]); sendErr != nil {
+				p.touch()
+				chunk, compressed := buf[:n], false
+				if compress {
+					chunk, compressed = protocol.CompressChunk(chunk)
+				}
+				send := tunnel.ConnectSend
+				if compressed {
+					send = tunnel.ConnectSendCompressed
+				}
+				if sendErr := send(reqID, chunk); sendErr != nil {
 					p.logger.Error("CONNECT send error", sendErr, "id", reqID)
 					return
 				}
 				p.logger.Debug("CONNECT sent to server", "id", reqID, "bytes", n)
 			}
 			if err != nil {
+				clientEOF = err == io.EOF
 				if err != io.EOF {
 					p.logger.Debug("CONNECT client read error", "id", reqID, "error", err)
 				}
@@ -313,22 +829,58 @@ func (p *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 
 	// Pump: server->client (main goroutine)
 	p.logger.Debug("CONNECT server->client pump starting", "id", reqID)
-	ch := p.tunnelConn.ConnectDataChannel(reqID)
-	for msg := range ch {
+	ch := tunnel.ConnectDataChannel(reqID)
+	if ch == nil {
+		// The server closed the tunnel before the pump started
+		teardown(false)
+		return
+	}
+	for {
+		var msg *protocol.ConnectData
+		select {
+		case <-done:
+			p.logger.Debug("CONNECT client->server pump ended, server->client pump exiting", "id", reqID)
+			return
+		case m, ok := <-ch:
+			if !ok {
+				// The server closed the tunnel, so only the client connection is left to close
+				p.logger.Debug("CONNECT server->client pump exiting", "id", reqID)
+				teardown(false)
+				return
+			}
+			msg = m
+		}
+		if msg == HalfCloseMarker {
+			// Server finished sending; keep reading from the client until its own EOF
+			p.logger.Debug("CONNECT server finished sending, half-closing client", "id", reqID)
+			if cw, ok := clientConn.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			}
+			continue
+		}
 		if msg.Chunk != nil && len(msg.Chunk) > 0 {
 			p.logger.Debug("CONNECT received from server", "id", reqID, "bytes", len(msg.Chunk))
-			if _, err := clientConn.Write(msg.Chunk); err != nil {
+			p.touch()
+			chunk := msg.Chunk
+			if msg.Compressed {
+				if chunk, err = protocol.DecompressChunk(msg.Chunk); err != nil {
+					p.logger.Error("CONNECT failed to decompress data from server", err, "id", reqID)
+					teardown(true)
+					return
+				}
+			}
+			if _, err := clientConn.Write(chunk); err != nil {
 				p.logger.Error("CONNECT write to client failed", err, "id", reqID)
+				teardown(true)
 				return
 			}
-			p.logger.Debug("CONNECT wrote to client", "id", reqID, "bytes", len(msg.Chunk))
+			p.logger.Debug("CONNECT wrote to client", "id", reqID, "bytes", len(chunk))
 		}
 	}
-	p.logger.Debug("CONNECT server->client pump exiting", "id", reqID)
 }
 
-// writeResponse writes the tunnel response back to the HTTP client
-func (p *Server) writeResponse(w http.ResponseWriter, resp *protocol.Response) {
+// writeResponse writes the tunnel response back to the HTTP client and returns the body size delivered
+func (p *Server) writeResponse(w http.ResponseWriter, resp *protocol.Response) int64 {
 	// Set headers
 	for name, values := range resp.Headers {
 		for _, value := range values {
@@ -336,13 +888,40 @@ func (p *Server) writeResponse(w http.ResponseWriter, resp *protocol.Response) {
 		}
 	}
 
+	// Declare trailers up front; they can only follow a chunked body
+	for name := range resp.Trailers {
+		w.Header().Add("Trailer", name)
+	}
+	if len(resp.Trailers) > 0 {
+		w.Header().Del("Content-Length")
+	}
+	markUpstreamError(w.Header(), resp.StatusCode)
+
+	// Servers that predate BodyBytes leave it unset, so the body is measured instead
+	var size int64
+	if protocol.BodyAllowedForStatus(resp.StatusCode) {
+		size = resp.BodyBytes
+		if size == 0 {
+			size = int64(len(resp.Body))
+		}
+	}
+	w.Header().Set(BytesHeader, strconv.FormatInt(size, 10))
+
 	// Set status code
 	w.WriteHeader(resp.StatusCode)
 
-	// Write body
-	if len(resp.Body) > 0 {
+	// Write body (never for statuses such as 304 Not Modified that must not carry one)
+	if len(resp.Body) > 0 && protocol.BodyAllowedForStatus(resp.StatusCode) {
 		w.Write(resp.Body)
 	}
+
+	// Set trailers after the body so they are sent after the final chunk
+	for name, values := range resp.Trailers {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	return size
 }
 
 // convertHeaders converts http.Header to protocol headers format
@@ -354,15 +933,68 @@ func convertHeaders(headers http.Header) map[string][]string {
 	return result
 }
 
+// hopByHopHeaders describe a single connection and are not forwarded by proxies (RFC 7230 section 6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // Non-standard, sent by some clients in place of Connection
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders deletes the standard hop-by-hop headers and any named in the Connection header.
+// "TE: trailers" is kept on gRPC requests, as gRPC servers use it to tell that the client can receive
+// their status.
+func removeHopByHopHeaders(header http.Header) {
+	acceptsTrailers := false
+	if protocol.IsGRPCContentType(header.Get("Content-Type")) {
+		for _, value := range header.Values("Te") {
+			for _, token := range strings.Split(value, ",") {
+				acceptsTrailers = acceptsTrailers || strings.EqualFold(strings.TrimSpace(token), "trailers")
+			}
+		}
+	}
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+	if acceptsTrailers {
+		header.Set("Te", "trailers")
+	}
+}
+
+// requestIDBytes is the random length of request IDs, enough that concurrent requests never share one
+const requestIDBytes = 16
+
 // generateRequestID generates a unique request ID
-func (p *Server) generateRequestID() string {
-	bytes := make([]byte, 8)
-	rand.Read(bytes)
-	return fmt.Sprintf("%x", bytes)
+func (p *Server) generateRequestID() (string, error) {
+	bytes := make([]byte, requestIDBytes)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate request ID: %w", err)
+	}
+	return hex.EncodeToString(bytes), nil
 }
 
-// logRequest logs request information (domain only for privacy)
+// logRequest logs request information (domain only for privacy, unless full URLs are enabled for debugging)
 func (p *Server) logRequest(r *http.Request) {
+	p.logger.Info("Proxying request", "method", r.Method, "domain", requestDomain(r))
+	if p.logFullURL {
+		p.logger.Debug("Proxying request URL", "method", r.Method, "url", p.logURL(r))
+	}
+}
+
+// requestDomain returns the host a request targets without its port
+func requestDomain(r *http.Request) string {
 	var domain string
 	if r.URL != nil && r.URL.Host != "" {
 		domain = r.URL.Host
@@ -374,8 +1006,29 @@ func (p *Server) logRequest(r *http.Request) {
 	if host, _, err := net.SplitHostPort(domain); err == nil {
 		domain = host
 	}
+	return domain
+}
 
-	p.logger.Info("Proxying request", "method", r.Method, "domain", domain)
+// logURL returns the request URL for Debug lines: the full URL when enabled, otherwise only the domain.
+// Info and higher lines log requestDomain, as full URLs may carry sensitive paths and query strings.
+func (p *Server) logURL(r *http.Request) string {
+	if !p.logFullURL {
+		return requestDomain(r)
+	}
+	fullURL := *r.URL
+	if fullURL.Host == "" {
+		fullURL.Host = r.Host
+	}
+	return fullURL.String()
+}
+
+// wsHandshakeHeaders are the client upgrade headers not forwarded when opening the target WebSocket
+var wsHandshakeHeaders = []string{
+	"Upgrade",
+	"Connection",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Extensions",
 }
 
 // isWebSocketUpgrade checks if the request is a WebSocket upgrade request
@@ -386,9 +1039,14 @@ func (p *Server) isWebSocketUpgrade(r *http.Request) bool {
 
 // handleWebSocket handles WebSocket upgrade requests and establishes a WebSocket tunnel
 func (p *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	reqID := p.generateRequestID()
+	reqID, err := p.generateRequestID()
+	if err != nil {
+		p.logger.Error("Failed to generate request ID", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "Failed to generate request ID")
+		return
+	}
 
-	p.logger.Info("WebSocket upgrade request", "id", reqID, "url", r.URL.String())
+	p.logger.Info("WebSocket upgrade request", "id", reqID, "domain", requestDomain(r))
 
 	// Ensure URL is absolute
 	wsURL := r.URL.String()
@@ -403,20 +1061,34 @@ func (p *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Request server to establish WebSocket connection
+	// Request server to establish WebSocket connection. The handshake headers belong to the client's
+	// own upgrade; the server's dialer generates its own and refuses duplicates.
+	headers := convertHeaders(r.Header)
+	for _, name := range wsHandshakeHeaders {
+		delete(headers, name)
+	}
 	wsOpen := &protocol.WebSocketOpen{
 		ID:      reqID,
 		URL:     wsURL,
-		Headers: convertHeaders(r.Header),
+		Headers: headers,
 	}
 
-	ack, err := p.tunnelConn.WebSocketOpen(wsOpen)
+	// The whole WebSocket session runs over one server connection
+	tunnel, release := p.poolFor(r).Acquire()
+	defer release()
+
+	ack, err := tunnel.WebSocketOpen(wsOpen)
 	if err != nil || !ack.Ok {
 		if err == nil {
-			err = fmt.Errorf(ack.Error)
+			err = errors.New(ack.Error)
 		}
 		p.logger.Error("WebSocket open failed", err, "id", reqID)
-		http.Error(w, "WebSocket tunnel error", http.StatusBadGateway)
+		p.stats.recordError(err.Error())
+		if ack != nil && ack.ErrorCode == ErrCodeForbidden {
+			writeError(w, r, http.StatusForbidden, ErrCodeForbidden, "WebSocket refused by the server")
+			return
+		}
+		writeError(w, r, http.StatusBadGateway, ErrCodeTunnelError, "WebSocket tunnel error")
 		return
 	}
 
@@ -432,16 +1104,21 @@ func (p *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	clientWS, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		p.logger.Error("Failed to upgrade client connection", err, "id", reqID)
-		_ = p.tunnelConn.WebSocketClose(reqID, websocket.CloseInternalServerErr, "upgrade failed")
+		_ = tunnel.WebSocketClose(reqID, websocket.CloseInternalServerErr, "upgrade failed")
 		return
 	}
 	defer clientWS.Close()
 
 	p.logger.Debug("Client WebSocket upgraded", "id", reqID)
 
+	// Ping the client so idle tunnels survive intermediaries and a vanished client is noticed
+	stopKeepalive := make(chan struct{})
+	defer close(stopKeepalive)
+	keepalive.WebSocket(clientWS, p.wsKeepalive, stopKeepalive)
+
 	// Create channels for bidirectional communication
 	clientToServer := make(chan *protocol.WebSocketMessage, 64)
-	serverToClient := p.tunnelConn.WebSocketMessageChannel(reqID)
+	serverToClient := tunnel.WebSocketMessageChannel(reqID)
 	done := make(chan struct{})
 
 	// Goroutine: Read from client WebSocket and send to tunnel
@@ -450,11 +1127,16 @@ func (p *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		for {
 			messageType, data, err := clientWS.ReadMessage()
 			if err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				if keepalive.IsTimeout(err) {
+					// Closing the server side ends the tunnel, which then closes the client
+					p.logger.Warn("Client WebSocket stopped answering pings, closing", "id", reqID)
+					_ = tunnel.WebSocketClose(reqID, websocket.CloseGoingAway, "client stopped answering pings")
+				} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 					p.logger.Error("Client WebSocket read error", err, "id", reqID)
 				}
 				return
 			}
+			p.touch()
 
 			msg := &protocol.WebSocketMessage{
 				ID:          reqID,
@@ -473,7 +1155,7 @@ func (p *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Goroutine: Send client messages through tunnel
 	go func() {
 		for msg := range clientToServer {
-			if err := p.tunnelConn.WebSocketSend(msg); err != nil {
+			if err := tunnel.WebSocketSend(msg); err != nil {
 				p.logger.Error("Failed to send WebSocket message through tunnel", err, "id", reqID)
 				return
 			}
@@ -490,6 +1172,7 @@ func (p *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 				close(done)
 				return
 			}
+			p.touch()
 
 			if err := clientWS.WriteMessage(msg.MessageType, msg.Data); err != nil {
 				p.logger.Error("Failed to write to client WebSocket", err, "id", reqID)
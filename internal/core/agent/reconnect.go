@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"fluidity/internal/shared/logging"
+	"fluidity/internal/shared/retry"
+)
+
+// ReconnectConfig controls how a lost tunnel connection is re-established
+type ReconnectConfig struct {
+	InitialDelayMax time.Duration // Upper bound of the random delay before the first attempt
+	InitialDelay    time.Duration // Backoff after the first failed attempt
+	MaxDelay        time.Duration // Maximum backoff between attempts
+	Multiplier      float64       // Multiplier for exponential backoff
+	Jitter          float64       // Fraction (0-1) of each backoff that is randomized
+	MinInterval     time.Duration // Minimum time between any two attempts
+}
+
+// DefaultReconnectConfig returns the default reconnection settings
+func DefaultReconnectConfig() ReconnectConfig {
+	return ReconnectConfig{
+		InitialDelayMax: 2 * time.Second,
+		InitialDelay:    1 * time.Second,
+		MaxDelay:        30 * time.Second,
+		Multiplier:      2.0,
+		Jitter:          0.5,
+		MinInterval:     1 * time.Second,
+	}
+}
+
+// Reconnector re-establishes lost tunnel connections with jittered, capped backoff so that
+// many agents losing the server at once do not reconnect in lockstep
+type Reconnector struct {
+	config      ReconnectConfig
+	connect     func() error
+	logger      *logging.Logger
+	mu          sync.Mutex
+	lastAttempt time.Time
+}
+
+// NewReconnector creates a reconnector that calls connect until it succeeds
+func NewReconnector(config ReconnectConfig, connect func() error, logger *logging.Logger) *Reconnector {
+	defaults := DefaultReconnectConfig()
+	if config.InitialDelay <= 0 {
+		config.InitialDelay = defaults.InitialDelay
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = defaults.MaxDelay
+	}
+	if config.Multiplier <= 0 {
+		config.Multiplier = defaults.Multiplier
+	}
+
+	return &Reconnector{
+		config:  config,
+		connect: connect,
+		logger:  logger,
+	}
+}
+
+// Run attempts to reconnect until connect succeeds or ctx is done
+func (r *Reconnector) Run(ctx context.Context) error {
+	// Spread the herd before the first attempt
+	var delay time.Duration
+	if r.config.InitialDelayMax > 0 {
+		delay = rand.N(r.config.InitialDelayMax)
+	}
+	backoff := r.config.InitialDelay
+
+	for attempt := 1; ; attempt++ {
+		if err := r.wait(ctx, delay); err != nil {
+			return err
+		}
+
+		err := r.connect()
+		if err == nil {
+			r.logger.Info("Reconnected to tunnel server", "attempts", attempt)
+			return nil
+		}
+
+		delay = retry.Jitter(backoff, r.config.Jitter)
+		if retryAfter, busy := retryAfterBusy(err); busy {
+			// Wait at least as long as the server asked, plus jitter so turned-away agents do not return together
+			retryAfter += time.Duration(rand.Float64() * r.config.Jitter * float64(retryAfter))
+			delay = max(delay, retryAfter)
+		}
+		r.logger.Warn("Reconnect attempt failed",
+			"attempt", attempt,
+			"error", err.Error(),
+			"nextAttemptIn", delay.String())
+
+		backoff = time.Duration(float64(backoff) * r.config.Multiplier)
+		if backoff > r.config.MaxDelay {
+			backoff = r.config.MaxDelay
+		}
+	}
+}
+
+// wait sleeps for delay, extended as needed to honour the minimum interval between attempts
+func (r *Reconnector) wait(ctx context.Context, delay time.Duration) error {
+	r.mu.Lock()
+	if r.config.MinInterval > 0 && !r.lastAttempt.IsZero() {
+		if earliest := time.Until(r.lastAttempt.Add(r.config.MinInterval)); earliest > delay {
+			delay = earliest
+		}
+	}
+	r.mu.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	r.mu.Lock()
+	r.lastAttempt = time.Now()
+	r.mu.Unlock()
+	return nil
+}
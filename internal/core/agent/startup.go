@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"net/http"
+	"time"
+)
+
+// SetStartupWait holds requests that arrive before the tunnel has first connected for up to wait,
+// rather than failing them while the connection is still being set up. Once the tunnel has connected,
+// later disconnects fail requests at once as before. 0 uses DefaultStartupWait and a negative wait
+// disables holding (call before Start).
+func (p *Server) SetStartupWait(wait time.Duration) {
+	switch {
+	case wait < 0:
+		p.startupWait = 0
+	case wait == 0:
+		p.startupWait = DefaultStartupWait
+	default:
+		p.startupWait = wait
+	}
+}
+
+// awaitTunnelStart holds a request until the tunnel has first connected, for up to the startup wait.
+// It answers the request with a 503 and returns false when the tunnel is still not up by then.
+func (p *Server) awaitTunnelStart(w http.ResponseWriter, r *http.Request) bool {
+	pool := p.poolFor(r)
+	if p.startupWait <= 0 || pool.Started() {
+		return true
+	}
+
+	start := time.Now()
+	p.logger.Debug("Tunnel is still connecting, holding request", "method", r.Method, "url", p.logURL(r), "max_wait", p.startupWait.String())
+	if pool.awaitStart(r.Context(), p.startupWait) {
+		p.logger.Debug("Tunnel connected, releasing held request", "method", r.Method, "url", p.logURL(r), "waited", time.Since(start).String())
+		return true
+	}
+	if r.Context().Err() != nil {
+		return false
+	}
+
+	p.logger.Warn("Tunnel did not connect in time for a held request", "method", r.Method, "domain", requestDomain(r), "waited", time.Since(start).String())
+	p.stats.recordError("tunnel still connecting")
+	writeError(w, r, http.StatusServiceUnavailable, ErrCodeTunnelUnavailable, "Tunnel is still connecting. Please try again shortly.")
+	return false
+}
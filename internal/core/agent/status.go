@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// statusWindow is the period covered by the rolling request count
+	statusWindow = 5 * time.Minute
+	// statusBucketSize is the granularity of the rolling request count
+	statusBucketSize = 10 * time.Second
+	// statusRefreshSeconds is how often the status page reloads itself
+	statusRefreshSeconds = 5
+)
+
+// requestStats tracks a rolling count of proxied requests and the most recent error
+type requestStats struct {
+	mu            sync.Mutex
+	buckets       []int
+	bucketStart   []time.Time
+	lastError     string
+	lastErrorTime time.Time
+}
+
+// newRequestStats creates an empty request statistics tracker
+func newRequestStats() *requestStats {
+	n := int(statusWindow / statusBucketSize)
+	return &requestStats{
+		buckets:     make([]int, n),
+		bucketStart: make([]time.Time, n),
+	}
+}
+
+// recordRequest counts a proxied request in the current bucket
+func (s *requestStats) recordRequest() {
+	now := time.Now()
+	start := now.Truncate(statusBucketSize)
+	idx := int(start.UnixNano()/int64(statusBucketSize)) % len(s.buckets)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.bucketStart[idx].Equal(start) {
+		s.bucketStart[idx] = start
+		s.buckets[idx] = 0
+	}
+	s.buckets[idx]++
+}
+
+// recordError stores the most recent request error
+func (s *requestStats) recordError(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = msg
+	s.lastErrorTime = time.Now()
+}
+
+// recentRequests returns the number of requests within the rolling window
+func (s *requestStats) recentRequests() int {
+	cutoff := time.Now().Add(-statusWindow)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := 0
+	for i, start := range s.bucketStart {
+		if start.After(cutoff) {
+			total += s.buckets[i]
+		}
+	}
+	return total
+}
+
+// lastErr returns the most recent error and when it occurred
+func (s *requestStats) lastErr() (string, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastError, s.lastErrorTime
+}
+
+// statusPageData is rendered by the status page template
+type statusPageData struct {
+	Health         ProxyHealthStatus
+	Uptime         string
+	RecentRequests int
+	WindowMinutes  int
+	LastError      string
+	LastErrorTime  string
+	RefreshSeconds int
+}
+
+var statusPageTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.RefreshSeconds}}">
+<title>Fluidity Agent Status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; }
+td { padding: 4px 12px; border-bottom: 1px solid #ddd; }
+.connected { color: #2a7d2a; font-weight: bold; }
+.disconnected { color: #b02a2a; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>Fluidity Agent</h1>
+<table>
+<tr><td>Status</td><td>{{.Health.Status}}</td></tr>
+<tr><td>Tunnel</td><td>{{if .Health.Connected}}<span class="connected">connected</span>{{else}}<span class="disconnected">disconnected</span>{{end}}</td></tr>
+<tr><td>Server address</td><td>{{.Health.ServerAddr}}</td></tr>
+<tr><td>Proxy port</td><td>{{.Health.ProxyPort}}</td></tr>
+<tr><td>Uptime</td><td>{{.Uptime}}</td></tr>
+<tr><td>Requests (last {{.WindowMinutes}} min)</td><td>{{.RecentRequests}}</td></tr>
+<tr><td>Last error</td><td>{{if .LastError}}{{.LastError}} ({{.LastErrorTime}}){{else}}none{{end}}</td></tr>
+</table>
+</body>
+</html>
+`))
+
+// handleStatusPage renders the human-readable status dashboard
+func (p *Server) handleStatusPage(w http.ResponseWriter, r *http.Request) {
+	health := p.healthStatus()
+	lastError, lastErrorTime := p.stats.lastErr()
+
+	data := statusPageData{
+		Health:         health,
+		Uptime:         (time.Duration(health.UptimeSeconds) * time.Second).String(),
+		RecentRequests: p.stats.recentRequests(),
+		WindowMinutes:  int(statusWindow / time.Minute),
+		LastError:      lastError,
+		RefreshSeconds: statusRefreshSeconds,
+	}
+	if !lastErrorTime.IsZero() {
+		data.LastErrorTime = lastErrorTime.Format(time.RFC3339)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if err := statusPageTemplate.Execute(w, data); err != nil {
+		p.logger.Error("Failed to render status page", err)
+	}
+}
+
+// isDirectRequest reports whether the request targets the proxy itself rather than an upstream host
+func (p *Server) isDirectRequest(r *http.Request) bool {
+	if r.Method == "CONNECT" || r.URL.IsAbs() {
+		return false
+	}
+
+	_, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return false
+	}
+	return port == strconv.Itoa(p.port)
+}
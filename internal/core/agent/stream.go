@@ -0,0 +1,209 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// streamBufferSize is the number of response chunks buffered per streamed response, which is the window
+// the server may send without credit
+const streamBufferSize = protocol.ChunkWindow
+
+// streamCreditBatch is how many consumed chunks are acknowledged to the server in one credit message
+const streamCreditBatch = protocol.ChunkWindow / 4
+
+// streamIdleTimeout ends a streamed response when no chunk arrives for this long
+const streamIdleTimeout = 5 * time.Minute
+
+// responseStream receives the body chunks of a streamed response
+type responseStream struct {
+	chunks chan *protocol.Chunk
+	done   chan struct{} // Closed when the proxy stops reading
+	final  bool          // Set once the final chunk is delivered and chunks is closed
+}
+
+// openStream registers a stream for a response whose body follows in http_response_chunk messages
+func (c *Client) openStream(id string) {
+	c.mu.Lock()
+	c.streams[id] = &responseStream{
+		chunks: make(chan *protocol.Chunk, streamBufferSize),
+		done:   make(chan struct{}),
+	}
+	c.mu.Unlock()
+}
+
+// deliverChunk hands a response chunk to its stream without blocking the response handler, closing the
+// stream after the final chunk. The server only sends chunks the proxy has granted credit for, so one that
+// does not fit overran the window: the stream is closed as truncated and the server told to stop it.
+// Only the response handler goroutine sends on or closes stream channels. A finished stream stays
+// registered until CloseStream, so a proxy that only gets to it after the final chunk still reads it.
+func (c *Client) deliverChunk(chunk *protocol.Chunk) {
+	c.mu.RLock()
+	stream := c.streams[chunk.ID]
+	finished := stream != nil && stream.final
+	c.mu.RUnlock()
+	if stream == nil || finished {
+		return
+	}
+
+	select {
+	case stream.chunks <- chunk:
+		if !chunk.Final {
+			return
+		}
+	case <-stream.done:
+		return
+	default:
+		c.logger.Error("Response stream overran its credit window, aborting", nil, "id", chunk.ID, "seq", chunk.Seq)
+		go c.send(protocol.Envelope{Type: "http_cancel", Payload: &protocol.HTTPCancel{ID: chunk.ID}})
+	}
+
+	c.mu.Lock()
+	stream.final = true
+	c.mu.Unlock()
+	close(stream.chunks)
+}
+
+// grantStreamCredit lets the server send chunks more chunks of a streamed response
+func (c *Client) grantStreamCredit(id string, chunks int) {
+	env := protocol.Envelope{Type: "http_response_credit", Payload: &protocol.ChunkCredit{ID: id, Chunks: chunks}}
+	if err := c.send(env); err != nil {
+		c.logger.Debug("Failed to send stream credit", "id", id, "error", err.Error())
+	}
+}
+
+// StreamChunks returns the chunk channel of a streamed response, closed after the final chunk
+func (c *Client) StreamChunks(id string) <-chan *protocol.Chunk {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if stream := c.streams[id]; stream != nil {
+		return stream.chunks
+	}
+	return nil
+}
+
+// CancelStream asks the server to stop relaying a streamed response. Chunks already sent are still
+// delivered, ending with the final chunk.
+func (c *Client) CancelStream(id string) error {
+	c.mu.RLock()
+	stream := c.streams[id]
+	open := stream != nil && !stream.final
+	c.mu.RUnlock()
+	if !open {
+		return nil
+	}
+	env := protocol.Envelope{Type: "http_cancel", Payload: &protocol.HTTPCancel{ID: id}}
+	if err := c.send(env); !errors.Is(err, errNotConnected) {
+		return err
+	}
+	return nil
+}
+
+// CloseStream stops receiving a streamed response, cancelling it on the server if it is still running
+func (c *Client) CloseStream(id string) {
+	c.CancelStream(id)
+
+	c.mu.Lock()
+	stream := c.streams[id]
+	delete(c.streams, id)
+	c.mu.Unlock()
+	if stream != nil {
+		close(stream.done)
+	}
+}
+
+// errResponseTooLarge stops a streamed response that exceeds the proxy's response body limit
+var errResponseTooLarge = errors.New("response body exceeds limit")
+
+// streamWriter writes response chunks to the client, flushing each as it arrives and granting the
+// server credit for more once they have been written
+type streamWriter struct {
+	proxy   *Server
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	tunnel  *Client
+	id      string
+	limit   int64 // Maximum bytes forwarded (0 for no limit)
+	written int64
+	pending int // Chunks written but not yet credited
+}
+
+// Write writes and flushes a chunk, counting it as proxied traffic
+func (sw *streamWriter) Write(b []byte) (int, error) {
+	if sw.limit > 0 && sw.written+int64(len(b)) > sw.limit {
+		return 0, errResponseTooLarge
+	}
+	n, err := sw.w.Write(b)
+	sw.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+	sw.rc.Flush()
+	sw.proxy.touch()
+
+	sw.pending++
+	if sw.pending >= streamCreditBatch {
+		sw.tunnel.grantStreamCredit(sw.id, sw.pending)
+		sw.pending = 0
+	}
+	return n, nil
+}
+
+// writeStream relays a streamed response to the client until the server sends the final chunk,
+// the client disconnects, or the stream stalls
+func (p *Server) writeStream(w http.ResponseWriter, r *http.Request, tunnel *Client, resp *protocol.Response) {
+	defer tunnel.CloseStream(resp.ID)
+
+	chunks := tunnel.StreamChunks(resp.ID)
+	if chunks == nil {
+		writeError(w, r, http.StatusBadGateway, ErrCodeTunnelError, "Tunnel error: response stream unavailable")
+		return
+	}
+
+	for name, values := range resp.Headers {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Del(BytesHeader)
+	w.Header().Add("Trailer", BytesHeader)
+	markUpstreamError(w.Header(), resp.StatusCode)
+
+	// Streams outlive the proxy's write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.WriteHeader(resp.StatusCode)
+	rc.Flush()
+
+	// When the client goes away the server stops the upstream request and ends the stream
+	stop := context.AfterFunc(r.Context(), func() {
+		tunnel.CancelStream(resp.ID)
+	})
+	defer stop()
+
+	sw := &streamWriter{proxy: p, w: w, rc: rc, tunnel: tunnel, id: resp.ID, limit: p.maxResponseBody}
+	written, err := protocol.ReassembleChunks(chunks, sw, streamIdleTimeout)
+	if errors.Is(err, errResponseTooLarge) {
+		// The status is already sent, so abort the connection rather than end the body as if complete
+		p.logger.Warn("Response stream exceeded the body limit, aborting", "id", resp.ID, "bytes", written, "limit", p.maxResponseBody)
+		p.stats.recordError(err.Error())
+		tunnel.CancelStream(resp.ID)
+		panic(http.ErrAbortHandler)
+	}
+	if err != nil {
+		// Ending the body normally would pass a truncated stream off as complete
+		if r.Context().Err() == nil {
+			p.logger.Warn("Response stream ended early, aborting", "id", resp.ID, "bytes", written, "error", err.Error())
+		}
+		panic(http.ErrAbortHandler)
+	}
+	// The size is only known, and only reported, once the whole body has been relayed
+	w.Header().Set(BytesHeader, strconv.FormatInt(written, 10))
+	p.logger.Debug("Response stream finished", "id", resp.ID, "bytes", written)
+}
@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// tunnelRoute sends requests for matching hosts through a named tunnel instead of the default one
+type tunnelRoute struct {
+	name  string
+	hosts *noProxyList
+	pool  *Pool
+}
+
+// AddTunnel routes requests for hosts through pool, a tunnel to its own server with its own
+// connections and reconnection, instead of the tunnel given to NewServer. Hosts take the same forms
+// as SetNoProxy entries. Routes are checked in the order they were added and the first match wins;
+// requests matching none use the default tunnel (call before Start).
+func (p *Server) AddTunnel(name string, pool *Pool, hosts []string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return fmt.Errorf("tunnel needs a name")
+	}
+	if pool == nil {
+		return fmt.Errorf("tunnel %s needs a connection pool", name)
+	}
+	for _, route := range p.routes {
+		if route.name == name {
+			return fmt.Errorf("tunnel %s is already configured", name)
+		}
+	}
+
+	list, err := parseNoProxy(hosts)
+	if err != nil {
+		return fmt.Errorf("tunnel %s: %w", name, err)
+	}
+	if !list.all && len(list.rules) == 0 {
+		return fmt.Errorf("tunnel %s routes no hosts", name)
+	}
+	p.routes = append(p.routes, tunnelRoute{name: name, hosts: list, pool: pool})
+	return nil
+}
+
+// Tunnels returns the pools of the named tunnels by name
+func (p *Server) Tunnels() map[string]*Pool {
+	tunnels := make(map[string]*Pool, len(p.routes))
+	for _, route := range p.routes {
+		tunnels[route.name] = route.pool
+	}
+	return tunnels
+}
+
+// poolFor returns the pool whose tunnel carries r: the first named tunnel routing its host, otherwise
+// the default one
+func (p *Server) poolFor(r *http.Request) *Pool {
+	if len(p.routes) == 0 {
+		return p.pool
+	}
+	host, port, ok := targetHostPort(r)
+	if !ok {
+		return p.pool
+	}
+	for _, route := range p.routes {
+		if route.hosts.matches(host, port) {
+			return route.pool
+		}
+	}
+	return p.pool
+}
@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// uploadChunkSize is the most request body sent in one http_request_chunk
+const uploadChunkSize = 32 * 1024
+
+// uploadStallTimeout fails a streamed request body when the server grants no credit for this long
+const uploadStallTimeout = 30 * time.Second
+
+var (
+	// errStreamingUnsupported is returned when streaming a request body to a server that cannot receive one
+	errStreamingUnsupported = errors.New("server does not support streamed request bodies")
+	// errUploadStalled is returned when the server stops granting credit for a streamed request body
+	errUploadStalled = errors.New("server stopped accepting the request body")
+)
+
+// SupportsRequestStreaming reports whether the server advertised streamed request bodies
+func (c *Client) SupportsRequestStreaming() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.serverHello != nil && c.serverHello.Features&protocol.FeatureRequestStreaming != 0
+}
+
+// SendRequestStream sends req with its body streamed from body in http_request_chunk messages as it is
+// read, rather than buffered first, and waits for the response. The server relays the body upstream as
+// it arrives, without a Content-Length unless req.BodyLength declares it.
+func (c *Client) SendRequestStream(req *protocol.Request, body io.Reader) (*protocol.Response, error) {
+	if !c.SupportsRequestStreaming() {
+		return nil, &notSentError{err: errStreamingUnsupported}
+	}
+	req.BodyStream = true
+	req.Body = nil
+	return c.sendRequest(req, body)
+}
+
+// sendBody streams body to the server for request id, one chunk per read, until EOF. Each chunk spends
+// one of the credits the server grants on credits as it consumes them, starting from a full window, so a
+// slow upstream slows the upload instead of piling chunks up on the server. It stops early once credits
+// is closed because the server has answered, as when it refused the request before reading the body.
+func (c *Client) sendBody(id string, body io.Reader, credits <-chan int) error {
+	buf := make([]byte, uploadChunkSize)
+	var seq uint64
+	var total int64
+	credit := protocol.ChunkWindow
+	for {
+		// Once the window is spent, wait for the server to grant more
+		if credit == 0 {
+			select {
+			case granted, ok := <-credits:
+				if !ok {
+					return nil
+				}
+				credit += granted
+			case <-time.After(uploadStallTimeout):
+				return errUploadStalled
+			}
+		}
+		// Take up any credit granted meanwhile, stopping if the server has answered
+		select {
+		case granted, ok := <-credits:
+			if !ok {
+				return nil
+			}
+			credit += granted
+		default:
+		}
+
+		n, readErr := body.Read(buf)
+		final := readErr == io.EOF
+		if readErr != nil && !final {
+			// A final chunk that disagrees with the bytes sent makes the server abort the upload
+			c.send(protocol.Envelope{Type: "http_request_chunk", Payload: &protocol.Chunk{ID: id, Seq: seq, Final: true, TotalBytes: -1}})
+			return fmt.Errorf("failed to read request body: %w", readErr)
+		}
+		if n == 0 && !final {
+			continue
+		}
+
+		total += int64(n)
+		chunk := &protocol.Chunk{ID: id, Seq: seq, Data: buf[:n], Final: final}
+		if final {
+			chunk.TotalBytes = total
+		}
+		if err := c.send(protocol.Envelope{Type: "http_request_chunk", Payload: chunk}); err != nil {
+			return fmt.Errorf("failed to send request body: %w", err)
+		}
+		seq++
+		credit--
+		if final {
+			return nil
+		}
+	}
+}
+
+// grantUploadCredit hands credit from the server to the streamed body of a request. Only the response
+// handler goroutine sends on or closes credit channels.
+func (c *Client) grantUploadCredit(credit *protocol.ChunkCredit) {
+	c.mu.RLock()
+	credits := c.uploads[credit.ID]
+	c.mu.RUnlock()
+	if credits == nil {
+		return
+	}
+	select {
+	case credits <- credit.Chunks:
+	default:
+		// More grants than chunks sent; the server is not keeping count
+		c.logger.Debug("Upload credit channel full", "id", credit.ID)
+	}
+}
+
+// endUpload stops streaming the body of a request the server has answered
+func (c *Client) endUpload(id string) {
+	c.mu.Lock()
+	credits := c.uploads[id]
+	delete(c.uploads, id)
+	c.mu.Unlock()
+	if credits != nil {
+		close(credits)
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+// DefaultAffinityIdleTimeout is how long an affinity pool may go unused before it is closed
+const DefaultAffinityIdleTimeout = 2 * time.Minute
+
+// affinityPool is the dedicated upstream client for one affinity key
+type affinityPool struct {
+	client   *http.Client
+	lastUsed time.Time
+}
+
+// SetAffinity pins requests that share an affinity key to a dedicated client holding a single upstream
+// connection per host, so related requests reach the same backend instance behind a load balancer. At
+// most maxPools keys are pinned at once, the least recently used giving way to new ones, and pools
+// unused for idleTimeout are closed. A maxPools of 0 disables affinity (call before Start).
+func (s *Server) SetAffinity(maxPools int, idleTimeout time.Duration) {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultAffinityIdleTimeout
+	}
+	s.affinityMax = maxPools
+	s.affinityIdle = idleTimeout
+}
+
+// affinityClient returns the dedicated client for key, derived from base
+func (s *Server) affinityClient(key string, base *http.Client) *http.Client {
+	s.affinityMutex.Lock()
+	defer s.affinityMutex.Unlock()
+
+	now := time.Now()
+	var oldestKey string
+	var oldest *affinityPool
+	for k, pool := range s.affinityPools {
+		if k == key {
+			continue
+		}
+		if now.Sub(pool.lastUsed) > s.affinityIdle {
+			pool.client.CloseIdleConnections()
+			delete(s.affinityPools, k)
+			continue
+		}
+		if oldest == nil || pool.lastUsed.Before(oldest.lastUsed) {
+			oldestKey, oldest = k, pool
+		}
+	}
+
+	if pool, ok := s.affinityPools[key]; ok {
+		pool.lastUsed = now
+		return pool.client
+	}
+
+	if len(s.affinityPools) >= s.affinityMax && oldest != nil {
+		s.logger.Debug("Affinity pools full, evicting least recently used", "key", oldestKey)
+		oldest.client.CloseIdleConnections()
+		delete(s.affinityPools, oldestKey)
+	}
+
+	// One connection per host, so every request with this key reuses the same upstream connection
+	transport := base.Transport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = 1
+	transport.MaxIdleConnsPerHost = 1
+	transport.IdleConnTimeout = s.affinityIdle
+
+	client := &http.Client{
+		Timeout:       base.Timeout,
+		Transport:     transport,
+		CheckRedirect: base.CheckRedirect,
+	}
+	if s.affinityPools == nil {
+		s.affinityPools = make(map[string]*affinityPool)
+	}
+	s.affinityPools[key] = &affinityPool{client: client, lastUsed: now}
+	return client
+}
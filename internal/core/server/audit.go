@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultAuditBuffer is the number of audit records held for the writer before new ones are dropped
+const DefaultAuditBuffer = 4096
+
+// Kinds of proxied traffic reported in audit records
+const (
+	AuditHTTP    = "http"
+	AuditConnect = "connect"
+)
+
+// AuditRecord is the metadata of one proxied request or CONNECT tunnel. It deliberately carries no
+// bodies, paths or query strings, only the domain (HTTP) or host:port (CONNECT) that was reached.
+type AuditRecord struct {
+	Time       time.Time `json:"time"`   // When the request or tunnel started
+	Client     string    `json:"client"` // Agent client certificate common name
+	Type       string    `json:"type"`   // AuditHTTP or AuditConnect
+	Method     string    `json:"method,omitempty"`
+	Domain     string    `json:"domain,omitempty"` // Upstream host of an HTTP request, without port or path
+	Target     string    `json:"target,omitempty"` // host:port of a CONNECT tunnel
+	Status     int       `json:"status,omitempty"` // Status sent to the agent for an HTTP request
+	BytesIn    int64     `json:"bytes_in"`         // Body or tunnel bytes sent from the agent to the upstream
+	BytesOut   int64     `json:"bytes_out"`        // Body or tunnel bytes sent from the upstream to the agent
+	DurationMs int64     `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"` // Why a CONNECT tunnel could not be opened
+}
+
+// auditLog writes audit records as JSON lines from its own goroutine, so a slow destination never
+// holds up the requests being audited
+type auditLog struct {
+	w       io.Writer
+	records chan AuditRecord
+	dropped atomic.Int64
+}
+
+// SetAuditLog writes an AuditRecord for every proxied HTTP request and CONNECT tunnel to w as JSON lines.
+// Records are buffered (bufferSize records, 0 uses DefaultAuditBuffer) and written asynchronously; when
+// the writer falls behind, new records are dropped and counted rather than delaying requests. A nil w
+// disables auditing (call before Start).
+func (s *Server) SetAuditLog(w io.Writer, bufferSize int) {
+	if w == nil {
+		s.audit = nil
+		return
+	}
+	if bufferSize <= 0 {
+		bufferSize = DefaultAuditBuffer
+	}
+	s.audit = &auditLog{w: w, records: make(chan AuditRecord, bufferSize)}
+}
+
+// startAudit runs the audit writer until the server stops, then writes whatever is still buffered
+func (s *Server) startAudit() {
+	if s.audit == nil {
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		bw := bufio.NewWriter(s.audit.w)
+		enc := json.NewEncoder(bw)
+		write := func(rec AuditRecord) {
+			if err := enc.Encode(rec); err != nil {
+				s.logger.Error("Failed to write audit record", err)
+			}
+		}
+		flush := func() {
+			if err := bw.Flush(); err != nil {
+				s.logger.Error("Failed to flush audit log", err)
+			}
+		}
+
+		for {
+			select {
+			case rec := <-s.audit.records:
+				write(rec)
+				// Flush once the burst of pending records has been written
+				if len(s.audit.records) == 0 {
+					flush()
+				}
+			case <-s.ctx.Done():
+				for len(s.audit.records) > 0 {
+					write(<-s.audit.records)
+				}
+				flush()
+				if n := s.audit.dropped.Load(); n > 0 {
+					s.logger.Warn("Audit records were dropped because the audit log fell behind", "dropped", n)
+				}
+				return
+			}
+		}
+	}()
+}
+
+// recordAudit queues rec for the audit log without blocking
+func (s *Server) recordAudit(rec AuditRecord) {
+	if s.audit == nil {
+		return
+	}
+	select {
+	case s.audit.records <- rec:
+	default:
+		if s.audit.dropped.Add(1) == 1 {
+			s.logger.Warn("Audit log buffer full, dropping records", "buffer", cap(s.audit.records))
+		}
+	}
+}
+
+// countingBody counts the bytes read from an upstream response body
+type countingBody struct {
+	io.ReadCloser
+	count *atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.count.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"strings"
+
+	"fluidity/internal/shared/circuitbreaker"
+)
+
+// SetCircuitBreakerOverrides gives domains matching a pattern their own circuit breaker with the
+// pattern's config, so a flaky but important dependency can be given more tolerance and a known-bad
+// one can trip fast. A pattern is a host name ("api.example.com") or a wildcard for its subdomains
+// ("*.example.com"); exact names win over wildcards, and longer wildcards over shorter ones.
+// Domains matching no pattern share the default breaker (call before Start).
+func (s *Server) SetCircuitBreakerOverrides(overrides map[string]circuitbreaker.Config) {
+	s.breakerConfigs = make(map[string]circuitbreaker.Config, len(overrides))
+	for pattern, config := range overrides {
+		if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern != "" {
+			s.breakerConfigs[pattern] = config
+		}
+	}
+	s.breakers = make(map[string]*circuitbreaker.CircuitBreaker)
+}
+
+// breakerFor returns the circuit breaker guarding domain, creating the domain's own breaker on
+// first use when an override matches it
+func (s *Server) breakerFor(domain string) *circuitbreaker.CircuitBreaker {
+	if len(s.breakerConfigs) == 0 {
+		return s.circuitBreaker
+	}
+	domain = strings.ToLower(domain)
+
+	s.breakerMutex.Lock()
+	defer s.breakerMutex.Unlock()
+
+	if cb, ok := s.breakers[domain]; ok {
+		return cb
+	}
+	config, ok := s.breakerConfigFor(domain)
+	if !ok {
+		return s.circuitBreaker
+	}
+	cb := circuitbreaker.New(config)
+	s.breakers[domain] = cb
+	return cb
+}
+
+// breakerConfigFor returns the config of the most specific override pattern matching domain
+func (s *Server) breakerConfigFor(domain string) (circuitbreaker.Config, bool) {
+	if config, ok := s.breakerConfigs[domain]; ok {
+		return config, true
+	}
+	// Try the wildcard for each parent domain, most specific first
+	for rest := domain; ; {
+		_, parent, found := strings.Cut(rest, ".")
+		if !found || parent == "" {
+			return circuitbreaker.Config{}, false
+		}
+		if config, ok := s.breakerConfigs["*."+parent]; ok {
+			return config, true
+		}
+		rest = parent
+	}
+}
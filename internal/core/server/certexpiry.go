@@ -0,0 +1,49 @@
+package server
+
+import (
+	"crypto/x509"
+	"time"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// DefaultCertExpiryWarning is how close to expiry an agent's client certificate must be for the server to
+// send it a cert_expiring advisory
+const DefaultCertExpiryWarning = 15 * time.Minute
+
+// SetCertExpiryWarning sends agents whose client certificate expires within threshold a cert_expiring
+// advisory after they connect, so they can renew before the connection is lost. The connection is still
+// accepted (0 uses DefaultCertExpiryWarning, negative disables; call before Start).
+func (s *Server) SetCertExpiryWarning(threshold time.Duration) {
+	switch {
+	case threshold < 0:
+		s.certWarning = 0
+	case threshold > 0:
+		s.certWarning = threshold
+	}
+}
+
+// adviseCertExpiry sends session a cert_expiring advisory when cert expires within the warning threshold
+func (s *Server) adviseCertExpiry(session *agentSession, cert *x509.Certificate) {
+	if s.certWarning <= 0 {
+		return
+	}
+	remaining := time.Until(cert.NotAfter)
+	if remaining > s.certWarning {
+		return
+	}
+
+	s.logger.Warn("Agent client certificate expires soon",
+		"client", cert.Subject.CommonName,
+		"not_after", cert.NotAfter.UTC().Format(time.RFC3339),
+		"remaining", remaining.Round(time.Second).String())
+	session.mu.Lock()
+	err := session.encoder.Encode(protocol.Envelope{
+		Type:    "cert_expiring",
+		Payload: &protocol.CertExpiring{NotAfter: cert.NotAfter, RemainingMs: remaining.Milliseconds()},
+	})
+	session.mu.Unlock()
+	if err != nil {
+		s.logger.Debug("Failed to send cert_expiring", "client", cert.Subject.CommonName, "error", err.Error())
+	}
+}
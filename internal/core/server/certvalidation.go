@@ -0,0 +1,108 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sync"
+)
+
+// Reasons a client certificate is rejected, used as the Reason dimension of the CertValidationFailures
+// metric and as the keys of CertValidationStats.Failures
+const (
+	CertFailureNoCertificate = "no_certificate"
+	CertFailureUntrustedCA   = "untrusted_ca"
+	CertFailureExpired       = "expired"
+	CertFailureInvalid       = "invalid"
+	CertFailureKeyPolicy     = "key_policy"
+)
+
+// CertValidationStats counts client certificate validations since the server started
+type CertValidationStats struct {
+	Successes int64            `json:"successes"`
+	Failures  map[string]int64 `json:"failures,omitempty"` // Keyed by failure reason
+}
+
+// certValidationCounter accumulates CertValidationStats
+type certValidationCounter struct {
+	mu        sync.Mutex
+	successes int64
+	failures  map[string]int64
+}
+
+// CertValidationStats returns the client certificate validations counted since the server started
+func (s *Server) CertValidationStats() CertValidationStats {
+	c := &s.certValidation
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := CertValidationStats{Successes: c.successes}
+	if len(c.failures) > 0 {
+		stats.Failures = make(map[string]int64, len(c.failures))
+		for reason, count := range c.failures {
+			stats.Failures[reason] = count
+		}
+	}
+	return stats
+}
+
+// certAccepted counts an agent whose client certificate passed validation
+func (s *Server) certAccepted() {
+	s.certValidation.mu.Lock()
+	s.certValidation.successes++
+	s.certValidation.mu.Unlock()
+
+	if s.metricsEmitter != nil {
+		s.metricsEmitter.RecordCertValidationSuccess()
+	}
+}
+
+// certRejected counts and logs an agent whose client certificate was rejected for reason. client is the
+// certificate's common name, empty when none was presented.
+func (s *Server) certRejected(reason, client string, remote net.Addr, detail error) {
+	c := &s.certValidation
+	c.mu.Lock()
+	if c.failures == nil {
+		c.failures = make(map[string]int64)
+	}
+	c.failures[reason]++
+	c.mu.Unlock()
+
+	if s.metricsEmitter != nil {
+		s.metricsEmitter.RecordCertValidationFailure(reason)
+	}
+
+	remoteIP := remote.String()
+	if host, _, err := net.SplitHostPort(remoteIP); err == nil {
+		remoteIP = host
+	}
+	kv := []interface{}{"reason", reason, "client", client, "remote_ip", remoteIP}
+	if detail != nil {
+		kv = append(kv, "error", detail.Error())
+	}
+	s.logger.Warn("Client certificate validation failed", kv...)
+}
+
+// handshakeCertFailure classifies a failed handshake caused by the client's certificate, returning the
+// rejection reason and the certificate's common name, or ok false when the failure had another cause
+func handshakeCertFailure(err error) (reason, client string, ok bool) {
+	var verifyErr *tls.CertificateVerificationError
+	if !errors.As(err, &verifyErr) {
+		return "", "", false
+	}
+	if len(verifyErr.UnverifiedCertificates) > 0 {
+		client = verifyErr.UnverifiedCertificates[0].Subject.CommonName
+	}
+
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return CertFailureUntrustedCA, client, true
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return CertFailureExpired, client, true
+	default:
+		return CertFailureInvalid, client, true
+	}
+}
@@ -1,6 +1,11 @@
 package server
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+
+	"fluidity/internal/shared/circuitbreaker"
+)
 
 // Config holds server configuration
 type Config struct {
@@ -13,6 +18,203 @@ type Config struct {
 	MaxConnections     int    `mapstructure:"max_connections" yaml:"max_connections"`
 	SecretsManagerName string `mapstructure:"secrets_manager_name" yaml:"secrets_manager_name"`
 	UseSecretsManager  bool   `mapstructure:"use_secrets_manager" yaml:"use_secrets_manager"`
+
+	// DisableIAMAuth accepts agents on mTLS alone instead of requiring the IAM authentication exchange
+	DisableIAMAuth bool `mapstructure:"disable_iam_auth" yaml:"disable_iam_auth"`
+
+	// HandshakeTimeout aborts TLS handshakes that take longer than this (0 uses the default of 10s, negative disables)
+	HandshakeTimeout time.Duration `mapstructure:"handshake_timeout" yaml:"handshake_timeout"`
+
+	// ListenReuseAddr sets SO_REUSEADDR on the listening socket so a restart can rebind while the previous process's connections are in TIME_WAIT (Go already sets it on Unix; unsupported on Windows)
+	ListenReuseAddr bool `mapstructure:"listen_reuse_addr" yaml:"listen_reuse_addr"`
+	// ListenReusePort sets SO_REUSEPORT so several server processes can listen on the same port (Linux, macOS and FreeBSD only)
+	ListenReusePort bool `mapstructure:"listen_reuse_port" yaml:"listen_reuse_port"`
+	// ListenBacklog is the length of the queue of connections waiting to be accepted (0 uses the OS default)
+	ListenBacklog int `mapstructure:"listen_backlog" yaml:"listen_backlog"`
+
+	// AllowedServerNames refuses TLS handshakes whose SNI is not one of these names, IPs or *.domain wildcards; handshakes without SNI are accepted (empty accepts any)
+	AllowedServerNames []string `mapstructure:"allowed_server_names" yaml:"allowed_server_names"`
+	// CertExpiryWarning sends agents whose client certificate expires within this a cert_expiring advisory (0 uses the default of 15m, negative disables)
+	CertExpiryWarning time.Duration `mapstructure:"cert_expiry_warning" yaml:"cert_expiry_warning"`
+
+	// ClientKeyAlgorithms lists the client certificate key algorithms accepted: rsa, ecdsa, ed25519 (empty accepts all)
+	ClientKeyAlgorithms []string `mapstructure:"client_key_algorithms" yaml:"client_key_algorithms"`
+	// MinClientRSABits rejects client certificates with smaller RSA keys, even when the CA signed them (0 accepts any)
+	MinClientRSABits int `mapstructure:"min_client_rsa_bits" yaml:"min_client_rsa_bits"`
+	// MinClientECDSABits rejects client certificates on smaller ECDSA curves, e.g. 256 for P-256 (0 accepts any)
+	MinClientECDSABits int `mapstructure:"min_client_ecdsa_bits" yaml:"min_client_ecdsa_bits"`
+
+	// AcceptRampRate caps new agent connections per second during AcceptRampWindow after start, turning the rest away with server_busy (0 disables)
+	AcceptRampRate float64 `mapstructure:"accept_ramp_rate" yaml:"accept_ramp_rate"`
+	// AcceptRampWindow is how long after start AcceptRampRate applies (0 disables)
+	AcceptRampWindow time.Duration `mapstructure:"accept_ramp_window" yaml:"accept_ramp_window"`
+
+	// MaxConnectionsPerIP caps agent connections from a single source IP (0 disables)
+	MaxConnectionsPerIP int `mapstructure:"max_connections_per_ip" yaml:"max_connections_per_ip"`
+	// MaxConnectStreamsPerAgent caps the CONNECT tunnels one agent connection may have open at once (0 disables)
+	MaxConnectStreamsPerAgent int `mapstructure:"max_connect_streams_per_agent" yaml:"max_connect_streams_per_agent"`
+	// MaxWebSocketsPerAgent caps the WebSockets one agent connection may have open at once (0 disables)
+	MaxWebSocketsPerAgent int `mapstructure:"max_websockets_per_agent" yaml:"max_websockets_per_agent"`
+	// ConnectCoalesceDelay gathers small CONNECT target reads for up to this long into one connect_data (0 sends each read immediately)
+	ConnectCoalesceDelay time.Duration `mapstructure:"connect_coalesce_delay" yaml:"connect_coalesce_delay"`
+	// ConnectCoalesceBytes sends gathered CONNECT data as soon as this much is buffered (0 uses the default of 16KB)
+	ConnectCoalesceBytes int `mapstructure:"connect_coalesce_bytes" yaml:"connect_coalesce_bytes"`
+
+	// AllowedMethods restricts which HTTP methods are forwarded (empty allows all)
+	AllowedMethods []string `mapstructure:"allowed_methods" yaml:"allowed_methods"`
+	// AllowedSchemes restricts which request URL schemes are forwarded (empty allows http and https)
+	AllowedSchemes []string `mapstructure:"allowed_schemes" yaml:"allowed_schemes"`
+	// StrictFraming rejects requests with both Content-Length and Transfer-Encoding or duplicate Content-Length headers instead of removing those headers
+	StrictFraming bool `mapstructure:"strict_framing" yaml:"strict_framing"`
+
+	// HealthPort is the plain HTTP health check port (0 disables the health server)
+	HealthPort int `mapstructure:"health_port" yaml:"health_port"`
+	// HealthRequired makes a health port bind failure fatal instead of a warning
+	HealthRequired bool `mapstructure:"health_required" yaml:"health_required"`
+
+	// BodySpillThreshold spills request bodies larger than this many bytes to disk, as they arrive when the agent streams them (0 disables)
+	BodySpillThreshold int64 `mapstructure:"body_spill_threshold" yaml:"body_spill_threshold"`
+	// BodySpillDir is the directory for spilled bodies (empty uses the OS temp dir)
+	BodySpillDir string `mapstructure:"body_spill_dir" yaml:"body_spill_dir"`
+
+	// MaxInflightBytes caps the bytes buffered in memory across all requests and tunnels, shedding new work with a 503 beyond it (0 disables)
+	MaxInflightBytes int64 `mapstructure:"max_inflight_bytes" yaml:"max_inflight_bytes"`
+	// MaxInflightMemoryFraction sets the cap as a fraction (0-1) of the memory available to the process, when MaxInflightBytes is 0
+	MaxInflightMemoryFraction float64 `mapstructure:"max_inflight_memory_fraction" yaml:"max_inflight_memory_fraction"`
+
+	// HookCommand is a program and its arguments run for every HTTP request and buffered response, reading the message as JSON on stdin and writing a verdict to stdout that may rewrite or reject it (empty disables)
+	HookCommand []string `mapstructure:"hook_command" yaml:"hook_command"`
+	// HookTimeout bounds each hook run (0 uses the default of 1s)
+	HookTimeout time.Duration `mapstructure:"hook_timeout" yaml:"hook_timeout"`
+	// HookBodies sends bodies to the hook as well as methods, URLs, statuses and headers
+	HookBodies bool `mapstructure:"hook_bodies" yaml:"hook_bodies"`
+	// HookFailOpen passes traffic through unchanged when the hook fails or times out, instead of failing the request
+	HookFailOpen bool `mapstructure:"hook_fail_open" yaml:"hook_fail_open"`
+
+	// StrictCompatibility refuses agents whose protocol version is incompatible instead of warning
+	StrictCompatibility bool `mapstructure:"strict_compatibility" yaml:"strict_compatibility"`
+
+	// MaxRequestDuration caps the total time an HTTP request may take, retries and response body included (0 uses the default of 5m, negative disables)
+	MaxRequestDuration time.Duration `mapstructure:"max_request_duration" yaml:"max_request_duration"`
+	// SlowRequestThreshold logs requests slower than this as warnings (0 uses the default, negative disables)
+	SlowRequestThreshold time.Duration `mapstructure:"slow_request_threshold" yaml:"slow_request_threshold"`
+
+	// RetryBudgetRatio caps upstream retries at this share of requests (0 uses the default of 0.1, negative disables)
+	RetryBudgetRatio float64 `mapstructure:"retry_budget_ratio" yaml:"retry_budget_ratio"`
+
+	// MaxConnectionsPerHost caps the upstream requests in flight to any one host (0 removes the cap)
+	MaxConnectionsPerHost int `mapstructure:"max_connections_per_host" yaml:"max_connections_per_host"`
+	// HostQueueWait is how long a request beyond the cap waits for a slot before a 503 (0 uses the default of 10s, negative refuses at once)
+	HostQueueWait time.Duration `mapstructure:"host_queue_wait" yaml:"host_queue_wait"`
+
+	// HedgeDelay sends a second upstream request for idempotent requests to HedgeHosts not answered within it (0 disables hedging)
+	HedgeDelay time.Duration `mapstructure:"hedge_delay" yaml:"hedge_delay"`
+	// HedgeHosts are the upstream hosts whose requests may be hedged
+	HedgeHosts []string `mapstructure:"hedge_hosts" yaml:"hedge_hosts"`
+	// HedgeBudgetRatio caps hedged requests at this share of eligible requests (0 uses the default of 0.1)
+	HedgeBudgetRatio float64 `mapstructure:"hedge_budget_ratio" yaml:"hedge_budget_ratio"`
+
+	// RequestWorkers processes requests on a fixed worker pool of this size (0 uses a goroutine per request)
+	RequestWorkers int `mapstructure:"request_workers" yaml:"request_workers"`
+	// RequestQueueDepth bounds the requests waiting for a worker; requests beyond it get a 503
+	RequestQueueDepth int `mapstructure:"request_queue_depth" yaml:"request_queue_depth"`
+
+	// AffinityMaxPools bounds the affinity keys pinned to their own upstream connection at once (0 disables affinity)
+	AffinityMaxPools int `mapstructure:"affinity_max_pools" yaml:"affinity_max_pools"`
+	// AffinityIdleTimeout closes affinity pools unused for this long (0 uses the default of 2m)
+	AffinityIdleTimeout time.Duration `mapstructure:"affinity_idle_timeout" yaml:"affinity_idle_timeout"`
+
+	// WebSocketPingInterval pings tunnelled target WebSockets this often (0 uses the default of 30s, negative disables)
+	WebSocketPingInterval time.Duration `mapstructure:"websocket_ping_interval" yaml:"websocket_ping_interval"`
+	// WebSocketPongTimeout closes a tunnelled WebSocket whose target misses a pong for this long (0 uses the default of 10s)
+	WebSocketPongTimeout time.Duration `mapstructure:"websocket_pong_timeout" yaml:"websocket_pong_timeout"`
+
+	// LogFullURL logs full request URLs at debug level (info logs stay domain-only; URLs may contain sensitive data)
+	LogFullURL bool `mapstructure:"log_full_url" yaml:"log_full_url"`
+	// LogStreamID limits debug logs to the request, tunnel or WebSocket with this ID (empty logs every stream)
+	LogStreamID string `mapstructure:"log_stream_id" yaml:"log_stream_id"`
+	// LogLevels overrides log_level for individual components such as tunnel-server or metrics
+	LogLevels map[string]string `mapstructure:"log_levels" yaml:"log_levels"`
+
+	// AuditLogPath appends a JSON line of metadata (no bodies or paths) for every proxied request and CONNECT tunnel to this file (empty disables auditing)
+	AuditLogPath string `mapstructure:"audit_log_path" yaml:"audit_log_path"`
+	// AuditLogBuffer is the number of audit records buffered for the writer before new ones are dropped (0 uses the default of 4096)
+	AuditLogBuffer int `mapstructure:"audit_log_buffer" yaml:"audit_log_buffer"`
+
+	// TCPKeepalive enables TCP keepalive probes with the idle and interval below (off keeps Go's defaults)
+	TCPKeepalive bool `mapstructure:"tcp_keepalive" yaml:"tcp_keepalive"`
+	// TCPKeepaliveIdle is the idle time before the first probe (0 uses the default of 15s)
+	TCPKeepaliveIdle time.Duration `mapstructure:"tcp_keepalive_idle" yaml:"tcp_keepalive_idle"`
+	// TCPKeepaliveInterval is the time between probes (0 uses the default of 15s)
+	TCPKeepaliveInterval time.Duration `mapstructure:"tcp_keepalive_interval" yaml:"tcp_keepalive_interval"`
+	// HeartbeatInterval pings the peer after this long without tunnel writes, keeping idle tunnels inside
+	// load balancer idle timeouts such as the NLB's 350s (0 uses the default of 60s, negative disables)
+	HeartbeatInterval time.Duration `mapstructure:"heartbeat_interval" yaml:"heartbeat_interval"`
+
+	// PrewarmHosts lists upstream hosts or URLs dialled at startup so first requests reuse a pooled connection
+	PrewarmHosts []string `mapstructure:"prewarm_hosts" yaml:"prewarm_hosts"`
+	// PrewarmInterval revisits prewarmed hosts this often to keep their connections idle in the pool (0 uses the default of 60s, negative warms only at startup)
+	PrewarmInterval time.Duration `mapstructure:"prewarm_interval" yaml:"prewarm_interval"`
+
+	// CircuitBreakerOverrides give matching upstream domains their own circuit breaker settings (others share the default breaker)
+	CircuitBreakerOverrides []CircuitBreakerOverride `mapstructure:"circuit_breaker_overrides" yaml:"circuit_breaker_overrides"`
+
+	// LoadShedSignal enables load shedding on active_requests or goroutines (empty disables)
+	LoadShedSignal string `mapstructure:"load_shed_signal" yaml:"load_shed_signal"`
+	// LoadShedThreshold is the signal value above which new requests are shed
+	LoadShedThreshold float64 `mapstructure:"load_shed_threshold" yaml:"load_shed_threshold"`
+	// LoadShedFraction is the share (0-1) of new requests rejected while over the threshold (0 uses 0.5)
+	LoadShedFraction float64 `mapstructure:"load_shed_fraction" yaml:"load_shed_fraction"`
+	// LoadShedPause pauses agents for at most this long at a time while over the threshold (0 disables)
+	LoadShedPause time.Duration `mapstructure:"load_shed_pause" yaml:"load_shed_pause"`
+
+	// RedirectPolicy is how upstream redirects are handled: follow (default), no-follow or follow-same-host-only
+	RedirectPolicy string `mapstructure:"redirect_policy" yaml:"redirect_policy"`
+
+	// HostOverrideAllowlist lists hosts agents may use as upstream Host/SNI overrides (empty refuses overrides)
+	HostOverrideAllowlist []string `mapstructure:"host_override_allowlist" yaml:"host_override_allowlist"`
+
+	// RequiredHeader admits only requests, tunnels and WebSockets whose client request carries this header (empty disables the check)
+	RequiredHeader string `mapstructure:"required_header" yaml:"required_header"`
+	// RequiredHeaderValues are the accepted values of RequiredHeader, typically shared secrets
+	RequiredHeaderValues []string `mapstructure:"required_header_values" yaml:"required_header_values" secret:"true"`
+
+	// ReaperInterval is how often idle tunnelled connections are audited (0 disables the reaper)
+	ReaperInterval time.Duration `mapstructure:"reaper_interval" yaml:"reaper_interval"`
+	// ReaperMaxIdle closes tunnelled connections idle for longer than this
+	ReaperMaxIdle time.Duration `mapstructure:"reaper_max_idle" yaml:"reaper_max_idle"`
+
+	// ProxyProtocol expects a PROXY protocol v1/v2 header on every connection (e.g. behind an NLB)
+	ProxyProtocol bool `mapstructure:"proxy_protocol" yaml:"proxy_protocol"`
+
+	// StopGracePeriod is how long shutdown waits for in-flight work after notifying agents (0 uses the default of 10s)
+	StopGracePeriod time.Duration `mapstructure:"stop_grace_period" yaml:"stop_grace_period"`
+	// StopPauseAgents pauses agents when shutdown begins, so pooled agents move new work to other servers
+	StopPauseAgents bool `mapstructure:"stop_pause_agents" yaml:"stop_pause_agents"`
+}
+
+// CircuitBreakerOverride is the circuit breaker configuration for upstream domains matching Pattern,
+// a host name or a "*.example.com" wildcard. Zero fields use the breaker defaults.
+type CircuitBreakerOverride struct {
+	Pattern             string        `mapstructure:"pattern" yaml:"pattern"`
+	MaxFailures         int           `mapstructure:"max_failures" yaml:"max_failures"`
+	ResetTimeout        time.Duration `mapstructure:"reset_timeout" yaml:"reset_timeout"`
+	HalfOpenTimeout     time.Duration `mapstructure:"half_open_timeout" yaml:"half_open_timeout"`
+	MaxHalfOpenRequests int           `mapstructure:"max_half_open_requests" yaml:"max_half_open_requests"`
+}
+
+// BreakerConfigs returns the overrides keyed by pattern, for SetCircuitBreakerOverrides
+func (c *Config) BreakerConfigs() map[string]circuitbreaker.Config {
+	configs := make(map[string]circuitbreaker.Config, len(c.CircuitBreakerOverrides))
+	for _, o := range c.CircuitBreakerOverrides {
+		configs[o.Pattern] = circuitbreaker.Config{
+			MaxFailures:     o.MaxFailures,
+			ResetTimeout:    o.ResetTimeout,
+			HalfOpenTimeout: o.HalfOpenTimeout,
+			MaxHalfOpenReqs: o.MaxHalfOpenRequests,
+		}
+	}
+	return configs
 }
 
 // GetListenAddress returns the full listen address
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+// connectWriteQueue is how many chunks from the agent may wait for a CONNECT target that is slower to
+// accept them than the agent is to send them
+const connectWriteQueue = 64
+
+// connectWriteTimeout bounds a single write to a CONNECT target
+const connectWriteTimeout = 30 * time.Second
+
+// connectQueueWait is how long the agent's read loop waits for room in a full queue. A target that drains
+// nothing for this long is closed, so it holds up the agent's other requests once and only briefly.
+const connectQueueWait = 2 * time.Second
+
+// Errors queueing data for a CONNECT target
+var (
+	errWriteQueueFull = errors.New("target is not accepting data")
+	errTunnelClosed   = errors.New("tunnel is closed")
+)
+
+// targetWrite is a chunk for a CONNECT target, or when then is set an action to run once every chunk
+// queued before it has been written
+type targetWrite struct {
+	chunk []byte
+	then  func()
+}
+
+// startWriter writes chunks queued for the target on their own goroutine, so a target that stops reading
+// cannot stall the agent's connection and every other request on it. onFail is called once if a write
+// fails or times out.
+func (c *trackedConn) startWriter(onFail func(error)) {
+	c.writes = make(chan targetWrite, connectWriteQueue)
+	go func() {
+		for {
+			var w targetWrite
+			select {
+			case <-c.done:
+				return
+			case w = <-c.writes:
+			}
+
+			if w.then != nil {
+				w.then()
+				continue
+			}
+			c.Conn.SetWriteDeadline(time.Now().Add(connectWriteTimeout))
+			if _, err := c.Conn.Write(w.chunk); err != nil {
+				select {
+				case <-c.done:
+					// Closed while writing; nothing to report
+				default:
+					onFail(err)
+				}
+				return
+			}
+		}
+	}()
+}
+
+// queueWrite queues w for the writer, waiting up to connectQueueWait for room. It fails when the target
+// has stopped accepting data or the connection is closed.
+func (c *trackedConn) queueWrite(w targetWrite) error {
+	select {
+	case c.writes <- w:
+		return nil
+	case <-c.done:
+		return errTunnelClosed
+	default:
+	}
+
+	timer := time.NewTimer(connectQueueWait)
+	defer timer.Stop()
+	select {
+	case c.writes <- w:
+		return nil
+	case <-c.done:
+		return errTunnelClosed
+	case <-timer.C:
+		return errWriteQueueFull
+	}
+}
+
+// closeAfterWrites closes the connection once the chunks already queued have been written, or at once
+// when the target is not draining its queue
+func (c *trackedConn) closeAfterWrites() {
+	select {
+	case c.writes <- targetWrite{then: func() { c.Close() }}:
+	default:
+		c.Close()
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net"
+)
+
+// SetMaxConnectionsPerIP caps the agent connections accepted from a single source IP so that one
+// host cannot take every slot under the global connection limit (0 disables; call before Start)
+func (s *Server) SetMaxConnectionsPerIP(limit int) {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	s.maxConnsPerIP = limit
+	if limit > 0 && s.sourceConns == nil {
+		s.sourceConns = make(map[string]int)
+	}
+}
+
+// acquireSource counts a connection against its source IP and reports false when that IP is already
+// at its limit. It returns the key to pass to releaseSource, empty when per-IP limits are disabled.
+func (s *Server) acquireSource(addr net.Addr) (string, bool) {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+
+	if s.maxConnsPerIP <= 0 {
+		return "", true
+	}
+
+	ip := sourceIP(addr)
+	if s.sourceConns[ip] >= s.maxConnsPerIP {
+		return "", false
+	}
+	s.sourceConns[ip]++
+	return ip, true
+}
+
+// releaseSource returns a connection slot taken by acquireSource
+func (s *Server) releaseSource(ip string) {
+	if ip == "" {
+		return
+	}
+
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	if s.sourceConns[ip] <= 1 {
+		delete(s.sourceConns, ip)
+		return
+	}
+	s.sourceConns[ip]--
+}
+
+// sourceIP returns the IP part of a remote address
+func sourceIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
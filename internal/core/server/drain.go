@@ -0,0 +1,113 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// DefaultStopGracePeriod bounds how long Stop waits for in-flight work and agent connections to finish
+const DefaultStopGracePeriod = 10 * time.Second
+
+// drainPollInterval is how often Stop checks whether in-flight work has finished
+const drainPollInterval = 100 * time.Millisecond
+
+// agentSession is a connected agent; encoder is set once the agent has authenticated
+type agentSession struct {
+	encoder        *json.Encoder
+	mu             *sync.Mutex
+	connectStreams atomic.Int32 // Open CONNECT tunnels, for the per-agent stream limit
+	wsStreams      atomic.Int32 // Open WebSockets, for the per-agent stream limit
+}
+
+// SetStopGracePeriod sets how long Stop lets in-flight requests and tunnels finish after notifying
+// agents of the shutdown, before closing what remains. It should be below the container's stop
+// timeout so the drain completes before the process is killed (call before Start).
+func (s *Server) SetStopGracePeriod(d time.Duration) {
+	if d > 0 {
+		s.stopGrace = d
+	}
+}
+
+// notifyShutdown tells every authenticated agent that the server is shutting down
+func (s *Server) notifyShutdown() {
+	notice := protocol.Envelope{
+		Type:    "server_shutting_down",
+		Payload: &protocol.ServerShutdown{GracePeriodMs: s.stopGrace.Milliseconds()},
+	}
+	agents := s.broadcast(notice)
+	s.logger.Info("Notified agents of shutdown", "agents", agents, "grace_period", s.stopGrace.String())
+}
+
+// broadcast sends env to every authenticated agent and returns how many it was sent to
+func (s *Server) broadcast(env protocol.Envelope) int {
+	s.connMutex.RLock()
+	sessions := make([]*agentSession, 0, len(s.agentConns))
+	for _, session := range s.agentConns {
+		if session.encoder != nil {
+			sessions = append(sessions, session)
+		}
+	}
+	s.connMutex.RUnlock()
+
+	sent := 0
+	for _, session := range sessions {
+		session.mu.Lock()
+		err := session.encoder.Encode(env)
+		session.mu.Unlock()
+		if err != nil {
+			s.logger.Debug("Failed to send notice to agent", "type", env.Type, "error", err.Error())
+			continue
+		}
+		sent++
+	}
+	return sent
+}
+
+// closeAgentConns closes every agent connection so their handlers return
+func (s *Server) closeAgentConns() {
+	s.connMutex.RLock()
+	conns := make([]*tls.Conn, 0, len(s.agentConns))
+	for conn := range s.agentConns {
+		conns = append(conns, conn)
+	}
+	s.connMutex.RUnlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// inFlight returns the number of requests and tunnels still being served
+func (s *Server) inFlight() int {
+	n := int(s.activeRequests.Load())
+
+	s.tcpMutex.RLock()
+	n += len(s.tcpConns)
+	s.tcpMutex.RUnlock()
+
+	s.wsMutex.RLock()
+	n += len(s.wsConns)
+	s.wsMutex.RUnlock()
+
+	return n
+}
+
+// drain waits until no requests or tunnels are in flight, or until deadline
+func (s *Server) drain(deadline time.Time) {
+	for {
+		n := s.inFlight()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			s.logger.Warn("Grace period expired with work in flight", "in_flight", n)
+			return
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
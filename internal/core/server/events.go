@@ -0,0 +1,178 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connection lifecycle events. Each is logged at info level as "Connection lifecycle event" with the
+// event name in the "event" field and these fields, which form a stable schema for session reports:
+//
+//	connection_accepted  remote_addr
+//	auth_succeeded       remote_addr, client, method ("mtls" or "iam")
+//	auth_failed          remote_addr, client (when known), reason
+//	first_request        remote_addr, client, since_connect_ms
+//	disconnected         remote_addr, client (when known), reason, duration_ms, requests, bytes_in, bytes_out
+//
+// Every accepted connection ends with exactly one disconnected event.
+const (
+	EventConnectionAccepted = "connection_accepted"
+	EventAuthSucceeded      = "auth_succeeded"
+	EventAuthFailed         = "auth_failed"
+	EventFirstRequest       = "first_request"
+	EventDisconnected       = "disconnected"
+)
+
+// Reasons reported by disconnected events
+const (
+	DisconnectAgentClosed          = "agent_closed"
+	DisconnectReadError            = "read_error"
+	DisconnectServerShutdown       = "server_shutdown"
+	DisconnectHandshakeFailed      = "handshake_failed"
+	DisconnectAuthFailed           = "auth_failed"
+	DisconnectConnectionLimit      = "connection_limit"
+	DisconnectIncompatibleProtocol = "incompatible_protocol"
+)
+
+// Authentication methods reported by auth_succeeded events
+const (
+	AuthMethodMTLS = "mtls"
+	AuthMethodIAM  = "iam"
+)
+
+// ConnectionEvent is one step in an agent connection's lifecycle. Fields that do not apply to the
+// event are left zero.
+type ConnectionEvent struct {
+	Event      string
+	Time       time.Time
+	RemoteAddr string
+	Client     string        // Client certificate common name, once the handshake has completed
+	Method     string        // Authentication method, for auth_succeeded
+	Reason     string        // Failure or disconnect reason, for auth_failed and disconnected
+	Elapsed    time.Duration // Time since the connection was accepted, for first_request and disconnected
+	Requests   int64         // HTTP requests, CONNECT tunnels and WebSockets opened, for disconnected
+	BytesIn    int64         // Tunnel protocol bytes read from the agent, for disconnected
+	BytesOut   int64         // Tunnel protocol bytes written to the agent, for disconnected
+}
+
+// EventHandler receives connection lifecycle events, for example to feed a metrics sink. It is called
+// synchronously on the connection's goroutine and must not block.
+type EventHandler func(ConnectionEvent)
+
+// SetEventHandler sends connection lifecycle events to handler as well as the log (call before Start)
+func (s *Server) SetEventHandler(handler EventHandler) {
+	s.eventHandler = handler
+}
+
+// connectionTracker accumulates one agent connection's lifecycle for its events
+type connectionTracker struct {
+	server       *Server
+	start        time.Time
+	remoteAddr   string
+	client       string
+	requests     atomic.Int64
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+	firstRequest sync.Once
+}
+
+// trackConnection starts tracking a connection and emits its connection_accepted event
+func (s *Server) trackConnection(remoteAddr string) *connectionTracker {
+	t := &connectionTracker{server: s, start: time.Now(), remoteAddr: remoteAddr}
+	t.emit(ConnectionEvent{Event: EventConnectionAccepted})
+	return t
+}
+
+// reader counts the bytes read through r
+func (t *connectionTracker) reader(r io.Reader) io.Reader {
+	return &countingReader{Reader: r, count: &t.bytesIn}
+}
+
+// writer counts the bytes written through w
+func (t *connectionTracker) writer(w io.Writer) io.Writer {
+	return &countingWriter{Writer: w, count: &t.bytesOut}
+}
+
+// authenticated emits auth_succeeded
+func (t *connectionTracker) authenticated(method string) {
+	t.emit(ConnectionEvent{Event: EventAuthSucceeded, Method: method})
+}
+
+// authFailed emits auth_failed
+func (t *connectionTracker) authFailed(reason string) {
+	t.emit(ConnectionEvent{Event: EventAuthFailed, Reason: reason})
+}
+
+// request counts a request, emitting first_request for the first
+func (t *connectionTracker) request() {
+	t.requests.Add(1)
+	t.firstRequest.Do(func() {
+		t.emit(ConnectionEvent{Event: EventFirstRequest, Elapsed: time.Since(t.start)})
+	})
+}
+
+// disconnected emits the connection's final event
+func (t *connectionTracker) disconnected(reason string) {
+	t.emit(ConnectionEvent{
+		Event:    EventDisconnected,
+		Reason:   reason,
+		Elapsed:  time.Since(t.start),
+		Requests: t.requests.Load(),
+		BytesIn:  t.bytesIn.Load(),
+		BytesOut: t.bytesOut.Load(),
+	})
+}
+
+// emit completes ev with the connection's details, logs it and passes it to the event handler
+func (t *connectionTracker) emit(ev ConnectionEvent) {
+	ev.Time = time.Now()
+	ev.RemoteAddr = t.remoteAddr
+	ev.Client = t.client
+
+	fields := []interface{}{"event", ev.Event, "remote_addr", ev.RemoteAddr}
+	if ev.Client != "" {
+		fields = append(fields, "client", ev.Client)
+	}
+	switch ev.Event {
+	case EventAuthSucceeded:
+		fields = append(fields, "method", ev.Method)
+	case EventAuthFailed:
+		fields = append(fields, "reason", ev.Reason)
+	case EventFirstRequest:
+		fields = append(fields, "since_connect_ms", ev.Elapsed.Milliseconds())
+	case EventDisconnected:
+		fields = append(fields, "reason", ev.Reason, "duration_ms", ev.Elapsed.Milliseconds(),
+			"requests", ev.Requests, "bytes_in", ev.BytesIn, "bytes_out", ev.BytesOut)
+	}
+	t.server.logger.Info("Connection lifecycle event", fields...)
+
+	if t.server.eventHandler != nil {
+		t.server.eventHandler(ev)
+	}
+}
+
+// countingReader adds the bytes read through it to count
+type countingReader struct {
+	io.Reader
+	count *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.count.Add(int64(n))
+	return n, err
+}
+
+// countingWriter adds the bytes written through it to count
+type countingWriter struct {
+	io.Writer
+	count *atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.count.Add(int64(n))
+	return n, err
+}
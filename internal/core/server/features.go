@@ -0,0 +1,67 @@
+package server
+
+import "fluidity/internal/shared/protocol"
+
+// FeatureReport describes what a running server supports and has enabled, so operators can confirm a
+// deployment's effective feature set without reading its config
+type FeatureReport struct {
+	BuildVersion       string          `json:"build_version"`
+	ProtocolVersion    int             `json:"protocol_version"`
+	MinProtocolVersion int             `json:"min_protocol_version"`
+	Capabilities       []string        `json:"capabilities"` // Protocol features advertised in the hello handshake
+	Features           map[string]bool `json:"features"`     // Optional server features and whether each is enabled
+}
+
+// GetFeatures reports the server's protocol capabilities and which optional features are enabled
+func (s *Server) GetFeatures() FeatureReport {
+	local := protocol.LocalHello()
+
+	s.connMutex.RLock()
+	perIPLimit := s.maxConnsPerIP > 0
+	s.connMutex.RUnlock()
+
+	return FeatureReport{
+		BuildVersion:       local.BuildVersion,
+		ProtocolVersion:    local.ProtocolVersion,
+		MinProtocolVersion: local.MinProtocolVersion,
+		Capabilities:       protocol.FeatureNames(local.Features),
+		Features: map[string]bool{
+			"iam_auth":                  s.iamRequired,
+			"strict_compatibility":      s.strictCompat,
+			"proxy_protocol":            s.proxyProtocolEnabled(),
+			"listen_reuse_port":         s.listenOpts.ReusePort,
+			"per_ip_connection_limit":   perIPLimit,
+			"per_agent_stream_limit":    s.connectLimit > 0 || s.wsLimit > 0,
+			"handshake_timeout":         s.handshakeWait > 0,
+			"accept_ramp":               s.acceptRamp != nil,
+			"cert_expiry_warning":       s.certWarning > 0,
+			"server_name_allowlist":     s.serverNames != nil,
+			"client_key_policy":         len(s.keyPolicy.Algorithms) > 0 || s.keyPolicy.MinRSABits > 0 || s.keyPolicy.MinECDSABits > 0,
+			"method_allowlist":          s.allowedMethods != nil,
+			"scheme_allowlist":          s.allowedSchemes != nil,
+			"strict_framing":            s.strictFraming,
+			"host_overrides":            len(s.overrideHosts) > 0,
+			"required_header":           s.gate != nil,
+			"request_worker_pool":       s.workers > 0,
+			"load_shedding":             s.shedder != nil,
+			"overload_pause":            s.shedder != nil && s.overloadPause > 0,
+			"drain_pause":               s.drainPause,
+			"retry_budget":              s.retryConfig.Budget != nil,
+			"hedging":                   s.hedging != nil,
+			"per_host_connection_limit": s.hostLimit != nil,
+			"circuit_breaker_overrides": len(s.breakerConfigs) > 0,
+			"affinity":                  s.affinityMax > 0,
+			"body_spill":                s.spillThreshold > 0,
+			"hook":                      s.hook != nil,
+			"memory_budget":             s.budget != nil,
+			"prewarm":                   len(s.prewarmURLs) > 0,
+			"idle_reaper":               s.reapInterval > 0 && s.reapMaxIdle > 0,
+			"websocket_keepalive":       s.wsKeepalive.Enabled(),
+			"tcp_keepalive":             s.tcpKeepalive.Enable,
+			"heartbeat":                 s.heartbeat > 0,
+			"full_url_logging":          s.logFullURL,
+			"metrics":                   s.metricsEmitter != nil,
+			"audit_log":                 s.audit != nil,
+		},
+	}
+}
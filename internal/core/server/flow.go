@@ -0,0 +1,124 @@
+package server
+
+import (
+	"time"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// DefaultMaxAgentPause bounds how long agents hold new work after PauseAgents when no limit is given
+const DefaultMaxAgentPause = 30 * time.Second
+
+// overloadPollInterval is how often the load shedding signal is checked when agents are paused under overload
+const overloadPollInterval = time.Second
+
+// SetOverloadPause pauses every agent while the load shedding signal is over its threshold, for at most
+// maxPause at a time, renewing the pause while the overload lasts and resuming agents once the load falls
+// back. It needs SetLoadShedding; 0 disables (call before Start).
+func (s *Server) SetOverloadPause(maxPause time.Duration) {
+	s.overloadPause = maxPause
+}
+
+// SetDrainPause pauses every agent when Stop begins draining, so agents pooled across servers send new
+// work to the others instead of one that is going away (call before Start)
+func (s *Server) SetDrainPause(enabled bool) {
+	s.drainPause = enabled
+}
+
+// PauseAgents tells every connected agent to hold new requests, tunnels and WebSockets until ResumeAgents,
+// so the server can shed load without refusing work outright. Agents resume by themselves after maxPause
+// (0 uses DefaultMaxAgentPause) in case the resume is lost, and agents connecting during the pause are
+// paused too.
+func (s *Server) PauseAgents(maxPause time.Duration) {
+	if maxPause <= 0 {
+		maxPause = DefaultMaxAgentPause
+	}
+	s.pausedUntil.Store(time.Now().Add(maxPause).UnixNano())
+
+	agents := s.broadcast(flowControlEnvelope(true, maxPause))
+	s.logger.Warn("Paused agents", "agents", agents, "max_pause", maxPause.String())
+}
+
+// ResumeAgents lets agents paused by PauseAgents send new work again
+func (s *Server) ResumeAgents() {
+	s.pausedUntil.Store(0)
+
+	agents := s.broadcast(flowControlEnvelope(false, 0))
+	s.logger.Info("Resumed agents", "agents", agents)
+}
+
+// startOverloadPause watches the load shedding signal, pausing and resuming agents as it crosses the threshold
+func (s *Server) startOverloadPause() {
+	if s.shedder == nil || s.overloadPause <= 0 {
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(overloadPollInterval)
+		defer ticker.Stop()
+
+		overloaded := false
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				overloaded = s.checkOverload(overloaded)
+			}
+		}
+	}()
+
+	s.logger.Info("Agents will be paused under overload", "threshold", s.shedder.threshold, "max_pause", s.overloadPause.String())
+}
+
+// checkOverload pauses agents when the load rises over the shedding threshold and resumes them when it
+// falls back, returning whether the server is now overloaded
+func (s *Server) checkOverload(overloaded bool) bool {
+	load := s.shedder.load()
+	if load > s.shedder.threshold {
+		// Renew the pause before it lapses for as long as the overload lasts
+		if !overloaded || s.pauseRemaining() < 2*overloadPollInterval {
+			s.logger.Warn("Server overloaded, pausing agents", "load", load, "threshold", s.shedder.threshold)
+			s.PauseAgents(s.overloadPause)
+		}
+		return true
+	}
+	if overloaded && !s.draining.Load() {
+		s.logger.Info("Server load recovered", "load", load, "threshold", s.shedder.threshold)
+		s.ResumeAgents()
+	}
+	return false
+}
+
+// pauseRemaining returns how long the current pause has left (0 when agents are not paused)
+func (s *Server) pauseRemaining() time.Duration {
+	until := s.pausedUntil.Load()
+	if until == 0 {
+		return 0
+	}
+	return max(time.Until(time.Unix(0, until)), 0)
+}
+
+// pauseNewAgent pauses a newly authenticated agent when the other agents are paused
+func (s *Server) pauseNewAgent(session *agentSession) {
+	remaining := s.pauseRemaining()
+	if remaining == 0 {
+		return
+	}
+	session.mu.Lock()
+	err := session.encoder.Encode(flowControlEnvelope(true, remaining))
+	session.mu.Unlock()
+	if err != nil {
+		s.logger.Debug("Failed to pause new agent", "error", err.Error())
+	}
+}
+
+// flowControlEnvelope builds a flow_control message pausing for at most maxPause, or resuming
+func flowControlEnvelope(pause bool, maxPause time.Duration) protocol.Envelope {
+	return protocol.Envelope{
+		Type:    "flow_control",
+		Payload: &protocol.FlowControl{Pause: pause, MaxPauseMs: maxPause.Milliseconds()},
+	}
+}
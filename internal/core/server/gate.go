@@ -0,0 +1,71 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// errGateRejected is reported to agents whose request lacks the required header or carries a wrong value
+var errGateRejected = errors.New("missing or invalid required header")
+
+// headerGate admits only requests carrying a header with one of a set of secret values
+type headerGate struct {
+	name   string
+	values [][sha256.Size]byte // Digests of the accepted values, so comparisons take the same time whatever their length
+}
+
+// SetRequiredHeader admits only HTTP requests, CONNECT tunnels and WebSockets whose client request carries
+// header name with one of values, as a shared-secret gate in front of the tunnel. Values are compared in
+// constant time, and the header is removed before anything is sent upstream. An empty name disables the
+// check (call before Start).
+func (s *Server) SetRequiredHeader(name string, values []string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		s.gate = nil
+		return nil
+	}
+	if len(values) == 0 {
+		return fmt.Errorf("required header %s needs at least one accepted value", name)
+	}
+
+	gate := &headerGate{name: http.CanonicalHeaderKey(name)}
+	for _, value := range values {
+		if value == "" {
+			return fmt.Errorf("required header %s has an empty accepted value", name)
+		}
+		gate.values = append(gate.values, sha256.Sum256([]byte(value)))
+	}
+	s.gate = gate
+	return nil
+}
+
+// admit reports whether headers carry the required header with an accepted value, and removes the header
+// so it never reaches the upstream. Every gate passes when no header is required.
+func (s *Server) admit(headers map[string][]string) bool {
+	if s.gate == nil {
+		return true
+	}
+
+	var presented []string
+	for name, values := range headers {
+		if strings.EqualFold(name, s.gate.name) {
+			presented = append(presented, values...)
+			delete(headers, name)
+		}
+	}
+	if len(presented) != 1 {
+		return false
+	}
+
+	// Compare against every accepted value so the time taken does not reveal which one matched
+	digest := sha256.Sum256([]byte(presented[0]))
+	match := 0
+	for _, accepted := range s.gate.values {
+		match |= subtle.ConstantTimeCompare(digest[:], accepted[:])
+	}
+	return match == 1
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// isGRPC reports whether a request is gRPC, which needs HTTP/2 to the upstream
+func isGRPC(req *protocol.Request) bool {
+	for name, values := range req.Headers {
+		if strings.EqualFold(name, "Content-Type") && len(values) > 0 {
+			return protocol.IsGRPCContentType(values[0])
+		}
+	}
+	return false
+}
+
+// h2cClient returns the client for gRPC requests to plaintext upstreams, which speaks HTTP/2 without TLS
+// (h2c with prior knowledge) since gRPC servers do not accept HTTP/1.1. gRPC over TLS negotiates HTTP/2
+// on the shared clients instead.
+func (s *Server) h2cClient() *http.Client {
+	s.sniMutex.Lock()
+	defer s.sniMutex.Unlock()
+
+	if s.h2c != nil {
+		return s.h2c
+	}
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	transport := s.httpClient.Transport.(*http.Transport).Clone()
+	transport.Protocols = &protocols
+
+	s.h2c = &http.Client{
+		Timeout:       s.httpClient.Timeout,
+		Transport:     transport,
+		CheckRedirect: s.httpClient.CheckRedirect,
+	}
+	return s.h2c
+}
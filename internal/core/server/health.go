@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"fluidity/internal/shared/version"
+)
+
+// HealthServer serves the tunnel server's health, feature and version endpoints over plain HTTP
+type HealthServer struct {
+	tunnel   *Server
+	server   *http.Server
+	listener net.Listener
+}
+
+// StartHealthServer binds the health endpoint on port and serves it in the background.
+// A port of 0 disables the health server. When the port cannot be bound and required
+// is false, a warning is logged and nil is returned so the tunnel keeps serving.
+func StartHealthServer(tunnel *Server, port int, required bool) (*HealthServer, error) {
+	if port == 0 {
+		tunnel.logger.Info("Health check server disabled")
+		return nil, nil
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		if required {
+			return nil, fmt.Errorf("failed to bind health port %d: %w", port, err)
+		}
+		tunnel.logger.Warn("Health check server disabled, failed to bind port",
+			"port", port,
+			"error", err.Error())
+		return nil, nil
+	}
+
+	h := &HealthServer{
+		tunnel:   tunnel,
+		listener: listener,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", h.handleHealth)
+	mux.HandleFunc("/features", h.handleFeatures)
+	mux.HandleFunc("/version", h.handleVersion)
+
+	h.server = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		IdleTimeout:  10 * time.Second,
+	}
+
+	go func() {
+		if err := h.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			tunnel.logger.Error("Health check server error", err)
+		}
+	}()
+
+	tunnel.logger.Info("Health check server started", "addr", listener.Addr().String())
+	return h, nil
+}
+
+// Addr returns the address the health server is listening on
+func (h *HealthServer) Addr() string {
+	return h.listener.Addr().String()
+}
+
+// Shutdown gracefully stops the health server
+func (h *HealthServer) Shutdown(ctx context.Context) error {
+	return h.server.Shutdown(ctx)
+}
+
+// handleHealth writes the tunnel server's health status as JSON
+func (h *HealthServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(h.tunnel.GetHealth()); err != nil {
+		h.tunnel.logger.Error("Failed to encode health response", err)
+	}
+}
+
+// handleFeatures writes the tunnel server's capabilities and enabled features as JSON
+func (h *HealthServer) handleFeatures(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(h.tunnel.GetFeatures()); err != nil {
+		h.tunnel.logger.Error("Failed to encode features response", err)
+	}
+}
+
+// handleVersion writes the running build's version, commit, build time and Go version as JSON
+func (h *HealthServer) handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(version.Get()); err != nil {
+		h.tunnel.logger.Error("Failed to encode version response", err)
+	}
+}
+
+// StreamCounts is the number of CONNECT tunnels and WebSockets open across all agents
+type StreamCounts struct {
+	Connect   int `json:"connect"`
+	WebSocket int `json:"websocket"`
+}
+
+// errorRecord is a significant error reported by the health endpoint
+type errorRecord struct {
+	message string
+	at      time.Time
+}
+
+// recordError remembers err as the server's most recent significant error
+func (s *Server) recordError(msg string, err error) {
+	if err != nil {
+		msg = msg + ": " + err.Error()
+	}
+	s.lastError.Store(&errorRecord{message: msg, at: time.Now()})
+}
+
+// activeStreams counts the CONNECT tunnels and WebSockets currently open
+func (s *Server) activeStreams() StreamCounts {
+	s.tcpMutex.RLock()
+	connect := len(s.tcpConns)
+	s.tcpMutex.RUnlock()
+
+	s.wsMutex.RLock()
+	webSocket := len(s.wsConns)
+	s.wsMutex.RUnlock()
+
+	return StreamCounts{Connect: connect, WebSocket: webSocket}
+}
+
+// certificateExpiry returns when the first static certificate in config stops being valid, or zero when
+// certificates are chosen per handshake or cannot be parsed
+func certificateExpiry(config *tls.Config) time.Time {
+	if len(config.Certificates) == 0 || len(config.Certificates[0].Certificate) == 0 {
+		return time.Time{}
+	}
+	cert := config.Certificates[0]
+	if cert.Leaf != nil {
+		return cert.Leaf.NotAfter
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return time.Time{}
+	}
+	return leaf.NotAfter
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"fluidity/internal/shared/protocol"
+	"fluidity/internal/shared/retry"
+)
+
+// DefaultHedgeBudgetRatio is the share of hedge-eligible requests that may send a hedged request
+const DefaultHedgeBudgetRatio = 0.1
+
+// hedgeBudgetBurst is the number of hedge allowances saved for bursts of slow responses
+const hedgeBudgetBurst = 10
+
+// hedgePolicy sends a second upstream request for slow idempotent requests to the configured hosts
+type hedgePolicy struct {
+	delay  time.Duration
+	hosts  map[string]bool
+	budget *retry.Budget
+}
+
+// hedgeAttempt is the outcome of one of a hedged request's upstream requests
+type hedgeAttempt struct {
+	index int
+	resp  *http.Response
+	err   error
+}
+
+// SetHedging sends a second, concurrent upstream request for idempotent requests to hosts that have not
+// responded within delay, using whichever response arrives first and cancelling the other. Hedges are
+// capped at ratio of eligible requests like the retry budget (0 uses DefaultHedgeBudgetRatio). A delay
+// of 0 or no hosts disables hedging (call before Start).
+func (s *Server) SetHedging(delay time.Duration, hosts []string, ratio float64) {
+	s.hedging = nil
+	if delay <= 0 {
+		return
+	}
+
+	policy := &hedgePolicy{delay: delay, hosts: make(map[string]bool, len(hosts))}
+	for _, h := range hosts {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			policy.hosts[h] = true
+		}
+	}
+	if len(policy.hosts) == 0 {
+		return
+	}
+	if ratio == 0 {
+		ratio = DefaultHedgeBudgetRatio
+	}
+	policy.budget = retry.NewBudget(ratio, hedgeBudgetBurst)
+	s.hedging = policy
+}
+
+// shouldHedge reports whether a request may be sent upstream twice
+func (s *Server) shouldHedge(req *protocol.Request, httpReq *http.Request) bool {
+	if s.hedging == nil || expectsEventStream(req) || !idempotentMethod(req.Method) {
+		return false
+	}
+	// A hedged request needs its own copy of the body
+	if httpReq.Body != nil && httpReq.Body != http.NoBody && httpReq.GetBody == nil {
+		return false
+	}
+	return s.hedging.hosts[strings.ToLower(requestDomain(req.URL))]
+}
+
+// idempotentMethod reports whether sending a request with method twice has the effect of sending it once
+func idempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// doUpstream sends a request upstream, hedging it when the request is eligible
+func (s *Server) doUpstream(client *http.Client, req *protocol.Request, httpReq *http.Request) (*http.Response, error) {
+	if !s.shouldHedge(req, httpReq) {
+		return client.Do(httpReq)
+	}
+	s.hedging.budget.Deposit()
+
+	attempts := make(chan hedgeAttempt, 2)
+	var cancels []context.CancelFunc
+	launch := func(r *http.Request, release func()) {
+		ctx, cancel := context.WithCancel(r.Context())
+		index := len(cancels)
+		cancels = append(cancels, func() {
+			cancel()
+			release()
+		})
+		go func() {
+			resp, err := client.Do(r.WithContext(ctx))
+			attempts <- hedgeAttempt{index: index, resp: resp, err: err}
+		}()
+	}
+	launch(httpReq, func() {})
+
+	timer := time.NewTimer(s.hedging.delay)
+	defer timer.Stop()
+	hedgeDue := timer.C
+
+	pending := 1
+	for {
+		select {
+		case <-hedgeDue:
+			hedgeDue = nil
+			if !s.hedging.budget.Withdraw() {
+				s.logger.Debug("Hedge budget exhausted, not hedging", "id", req.ID)
+				continue
+			}
+			// The hedge needs a connection of its own, which the host's connection limit may not allow
+			release, ok := s.tryHostSlot(req)
+			if !ok {
+				s.logger.Debug("Upstream host at its connection limit, not hedging", "id", req.ID)
+				continue
+			}
+			hedged := httpReq.Clone(httpReq.Context())
+			if httpReq.GetBody != nil {
+				body, err := httpReq.GetBody()
+				if err != nil {
+					release()
+					continue
+				}
+				hedged.Body = body
+			}
+			s.logger.Debug("Hedging slow request", "id", req.ID, "delay_ms", s.hedging.delay.Milliseconds())
+			launch(hedged, release)
+			pending++
+
+		case attempt := <-attempts:
+			pending--
+			if attempt.err != nil {
+				cancels[attempt.index]()
+				if pending == 0 {
+					// Failures are left to the retry logic rather than answered with a hedge
+					return nil, attempt.err
+				}
+				continue
+			}
+
+			for i, cancel := range cancels {
+				if i != attempt.index {
+					cancel()
+				}
+			}
+			if pending > 0 {
+				go discardHedgeAttempts(attempts, pending)
+			}
+			if attempt.index > 0 {
+				s.logger.Debug("Hedged request won", "id", req.ID)
+			}
+			attempt.resp.Body = &cancelOnClose{ReadCloser: attempt.resp.Body, cancel: cancels[attempt.index]}
+			return attempt.resp, nil
+		}
+	}
+}
+
+// discardHedgeAttempts closes the responses of the n upstream requests that lost the race
+func discardHedgeAttempts(attempts <-chan hedgeAttempt, n int) {
+	for ; n > 0; n-- {
+		if attempt := <-attempts; attempt.resp != nil {
+			attempt.resp.Body.Close()
+		}
+	}
+}
+
+// cancelOnClose releases the winning upstream request's context once its body has been consumed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
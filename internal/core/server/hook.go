@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// DefaultHookTimeout bounds a single hook call when no timeout is configured
+const DefaultHookTimeout = time.Second
+
+// Hook phases
+const (
+	HookPhaseRequest  = "request"  // Before the request is sent upstream
+	HookPhaseResponse = "response" // After a buffered upstream response is read, before it is relayed
+)
+
+// HookMessage describes a request or response to a hook
+type HookMessage struct {
+	Phase   string              `json:"phase"`
+	ID      string              `json:"id"`
+	Method  string              `json:"method"`
+	URL     string              `json:"url"`
+	Status  int                 `json:"status,omitempty"` // Upstream status, in the response phase
+	Headers map[string][]string `json:"headers"`
+	Body    []byte              `json:"body,omitempty"` // Only when the hook is configured to see bodies
+}
+
+// HookVerdict is a hook's decision. A zero verdict lets the message through unchanged.
+type HookVerdict struct {
+	Reject  bool                `json:"reject,omitempty"`
+	Status  int                 `json:"status,omitempty"` // Status returned to the client on reject (0 uses 403)
+	Reason  string              `json:"reason,omitempty"`
+	Headers map[string][]string `json:"headers,omitempty"` // Replaces the headers when set
+	Body    []byte              `json:"body,omitempty"`    // Replaces the body when set (an empty JSON string clears it)
+}
+
+// Hook inspects requests and responses passing through the server, and may rewrite or reject them
+type Hook interface {
+	Apply(ctx context.Context, msg *HookMessage) (*HookVerdict, error)
+}
+
+// HookFunc adapts a function to the Hook interface
+type HookFunc func(ctx context.Context, msg *HookMessage) (*HookVerdict, error)
+
+// Apply calls f
+func (f HookFunc) Apply(ctx context.Context, msg *HookMessage) (*HookVerdict, error) {
+	return f(ctx, msg)
+}
+
+// HookOptions control how the server calls its hook
+type HookOptions struct {
+	Timeout  time.Duration // Bounds each call (0 uses DefaultHookTimeout)
+	Bodies   bool          // Send request and buffered response bodies to the hook, not just their metadata
+	FailOpen bool          // Let messages through unchanged when the hook fails or times out, instead of failing the request
+}
+
+// requestHook is the configured hook with its options
+type requestHook struct {
+	hook Hook
+	HookOptions
+}
+
+// SetHook calls hook for every HTTP request before it is sent upstream and for every buffered response
+// before it is relayed, so operators can filter or transform traffic without rebuilding the server.
+// Streamed event-stream responses, CONNECT tunnels and WebSockets are not passed to the hook. A nil hook
+// removes it (call before Start).
+func (s *Server) SetHook(hook Hook, options HookOptions) {
+	if hook == nil {
+		s.hook = nil
+		return
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultHookTimeout
+	}
+	s.hook = &requestHook{hook: hook, HookOptions: options}
+}
+
+// errHookRejected is returned when a hook turns a request or response away
+var errHookRejected = errors.New("rejected by hook")
+
+// errHookFailed is returned when a hook fails and is not configured to fail open
+var errHookFailed = errors.New("hook failed")
+
+// runHook passes msg to the hook, applying its rewrites to headers and body. It returns the status to
+// send the client instead when the message is rejected or the hook fails closed.
+func (s *Server) runHook(msg *HookMessage, headers *map[string][]string, body *[]byte) (int, error) {
+	h := s.hook
+	if !h.Bodies {
+		msg.Body = nil
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, h.Timeout)
+	defer cancel()
+
+	verdict, err := h.hook.Apply(ctx, msg)
+	if err != nil {
+		if h.FailOpen {
+			s.logger.Warn("Hook failed, passing message through unchanged", "id", msg.ID, "phase", msg.Phase, "error", err.Error())
+			return 0, nil
+		}
+		return http.StatusBadGateway, fmt.Errorf("%w: %v", errHookFailed, err)
+	}
+	if verdict == nil {
+		return 0, nil
+	}
+	if verdict.Reject {
+		status := verdict.Status
+		if status < 400 || status > 599 {
+			status = http.StatusForbidden
+		}
+		if verdict.Reason != "" {
+			return status, fmt.Errorf("%w: %s", errHookRejected, verdict.Reason)
+		}
+		return status, errHookRejected
+	}
+
+	if verdict.Headers != nil {
+		*headers = verdict.Headers
+	}
+	if verdict.Body != nil {
+		*body = verdict.Body
+		if *headers == nil {
+			*headers = make(map[string][]string)
+		}
+		setContentLength(*headers, len(verdict.Body))
+	}
+	return 0, nil
+}
+
+// setContentLength replaces any Content-Length header with length, after a hook rewrote the body
+func setContentLength(headers map[string][]string, length int) {
+	for name := range headers {
+		if strings.EqualFold(name, "Content-Length") {
+			delete(headers, name)
+		}
+	}
+	headers["Content-Length"] = []string{strconv.Itoa(length)}
+}
+
+// sendHookError tells the client a hook rejected its request or response, or failed
+func (s *Server) sendHookError(reqID string, status int, err error, encoder *json.Encoder, mu *sync.Mutex) {
+	code := protocol.ErrCodeForbidden
+	if errors.Is(err, errHookFailed) {
+		code = protocol.ErrCodeInternal
+	}
+	s.logger.Warn("Hook stopped request", "id", reqID, "status", status, "reason", err.Error())
+	s.sendErrorResponseWithStatus(reqID, status, code, err, encoder, mu)
+}
+
+// CommandHook runs an external program for each message: the HookMessage is written to its stdin as JSON
+// and it writes a HookVerdict to stdout as JSON (empty output lets the message through). A non-zero exit
+// status is a hook failure. The program is killed when the call times out.
+type CommandHook struct {
+	path string
+	args []string
+}
+
+// NewCommandHook returns a hook running command, the program followed by its arguments
+func NewCommandHook(command []string) (*CommandHook, error) {
+	if len(command) == 0 || strings.TrimSpace(command[0]) == "" {
+		return nil, fmt.Errorf("hook command is empty")
+	}
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		return nil, fmt.Errorf("hook command %q: %w", command[0], err)
+	}
+	return &CommandHook{path: path, args: command[1:]}, nil
+}
+
+// Apply runs the command for msg
+func (h *CommandHook) Apply(ctx context.Context, msg *HookMessage) (*HookVerdict, error) {
+	input, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, h.path, h.args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = 100 * time.Millisecond
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("hook timed out: %w", ctx.Err())
+		}
+		if detail := strings.TrimSpace(stderr.String()); detail != "" {
+			return nil, fmt.Errorf("%w: %s", err, detail)
+		}
+		return nil, err
+	}
+
+	output := bytes.TrimSpace(stdout.Bytes())
+	if len(output) == 0 {
+		return nil, nil
+	}
+	var verdict HookVerdict
+	if err := json.Unmarshal(output, &verdict); err != nil {
+		return nil, fmt.Errorf("invalid hook output: %w", err)
+	}
+	return &verdict, nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// DefaultHostQueueWait is how long a request waits for a free upstream connection to its host
+const DefaultHostQueueWait = 10 * time.Second
+
+// hostLimiter caps the upstream requests in flight to each host
+type hostLimiter struct {
+	limit int
+	wait  time.Duration
+	mu    sync.Mutex
+	hosts map[string]*hostSlots
+}
+
+// hostSlots is one host's semaphore, kept only while requests hold or wait for it
+type hostSlots struct {
+	sem   chan struct{}
+	users int
+}
+
+// SetMaxConnectionsPerHost caps the upstream requests in flight to any one host, so a burst to a slow host
+// cannot open unbounded connections to it. Requests beyond the cap wait up to wait for a slot and are then
+// refused with a 503 (0 waits DefaultHostQueueWait, negative refuses at once). A limit of 0 or less
+// removes the cap (call before Start).
+func (s *Server) SetMaxConnectionsPerHost(limit int, wait time.Duration) {
+	if limit <= 0 {
+		s.hostLimit = nil
+		return
+	}
+	if wait == 0 {
+		wait = DefaultHostQueueWait
+	}
+	s.hostLimit = &hostLimiter{limit: limit, wait: wait, hosts: make(map[string]*hostSlots)}
+}
+
+// acquireHostSlot waits for one of the request host's upstream slots and returns the function releasing it
+func (s *Server) acquireHostSlot(ctx context.Context, req *protocol.Request) (func(), error) {
+	if s.hostLimit == nil {
+		return func() {}, nil
+	}
+	host := strings.ToLower(requestDomain(req.URL))
+	release, err := s.hostLimit.acquire(ctx, host, s.hostLimit.wait)
+	if err != nil {
+		s.logger.Warn("Upstream host at its connection limit, refusing request", "id", req.ID, "domain", host, "limit", s.hostLimit.limit)
+	}
+	return release, err
+}
+
+// tryHostSlot takes one of the request host's upstream slots only if one is free, for an extra request
+// such as a hedge that should never wait
+func (s *Server) tryHostSlot(req *protocol.Request) (func(), bool) {
+	if s.hostLimit == nil {
+		return func() {}, true
+	}
+	release, err := s.hostLimit.acquire(context.Background(), strings.ToLower(requestDomain(req.URL)), -1)
+	return release, err == nil
+}
+
+// acquire takes a slot for host, waiting up to wait for one to free up (negative does not wait)
+func (l *hostLimiter) acquire(ctx context.Context, host string, wait time.Duration) (func(), error) {
+	l.mu.Lock()
+	slots := l.hosts[host]
+	if slots == nil {
+		slots = &hostSlots{sem: make(chan struct{}, l.limit)}
+		l.hosts[host] = slots
+	}
+	slots.users++
+	l.mu.Unlock()
+
+	done := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if slots.users--; slots.users == 0 {
+			delete(l.hosts, host)
+		}
+	}
+
+	select {
+	case slots.sem <- struct{}{}:
+	default:
+		if wait < 0 {
+			done()
+			return nil, fmt.Errorf("too many requests in flight to %s", host)
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case slots.sem <- struct{}{}:
+		case <-timer.C:
+			done()
+			return nil, fmt.Errorf("too many requests in flight to %s", host)
+		case <-ctx.Done():
+			done()
+			return nil, ctx.Err()
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-slots.sem
+			done()
+		})
+	}, nil
+}
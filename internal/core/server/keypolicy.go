@@ -0,0 +1,73 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// Client key algorithms named in a ClientKeyPolicy
+const (
+	KeyAlgorithmRSA     = "rsa"
+	KeyAlgorithmECDSA   = "ecdsa"
+	KeyAlgorithmEd25519 = "ed25519"
+)
+
+// ClientKeyPolicy is the weakest client certificate key the server accepts, enforced in addition to
+// whatever the CA allowed when signing. Zero fields accept anything.
+type ClientKeyPolicy struct {
+	Algorithms   []string // Accepted key algorithms (rsa, ecdsa, ed25519); empty accepts all
+	MinRSABits   int      // Smallest accepted RSA modulus, e.g. 2048
+	MinECDSABits int      // Smallest accepted ECDSA curve size, e.g. 256 for P-256
+}
+
+// SetClientKeyPolicy rejects agents whose client certificate key does not meet policy (call before Start)
+func (s *Server) SetClientKeyPolicy(policy ClientKeyPolicy) {
+	s.keyPolicy = policy
+}
+
+// check returns an error describing why cert's public key does not meet the policy
+func (p ClientKeyPolicy) check(cert *x509.Certificate) error {
+	algorithm, bits := keyStrength(cert)
+	if algorithm == "" {
+		return fmt.Errorf("unsupported client key type %T", cert.PublicKey)
+	}
+
+	if len(p.Algorithms) > 0 {
+		allowed := false
+		for _, a := range p.Algorithms {
+			if strings.EqualFold(strings.TrimSpace(a), algorithm) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("client key algorithm %s not allowed (allowed: %s)", algorithm, strings.Join(p.Algorithms, ", "))
+		}
+	}
+
+	switch {
+	case algorithm == KeyAlgorithmRSA && bits < p.MinRSABits:
+		return fmt.Errorf("client RSA key is %d bits, minimum is %d", bits, p.MinRSABits)
+	case algorithm == KeyAlgorithmECDSA && bits < p.MinECDSABits:
+		return fmt.Errorf("client ECDSA key is %d bits, minimum is %d", bits, p.MinECDSABits)
+	}
+	return nil
+}
+
+// keyStrength returns the algorithm and size in bits of cert's public key, or "" for unknown key types
+func keyStrength(cert *x509.Certificate) (string, int) {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return KeyAlgorithmRSA, key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return KeyAlgorithmECDSA, key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return KeyAlgorithmEd25519, 256
+	default:
+		return "", 0
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// ListenOptions are socket options for the listener agents connect to. The zero value matches a plain
+// net.Listen.
+type ListenOptions struct {
+	ReuseAddr bool // Set SO_REUSEADDR so a restart can rebind while old connections are in TIME_WAIT (already the Go default on Unix)
+	ReusePort bool // Set SO_REUSEPORT so several server processes can share the port (Linux, macOS and FreeBSD only)
+	Backlog   int  // Length of the queue of connections waiting to be accepted (0 uses the OS default)
+}
+
+// listen opens the TCP listener for addr with opts applied
+func listen(addr string, opts ListenOptions) (net.Listener, error) {
+	if opts.Backlog < 0 {
+		return nil, fmt.Errorf("listen backlog must not be negative, got %d", opts.Backlog)
+	}
+
+	config := net.ListenConfig{Control: opts.control}
+	listener, err := config.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Backlog == 0 {
+		return listener, nil
+	}
+
+	// Go listens with the OS maximum backlog; listening again on the socket replaces it
+	rawConn, err := listener.(*net.TCPListener).SyscallConn()
+	if err == nil {
+		ctrlErr := rawConn.Control(func(fd uintptr) {
+			err = setBacklog(fd, opts.Backlog)
+		})
+		if err == nil {
+			err = ctrlErr
+		}
+	}
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set listen backlog: %w", err)
+	}
+	return listener, nil
+}
+
+// control sets the socket options before the listener binds
+func (opts ListenOptions) control(network, address string, c syscall.RawConn) error {
+	if !opts.ReuseAddr && !opts.ReusePort {
+		return nil
+	}
+	var err error
+	ctrlErr := c.Control(func(fd uintptr) {
+		if opts.ReuseAddr {
+			if err = setReuseAddr(fd); err != nil {
+				err = fmt.Errorf("SO_REUSEADDR: %w", err)
+				return
+			}
+		}
+		if opts.ReusePort {
+			if err = setReusePort(fd); err != nil {
+				err = fmt.Errorf("SO_REUSEPORT: %w", err)
+			}
+		}
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
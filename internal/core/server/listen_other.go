@@ -0,0 +1,22 @@
+//go:build !(linux || darwin || freebsd)
+
+package server
+
+import "errors"
+
+// errSockoptUnsupported is returned for listen options this platform's sockets do not offer in the same form
+var errSockoptUnsupported = errors.New("not supported on this platform")
+
+// setReuseAddr is refused because elsewhere, notably on Windows, SO_REUSEADDR lets another process take
+// over a port in use rather than only skipping TIME_WAIT
+func setReuseAddr(fd uintptr) error {
+	return errSockoptUnsupported
+}
+
+func setReusePort(fd uintptr) error {
+	return errSockoptUnsupported
+}
+
+func setBacklog(fd uintptr, backlog int) error {
+	return errSockoptUnsupported
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+)
+
+// Built-in load signals for SetLoadShedding
+const (
+	LoadSignalActiveRequests = "active_requests"
+	LoadSignalGoroutines     = "goroutines"
+)
+
+// DefaultLoadShedFraction is the share of new requests shed while over the threshold when none is configured
+const DefaultLoadShedFraction = 0.5
+
+// LoadFunc reports the server's current load in the units of the shedding threshold
+type LoadFunc func() float64
+
+// loadShedder rejects a fraction of new requests while load is above a threshold
+type loadShedder struct {
+	load      LoadFunc
+	threshold float64
+	fraction  float64
+}
+
+// LoadSignal returns the built-in load function for name, measured against s
+func (s *Server) LoadSignal(name string) (LoadFunc, error) {
+	switch name {
+	case LoadSignalActiveRequests:
+		return func() float64 { return float64(s.activeRequests.Load()) }, nil
+	case LoadSignalGoroutines:
+		return func() float64 { return float64(runtime.NumGoroutine()) }, nil
+	default:
+		return nil, fmt.Errorf("unknown load signal %q", name)
+	}
+}
+
+// SetLoadShedding rejects fraction (0-1) of new requests with 503 while load reports more than threshold,
+// so requests already in flight can finish instead of every request slowing down. A nil load function
+// disables shedding (call before Start).
+func (s *Server) SetLoadShedding(load LoadFunc, threshold, fraction float64) {
+	if load == nil || fraction <= 0 {
+		s.shedder = nil
+		return
+	}
+	s.shedder = &loadShedder{load: load, threshold: threshold, fraction: min(fraction, 1)}
+}
+
+// shouldShed reports whether a new request should be rejected to relieve load
+func (s *Server) shouldShed(reqID string) bool {
+	if s.shedder == nil {
+		return false
+	}
+	load := s.shedder.load()
+	if load <= s.shedder.threshold || rand.Float64() >= s.shedder.fraction {
+		return false
+	}
+	s.logger.Warn("Server overloaded, shedding request", "id", reqID, "load", load, "threshold", s.shedder.threshold)
+	return true
+}
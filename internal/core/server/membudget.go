@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// connectBufferSize is the read buffer each CONNECT tunnel holds, and reserves from the memory budget
+const connectBufferSize = 32 * 1024
+
+// webSocketBufferSize is the size of each of the read and write buffers a WebSocket holds; both are
+// reserved from the memory budget
+const webSocketBufferSize = 4 * 1024
+
+// errMemoryBudget is returned when buffering more data would exceed the server's in-flight byte budget
+var errMemoryBudget = errors.New("server in-flight memory budget exhausted")
+
+// memoryBudget bounds the bytes buffered across all requests and tunnels at once
+type memoryBudget struct {
+	limit int64
+	used  atomic.Int64
+	peak  atomic.Int64
+}
+
+// SetMemoryBudget caps the bytes held in memory across all in-flight HTTP request and response bodies and
+// CONNECT tunnel and WebSocket buffers. New work that would take the total past maxBytes is refused with a
+// 503 until memory frees up, so many simultaneous large transfers cannot drive the server out of memory.
+// A response that outgrows the budget once the upstream has answered fails with a 502, as the request
+// has already taken effect and must not be retried blindly. 0 or less removes the cap (call before Start).
+func (s *Server) SetMemoryBudget(maxBytes int64) {
+	if maxBytes <= 0 {
+		s.budget = nil
+		return
+	}
+	s.budget = &memoryBudget{limit: maxBytes}
+}
+
+// InflightBytes returns the bytes currently held against the memory budget (0 without a budget)
+func (s *Server) InflightBytes() int64 {
+	if s.budget == nil {
+		return 0
+	}
+	return s.budget.used.Load()
+}
+
+// PeakInflightBytes returns the most bytes held against the memory budget at once (0 without a budget)
+func (s *Server) PeakInflightBytes() int64 {
+	if s.budget == nil {
+		return 0
+	}
+	return s.budget.peak.Load()
+}
+
+// reserve takes n bytes from the budget, reporting false when that would exceed it. A nil budget
+// admits everything.
+func (b *memoryBudget) reserve(n int64) bool {
+	if b == nil || n <= 0 {
+		return true
+	}
+	for {
+		used := b.used.Load()
+		if used+n > b.limit {
+			return false
+		}
+		if b.used.CompareAndSwap(used, used+n) {
+			for peak := b.peak.Load(); used+n > peak && !b.peak.CompareAndSwap(peak, used+n); peak = b.peak.Load() {
+			}
+			return true
+		}
+	}
+}
+
+// release returns n reserved bytes to the budget
+func (b *memoryBudget) release(n int64) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.used.Add(-n)
+}
+
+// budgetBody reserves the bytes read from an upstream response body, which is buffered whole before it
+// is relayed, failing the read once the budget is exhausted
+type budgetBody struct {
+	io.ReadCloser
+	budget   *memoryBudget
+	reserved int64
+}
+
+func (b *budgetBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if !b.budget.reserve(int64(n)) {
+			return 0, errMemoryBudget
+		}
+		b.reserved += int64(n)
+	}
+	return n, err
+}
+
+// errAgentResponseLimit fails a buffered response whose body outgrows the limit the agent sent
+var errAgentResponseLimit = errors.New("response body exceeds the agent's limit")
+
+// limitedBody fails reads once more than remaining bytes have been read
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, errAgentResponseLimit
+	}
+	return n, err
+}
+
+// MemoryBudgetFraction returns fraction (0-1) of the memory available to the process, for SetMemoryBudget.
+// The available memory is the Go memory limit when one is set, otherwise the container's cgroup limit,
+// otherwise the host's total memory.
+func MemoryBudgetFraction(fraction float64) (int64, error) {
+	if fraction <= 0 || fraction > 1 {
+		return 0, fmt.Errorf("memory budget fraction %v must be above 0 and at most 1", fraction)
+	}
+	available, err := availableMemory()
+	if err != nil {
+		return 0, err
+	}
+	return int64(float64(available) * fraction), nil
+}
+
+// availableMemory returns the memory the process may use
+func availableMemory() (int64, error) {
+	if limit := debug.SetMemoryLimit(-1); limit > 0 && limit < math.MaxInt64 {
+		return limit, nil
+	}
+
+	// cgroup v2, then v1; v1 reports an effectively unlimited value when no limit is set
+	for _, path := range []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if limit, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil && limit > 0 && limit < 1<<60 {
+			return limit, nil
+		}
+	}
+
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, fmt.Errorf("cannot determine available memory: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				break
+			}
+			return kb * 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("cannot determine available memory: no MemTotal in /proc/meminfo")
+}
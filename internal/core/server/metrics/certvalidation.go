@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// CertValidationStats counts client certificate validations since metrics were last emitted
+type CertValidationStats struct {
+	Successes int64
+	Failures  map[string]int64 // Keyed by failure reason
+}
+
+// certValidationTracker aggregates client certificate validation outcomes between emissions
+type certValidationTracker struct {
+	mu        sync.Mutex
+	successes int64
+	failures  map[string]int64
+}
+
+// record counts one validation, a failure when reason is set
+func (t *certValidationTracker) record(reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if reason == "" {
+		t.successes++
+		return
+	}
+	if t.failures == nil {
+		t.failures = make(map[string]int64)
+	}
+	t.failures[reason]++
+}
+
+// snapshot returns a copy of the counts, resetting them when reset is set
+func (t *certValidationTracker) snapshot(reset bool) CertValidationStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := CertValidationStats{Successes: t.successes, Failures: make(map[string]int64, len(t.failures))}
+	for reason, count := range t.failures {
+		stats.Failures[reason] = count
+	}
+	if reset {
+		t.successes = 0
+		t.failures = nil
+	}
+	return stats
+}
+
+// RecordCertValidationSuccess counts an agent whose client certificate passed validation
+func (e *Emitter) RecordCertValidationSuccess() {
+	if !e.config.Enabled {
+		return
+	}
+	e.certValidations.record("")
+}
+
+// RecordCertValidationFailure counts an agent whose client certificate was rejected for reason
+func (e *Emitter) RecordCertValidationFailure(reason string) {
+	if !e.config.Enabled || reason == "" {
+		return
+	}
+	e.certValidations.record(reason)
+}
+
+// CertValidationStats returns the client certificate validations counted since metrics were last emitted
+func (e *Emitter) CertValidationStats() CertValidationStats {
+	return e.certValidations.snapshot(false)
+}
+
+// certValidationMetricData builds the validation datums for one emission and resets the counters. The
+// success count is always sent so dashboards see a zero, failures only for reasons that occurred.
+func (e *Emitter) certValidationMetricData(now time.Time) []types.MetricDatum {
+	stats := e.certValidations.snapshot(true)
+
+	data := []types.MetricDatum{{
+		MetricName: aws.String("CertValidationSuccesses"),
+		Value:      aws.Float64(float64(stats.Successes)),
+		Unit:       types.StandardUnitCount,
+		Timestamp:  &now,
+		Dimensions: []types.Dimension{
+			{Name: aws.String("ServiceName"), Value: aws.String(e.config.ServiceName)},
+			{Name: aws.String("ClusterName"), Value: aws.String(e.config.ClusterName)},
+		},
+	}}
+	for reason, count := range stats.Failures {
+		data = append(data, types.MetricDatum{
+			MetricName: aws.String("CertValidationFailures"),
+			Value:      aws.Float64(float64(count)),
+			Unit:       types.StandardUnitCount,
+			Timestamp:  &now,
+			Dimensions: []types.Dimension{
+				{Name: aws.String("ServiceName"), Value: aws.String(e.config.ServiceName)},
+				{Name: aws.String("ClusterName"), Value: aws.String(e.config.ClusterName)},
+				{Name: aws.String("Reason"), Value: aws.String(reason)},
+			},
+		})
+	}
+	return data
+}
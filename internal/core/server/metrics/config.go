@@ -26,6 +26,10 @@ type Config struct {
 
 	// Enabled indicates if metrics emission is enabled
 	Enabled bool
+
+	// MaxDomains is the number of distinct upstream domains given their own metrics, with the rest
+	// counted under OtherDomain (0 uses DefaultMaxDomains, negative disables per-domain metrics)
+	MaxDomains int
 }
 
 // LoadConfig loads metrics configuration from environment variables
@@ -37,6 +41,7 @@ func LoadConfig() (*Config, error) {
 		ClusterName:  getEnvOrDefault("ECS_CLUSTER_NAME", "fluidity"),
 		EmitInterval: getEnvDuration("METRICS_EMIT_INTERVAL", 60*time.Second),
 		Enabled:      getEnvBool("METRICS_ENABLED", true),
+		MaxDomains:   getEnvInt("METRICS_MAX_DOMAINS", DefaultMaxDomains),
 	}
 
 	return config, nil
@@ -81,6 +86,16 @@ func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
 	return defaultValue
 }
 
+// getEnvInt returns environment variable as int or default
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if intValue, err := strconv.Atoi(value); err == nil {
+			return intValue
+		}
+	}
+	return defaultValue
+}
+
 // getEnvBool returns environment variable as bool or default
 func getEnvBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
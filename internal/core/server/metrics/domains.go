@@ -0,0 +1,164 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// DefaultMaxDomains is the number of distinct upstream domains given their own metrics
+const DefaultMaxDomains = 50
+
+// OtherDomain collects the requests of domains seen after the distinct domain limit was reached
+const OtherDomain = "other"
+
+// DomainStats summarises the requests to one upstream domain since metrics were last emitted
+type DomainStats struct {
+	Requests   int64
+	Errors     int64
+	LatencySum time.Duration
+	LatencyMin time.Duration
+	LatencyMax time.Duration
+}
+
+// AverageLatency returns the mean request latency (0 when there were no requests)
+func (s DomainStats) AverageLatency() time.Duration {
+	if s.Requests == 0 {
+		return 0
+	}
+	return s.LatencySum / time.Duration(s.Requests)
+}
+
+// domainTracker aggregates per-domain stats, keeping the set of named domains bounded so the metrics'
+// cardinality cannot grow with every host clients visit
+type domainTracker struct {
+	mu      sync.Mutex
+	limit   int
+	domains map[string]*DomainStats
+}
+
+// newDomainTracker tracks up to limit named domains (0 uses DefaultMaxDomains, negative disables tracking)
+func newDomainTracker(limit int) *domainTracker {
+	if limit < 0 {
+		return nil
+	}
+	if limit == 0 {
+		limit = DefaultMaxDomains
+	}
+	return &domainTracker{limit: limit, domains: make(map[string]*DomainStats)}
+}
+
+// record adds a request to its domain, or to OtherDomain once limit domains are already tracked
+func (t *domainTracker) record(domain string, latency time.Duration, failed bool) {
+	if domain == "" {
+		domain = OtherDomain
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.domains[domain]
+	if !ok {
+		// Named domains keep their slot between emissions so a busy domain is never bucketed later on
+		if len(t.domains) >= t.limit {
+			domain = OtherDomain
+		}
+		if stats, ok = t.domains[domain]; !ok {
+			stats = &DomainStats{}
+			t.domains[domain] = stats
+		}
+	}
+
+	stats.Requests++
+	if failed {
+		stats.Errors++
+	}
+	stats.LatencySum += latency
+	if stats.Requests == 1 || latency < stats.LatencyMin {
+		stats.LatencyMin = latency
+	}
+	if latency > stats.LatencyMax {
+		stats.LatencyMax = latency
+	}
+}
+
+// snapshot returns a copy of the stats of domains with requests, resetting them when reset is set
+func (t *domainTracker) snapshot(reset bool) map[string]DomainStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make(map[string]DomainStats, len(t.domains))
+	for domain, stats := range t.domains {
+		if stats.Requests == 0 {
+			continue
+		}
+		result[domain] = *stats
+		if reset {
+			*stats = DomainStats{}
+		}
+	}
+	return result
+}
+
+// RecordRequest counts a request to an upstream domain with its latency and whether it failed
+func (e *Emitter) RecordRequest(domain string, latency time.Duration, failed bool) {
+	if !e.config.Enabled || e.domains == nil {
+		return
+	}
+	e.domains.record(domain, latency, failed)
+}
+
+// DomainStats returns the per-domain stats gathered since metrics were last emitted
+func (e *Emitter) DomainStats() map[string]DomainStats {
+	if e.domains == nil {
+		return map[string]DomainStats{}
+	}
+	return e.domains.snapshot(false)
+}
+
+// domainMetricData builds the per-domain datums for one emission and resets the counters
+func (e *Emitter) domainMetricData(now time.Time) []types.MetricDatum {
+	if e.domains == nil {
+		return nil
+	}
+
+	var data []types.MetricDatum
+	for domain, stats := range e.domains.snapshot(true) {
+		dimensions := []types.Dimension{
+			{Name: aws.String("ServiceName"), Value: aws.String(e.config.ServiceName)},
+			{Name: aws.String("ClusterName"), Value: aws.String(e.config.ClusterName)},
+			{Name: aws.String("Domain"), Value: aws.String(domain)},
+		}
+		data = append(data,
+			types.MetricDatum{
+				MetricName: aws.String("UpstreamRequests"),
+				Value:      aws.Float64(float64(stats.Requests)),
+				Unit:       types.StandardUnitCount,
+				Timestamp:  &now,
+				Dimensions: dimensions,
+			},
+			types.MetricDatum{
+				MetricName: aws.String("UpstreamErrors"),
+				Value:      aws.Float64(float64(stats.Errors)),
+				Unit:       types.StandardUnitCount,
+				Timestamp:  &now,
+				Dimensions: dimensions,
+			},
+			types.MetricDatum{
+				MetricName: aws.String("UpstreamLatency"),
+				StatisticValues: &types.StatisticSet{
+					SampleCount: aws.Float64(float64(stats.Requests)),
+					Sum:         aws.Float64(float64(stats.LatencySum.Milliseconds())),
+					Minimum:     aws.Float64(float64(stats.LatencyMin.Milliseconds())),
+					Maximum:     aws.Float64(float64(stats.LatencyMax.Milliseconds())),
+				},
+				Unit:       types.StandardUnitMilliseconds,
+				Timestamp:  &now,
+				Dimensions: dimensions,
+			},
+		)
+	}
+	return data
+}
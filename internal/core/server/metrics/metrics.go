@@ -13,16 +13,21 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 )
 
+// maxDatumsPerCall is the most metric datums CloudWatch accepts in one PutMetricData call
+const maxDatumsPerCall = 1000
+
 // Emitter manages CloudWatch metrics emission
 type Emitter struct {
-	config       *Config
-	client       *cloudwatch.Client
-	logger       *logging.Logger
-	activeConns  atomic.Int64
-	lastActivity atomic.Int64 // Unix epoch seconds
-	ctx          context.Context
-	cancel       context.CancelFunc
-	emitTicker   *time.Ticker
+	config          *Config
+	client          *cloudwatch.Client
+	logger          *logging.Logger
+	activeConns     atomic.Int64
+	lastActivity    atomic.Int64 // Unix epoch seconds
+	domains         *domainTracker
+	certValidations certValidationTracker
+	ctx             context.Context
+	cancel          context.CancelFunc
+	emitTicker      *time.Ticker
 }
 
 // NewEmitter creates a new metrics emitter
@@ -69,6 +74,7 @@ func NewEmitter(cfg *Config, logger *logging.Logger) (*Emitter, error) {
 		ctx:        ctx,
 		cancel:     cancel,
 		emitTicker: time.NewTicker(cfg.EmitInterval),
+		domains:    newDomainTracker(cfg.MaxDomains),
 	}
 
 	// Initialize last activity to now
@@ -216,21 +222,26 @@ func (e *Emitter) emitMetrics() {
 			},
 		},
 	}
-
-	// Send to CloudWatch (batched automatically by SDK)
-	input := &cloudwatch.PutMetricDataInput{
-		Namespace:  aws.String(e.config.Namespace),
-		MetricData: metricData,
-	}
+	metricData = append(metricData, e.domainMetricData(now)...)
+	metricData = append(metricData, e.certValidationMetricData(now)...)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	_, err := e.client.PutMetricData(ctx, input)
-	if err != nil {
-		e.logger.Warn("Failed to emit metrics to CloudWatch", "error", err.Error())
-		// Don't fail the application - graceful degradation
-		return
+	// Send to CloudWatch, within its limit on datums per call
+	for len(metricData) > 0 {
+		batch := metricData[:min(len(metricData), maxDatumsPerCall)]
+		metricData = metricData[len(batch):]
+
+		input := &cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(e.config.Namespace),
+			MetricData: batch,
+		}
+		if _, err := e.client.PutMetricData(ctx, input); err != nil {
+			e.logger.Warn("Failed to emit metrics to CloudWatch", "error", err.Error())
+			// Don't fail the application - graceful degradation
+			return
+		}
 	}
 
 	e.logger.Debug("Metrics emitted successfully",
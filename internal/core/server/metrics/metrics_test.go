@@ -344,3 +344,149 @@ func TestConcurrentConnectionUpdates(t *testing.T) {
 		t.Errorf("After concurrent decrements GetActiveConnections() = %d, want 0", count)
 	}
 }
+
+func TestDomainMetricsAggregation(t *testing.T) {
+	config := &Config{
+		Region:       "us-east-1",
+		Namespace:    "Fluidity",
+		EmitInterval: 60 * time.Second,
+		Enabled:      true,
+		ServiceName:  "test-service",
+		ClusterName:  "test-cluster",
+	}
+
+	emitter, err := NewEmitter(config, logging.NewLogger("test"))
+	if err != nil {
+		t.Fatalf("NewEmitter() error = %v", err)
+	}
+
+	emitter.RecordRequest("api.example.com", 10*time.Millisecond, false)
+	emitter.RecordRequest("api.example.com", 30*time.Millisecond, true)
+	emitter.RecordRequest("api.example.com", 20*time.Millisecond, false)
+	emitter.RecordRequest("cdn.example.com", 5*time.Millisecond, false)
+
+	stats := emitter.DomainStats()
+	if len(stats) != 2 {
+		t.Fatalf("DomainStats() has %d domains, want 2", len(stats))
+	}
+
+	api := stats["api.example.com"]
+	if api.Requests != 3 || api.Errors != 1 {
+		t.Errorf("api.example.com requests = %d, errors = %d, want 3 and 1", api.Requests, api.Errors)
+	}
+	if api.LatencyMin != 10*time.Millisecond || api.LatencyMax != 30*time.Millisecond {
+		t.Errorf("api.example.com latency min = %v, max = %v, want 10ms and 30ms", api.LatencyMin, api.LatencyMax)
+	}
+	if avg := api.AverageLatency(); avg != 20*time.Millisecond {
+		t.Errorf("api.example.com average latency = %v, want 20ms", avg)
+	}
+
+	cdn := stats["cdn.example.com"]
+	if cdn.Requests != 1 || cdn.Errors != 0 {
+		t.Errorf("cdn.example.com requests = %d, errors = %d, want 1 and 0", cdn.Requests, cdn.Errors)
+	}
+
+	// Emitting builds three datums per domain and starts a new interval
+	if data := emitter.domainMetricData(time.Now()); len(data) != 6 {
+		t.Errorf("domainMetricData() returned %d datums, want 6", len(data))
+	}
+	if stats := emitter.DomainStats(); len(stats) != 0 {
+		t.Errorf("DomainStats() after emission has %d domains, want 0", len(stats))
+	}
+}
+
+func TestDomainMetricsOverflowToOther(t *testing.T) {
+	config := &Config{
+		Region:       "us-east-1",
+		Namespace:    "Fluidity",
+		EmitInterval: 60 * time.Second,
+		Enabled:      true,
+		MaxDomains:   2,
+	}
+
+	emitter, err := NewEmitter(config, logging.NewLogger("test"))
+	if err != nil {
+		t.Fatalf("NewEmitter() error = %v", err)
+	}
+
+	emitter.RecordRequest("a.example.com", time.Millisecond, false)
+	emitter.RecordRequest("b.example.com", time.Millisecond, false)
+	emitter.RecordRequest("c.example.com", time.Millisecond, true)
+	emitter.RecordRequest("d.example.com", time.Millisecond, false)
+	emitter.RecordRequest("a.example.com", time.Millisecond, false)
+
+	stats := emitter.DomainStats()
+	if len(stats) != 3 {
+		t.Fatalf("DomainStats() has %d domains, want a, b and %s: %v", len(stats), OtherDomain, stats)
+	}
+	if got := stats["a.example.com"].Requests; got != 2 {
+		t.Errorf("a.example.com requests = %d, want 2", got)
+	}
+	other := stats[OtherDomain]
+	if other.Requests != 2 || other.Errors != 1 {
+		t.Errorf("%s requests = %d, errors = %d, want 2 and 1", OtherDomain, other.Requests, other.Errors)
+	}
+
+	// Domains keep their slot across emissions, so late domains stay bucketed
+	emitter.domainMetricData(time.Now())
+	emitter.RecordRequest("c.example.com", time.Millisecond, false)
+	emitter.RecordRequest("b.example.com", time.Millisecond, false)
+	stats = emitter.DomainStats()
+	if stats[OtherDomain].Requests != 1 || stats["b.example.com"].Requests != 1 {
+		t.Errorf("after emission got %v, want one request each for b.example.com and %s", stats, OtherDomain)
+	}
+}
+
+func TestDomainMetricsDisabled(t *testing.T) {
+	emitter, err := NewEmitter(&Config{Enabled: false}, logging.NewLogger("test"))
+	if err != nil {
+		t.Fatalf("NewEmitter() error = %v", err)
+	}
+
+	emitter.RecordRequest("api.example.com", time.Millisecond, false)
+	if stats := emitter.DomainStats(); len(stats) != 0 {
+		t.Errorf("DomainStats() with metrics disabled has %d domains, want 0", len(stats))
+	}
+}
+
+func TestCertValidationMetrics(t *testing.T) {
+	config := &Config{
+		Region:       "us-east-1",
+		Namespace:    "Fluidity",
+		EmitInterval: 60 * time.Second,
+		Enabled:      true,
+		ServiceName:  "test-service",
+		ClusterName:  "test-cluster",
+	}
+
+	emitter, err := NewEmitter(config, logging.NewLogger("test"))
+	if err != nil {
+		t.Fatalf("NewEmitter() error = %v", err)
+	}
+
+	emitter.RecordCertValidationSuccess()
+	emitter.RecordCertValidationSuccess()
+	emitter.RecordCertValidationFailure("expired")
+	emitter.RecordCertValidationFailure("untrusted_ca")
+	emitter.RecordCertValidationFailure("untrusted_ca")
+
+	stats := emitter.CertValidationStats()
+	if stats.Successes != 2 {
+		t.Errorf("Successes = %d, want 2", stats.Successes)
+	}
+	if stats.Failures["expired"] != 1 || stats.Failures["untrusted_ca"] != 2 {
+		t.Errorf("Failures = %v, want expired 1 and untrusted_ca 2", stats.Failures)
+	}
+
+	// One success datum plus one failure datum per reason, then a new interval
+	if data := emitter.certValidationMetricData(time.Now()); len(data) != 3 {
+		t.Errorf("certValidationMetricData() returned %d datums, want 3", len(data))
+	}
+	stats = emitter.CertValidationStats()
+	if stats.Successes != 0 || len(stats.Failures) != 0 {
+		t.Errorf("CertValidationStats() after emission = %+v, want zero", stats)
+	}
+	if data := emitter.certValidationMetricData(time.Now()); len(data) != 1 {
+		t.Errorf("certValidationMetricData() with no validations returned %d datums, want 1", len(data))
+	}
+}
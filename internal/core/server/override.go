@@ -0,0 +1,78 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// SetHostOverrideAllowlist sets the hosts that agents may present as an upstream Host header or
+// TLS server name override. Overrides are refused when the allowlist is empty (call before Start).
+func (s *Server) SetHostOverrideAllowlist(hosts []string) {
+	s.overrideHosts = make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			s.overrideHosts[h] = true
+		}
+	}
+}
+
+// checkHostOverride returns an error when the request carries an override outside the allowlist
+func (s *Server) checkHostOverride(req *protocol.Request) error {
+	for _, host := range []string{req.HostHeader, req.ServerName} {
+		if host != "" && !s.overrideHosts[strings.ToLower(host)] {
+			return fmt.Errorf("host override %q not allowed", host)
+		}
+	}
+	return nil
+}
+
+// clientFor returns the HTTP client for a request, using a client presenting the requested
+// TLS server name when the request overrides it, the key's dedicated client for pinned requests
+// and an HTTP/2 client for gRPC to plaintext upstreams
+func (s *Server) clientFor(req *protocol.Request) *http.Client {
+	if isGRPC(req) && strings.HasPrefix(strings.ToLower(req.URL), "http://") {
+		return s.h2cClient()
+	}
+	client := s.sniClientFor(req)
+	if req.AffinityKey != "" && s.affinityMax > 0 {
+		// Requests for different server names must not share a pinned connection
+		return s.affinityClient(strings.ToLower(req.ServerName)+" "+req.AffinityKey, client)
+	}
+	return client
+}
+
+// sniClientFor returns the shared client presenting the request's TLS server name
+func (s *Server) sniClientFor(req *protocol.Request) *http.Client {
+	if req.ServerName == "" {
+		return s.httpClient
+	}
+	name := strings.ToLower(req.ServerName)
+
+	s.sniMutex.Lock()
+	defer s.sniMutex.Unlock()
+
+	if client, ok := s.sniClients[name]; ok {
+		return client
+	}
+
+	transport := s.httpClient.Transport.(*http.Transport).Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.ServerName = name
+
+	client := &http.Client{
+		Timeout:       s.httpClient.Timeout,
+		Transport:     transport,
+		CheckRedirect: s.httpClient.CheckRedirect,
+	}
+	if s.sniClients == nil {
+		s.sniClients = make(map[string]*http.Client)
+	}
+	s.sniClients[name] = client
+	return client
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultPrewarmInterval is how often prewarmed upstreams are revisited to keep their pooled
+// connections alive; it sits below the upstream transport's 90s idle timeout
+const DefaultPrewarmInterval = 60 * time.Second
+
+// prewarmTimeout bounds each prewarm request
+const prewarmTimeout = 10 * time.Second
+
+// SetPrewarmHosts dials hosts at startup so the first requests to them reuse a pooled connection, and
+// revisits them every interval to keep it idle in the pool. Hosts are URLs or bare host names, which
+// use https. An interval of 0 uses DefaultPrewarmInterval; negative warms only at startup (call before Start).
+func (s *Server) SetPrewarmHosts(hosts []string, interval time.Duration) {
+	s.prewarmURLs = s.prewarmURLs[:0]
+	for _, host := range hosts {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if !strings.Contains(host, "://") {
+			host = "https://" + host
+		}
+		s.prewarmURLs = append(s.prewarmURLs, host)
+	}
+
+	if interval == 0 {
+		interval = DefaultPrewarmInterval
+	}
+	s.prewarmPeriod = interval
+}
+
+// startPrewarm warms the configured upstreams and keeps them warm until the server stops
+func (s *Server) startPrewarm() {
+	if len(s.prewarmURLs) == 0 {
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.prewarm()
+		if s.prewarmPeriod < 0 {
+			return
+		}
+
+		ticker := time.NewTicker(s.prewarmPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				s.prewarm()
+			}
+		}
+	}()
+
+	s.logger.Info("Upstream connection prewarming started", "hosts", len(s.prewarmURLs), "interval", s.prewarmPeriod.String())
+}
+
+// prewarm sends a HEAD request to each upstream, leaving its connection idle in the pool
+func (s *Server) prewarm() {
+	for _, target := range s.prewarmURLs {
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(s.ctx, prewarmTimeout)
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
+		if err != nil {
+			cancel()
+			s.logger.Warn("Invalid prewarm host, skipping", "host", target, "error", err.Error())
+			continue
+		}
+
+		resp, err := s.httpClient.Do(req)
+		if err != nil {
+			cancel()
+			s.logger.Warn("Failed to prewarm upstream connection", "host", target, "error", err.Error())
+			continue
+		}
+		// The body must be drained and closed for the connection to return to the pool
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		cancel()
+		s.logger.Debug("Prewarmed upstream connection", "host", target, "status", resp.StatusCode)
+	}
+}
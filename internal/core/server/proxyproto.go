@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fluidity/internal/shared/keepalive"
+)
+
+// proxyHeaderTimeout bounds how long a connection may take to send its PROXY protocol header
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature prefixes every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener optionally decodes a PROXY protocol header on accepted connections so that
+// RemoteAddr reports the client behind a load balancer rather than the load balancer itself
+type proxyProtocolListener struct {
+	net.Listener
+	enabled   atomic.Bool
+	keepalive net.KeepAliveConfig // TCP keepalive applied to accepted connections when enabled
+}
+
+// Accept wraps the next connection for PROXY protocol decoding when enabled
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		// A failure leaves the connection with the listener's default keepalive
+		_ = keepalive.TCP(conn, l.keepalive)
+	}
+	if err != nil || !l.enabled.Load() {
+		return conn, err
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// SetProxyProtocol requires every connection to start with a PROXY protocol v1 or v2 header, as sent by a
+// load balancer such as an AWS NLB, and reports the client address from it (call before Start)
+func (s *Server) SetProxyProtocol(enabled bool) {
+	if l, ok := s.rawListener.(*proxyProtocolListener); ok {
+		l.enabled.Store(enabled)
+	}
+}
+
+// proxyProtocolEnabled reports whether connections carry a PROXY protocol header
+func (s *Server) proxyProtocolEnabled() bool {
+	l, ok := s.rawListener.(*proxyProtocolListener)
+	return ok && l.enabled.Load()
+}
+
+// proxyProtocolConn reads the PROXY protocol header before the first read of connection data.
+// The header is read lazily, on the handshake's first read, so a slow client cannot stall Accept.
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	headerErr  error
+	remoteAddr atomic.Value // net.Addr
+
+	deadlineMu   sync.Mutex
+	readDeadline time.Time // Read deadline set by the caller, restored once the header is read
+}
+
+// Read returns connection data following the PROXY protocol header
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY protocol header once it has been read
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if addr, ok := c.remoteAddr.Load().(net.Addr); ok {
+		return addr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines, recording the read deadline for readHeader to restore
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.readDeadline = t
+	c.deadlineMu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline, recording it for readHeader to restore
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.readDeadline = t
+	c.deadlineMu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// readHeader decodes the PROXY protocol header, recording the source address it carries. The header
+// gets proxyHeaderTimeout, or less when the caller's deadline (such as the handshake's) is sooner,
+// and the caller's deadline is restored afterwards.
+func (c *proxyProtocolConn) readHeader() {
+	c.deadlineMu.Lock()
+	outer := c.readDeadline
+	c.deadlineMu.Unlock()
+	deadline := time.Now().Add(proxyHeaderTimeout)
+	if !outer.IsZero() && outer.Before(deadline) {
+		deadline = outer
+	}
+	c.Conn.SetReadDeadline(deadline)
+	defer func() {
+		c.deadlineMu.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.deadlineMu.Unlock()
+	}()
+
+	addr, err := readProxyHeader(c.reader)
+	if err != nil {
+		c.headerErr = fmt.Errorf("invalid PROXY protocol header from %s: %w", c.Conn.RemoteAddr(), err)
+		return
+	}
+	if addr != nil {
+		c.remoteAddr.Store(addr)
+	}
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header. It returns a nil address for headers
+// that carry no client address (v1 UNKNOWN, v2 LOCAL or unsupported address families).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	prefix, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(prefix, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	return nil, errors.New("missing PROXY protocol signature")
+}
+
+// readProxyHeaderV1 reads a text header such as "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// A v1 header is at most 107 bytes including the CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header is not terminated by CRLF")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed v1 source address %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads a binary header
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	version, command := header[12]>>4, header[12]&0x0f
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", version)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0: // LOCAL: health checks from the load balancer itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", command)
+	}
+
+	// Address families beyond TCP over IPv4/IPv6 carry no usable client IP; TLVs are ignored
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("short v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("short v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// minBusyRetryAfter is the shortest wait a server_busy notice asks of an agent
+const minBusyRetryAfter = time.Second
+
+// busyLinger bounds how long a turned-away connection stays open for the agent to read server_busy
+const busyLinger = 2 * time.Second
+
+// SetAcceptRamp takes on new agent connections no faster than rate per second for window after Start,
+// smoothing the burst of handshakes, authentication and certificate signing when many queued agents
+// reach a server that has just woken. Connections over the rate are sent server_busy with a short
+// retry-after and closed. A rate or window of 0 disables the ramp (call before Start).
+func (s *Server) SetAcceptRamp(rate float64, window time.Duration) {
+	s.acceptRamp = nil
+	if rate > 0 && window > 0 {
+		s.acceptRamp = &acceptRamp{rate: rate, window: window}
+	}
+}
+
+// acceptRamp is a token bucket, holding at most one connection, that limits accepts during warmup
+type acceptRamp struct {
+	mu     sync.Mutex
+	rate   float64
+	window time.Duration
+	until  time.Time
+	tokens float64
+	last   time.Time
+}
+
+// start opens the warmup window
+func (r *acceptRamp) start(now time.Time) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.until = now.Add(r.window)
+	r.tokens = 1
+	r.last = now
+}
+
+// allow reports whether a connection may be taken on now and, when it may not, how long until one can
+func (r *acceptRamp) allow(now time.Time) (bool, time.Duration) {
+	if r == nil {
+		return true, 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !now.Before(r.until) {
+		return true, 0
+	}
+	r.tokens = min(1, r.tokens+now.Sub(r.last).Seconds()*r.rate)
+	r.last = now
+	if r.tokens >= 1 {
+		r.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - r.tokens) / r.rate * float64(time.Second))
+}
+
+// rejectBusy completes the handshake of a connection turned away by the ramp, tells the agent to retry
+// after retryAfter and closes the connection once the agent has hung up or busyLinger has passed
+func (s *Server) rejectBusy(conn *tls.Conn, retryAfter time.Duration) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	retryAfter = max(retryAfter, minBusyRetryAfter)
+	s.logger.Warn("Server warming up, deferring new connection", "remote_addr", conn.RemoteAddr(), "retry_after", retryAfter.String())
+
+	if s.handshakeWait > 0 {
+		conn.SetDeadline(time.Now().Add(s.handshakeWait))
+	}
+	if err := conn.Handshake(); err != nil {
+		s.logger.Debug("TLS handshake of deferred connection failed", "remote_addr", conn.RemoteAddr(), "error", err.Error())
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(busyLinger))
+	notice := protocol.Envelope{Type: "server_busy", Payload: &protocol.ServerBusy{RetryAfterMs: retryAfter.Milliseconds()}}
+	if err := json.NewEncoder(conn).Encode(notice); err != nil {
+		s.logger.Debug("Failed to send server_busy", "remote_addr", conn.RemoteAddr(), "error", err.Error())
+		return
+	}
+
+	// Whatever the agent sends before it reads the notice is discarded
+	io.Copy(io.Discard, conn)
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// activity records when a tunnelled connection last carried data
+type activity struct {
+	last atomic.Int64 // Unix nanoseconds
+}
+
+// touch marks the connection as active now
+func (a *activity) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+// idleFor returns how long the connection has been idle at now
+func (a *activity) idleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, a.last.Load()))
+}
+
+// trackedConn is a CONNECT target connection with its last activity time and its agent's stream slot
+type trackedConn struct {
+	net.Conn
+	activity
+	slot     *streamSlot
+	bytesIn  atomic.Int64 // Bytes written to the target
+	bytesOut atomic.Int64 // Bytes read from the target
+	closed   sync.Once
+	onClose  func()           // Called once the connection is closed, when set
+	writes   chan targetWrite // Chunks waiting for the writer goroutine
+	done     chan struct{}    // Closed when the connection is closed
+}
+
+// newTrackedConn wraps conn, marking it active now
+func newTrackedConn(conn net.Conn, slot *streamSlot) *trackedConn {
+	c := &trackedConn{Conn: conn, slot: slot, done: make(chan struct{})}
+	c.touch()
+	return c
+}
+
+// Close closes the target connection, stops its writer and gives back the agent's stream slot
+func (c *trackedConn) Close() error {
+	c.slot.release()
+	err := c.Conn.Close()
+	c.closed.Do(func() {
+		close(c.done)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return err
+}
+
+// trackedWSConn is a target WebSocket connection with its last activity time and its agent's stream slot
+type trackedWSConn struct {
+	*websocket.Conn
+	activity
+	slot    *streamSlot
+	closed  sync.Once
+	onClose func() // Called once the connection is closed, when set
+}
+
+// newTrackedWSConn wraps conn, marking it active now
+func newTrackedWSConn(conn *websocket.Conn, slot *streamSlot) *trackedWSConn {
+	c := &trackedWSConn{Conn: conn, slot: slot}
+	c.touch()
+	return c
+}
+
+// Close closes the target WebSocket and gives back the agent's stream slot
+func (c *trackedWSConn) Close() error {
+	c.slot.release()
+	err := c.Conn.Close()
+	if c.onClose != nil {
+		c.closed.Do(c.onClose)
+	}
+	return err
+}
+
+// SetIdleReaper periodically closes tunnelled TCP and WebSocket connections idle for longer than
+// maxIdle and reconciles the active connection count. This guards against entries left behind by a
+// leaked reader goroutine. An interval or maxIdle of 0 disables the reaper (call before Start).
+func (s *Server) SetIdleReaper(interval, maxIdle time.Duration) {
+	s.reapInterval = interval
+	s.reapMaxIdle = maxIdle
+}
+
+// startReaper runs the idle connection reaper until the server stops
+func (s *Server) startReaper() {
+	if s.reapInterval <= 0 || s.reapMaxIdle <= 0 {
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.reapInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case now := <-ticker.C:
+				s.reapIdle(now)
+			}
+		}
+	}()
+
+	s.logger.Info("Idle connection reaper started", "interval", s.reapInterval.String(), "max_idle", s.reapMaxIdle.String())
+}
+
+// reapIdle closes and forgets connections idle beyond the limit at now
+func (s *Server) reapIdle(now time.Time) {
+	var staleTCP []*trackedConn
+	s.tcpMutex.Lock()
+	for id, conn := range s.tcpConns {
+		if idle := conn.idleFor(now); idle > s.reapMaxIdle {
+			s.logger.Warn("Reaping idle CONNECT tunnel", "id", id, "idle", idle.String())
+			delete(s.tcpConns, id)
+			delete(s.tcpHalfClosed, id)
+			staleTCP = append(staleTCP, conn)
+		}
+	}
+	s.tcpMutex.Unlock()
+
+	var staleWS []*trackedWSConn
+	s.wsMutex.Lock()
+	for id, conn := range s.wsConns {
+		if idle := conn.idleFor(now); idle > s.reapMaxIdle {
+			s.logger.Warn("Reaping idle WebSocket tunnel", "id", id, "idle", idle.String())
+			delete(s.wsConns, id)
+			staleWS = append(staleWS, conn)
+		}
+	}
+	s.wsMutex.Unlock()
+
+	// Closing unblocks any reader goroutine still attached, which then notifies the agent
+	for _, conn := range staleTCP {
+		conn.Close()
+	}
+	for _, conn := range staleWS {
+		conn.Close()
+	}
+
+	s.connMutex.Lock()
+	if tracked := int32(len(s.agentConns)); s.activeConns != tracked {
+		s.logger.Warn("Reconciling active connection count", "counted", s.activeConns, "tracked", tracked)
+		s.activeConns = tracked
+	}
+	s.connMutex.Unlock()
+}
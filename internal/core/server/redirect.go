@@ -0,0 +1,47 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Upstream redirect policies for SetRedirectPolicy
+const (
+	RedirectFollow         = "follow"                // Follow every redirect, as Go's HTTP client does by default
+	RedirectNoFollow       = "no-follow"             // Return 3xx responses to the agent unfollowed
+	RedirectFollowSameHost = "follow-same-host-only" // Follow redirects to the request's own host, returning others
+)
+
+// maxRedirects matches the redirect limit of Go's HTTP client
+const maxRedirects = 10
+
+// SetRedirectPolicy sets how upstream redirects are handled: RedirectFollow (the default, also used for
+// empty), RedirectNoFollow, or RedirectFollowSameHost, which hands redirects to another host back to the
+// agent rather than letting the server reach a host the agent never asked for (call before Start)
+func (s *Server) SetRedirectPolicy(policy string) error {
+	var check func(req *http.Request, via []*http.Request) error
+	switch strings.ToLower(strings.TrimSpace(policy)) {
+	case "", RedirectFollow:
+	case RedirectNoFollow:
+		check = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	case RedirectFollowSameHost:
+		check = func(req *http.Request, via []*http.Request) error {
+			if !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+				s.logger.Debug("Not following cross-host redirect", "from", via[0].URL.Host, "to", req.URL.Host)
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= maxRedirects {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		}
+	default:
+		return fmt.Errorf("unknown redirect policy %q", policy)
+	}
+	s.httpClient.CheckRedirect = check
+	return nil
+}
@@ -5,16 +5,24 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"fluidity/internal/core/server/metrics"
 	"fluidity/internal/shared/circuitbreaker"
+	"fluidity/internal/shared/coalesce"
+	"fluidity/internal/shared/keepalive"
 	"fluidity/internal/shared/logging"
 	"fluidity/internal/shared/protocol"
 	"fluidity/internal/shared/retry"
@@ -26,6 +34,9 @@ import (
 // Server handles mTLS connections from agents
 type Server struct {
 	listener       net.Listener
+	rawListener    net.Listener
+	listenOpts     ListenOptions
+	tlsConfig      *tls.Config // The listener's own copy of the TLS config given to NewServer
 	httpClient     *http.Client
 	circuitBreaker *circuitbreaker.CircuitBreaker
 	retryConfig    retry.Config
@@ -37,34 +48,135 @@ type Server struct {
 	maxConns       int
 	activeConns    int32
 	connMutex      sync.RWMutex
-	tcpConns       map[string]net.Conn
+	tcpConns       map[string]*trackedConn
+	tcpHalfClosed  map[string]*halfCloseState
 	tcpMutex       sync.RWMutex
-	wsConns        map[string]*websocket.Conn
+	wsConns        map[string]*trackedWSConn
 	wsMutex        sync.RWMutex
 	startTime      time.Time
 	testMode       bool // Skip IAM authentication for testing
+	iamRequired    bool
+	allowedMethods map[string]bool
+	allowedSchemes map[string]bool
+	strictFraming  bool
+	spillThreshold int64
+	spillDir       string
+	strictCompat   bool
+	logFullURL     bool
+	slowThreshold  time.Duration
+	workers        int
+	requestQueue   chan requestJob
+	overrideHosts  map[string]bool
+	sniClients     map[string]*http.Client
+	h2c            *http.Client // Plaintext HTTP/2 client for gRPC, created on first use
+	certValidation certValidationCounter
+	sniMutex       sync.Mutex
+	agentConns     map[*tls.Conn]*agentSession
+	audit          *auditLog
+	reapInterval   time.Duration
+	reapMaxIdle    time.Duration
+	streams        map[string]*trackedRequest
+	streamMutex    sync.Mutex
+	uploads        map[string]*requestUpload
+	uploadMutex    sync.Mutex
+	stopGrace      time.Duration
+	draining       atomic.Bool
+	activeRequests atomic.Int64
+	maxConnsPerIP  int
+	sourceConns    map[string]int
+	shedder        *loadShedder
+	affinityMax    int
+	affinityIdle   time.Duration
+	affinityPools  map[string]*affinityPool
+	affinityMutex  sync.Mutex
+	wsKeepalive    keepalive.Config
+	tcpKeepalive   net.KeepAliveConfig
+	heartbeat      time.Duration // Idle time after which agents are sent a ping (0 disables)
+	eventHandler   EventHandler
+	connectLimit   int
+	wsLimit        int
+	prewarmURLs    []string
+	prewarmPeriod  time.Duration
+	breakerConfigs map[string]circuitbreaker.Config
+	breakers       map[string]*circuitbreaker.CircuitBreaker
+	breakerMutex   sync.Mutex
+	handshakeWait  time.Duration
+	certWarning    time.Duration // Client certificates expiring within this are sent cert_expiring (0 disables)
+	keyPolicy      ClientKeyPolicy
+	tcpCoalesce    coalesce.Config
+	requestCap     time.Duration
+	acceptRamp     *acceptRamp
+	hedging        *hedgePolicy
+	hostLimit      *hostLimiter
+	gate           *headerGate
+	serverNames    *serverNameList
+	hook           *requestHook
+	budget         *memoryBudget
+	certExpiry     time.Time                   // NotAfter of the listener's certificate (zero when it is chosen per handshake)
+	lastError      atomic.Pointer[errorRecord] // Most recent significant error, for the health endpoint
+	pausedUntil    atomic.Int64                // Unix nanoseconds when the agents' flow_control pause lapses (0 when not paused)
+	overloadPause  time.Duration               // Longest pause sent to agents while overloaded (0 disables)
+	drainPause     bool                        // Pause agents when Stop begins draining
 }
 
+// DefaultSlowRequestThreshold is the request duration above which a slow request warning is logged
+const DefaultSlowRequestThreshold = 10 * time.Second
+
+// DefaultHandshakeTimeout bounds the TLS handshake of an accepted connection
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// DefaultMaxRequestDuration bounds the total time spent processing an HTTP request, retries included
+const DefaultMaxRequestDuration = 5 * time.Minute
+
+// streamHeaderTimeout bounds the wait for an event stream's response headers, as streams are exempt from
+// the request duration cap
+const streamHeaderTimeout = 30 * time.Second
+
+// DefaultRetryBudgetRatio is the share of requests that may be retried across all agents
+const DefaultRetryBudgetRatio = 0.1
+
+// retryBudgetBurst is the number of retry allowances saved for bursts of failures
+const retryBudgetBurst = 10
+
 // NewServer creates a new tunnel server
 func NewServer(tlsConfig *tls.Config, addr string, maxConns int, logLevel string) (*Server, error) {
 	return NewServerWithTestMode(tlsConfig, addr, maxConns, logLevel, false)
 }
 
+// NewServerWithListenOptions creates a new tunnel server whose listening socket has opts applied
+func NewServerWithListenOptions(tlsConfig *tls.Config, addr string, maxConns int, logLevel string, opts ListenOptions) (*Server, error) {
+	return newServer(tlsConfig, addr, maxConns, logLevel, false, opts)
+}
+
 // NewServerWithTestMode creates a new tunnel server with test mode option
 func NewServerWithTestMode(tlsConfig *tls.Config, addr string, maxConns int, logLevel string, testMode bool) (*Server, error) {
-	listener, err := tls.Listen("tcp", addr, tlsConfig)
+	return newServer(tlsConfig, addr, maxConns, logLevel, testMode, ListenOptions{})
+}
+
+func newServer(tlsConfig *tls.Config, addr string, maxConns int, logLevel string, testMode bool, opts ListenOptions) (*Server, error) {
+	if tlsConfig == nil || (len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil && tlsConfig.GetConfigForClient == nil) {
+		return nil, fmt.Errorf("failed to create listener: TLS config has no server certificate")
+	}
+	tcpListener, err := listen(addr, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create listener: %w", err)
 	}
 
-	// HTTP client for making requests to target websites
+	// PROXY protocol headers precede the TLS handshake, so they are decoded beneath the TLS listener
+	rawListener := &proxyProtocolListener{Listener: tcpListener}
+	tlsConfig = tlsConfig.Clone()
+	listener := tls.NewListener(rawListener, tlsConfig)
+
+	// HTTP client for making requests to target websites; it has no overall timeout, as the request
+	// duration cap bounds each request, retries included
 	httpClient := &http.Client{
-		Timeout: 30 * time.Second,
 		Transport: &http.Transport{
 			MaxIdleConns:        100,
 			MaxIdleConnsPerHost: 10,
 			IdleConnTimeout:     90 * time.Second,
 			TLSHandshakeTimeout: 10 * time.Second,
+			// Keep HTTP/2 when clones set their own TLS config, as gRPC upstreams need it
+			ForceAttemptHTTP2: true,
 		},
 	}
 
@@ -83,6 +195,7 @@ func NewServerWithTestMode(tlsConfig *tls.Config, addr string, maxConns int, log
 		InitialDelay: 500 * time.Millisecond,
 		MaxDelay:     5 * time.Second,
 		Multiplier:   2.0,
+		Budget:       retry.NewBudget(DefaultRetryBudgetRatio, retryBudgetBurst),
 	}
 
 	// Initialize metrics emitter (optional - gracefully disabled if not configured)
@@ -99,6 +212,9 @@ func NewServerWithTestMode(tlsConfig *tls.Config, addr string, maxConns int, log
 
 	return &Server{
 		listener:       listener,
+		rawListener:    rawListener,
+		listenOpts:     opts,
+		tlsConfig:      tlsConfig,
 		httpClient:     httpClient,
 		circuitBreaker: cb,
 		retryConfig:    retryConfig,
@@ -107,13 +223,155 @@ func NewServerWithTestMode(tlsConfig *tls.Config, addr string, maxConns int, log
 		ctx:            ctx,
 		cancel:         cancel,
 		maxConns:       maxConns,
-		tcpConns:       make(map[string]net.Conn),
-		wsConns:        make(map[string]*websocket.Conn),
+		tcpConns:       make(map[string]*trackedConn),
+		tcpHalfClosed:  make(map[string]*halfCloseState),
+		wsConns:        make(map[string]*trackedWSConn),
+		agentConns:     make(map[*tls.Conn]*agentSession),
+		streams:        make(map[string]*trackedRequest),
+		uploads:        make(map[string]*requestUpload),
 		startTime:      time.Now(),
+		certExpiry:     certificateExpiry(tlsConfig),
 		testMode:       testMode,
+		iamRequired:    !testMode,
+		slowThreshold:  DefaultSlowRequestThreshold,
+		stopGrace:      DefaultStopGracePeriod,
+		wsKeepalive:    keepalive.DefaultConfig(),
+		heartbeat:      keepalive.DefaultHeartbeatInterval,
+		handshakeWait:  DefaultHandshakeTimeout,
+		certWarning:    DefaultCertExpiryWarning,
+		requestCap:     DefaultMaxRequestDuration,
 	}, nil
 }
 
+// SetSlowRequestThreshold sets the duration above which requests are logged as slow (negative disables; call before Start)
+func (s *Server) SetSlowRequestThreshold(threshold time.Duration) {
+	s.slowThreshold = threshold
+}
+
+// SetMaxRequestDuration caps the wall-clock time an HTTP request may take from the first upstream attempt
+// to its fully read response, however slowly the upstream trickles it; requests over the cap are
+// cancelled and answered with a 504. Event streams are exempt. 0 keeps DefaultMaxRequestDuration and
+// negative disables the cap (call before Start).
+func (s *Server) SetMaxRequestDuration(limit time.Duration) {
+	if limit != 0 {
+		s.requestCap = limit
+	}
+}
+
+// SetHandshakeTimeout bounds the TLS handshake (including any PROXY protocol header) of accepted
+// connections, so a client that connects and then stalls cannot hold a connection slot. 0 keeps
+// DefaultHandshakeTimeout and negative disables the deadline (call before Start).
+func (s *Server) SetHandshakeTimeout(timeout time.Duration) {
+	if timeout != 0 {
+		s.handshakeWait = timeout
+	}
+}
+
+// SetConnectCoalescing gathers small reads from CONNECT targets for up to delay, or until maxBytes are
+// buffered, before sending them to the agent as one connect_data, so interactive streams do not pay
+// envelope overhead per keystroke. A delay of 0 sends every read immediately (call before Start).
+func (s *Server) SetConnectCoalescing(delay time.Duration, maxBytes int) {
+	s.tcpCoalesce = coalesce.Config{Delay: delay, MaxBytes: maxBytes}
+}
+
+// SetWebSocketKeepalive pings tunnelled target WebSockets every interval and closes those that do not
+// answer within timeout (an interval of 0 disables pings; call before Start)
+func (s *Server) SetWebSocketKeepalive(interval, timeout time.Duration) {
+	s.wsKeepalive = keepalive.Config{Interval: interval, Timeout: timeout}
+}
+
+// SetHeartbeatInterval pings agents whenever their tunnel has written nothing for interval, so load
+// balancers such as an NLB never drop it as idle. 0 uses keepalive.DefaultHeartbeatInterval and a
+// negative interval disables heartbeats (call before Start).
+func (s *Server) SetHeartbeatInterval(interval time.Duration) {
+	s.heartbeat = keepalive.ResolveHeartbeat(interval)
+}
+
+// SetTCPKeepalive applies TCP keepalive to accepted agent connections and CONNECT upstream dials, so
+// dead peers are detected at the TCP layer; a config that does not enable keepalive leaves Go's
+// defaults (call before Start)
+func (s *Server) SetTCPKeepalive(config net.KeepAliveConfig) {
+	s.tcpKeepalive = config
+	if l, ok := s.rawListener.(*proxyProtocolListener); ok {
+		l.keepalive = config
+	}
+}
+
+// SetRetryBudget limits upstream retries to ratio of requests so that retries do not multiply load
+// during an outage (negative disables the budget; call before Start)
+func (s *Server) SetRetryBudget(ratio float64) {
+	if ratio < 0 {
+		s.retryConfig.Budget = nil
+		return
+	}
+	s.retryConfig.Budget = retry.NewBudget(ratio, retryBudgetBurst)
+}
+
+// Logger returns the server's logger so callers can adjust its level or output
+func (s *Server) Logger() *logging.Logger {
+	return s.logger
+}
+
+// SetLogFullURL adds each request's full URL to the debug log; info logs stay domain-only (call before Start)
+func (s *Server) SetLogFullURL(enabled bool) {
+	s.logFullURL = enabled
+	if enabled {
+		s.logger.Warn("Full request URLs will be logged at debug level; paths and query strings may contain sensitive data")
+	}
+}
+
+// SetStrictCompatibility makes the server refuse agents with an incompatible protocol version (call before Start)
+func (s *Server) SetStrictCompatibility(strict bool) {
+	s.strictCompat = strict
+}
+
+// SetIAMAuthRequired sets whether agents must complete the IAM authentication handshake before any
+// other message. When not required, as for mTLS-only deployments, the handshake is skipped and a stray
+// IAM auth request is acknowledged without validation. Required by default outside test mode (call before Start).
+func (s *Server) SetIAMAuthRequired(required bool) {
+	s.iamRequired = required
+}
+
+// SetAllowedMethods restricts the HTTP methods the server will forward (empty allows all; call before Start)
+func (s *Server) SetAllowedMethods(methods []string) {
+	s.allowedMethods = nil
+	if len(methods) == 0 {
+		return
+	}
+	s.allowedMethods = make(map[string]bool, len(methods))
+	for _, m := range methods {
+		s.allowedMethods[strings.ToUpper(strings.TrimSpace(m))] = true
+	}
+}
+
+// SetAllowedSchemes restricts the request URL schemes the server will forward, refusing others such as
+// file or gopher with invalid_scheme (empty uses protocol.DefaultAllowedSchemes; call before Start)
+func (s *Server) SetAllowedSchemes(schemes []string) {
+	s.allowedSchemes = nil
+	if len(schemes) == 0 {
+		return
+	}
+	s.allowedSchemes = make(map[string]bool, len(schemes))
+	for _, scheme := range schemes {
+		s.allowedSchemes[strings.ToLower(strings.TrimSpace(scheme))] = true
+	}
+}
+
+// schemeAllowed reports whether a request for scheme may be forwarded
+func (s *Server) schemeAllowed(scheme string) bool {
+	if s.allowedSchemes == nil {
+		return slices.Contains(protocol.DefaultAllowedSchemes, scheme)
+	}
+	return s.allowedSchemes[scheme]
+}
+
+// SetStrictFraming rejects requests whose body length is ambiguous, with Content-Length and
+// Transfer-Encoding headers together or more than one Content-Length, instead of removing those headers
+// and framing the body from its actual length (call before Start)
+func (s *Server) SetStrictFraming(strict bool) {
+	s.strictFraming = strict
+}
+
 // Start begins accepting connections
 func (s *Server) Start() error {
 	s.logger.Info("Tunnel server starting", "addr", s.listener.Addr())
@@ -123,6 +381,13 @@ func (s *Server) Start() error {
 		s.metricsEmitter.Start()
 	}
 
+	s.startWorkers()
+	s.startAudit()
+	s.startReaper()
+	s.startPrewarm()
+	s.startOverloadPause()
+	s.acceptRamp.start(time.Now())
+
 	for {
 		select {
 		case <-s.ctx.Done():
@@ -137,13 +402,16 @@ func (s *Server) Start() error {
 			case <-s.ctx.Done():
 				return nil
 			default:
+				if s.draining.Load() {
+					return nil
+				}
 				s.logger.Error("Failed to accept connection", err)
 				continue
 			}
 		}
 
 		s.logger.Debug("New connection accepted", "remote_addr", conn.RemoteAddr(), "local_addr", conn.LocalAddr())
-		
+
 		// Log TLS connection details
 		if tlsConn, ok := conn.(*tls.Conn); ok {
 			state := tlsConn.ConnectionState()
@@ -155,6 +423,13 @@ func (s *Server) Start() error {
 				"negotiated_protocol", state.NegotiatedProtocol)
 		}
 
+		// While warming up, take on new agents no faster than the ramp allows
+		if ok, wait := s.acceptRamp.allow(time.Now()); !ok {
+			s.wg.Add(1)
+			go s.rejectBusy(conn.(*tls.Conn), wait)
+			continue
+		}
+
 		// Check connection limit
 		s.connMutex.RLock()
 		if int(s.activeConns) >= s.maxConns {
@@ -165,27 +440,49 @@ func (s *Server) Start() error {
 		}
 		s.connMutex.RUnlock()
 
+		// Check the per-IP limit; behind a PROXY protocol load balancer the client address is only
+		// known once the header has been read, so handleConnection checks it after the handshake
+		var source string
+		if !s.proxyProtocolEnabled() {
+			var ok bool
+			if source, ok = s.acquireSource(conn.RemoteAddr()); !ok {
+				s.logger.Warn("Per-IP connection limit reached, rejecting new connection", "remote_addr", conn.RemoteAddr(), "limit", s.maxConnsPerIP)
+				conn.Close()
+				continue
+			}
+		}
+
 		// Handle each connection in a goroutine
 		s.wg.Add(1)
-		go s.handleConnection(conn.(*tls.Conn))
+		go s.handleConnection(conn.(*tls.Conn), source)
 	}
 }
 
 // Stop gracefully shuts down the server
 func (s *Server) Stop() error {
-	s.logger.Info("Stopping tunnel server")
+	s.logger.Info("Stopping tunnel server", "grace_period", s.stopGrace.String())
+	deadline := time.Now().Add(s.stopGrace)
+
+	// Refuse new agents, then let connected ones know so they can finish or move elsewhere
+	s.draining.Store(true)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.notifyShutdown()
+	if s.drainPause {
+		s.PauseAgents(s.stopGrace)
+	}
+	s.drain(deadline)
+
 	s.cancel()
+	s.closeAgentConns()
 
 	// Stop metrics emitter
 	if s.metricsEmitter != nil {
 		s.metricsEmitter.Stop()
 	}
 
-	if s.listener != nil {
-		s.listener.Close()
-	}
-
-	// Wait for all connections to close
+	// Wait for all connections to close, within what is left of the grace period
 	done := make(chan struct{})
 	go func() {
 		s.wg.Wait()
@@ -194,7 +491,7 @@ func (s *Server) Stop() error {
 
 	select {
 	case <-done:
-	case <-time.After(10 * time.Second):
+	case <-time.After(max(time.Until(deadline), time.Second)):
 		s.logger.Warn("Timeout waiting for connections to close")
 	}
 
@@ -203,11 +500,16 @@ func (s *Server) Stop() error {
 
 // HealthStatus represents the health check response
 type HealthStatus struct {
-	Status             string  `json:"status"`
-	ActiveConnections  int32   `json:"active_connections"`
-	UptimeSeconds      int64   `json:"uptime_seconds"`
-	MaxConnections     int     `json:"max_connections"`
-	ConnectionsPercent float64 `json:"connections_percent"`
+	Status             string              `json:"status"`
+	ActiveConnections  int32               `json:"active_connections"`
+	UptimeSeconds      int64               `json:"uptime_seconds"`
+	MaxConnections     int                 `json:"max_connections"`
+	ConnectionsPercent float64             `json:"connections_percent"`
+	ActiveStreams      StreamCounts        `json:"active_streams"`
+	CertValidUntil     time.Time           `json:"cert_valid_until"`
+	LastError          string              `json:"last_error,omitempty"`
+	LastErrorAt        time.Time           `json:"last_error_at"`
+	CertValidation     CertValidationStats `json:"cert_validation"`
 }
 
 // GetHealth returns the health status of the server
@@ -222,23 +524,37 @@ func (s *Server) GetHealth() HealthStatus {
 		connPercent = (float64(activeConns) / float64(s.maxConns)) * 100
 	}
 
-	return HealthStatus{
+	health := HealthStatus{
 		Status:             "healthy",
 		ActiveConnections:  activeConns,
 		UptimeSeconds:      uptime,
 		MaxConnections:     s.maxConns,
 		ConnectionsPercent: connPercent,
+		ActiveStreams:      s.activeStreams(),
+		CertValidUntil:     s.certExpiry,
+		CertValidation:     s.CertValidationStats(),
+	}
+	if last := s.lastError.Load(); last != nil {
+		health.LastError = last.message
+		health.LastErrorAt = last.at
 	}
+	return health
 }
 
-// handleConnection processes requests from a single agent
-func (s *Server) handleConnection(conn *tls.Conn) {
+// handleConnection processes requests from a single agent. source is the per-IP slot taken in Start,
+// empty when it is still to be checked.
+func (s *Server) handleConnection(conn *tls.Conn, source string) {
+	tracker := s.trackConnection(conn.RemoteAddr().String())
+	disconnectReason := DisconnectAgentClosed
 	defer func() {
+		tracker.disconnected(disconnectReason)
 		conn.Close()
 		s.wg.Done()
+		s.releaseSource(source)
 
 		s.connMutex.Lock()
 		s.activeConns--
+		delete(s.agentConns, conn)
 		s.connMutex.Unlock()
 
 		// Decrement metrics
@@ -247,8 +563,10 @@ func (s *Server) handleConnection(conn *tls.Conn) {
 		}
 	}()
 
+	session := &agentSession{}
 	s.connMutex.Lock()
 	s.activeConns++
+	s.agentConns[conn] = session
 	s.connMutex.Unlock()
 
 	// Increment metrics
@@ -256,20 +574,60 @@ func (s *Server) handleConnection(conn *tls.Conn) {
 		s.metricsEmitter.IncrementConnections()
 	}
 
-	// Complete the TLS handshake before inspecting connection state
+	// Complete the TLS handshake before inspecting connection state, within a deadline so a stalled
+	// handshake cannot hold the connection slot; the deadline is cleared once it completes
+	if s.handshakeWait > 0 {
+		conn.SetDeadline(time.Now().Add(s.handshakeWait))
+	}
 	if err := conn.Handshake(); err != nil {
-		s.logger.Error("TLS handshake failed", err, "remote_addr", conn.RemoteAddr())
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			s.logger.Warn("TLS handshake timed out, closing connection", "remote_addr", conn.RemoteAddr(), "timeout", s.handshakeWait.String())
+		} else if reason, client, ok := handshakeCertFailure(err); ok {
+			s.certRejected(reason, client, conn.RemoteAddr(), err)
+			s.recordError("TLS handshake failed", err)
+		} else {
+			s.logger.Error("TLS handshake failed", err, "remote_addr", conn.RemoteAddr())
+			s.recordError("TLS handshake failed", err)
+		}
+		disconnectReason = DisconnectHandshakeFailed
 		return
 	}
+	conn.SetDeadline(time.Time{})
+
+	if source == "" && s.proxyProtocolEnabled() {
+		// The PROXY protocol header has now been read, so report the client behind the load balancer
+		tracker.remoteAddr = conn.RemoteAddr().String()
+		var ok bool
+		if source, ok = s.acquireSource(conn.RemoteAddr()); !ok {
+			s.logger.Warn("Per-IP connection limit reached, rejecting new connection", "remote_addr", conn.RemoteAddr(), "limit", s.maxConnsPerIP)
+			disconnectReason = DisconnectConnectionLimit
+			return
+		}
+	}
 
 	// Verify client certificate (after handshake)
 	state := conn.ConnectionState()
 	if len(state.PeerCertificates) == 0 {
 		s.logger.Warn("Client connected without certificate", "remote_addr", conn.RemoteAddr())
+		s.certRejected(CertFailureNoCertificate, "", conn.RemoteAddr(), nil)
+		tracker.authFailed("no client certificate")
+		disconnectReason = DisconnectAuthFailed
 		return
 	}
 
 	clientCert := state.PeerCertificates[0]
+	tracker.client = clientCert.Subject.CommonName
+	if err := s.keyPolicy.check(clientCert); err != nil {
+		s.logger.Warn("Rejecting client certificate with a key below the minimum strength",
+			"client", clientCert.Subject.CommonName,
+			"remote_addr", conn.RemoteAddr(),
+			"reason", err.Error())
+		s.certRejected(CertFailureKeyPolicy, clientCert.Subject.CommonName, conn.RemoteAddr(), err)
+		tracker.authFailed(err.Error())
+		disconnectReason = DisconnectAuthFailed
+		return
+	}
+	s.certAccepted()
 	clientInfo := tlsutil.GetCertificateInfo(clientCert)
 	s.logger.Info("Agent connected",
 		"client", clientCert.Subject.CommonName,
@@ -278,31 +636,58 @@ func (s *Server) handleConnection(conn *tls.Conn) {
 		"tls_version", state.Version)
 	s.logger.Debug("Agent TLS details", "cert_info", clientInfo, "negotiated_protocol", state.NegotiatedProtocol)
 
-	decoder := json.NewDecoder(conn)
-	encoder := json.NewEncoder(conn)
-
-	// IAM authentication (skip in test mode)
-	if !s.testMode {
+	decoder := json.NewDecoder(tracker.reader(conn))
+	// Writes are tracked so heartbeats are only sent while the connection is otherwise idle
+	var activity keepalive.Activity
+	activity.Touch()
+	encoder := json.NewEncoder(activity.Writer(tracker.writer(conn)))
+	stopHeartbeat := make(chan struct{})
+	defer close(stopHeartbeat)
+	heartbeating := false
+
+	// IAM authentication (skipped in test mode and mTLS-only deployments)
+	if s.iamRequired {
 		if err := s.performIAMAuthentication(decoder, encoder); err != nil {
 			s.logger.Error("IAM authentication failed", err)
+			s.recordError("IAM authentication failed", err)
+			tracker.authFailed(err.Error())
+			disconnectReason = DisconnectAuthFailed
 			return
 		}
+		tracker.authenticated(AuthMethodIAM)
+	} else {
+		tracker.authenticated(AuthMethodMTLS)
 	}
 
 	// Mutex to protect concurrent writes to encoder
 	var encoderMutex sync.Mutex
 
+	// Authenticated agents receive broadcasts such as the shutdown notice
+	s.connMutex.Lock()
+	session.encoder, session.mu = encoder, &encoderMutex
+	s.connMutex.Unlock()
+	s.pauseNewAgent(session)
+	s.adviseCertExpiry(session, clientCert)
+
+	// Features advertised by the agent's hello (none for legacy agents)
+	var agentFeatures uint64
+
 	for {
 		select {
 		case <-s.ctx.Done():
+			disconnectReason = DisconnectServerShutdown
 			return
 		default:
 		}
 
 		var env protocol.Envelope
 		if err := decoder.Decode(&env); err != nil {
-			if err != io.EOF {
+			switch {
+			case s.draining.Load() || s.ctx.Err() != nil:
+				disconnectReason = DisconnectServerShutdown
+			case err != io.EOF:
 				s.logger.Error("Failed to decode envelope from agent", err, "remote_addr", conn.RemoteAddr())
+				disconnectReason = DisconnectReadError
 			}
 			break
 		}
@@ -311,13 +696,20 @@ func (s *Server) handleConnection(conn *tls.Conn) {
 
 		// Validate message type
 		validTypes := map[string]bool{
-			"http_request":  true,
-			"connect_open":  true,
-			"connect_data":  true,
-			"connect_close": true,
-			"ws_open":       true,
-			"ws_message":    true,
-			"ws_close":      true,
+			"http_request":         true,
+			"http_request_chunk":   true,
+			"connect_open":         true,
+			"connect_data":         true,
+			"connect_close":        true,
+			"connect_half_close":   true,
+			"ws_open":              true,
+			"ws_message":           true,
+			"ws_close":             true,
+			"hello":                true,
+			"iam_auth_request":     !s.iamRequired,
+			"http_cancel":          true,
+			"http_response_credit": true,
+			"ping":                 true,
 		}
 		if !validTypes[env.Type] {
 			s.logger.Warn("Received unknown message type from agent, ignoring", "type", env.Type, "remote_addr", conn.RemoteAddr())
@@ -333,8 +725,22 @@ func (s *Server) handleConnection(conn *tls.Conn) {
 				s.logger.Error("Failed to parse http_request", err)
 				continue
 			}
-			// Process request in a goroutine to handle concurrent requests
-			go s.processRequest(&req, encoder, &encoderMutex)
+			tracker.request()
+			if req.BodyStream {
+				s.openUpload(req.ID, encoder, &encoderMutex)
+			}
+			// Process request concurrently, on the worker pool when one is configured
+			s.dispatchRequest(&req, clientCert.Subject.CommonName, encoder, &encoderMutex)
+
+		case "http_request_chunk":
+			m, _ := env.Payload.(map[string]any)
+			b, _ := json.Marshal(m)
+			var chunk protocol.Chunk
+			if err := json.Unmarshal(b, &chunk); err != nil {
+				s.logger.Error("Failed to parse http_request_chunk", err)
+				continue
+			}
+			s.deliverUploadChunk(&chunk)
 
 		case "connect_open":
 			m, _ := env.Payload.(map[string]any)
@@ -344,7 +750,13 @@ func (s *Server) handleConnection(conn *tls.Conn) {
 				s.logger.Error("Failed to parse connect_open", err)
 				continue
 			}
-			go s.handleConnectOpen(&open, encoder, &encoderMutex)
+			tracker.request()
+			slot, ok := acquireStream(&session.connectStreams, s.connectLimit)
+			if !ok {
+				s.rejectConnectOpen(&open, clientCert.Subject.CommonName, encoder, &encoderMutex)
+				continue
+			}
+			go s.handleConnectOpen(&open, clientCert.Subject.CommonName, slot, agentFeatures&protocol.FeatureHalfClose != 0, encoder, &encoderMutex)
 
 		case "connect_data":
 			m, _ := env.Payload.(map[string]any)
@@ -354,7 +766,8 @@ func (s *Server) handleConnection(conn *tls.Conn) {
 				s.logger.Error("Failed to parse connect_data", err)
 				continue
 			}
-			go s.handleConnectData(&data)
+			// Handled in order so a later half-close can never overtake this data
+			s.handleConnectData(&data)
 
 		case "connect_close":
 			m, _ := env.Payload.(map[string]any)
@@ -365,6 +778,15 @@ func (s *Server) handleConnection(conn *tls.Conn) {
 			}
 			go s.handleConnectClose(&cls)
 
+		case "connect_half_close":
+			m, _ := env.Payload.(map[string]any)
+			b, _ := json.Marshal(m)
+			var half protocol.ConnectHalfClose
+			if err := json.Unmarshal(b, &half); err != nil {
+				continue
+			}
+			s.handleConnectHalfClose(&half, encoder, &encoderMutex)
+
 		case "ws_open":
 			m, _ := env.Payload.(map[string]any)
 			b, _ := json.Marshal(m)
@@ -373,7 +795,13 @@ func (s *Server) handleConnection(conn *tls.Conn) {
 				s.logger.Error("Failed to parse ws_open", err)
 				continue
 			}
-			go s.handleWebSocketOpen(&open, encoder, &encoderMutex)
+			tracker.request()
+			slot, ok := acquireStream(&session.wsStreams, s.wsLimit)
+			if !ok {
+				s.rejectWebSocketOpen(&open, clientCert.Subject.CommonName, encoder, &encoderMutex)
+				continue
+			}
+			go s.handleWebSocketOpen(&open, slot, encoder, &encoderMutex)
 
 		case "ws_message":
 			m, _ := env.Payload.(map[string]any)
@@ -394,6 +822,71 @@ func (s *Server) handleConnection(conn *tls.Conn) {
 			}
 			go s.handleWebSocketClose(&cls)
 
+		case "hello":
+			m, _ := env.Payload.(map[string]any)
+			b, _ := json.Marshal(m)
+			var hello protocol.Hello
+			if err := json.Unmarshal(b, &hello); err != nil {
+				s.logger.Error("Failed to parse hello", err)
+				continue
+			}
+			if !s.handleHello(&hello, clientCert.Subject.CommonName, encoder, &encoderMutex) {
+				disconnectReason = DisconnectIncompatibleProtocol
+				return
+			}
+			agentFeatures = hello.Features
+
+			// Agents that did not advertise heartbeat support are not pinged
+			if s.heartbeat > 0 && !heartbeating && agentFeatures&protocol.FeatureHeartbeat != 0 {
+				heartbeating = true
+				go keepalive.Heartbeat(&activity, s.heartbeat, stopHeartbeat, func() error {
+					s.logger.Debug("Sending heartbeat ping to agent", "client", clientCert.Subject.CommonName)
+					encoderMutex.Lock()
+					defer encoderMutex.Unlock()
+					return encoder.Encode(protocol.Envelope{Type: "ping"})
+				})
+			}
+
+		case "ping":
+			s.logger.Debug("Heartbeat ping received from agent", "client", clientCert.Subject.CommonName)
+
+		case "http_cancel":
+			m, _ := env.Payload.(map[string]any)
+			b, _ := json.Marshal(m)
+			var cancel protocol.HTTPCancel
+			if err := json.Unmarshal(b, &cancel); err != nil {
+				s.logger.Error("Failed to parse http_cancel", err)
+				continue
+			}
+			s.cancelRequest(cancel.ID)
+
+		case "http_response_credit":
+			m, _ := env.Payload.(map[string]any)
+			b, _ := json.Marshal(m)
+			var credit protocol.ChunkCredit
+			if err := json.Unmarshal(b, &credit); err != nil {
+				s.logger.Error("Failed to parse http_response_credit", err)
+				continue
+			}
+			s.grantStreamCredit(&credit)
+
+		case "iam_auth_request":
+			// IAM auth is not required, so answer agents that still attempt it rather than leave them waiting
+			m, _ := env.Payload.(map[string]any)
+			b, _ := json.Marshal(m)
+			var authReq protocol.IAMAuthRequest
+			if err := json.Unmarshal(b, &authReq); err != nil {
+				s.logger.Error("Failed to parse iam_auth_request", err)
+				continue
+			}
+			s.logger.Debug("IAM authentication not required, acknowledging request", "request_id", authReq.ID)
+			encoderMutex.Lock()
+			err := encoder.Encode(protocol.Envelope{Type: "iam_auth_response", Payload: protocol.IAMAuthResponse{ID: authReq.ID, Ok: true}})
+			encoderMutex.Unlock()
+			if err != nil {
+				s.logger.Error("Failed to send IAM auth response", err)
+			}
+
 		default:
 			// Ignore unknown message types
 		}
@@ -403,8 +896,43 @@ func (s *Server) handleConnection(conn *tls.Conn) {
 }
 
 // processRequest handles a single HTTP request with circuit breaker and retry logic
-func (s *Server) processRequest(req *protocol.Request, encoder *json.Encoder, mu *sync.Mutex) {
-	s.logger.Debug("Processing request", "id", req.ID, "method", req.Method, "url", req.URL)
+func (s *Server) processRequest(req *protocol.Request, client string, encoder *json.Encoder, mu *sync.Mutex) {
+	s.logger.Debug("Processing request", "id", req.ID, "method", req.Method, "url", s.logURL(req.URL))
+	start := time.Now()
+	if req.BodyStream {
+		defer s.closeUpload(req.ID)
+	}
+
+	// Every request is audited, including those turned away, with the status the agent was sent. The body
+	// is measured now, as a body spilled to disk no longer has it in memory.
+	status := http.StatusBadGateway
+	bodySize := int64(len(req.Body))
+	var received, uploaded atomic.Int64
+	if s.audit != nil {
+		defer func() {
+			s.recordAudit(AuditRecord{
+				Time:       start,
+				Client:     client,
+				Type:       AuditHTTP,
+				Method:     req.Method,
+				Domain:     requestDomain(req.URL),
+				Status:     status,
+				BytesIn:    bodySize + uploaded.Load(),
+				BytesOut:   received.Load(),
+				DurationMs: time.Since(start).Milliseconds(),
+			})
+		}()
+	}
+
+	// Under overload, turn new work away before it counts against the load
+	if s.shouldShed(req.ID) {
+		status = http.StatusServiceUnavailable
+		s.sendRetryLaterResponse(req.ID, fmt.Errorf("server overloaded, request shed"), protocol.ErrCodeLoadShed, 1, encoder, mu)
+		return
+	}
+
+	s.activeRequests.Add(1)
+	defer s.activeRequests.Add(-1)
 
 	// Update last activity timestamp
 	if s.metricsEmitter != nil {
@@ -414,25 +942,179 @@ func (s *Server) processRequest(req *protocol.Request, encoder *json.Encoder, mu
 	// Log the target endpoint (domain only)
 	s.logRequest(req)
 
-	// Execute request with circuit breaker and retry logic
-	err := s.circuitBreaker.Execute(func() error {
-		return s.executeRequestWithRetry(req, encoder, mu)
+	// An empty method means GET, as in net/http
+	if req.Method == "" {
+		req.Method = http.MethodGet
+	}
+
+	// Requests without the deployment's gate header are turned away before anything else
+	if !s.admit(req.Headers) {
+		s.logger.Warn("Rejecting request without the required header", "id", req.ID, "client", client)
+		status = http.StatusForbidden
+		s.sendErrorResponseWithStatus(req.ID, http.StatusForbidden, protocol.ErrCodeForbidden, errGateRejected, encoder, mu)
+		return
+	}
+
+	// Reject malformed methods to prevent request smuggling via a crafted method
+	if !protocol.IsValidMethod(req.Method) {
+		s.logger.Warn("Rejecting request with malformed method", "id", req.ID, "method", fmt.Sprintf("%q", req.Method))
+		status = http.StatusBadRequest
+		s.sendErrorResponseWithStatus(req.ID, http.StatusBadRequest, protocol.ErrCodeBadRequest, fmt.Errorf("malformed HTTP method"), encoder, mu)
+		return
+	}
+
+	// Conflicting framing headers are a request smuggling vector, whichever length the upstream would believe
+	if err := protocol.CheckFraming(req.Headers); err != nil {
+		if s.strictFraming {
+			s.logger.Warn("Rejecting request with ambiguous framing headers", "id", req.ID, "error", err.Error())
+			status = http.StatusBadRequest
+			s.sendErrorResponseWithStatus(req.ID, http.StatusBadRequest, protocol.ErrCodeBadRequest, err, encoder, mu)
+			return
+		}
+		s.logger.Warn("Removing ambiguous framing headers from request", "id", req.ID, "error", err.Error())
+		protocol.SanitizeFraming(req.Headers)
+	}
+
+	if s.allowedMethods != nil && !s.allowedMethods[req.Method] {
+		s.logger.Warn("Rejecting request with disallowed method", "id", req.ID, "method", req.Method)
+		status = http.StatusMethodNotAllowed
+		s.sendErrorResponseWithStatus(req.ID, http.StatusMethodNotAllowed, protocol.ErrCodeMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method), encoder, mu)
+		return
+	}
+
+	// Go's client would try any scheme it supports, so only allowed ones are passed to it
+	if target, err := parseURL(req.URL); err == nil && !s.schemeAllowed(target.Scheme) {
+		s.logger.Warn("Rejecting request with disallowed scheme", "id", req.ID, "scheme", target.Scheme)
+		status = http.StatusBadRequest
+		s.sendErrorResponseWithStatus(req.ID, http.StatusBadRequest, protocol.ErrCodeInvalidScheme, fmt.Errorf("scheme %q not allowed", target.Scheme), encoder, mu)
+		return
+	}
+
+	if err := s.checkHostOverride(req); err != nil {
+		s.logger.Warn("Rejecting request with disallowed host override", "id", req.ID, "host", req.HostHeader, "server_name", req.ServerName)
+		status = http.StatusForbidden
+		s.sendErrorResponseWithStatus(req.ID, http.StatusForbidden, protocol.ErrCodeForbidden, err, encoder, mu)
+		return
+	}
+
+	// Verify request body integrity when the agent supplied a checksum
+	if err := protocol.VerifyChecksum(req.Body, req.Checksum); err != nil {
+		s.logger.Error("Request body checksum verification failed", err, "id", req.ID, "size", len(req.Body))
+		s.sendErrorResponse(req.ID, protocol.ErrCodeIntegrity, fmt.Errorf("request %w", err), encoder, mu)
+		return
+	}
+
+	// The operator's hook may rewrite or turn away the request before it goes upstream
+	if s.hook != nil {
+		msg := &HookMessage{Phase: HookPhaseRequest, ID: req.ID, Method: req.Method, URL: req.URL, Headers: req.Headers, Body: req.Body}
+		if hookStatus, err := s.runHook(msg, &req.Headers, &req.Body); err != nil {
+			status = hookStatus
+			s.sendHookError(req.ID, hookStatus, err, encoder, mu)
+			return
+		}
+	}
+
+	// Bodies held in memory count against the in-flight budget until the request completes or they are spilled
+	held := int64(len(req.Body))
+	if held > 0 {
+		if !s.budget.reserve(held) {
+			s.logger.Warn("Memory budget exhausted, shedding request", "id", req.ID, "size", len(req.Body), "inflight", s.InflightBytes())
+			status = http.StatusServiceUnavailable
+			s.sendRetryLaterResponse(req.ID, errMemoryBudget, protocol.ErrCodeLoadShed, 1, encoder, mu)
+			return
+		}
+		defer func() { s.budget.release(held) }()
+	}
+
+	// Move large bodies to disk so they are not held in memory while the upstream request runs
+	var spilled *spilledBody
+	if s.spillThreshold > 0 && int64(len(req.Body)) > s.spillThreshold {
+		var err error
+		spilled, err = s.spillBody(req)
+		if err != nil {
+			s.logger.Error("Failed to spill request body to disk", err, "id", req.ID, "size", len(req.Body))
+			s.sendErrorResponse(req.ID, protocol.ErrCodeInternal, err, encoder, mu)
+			return
+		}
+		defer spilled.remove()
+		s.budget.release(held)
+		held = 0
+		s.logger.Debug("Spilled request body to disk", "id", req.ID, "size", spilled.size)
+	}
+
+	// A body streamed in http_request_chunk messages is relayed upstream as it arrives, unless it is declared
+	// large enough to spill, when it is written to disk as it arrives and sent upstream from there
+	var upload io.ReadCloser
+	if req.BodyStream {
+		upload = s.uploadBody(req.ID, &uploaded)
+		defer upload.Close()
+		if s.spillThreshold > 0 && req.BodyLength > s.spillThreshold {
+			var err error
+			spilled, err = s.spillUpload(upload, req.BodyLength)
+			if err != nil {
+				code := protocol.ErrCodeInternal
+				if uploadFailed(err) {
+					code = protocol.ErrCodeBadRequest
+				}
+				s.logger.Error("Failed to spill streamed request body to disk", err, "id", req.ID, "size", req.BodyLength)
+				s.sendErrorResponse(req.ID, code, err, encoder, mu)
+				return
+			}
+			defer spilled.remove()
+			upload = nil
+			s.logger.Debug("Spilled streamed request body to disk", "id", req.ID, "size", spilled.size)
+		}
+	}
+
+	// Execute request with the domain's circuit breaker and retry logic
+	breaker := s.breakerFor(requestDomain(req.URL))
+	err := breaker.Execute(func() error {
+		var execErr error
+		status, execErr = s.executeRequestWithRetry(req, spilled, upload, &received, encoder, mu)
+		return execErr
 	})
 
 	if err != nil {
-		// Check if circuit is open
-		if err == circuitbreaker.ErrCircuitOpen {
+		// Check if circuit is open (or half-open and already at its trial request limit)
+		if err == circuitbreaker.ErrCircuitOpen || err == circuitbreaker.ErrTooManyRequests {
 			s.logger.Warn("Circuit breaker is open, rejecting request", "id", req.ID)
-			s.sendErrorResponse(req.ID, fmt.Errorf("service temporarily unavailable (circuit open)"), encoder, mu)
+			status = http.StatusServiceUnavailable
+			s.sendCircuitOpenResponse(req.ID, breaker, encoder, mu)
 		}
 		// Other errors already handled by executeRequestWithRetry
 	}
+
+	duration := time.Since(start)
+	if s.metricsEmitter != nil {
+		s.metricsEmitter.RecordRequest(requestDomain(req.URL), duration, err != nil || status >= http.StatusInternalServerError)
+	}
+	s.logSlowRequest(req, status, duration)
+}
+
+// logSlowRequest warns about requests that took longer than the slow request threshold
+func (s *Server) logSlowRequest(req *protocol.Request, status int, duration time.Duration) {
+	// Event streams stay open by design, so their duration says nothing about upstream latency
+	if s.slowThreshold <= 0 || duration < s.slowThreshold || expectsEventStream(req) {
+		return
+	}
+	s.logger.Warn("Slow request",
+		"id", req.ID,
+		"method", req.Method,
+		"domain", requestDomain(req.URL),
+		"status", status,
+		"duration_ms", duration.Milliseconds(),
+		"threshold_ms", s.slowThreshold.Milliseconds())
 }
 
-// executeRequestWithRetry executes a single HTTP request with retry logic
-func (s *Server) executeRequestWithRetry(req *protocol.Request, encoder *json.Encoder, mu *sync.Mutex) error {
+// executeRequestWithRetry executes a single HTTP request with retry logic and returns the status sent to the agent
+// (the body is streamed from spilled or upload when one is non-nil, and the response body bytes are added to received)
+func (s *Server) executeRequestWithRetry(req *protocol.Request, spilled *spilledBody, upload io.Reader, received *atomic.Int64, encoder *json.Encoder, mu *sync.Mutex) (int, error) {
 	// Define shouldRetry function for network errors
 	shouldRetry := func(err error) bool {
+		// An uploaded body has been consumed and cannot be sent again
+		if upload != nil {
+			return false
+		}
 		// Retry on network errors or temporary failures
 		if urlErr, ok := err.(*url.Error); ok {
 			// Retry on timeout or temporary errors
@@ -447,23 +1129,98 @@ func (s *Server) executeRequestWithRetry(req *protocol.Request, encoder *json.En
 	var httpResp *http.Response
 	var body []byte
 
+	// The agent can cancel the request with http_cancel, as when it gives up waiting for the response
+	ctx, cancel := s.trackRequest(req.ID)
+	defer cancel()
+
+	client := s.clientFor(req)
+	start := time.Now()
+	var limit *time.Timer
+	var expire context.CancelCauseFunc
+	switch {
+	case req.Stream:
+		// Only the response headers show whether the response is an event stream, which never completes.
+		// The time limit runs as a timer that a streamed response stops: just the wait for the headers when
+		// the client asked for a stream (the duration cap takes over if the response is not one), otherwise
+		// the duration cap.
+		ctx, expire = context.WithCancelCause(ctx)
+		defer expire(nil)
+		if expectsEventStream(req) {
+			limit = time.AfterFunc(streamHeaderTimeout, func() { expire(nil) })
+		} else if s.requestCap > 0 {
+			limit = time.AfterFunc(s.requestCap, func() { expire(context.DeadlineExceeded) })
+		}
+		defer func() {
+			if limit != nil {
+				limit.Stop()
+			}
+		}()
+		client = &http.Client{Transport: client.Transport, CheckRedirect: client.CheckRedirect}
+	case s.requestCap > 0:
+		var capped context.CancelFunc
+		ctx, capped = context.WithTimeout(ctx, s.requestCap)
+		defer capped()
+	}
+
+	// Hold one of the host's upstream slots until the response has been relayed
+	release, err := s.acquireHostSlot(ctx, req)
+	if err != nil {
+		// Refused before reaching the upstream, so the upstream's circuit breaker does not count it as a failure
+		if ctx.Err() != nil {
+			return s.sendUpstreamError(ctx, req.ID, err, encoder, mu), nil
+		}
+		s.sendRetryLaterResponse(req.ID, err, protocol.ErrCodeHostBusy, 1, encoder, mu)
+		return http.StatusServiceUnavailable, nil
+	}
+	defer release()
+
 	// Execute with retry
-	err := retry.Execute(s.ctx, s.retryConfig, shouldRetry, func() error {
+	err = retry.Execute(ctx, s.retryConfig, shouldRetry, func() error {
 		// Create HTTP request
-		httpReq, err := http.NewRequestWithContext(s.ctx, req.Method, req.URL, bytes.NewReader(req.Body))
+		var reqBody io.Reader = bytes.NewReader(req.Body)
+		switch {
+		case spilled != nil:
+			reqBody = spilled.reader()
+		case upload != nil:
+			reqBody = upload
+		}
+		httpReq, err := http.NewRequestWithContext(ctx, req.Method, req.URL, reqBody)
 		if err != nil {
 			return err
 		}
+		if upload != nil {
+			// Unless the agent declared the length, it is unknown until the final chunk, so the upstream
+			// receives a chunked body
+			httpReq.ContentLength = -1
+			if req.BodyLength > 0 {
+				httpReq.ContentLength = req.BodyLength
+			}
+		}
+		if spilled != nil {
+			httpReq.ContentLength = spilled.size
+			httpReq.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(spilled.reader()), nil
+			}
+		}
 
 		// Set headers
 		for name, values := range req.Headers {
+			if isHostHeader(name) {
+				continue
+			}
 			for _, value := range values {
 				httpReq.Header.Add(name, value)
 			}
 		}
 
+		// The upstream Host always matches the URL unless an allowlisted override replaces it
+		httpReq.Host = httpReq.URL.Host
+		if req.HostHeader != "" {
+			httpReq.Host = req.HostHeader
+		}
+
 		// Make request
-		resp, err := s.httpClient.Do(httpReq)
+		resp, err := s.doUpstream(client, req, httpReq)
 		if err != nil {
 			s.logger.Debug("Request failed, will retry if applicable", "id", req.ID, "error", err)
 			return err
@@ -474,25 +1231,91 @@ func (s *Server) executeRequestWithRetry(req *protocol.Request, encoder *json.En
 	})
 
 	if err != nil {
-		s.sendErrorResponse(req.ID, err, encoder, mu)
-		return err
+		return s.sendUpstreamError(ctx, req.ID, err, encoder, mu), err
 	}
 
 	defer httpResp.Body.Close()
+	httpResp.Body = &countingBody{ReadCloser: httpResp.Body, count: received}
+
+	if req.Stream && isEventStream(httpResp.Header) {
+		if limit != nil {
+			limit.Stop()
+		}
+		return s.streamResponse(ctx, req, httpResp, encoder, mu)
+	}
+	if req.Stream && expectsEventStream(req) && limit.Stop() && s.requestCap > 0 {
+		// An ordinary body is read within what is left of the duration cap
+		limit = time.AfterFunc(max(s.requestCap-time.Since(start), 0), func() { expire(context.DeadlineExceeded) })
+	}
+
+	// A body over the agent's limit is refused here rather than relayed for the agent to discard
+	if limit := req.MaxResponseBytes; limit > 0 {
+		if httpResp.ContentLength > limit {
+			s.logger.Warn("Response body exceeds the agent's limit, failing response", "id", req.ID, "bytes", httpResp.ContentLength, "limit", limit)
+			s.sendErrorResponse(req.ID, protocol.ErrCodeResponseTooLarge, fmt.Errorf("%w of %d bytes (Content-Length %d)", errAgentResponseLimit, limit, httpResp.ContentLength), encoder, mu)
+			return http.StatusBadGateway, nil
+		}
+		httpResp.Body = &limitedBody{ReadCloser: httpResp.Body, remaining: limit}
+	}
+
+	// Buffered response bodies count against the in-flight budget until they have been relayed
+	if s.budget != nil {
+		budgeted := &budgetBody{ReadCloser: httpResp.Body, budget: s.budget}
+		defer func() { s.budget.release(budgeted.reserved) }()
+		httpResp.Body = budgeted
+	}
 
 	// Read response body
 	body, err = io.ReadAll(httpResp.Body)
+	if errors.Is(err, errMemoryBudget) {
+		// The upstream has already acted on the request, so this is a final failure rather than a retryable
+		// shed; it is not the upstream's fault, so its circuit breaker does not count it
+		s.logger.Warn("Memory budget exhausted, failing response", "id", req.ID, "inflight", s.InflightBytes())
+		s.sendErrorResponse(req.ID, protocol.ErrCodeResponseTooLarge, err, encoder, mu)
+		return http.StatusBadGateway, nil
+	}
+	if errors.Is(err, errAgentResponseLimit) {
+		s.logger.Warn("Response body exceeds the agent's limit, failing response", "id", req.ID, "limit", req.MaxResponseBytes)
+		s.sendErrorResponse(req.ID, protocol.ErrCodeResponseTooLarge, fmt.Errorf("%w of %d bytes", err, req.MaxResponseBytes), encoder, mu)
+		return http.StatusBadGateway, nil
+	}
 	if err != nil {
-		s.sendErrorResponse(req.ID, err, encoder, mu)
-		return err
+		return s.sendUpstreamError(ctx, req.ID, err, encoder, mu), err
+	}
+
+	// Responses such as 304 Not Modified must be relayed without a body
+	if !protocol.BodyAllowedForStatus(httpResp.StatusCode) {
+		body = nil
+	}
+
+	// The operator's hook may rewrite or withhold the response before it is relayed
+	headers := convertHeaders(httpResp.Header)
+	if s.hook != nil {
+		msg := &HookMessage{Phase: HookPhaseResponse, ID: req.ID, Method: req.Method, URL: req.URL, Status: httpResp.StatusCode, Headers: headers, Body: body}
+		if hookStatus, err := s.runHook(msg, &headers, &body); err != nil {
+			// Refused after the upstream answered, so the upstream's circuit breaker does not count it
+			s.sendHookError(req.ID, hookStatus, err, encoder, mu)
+			return hookStatus, nil
+		}
 	}
 
 	// Send response back through tunnel wrapped in Envelope
 	resp := &protocol.Response{
 		ID:         req.ID,
 		StatusCode: httpResp.StatusCode,
-		Headers:    convertHeaders(httpResp.Header),
+		Headers:    headers,
 		Body:       body,
+		BodyBytes:  int64(len(body)),
+	}
+
+	// Trailers are only populated once the body has been read to EOF
+	if len(httpResp.Trailer) > 0 {
+		resp.Trailers = convertHeaders(httpResp.Trailer)
+	}
+
+	// Checksum the response body when the agent requested integrity checks
+	if req.Checksum != "" {
+		resp.Checksum = protocol.Checksum(body)
 	}
 
 	env := protocol.Envelope{Type: "http_response", Payload: resp}
@@ -501,23 +1324,82 @@ func (s *Server) executeRequestWithRetry(req *protocol.Request, encoder *json.En
 	mu.Unlock()
 	if encodeErr != nil {
 		s.logger.Error("Failed to send response", encodeErr, "id", req.ID)
-		return encodeErr
+		return httpResp.StatusCode, encodeErr
 	}
 
 	s.logger.Debug("Response sent", "id", req.ID, "status", httpResp.StatusCode, "size", len(body))
-	return nil
+	return httpResp.StatusCode, nil
+}
+
+// sendUpstreamError reports a failed upstream request to the client and returns the status sent: a 504
+// when ctx hit the request duration cap or the upstream timed out, otherwise a 502
+func (s *Server) sendUpstreamError(ctx context.Context, reqID string, err error, encoder *json.Encoder, mu *sync.Mutex) int {
+	capExceeded := errors.Is(context.Cause(ctx), context.DeadlineExceeded)
+	if capExceeded || errors.Is(err, context.DeadlineExceeded) {
+		if capExceeded {
+			err = fmt.Errorf("request exceeded the maximum duration of %v: %w", s.requestCap, err)
+		}
+		s.sendErrorResponseWithStatus(reqID, http.StatusGatewayTimeout, protocol.ErrCodeTimeout, err, encoder, mu)
+		return http.StatusGatewayTimeout
+	}
+	s.sendErrorResponse(reqID, protocol.ErrCodeUpstreamFailed, err, encoder, mu)
+	return http.StatusBadGateway
+}
+
+// sendErrorResponse sends a 502 error response with its error code back to the client
+func (s *Server) sendErrorResponse(reqID string, code string, err error, encoder *json.Encoder, mu *sync.Mutex) {
+	s.sendErrorResponseWithStatus(reqID, http.StatusBadGateway, code, err, encoder, mu)
 }
 
-// sendErrorResponse sends an error response back to the client
-func (s *Server) sendErrorResponse(reqID string, err error, encoder *json.Encoder, mu *sync.Mutex) {
-	s.logger.Error("Request processing failed", err, "id", reqID)
+// sendErrorResponseWithStatus sends an error response with a specific status code and error code back to the
+// client; the code marks the response as tunnel-generated so the agent can report it as such
+func (s *Server) sendErrorResponseWithStatus(reqID string, statusCode int, code string, err error, encoder *json.Encoder, mu *sync.Mutex) {
+	logErr := s.logError(err)
+	s.logger.Error("Request processing failed", logErr, "id", reqID, "status", statusCode)
+	if statusCode >= http.StatusInternalServerError {
+		s.recordError("Request processing failed", logErr)
+	}
 
 	resp := &protocol.Response{
 		ID:         reqID,
-		StatusCode: 502,
+		StatusCode: statusCode,
 		Headers:    map[string][]string{"Content-Type": {"text/plain"}},
 		Body:       []byte(fmt.Sprintf("Tunnel error: %v", err)),
 		Error:      err.Error(),
+		ErrorCode:  code,
+	}
+
+	env := protocol.Envelope{Type: "http_response", Payload: resp}
+	mu.Lock()
+	encodeErr := encoder.Encode(env)
+	mu.Unlock()
+	if encodeErr != nil {
+		s.logger.Error("Failed to send error response", encodeErr, "id", reqID)
+	}
+}
+
+// sendCircuitOpenResponse sends a 503 telling the client when the open breaker will next admit a request
+func (s *Server) sendCircuitOpenResponse(reqID string, breaker *circuitbreaker.CircuitBreaker, encoder *json.Encoder, mu *sync.Mutex) {
+	// Retry-After is whole seconds, rounded up so clients never retry before the breaker reopens
+	retryAfter := int(math.Ceil(breaker.RetryAfter().Seconds()))
+	retryAfter = max(retryAfter, 1)
+
+	err := fmt.Errorf("service temporarily unavailable (circuit open)")
+	s.sendRetryLaterResponse(reqID, err, protocol.ErrCodeCircuitOpen, retryAfter, encoder, mu)
+}
+
+// sendRetryLaterResponse sends a 503 telling the client to retry after retryAfter seconds
+func (s *Server) sendRetryLaterResponse(reqID string, err error, code string, retryAfter int, encoder *json.Encoder, mu *sync.Mutex) {
+	resp := &protocol.Response{
+		ID:         reqID,
+		StatusCode: http.StatusServiceUnavailable,
+		Headers: map[string][]string{
+			"Content-Type": {"text/plain"},
+			"Retry-After":  {strconv.Itoa(retryAfter)},
+		},
+		Body:      []byte(fmt.Sprintf("Tunnel error: %v", err)),
+		Error:     err.Error(),
+		ErrorCode: code,
 	}
 
 	env := protocol.Envelope{Type: "http_response", Payload: resp}
@@ -529,6 +1411,11 @@ func (s *Server) sendErrorResponse(reqID string, err error, encoder *json.Encode
 	}
 }
 
+// isHostHeader reports whether a forwarded header name is Host, which must never be taken from the agent
+func isHostHeader(name string) bool {
+	return http.CanonicalHeaderKey(name) == "Host"
+}
+
 // convertHeaders converts http.Header to protocol headers format
 func convertHeaders(headers http.Header) map[string][]string {
 	result := make(map[string][]string)
@@ -538,45 +1425,112 @@ func convertHeaders(headers http.Header) map[string][]string {
 	return result
 }
 
-// logRequest logs request information (domain only for privacy)
+// logRequest logs request information (domain only for privacy, unless full URLs are enabled for debugging)
 func (s *Server) logRequest(req *protocol.Request) {
-	if parsedURL, err := parseURL(req.URL); err == nil {
-		domain := parsedURL.Host
-
-		// Remove port from domain for cleaner logging
-		if host, _, err := net.SplitHostPort(domain); err == nil {
-			domain = host
+	if _, err := parseURL(req.URL); err == nil {
+		s.logger.Info("Forwarding request", "method", req.Method, "domain", requestDomain(req.URL), "id", req.ID)
+		if s.logFullURL {
+			s.logger.Debug("Forwarding request URL", "method", req.Method, "url", s.logURL(req.URL), "id", req.ID)
 		}
-
-		s.logger.Info("Forwarding request", "method", req.Method, "domain", domain, "id", req.ID)
 	} else {
-		s.logger.Warn("Invalid URL in request", "url", req.URL, "id", req.ID)
+		s.logger.Warn("Invalid URL in request", "id", req.ID)
+		if s.logFullURL {
+			s.logger.Debug("Invalid request URL", "url", req.URL, "id", req.ID)
+		}
 	}
 }
 
+// requestDomain returns the host of a request URL without its port (empty if the URL is invalid)
+func requestDomain(rawURL string) string {
+	parsedURL, err := parseURL(rawURL)
+	if err != nil {
+		return ""
+	}
+
+	// Remove port from domain for cleaner logging
+	domain := parsedURL.Host
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		domain = host
+	}
+	return domain
+}
+
+// logURL returns a request URL for Debug lines: the full URL when enabled, otherwise only the domain.
+// Info and higher lines log requestDomain, as full URLs may carry sensitive paths and query strings.
+func (s *Server) logURL(rawURL string) string {
+	if s.logFullURL {
+		return rawURL
+	}
+	return requestDomain(rawURL)
+}
+
+// logError returns err for logging: unless full URLs are enabled, the URL an upstream *url.Error quotes in
+// its message is replaced by its domain (the error sent back to the agent keeps the full URL)
+func (s *Server) logError(err error) error {
+	var urlErr *url.Error
+	if s.logFullURL || !errors.As(err, &urlErr) {
+		return err
+	}
+	return errors.New(strings.ReplaceAll(err.Error(), strconv.Quote(urlErr.URL), strconv.Quote(requestDomain(urlErr.URL))))
+}
+
 // parseURL is a helper function to parse URLs safely
 func parseURL(rawURL string) (*url.URL, error) {
 	return url.Parse(rawURL)
 }
 
-// handleConnectOpen opens a TCP connection to the target address
-func (s *Server) handleConnectOpen(open *protocol.ConnectOpen, encoder *json.Encoder, mu *sync.Mutex) {
+// handleConnectOpen opens a TCP connection to the target address, holding slot until the tunnel closes
+func (s *Server) handleConnectOpen(open *protocol.ConnectOpen, client string, slot *streamSlot, halfClose bool, encoder *json.Encoder, mu *sync.Mutex) {
 	s.logger.Info("CONNECT open request", "id", open.ID, "address", open.Address)
+	start := time.Now()
+	audit := AuditRecord{Time: start, Client: client, Type: AuditConnect, Method: http.MethodConnect, Target: open.Address}
+
+	if !s.admit(open.Headers) {
+		s.logger.Warn("Rejecting CONNECT without the required header", "id", open.ID, "client", client)
+		slot.release()
+		audit.Error, audit.DurationMs = errGateRejected.Error(), time.Since(start).Milliseconds()
+		s.recordAudit(audit)
+		reason := errGateRejected.Error()
+		mu.Lock()
+		_ = encoder.Encode(protocol.Envelope{Type: "connect_ack", Payload: &protocol.ConnectAck{ID: open.ID, Ok: false, Error: reason, ErrorCode: protocol.ErrCodeForbidden}})
+		_ = encoder.Encode(protocol.Envelope{Type: "connect_close", Payload: &protocol.ConnectClose{ID: open.ID, Error: reason}})
+		mu.Unlock()
+		return
+	}
+
+	// The tunnel's read buffer counts against the in-flight budget until the tunnel closes
+	if !s.budget.reserve(connectBufferSize) {
+		s.logger.Warn("Memory budget exhausted, shedding CONNECT", "id", open.ID, "inflight", s.InflightBytes())
+		slot.release()
+		audit.Error, audit.DurationMs = errMemoryBudget.Error(), time.Since(start).Milliseconds()
+		s.recordAudit(audit)
+		reason := errMemoryBudget.Error()
+		mu.Lock()
+		_ = encoder.Encode(protocol.Envelope{Type: "connect_ack", Payload: &protocol.ConnectAck{ID: open.ID, Ok: false, Error: reason, ErrorCode: protocol.ErrCodeLoadShed}})
+		_ = encoder.Encode(protocol.Envelope{Type: "connect_close", Payload: &protocol.ConnectClose{ID: open.ID, Error: reason}})
+		mu.Unlock()
+		return
+	}
 
 	// Create context with timeout for dial
 	dialCtx, dialCancel := context.WithTimeout(s.ctx, 10*time.Second)
 	defer dialCancel()
 
 	// Dial target with context
-	var dialer net.Dialer
+	dialer := net.Dialer{KeepAliveConfig: s.tcpKeepalive}
 	targetConn, err := dialer.DialContext(dialCtx, "tcp", open.Address)
 	if err != nil {
 		s.logger.Error("CONNECT dial failed", err, "id", open.ID, "address", open.Address)
+		s.recordError("CONNECT dial failed", err)
+		slot.release()
+		s.budget.release(connectBufferSize)
 		// Send error via connect_close
 		errMsg := err.Error()
 		if dialCtx.Err() == context.DeadlineExceeded {
 			errMsg = "connection timeout"
 		}
+		audit.Error, audit.DurationMs = errMsg, time.Since(start).Milliseconds()
+		s.recordAudit(audit)
 		env := protocol.Envelope{Type: "connect_close", Payload: &protocol.ConnectClose{ID: open.ID, Error: errMsg}}
 		mu.Lock()
 		_ = encoder.Encode(env)
@@ -587,12 +1541,30 @@ func (s *Server) handleConnectOpen(open *protocol.ConnectOpen, encoder *json.Enc
 	s.logger.Debug("CONNECT dial successful", "id", open.ID, "address", open.Address)
 
 	// Store connection
+	tracked := newTrackedConn(targetConn, slot)
+	tracked.onClose = func() {
+		s.budget.release(connectBufferSize)
+		if s.audit != nil {
+			audit.BytesIn, audit.BytesOut = tracked.bytesIn.Load(), tracked.bytesOut.Load()
+			audit.DurationMs = time.Since(start).Milliseconds()
+			s.recordAudit(audit)
+		}
+	}
+	tracked.startWriter(func(err error) {
+		s.logger.Error("Failed to write to target conn", err, "id", open.ID)
+		s.closeConnect(open.ID)
+	})
 	s.tcpMutex.Lock()
-	s.tcpConns[open.ID] = targetConn
+	s.tcpConns[open.ID] = tracked
 	s.tcpMutex.Unlock()
 
-	// Send ack
-	env := protocol.Envelope{Type: "connect_ack", Payload: &protocol.ConnectAck{ID: open.ID, Ok: true}}
+	// Send ack, agreeing to compress the tunnel when the agent asked for a compression this server knows
+	compress := open.Compression == protocol.CompressionGzip
+	ack := &protocol.ConnectAck{ID: open.ID, Ok: true}
+	if compress {
+		ack.Compression = protocol.CompressionGzip
+	}
+	env := protocol.Envelope{Type: "connect_ack", Payload: ack}
 	mu.Lock()
 	encErr := encoder.Encode(env)
 	mu.Unlock()
@@ -604,12 +1576,20 @@ func (s *Server) handleConnectOpen(open *protocol.ConnectOpen, encoder *json.Enc
 
 	// Start reader goroutine: read from target and send to agent
 	go func() {
+		targetEOF := false
 		defer func() {
 			s.logger.Debug("CONNECT reader goroutine exiting", "id", open.ID)
+
+			// On a clean EOF, agents that support it get a half-close and can keep sending
+			if targetEOF && halfClose && !s.markTargetEOF(open.ID, encoder, mu) {
+				return
+			}
+
 			s.tcpMutex.Lock()
 			delete(s.tcpConns, open.ID)
+			delete(s.tcpHalfClosed, open.ID)
 			s.tcpMutex.Unlock()
-			targetConn.Close()
+			tracked.Close()
 			// Send close
 			closeEnv := protocol.Envelope{Type: "connect_close", Payload: &protocol.ConnectClose{ID: open.ID}}
 			mu.Lock()
@@ -618,7 +1598,8 @@ func (s *Server) handleConnectOpen(open *protocol.ConnectOpen, encoder *json.Enc
 		}()
 
 		s.logger.Debug("CONNECT reader goroutine started", "id", open.ID)
-		buf := make([]byte, 32*1024)
+		buf := make([]byte, connectBufferSize)
+		reader := coalesce.NewReader(targetConn, s.tcpCoalesce)
 
 		// Set read deadline to detect stale connections
 		targetConn.SetReadDeadline(time.Now().Add(5 * time.Minute))
@@ -631,14 +1612,20 @@ func (s *Server) handleConnectOpen(open *protocol.ConnectOpen, encoder *json.Enc
 			default:
 			}
 
-			n, err := targetConn.Read(buf)
+			n, err := reader.Read(buf)
 			if n > 0 {
 				s.logger.Debug("CONNECT read data from target", "id", open.ID, "bytes", n)
 
 				// Reset read deadline on successful read
 				targetConn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+				tracked.touch()
+				tracked.bytesOut.Add(int64(n))
 
-				dataEnv := protocol.Envelope{Type: "connect_data", Payload: &protocol.ConnectData{ID: open.ID, Chunk: buf[:n]}}
+				data := &protocol.ConnectData{ID: open.ID, Chunk: buf[:n]}
+				if compress {
+					data.Chunk, data.Compressed = protocol.CompressChunk(data.Chunk)
+				}
+				dataEnv := protocol.Envelope{Type: "connect_data", Payload: data}
 				mu.Lock()
 				encErr := encoder.Encode(dataEnv)
 				mu.Unlock()
@@ -649,6 +1636,7 @@ func (s *Server) handleConnectOpen(open *protocol.ConnectOpen, encoder *json.Enc
 				s.logger.Debug("CONNECT sent data to agent", "id", open.ID, "bytes", n)
 			}
 			if err != nil {
+				targetEOF = err == io.EOF
 				if err != io.EOF {
 					// Check if it's a timeout error
 					if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
@@ -663,7 +1651,7 @@ func (s *Server) handleConnectOpen(open *protocol.ConnectOpen, encoder *json.Enc
 	}()
 }
 
-// handleConnectData writes data to the TCP connection
+// handleConnectData queues data for the TCP connection's writer
 func (s *Server) handleConnectData(data *protocol.ConnectData) {
 	s.tcpMutex.RLock()
 	targetConn := s.tcpConns[data.ID]
@@ -674,20 +1662,44 @@ func (s *Server) handleConnectData(data *protocol.ConnectData) {
 		return
 	}
 
-	s.logger.Debug("CONNECT writing data to target", "id", data.ID, "bytes", len(data.Chunk))
-	if _, err := targetConn.Write(data.Chunk); err != nil {
+	chunk := data.Chunk
+	if data.Compressed {
+		var err error
+		if chunk, err = protocol.DecompressChunk(data.Chunk); err != nil {
+			s.logger.Error("Failed to decompress CONNECT data", err, "id", data.ID)
+			s.closeConnect(data.ID)
+			return
+		}
+	}
+
+	s.logger.Debug("CONNECT queueing data for target", "id", data.ID, "bytes", len(chunk))
+	targetConn.touch()
+	targetConn.bytesIn.Add(int64(len(chunk)))
+	if err := targetConn.queueWrite(targetWrite{chunk: chunk}); err != nil {
 		s.logger.Error("Failed to write to target conn", err, "id", data.ID)
-		s.handleConnectClose(&protocol.ConnectClose{ID: data.ID})
-	} else {
-		s.logger.Debug("CONNECT wrote data to target", "id", data.ID, "bytes", len(data.Chunk))
+		s.closeConnect(data.ID)
 	}
 }
 
-// handleConnectClose closes the TCP connection
+// handleConnectClose closes the TCP connection once the data the agent sent before closing has been written
 func (s *Server) handleConnectClose(cls *protocol.ConnectClose) {
 	s.tcpMutex.Lock()
 	targetConn := s.tcpConns[cls.ID]
 	delete(s.tcpConns, cls.ID)
+	delete(s.tcpHalfClosed, cls.ID)
+	s.tcpMutex.Unlock()
+
+	if targetConn != nil {
+		targetConn.closeAfterWrites()
+	}
+}
+
+// closeConnect closes the TCP connection at once, discarding data not yet written
+func (s *Server) closeConnect(id string) {
+	s.tcpMutex.Lock()
+	targetConn := s.tcpConns[id]
+	delete(s.tcpConns, id)
+	delete(s.tcpHalfClosed, id)
 	s.tcpMutex.Unlock()
 
 	if targetConn != nil {
@@ -695,13 +1707,123 @@ func (s *Server) handleConnectClose(cls *protocol.ConnectClose) {
 	}
 }
 
-// handleWebSocketOpen establishes a WebSocket connection to the target
-func (s *Server) handleWebSocketOpen(open *protocol.WebSocketOpen, encoder *json.Encoder, mu *sync.Mutex) {
-	s.logger.Info("WebSocket open request", "id", open.ID, "url", open.URL)
+// halfCloseState records which directions of a CONNECT tunnel have finished
+type halfCloseState struct {
+	targetEOF   bool // target finished sending; the agent was sent connect_half_close
+	agentClosed bool // agent finished sending; the target's write side was closed
+}
+
+// markTargetEOF records that the target finished sending. It reports whether the tunnel
+// should now close fully; otherwise it tells the agent and keeps the agent->target direction open.
+func (s *Server) markTargetEOF(id string, encoder *json.Encoder, mu *sync.Mutex) bool {
+	s.tcpMutex.Lock()
+	if _, ok := s.tcpConns[id]; !ok {
+		s.tcpMutex.Unlock()
+		return true
+	}
+	state := s.tcpHalfClosed[id]
+	if state == nil {
+		state = &halfCloseState{}
+		s.tcpHalfClosed[id] = state
+	}
+	state.targetEOF = true
+	closeNow := state.agentClosed
+	s.tcpMutex.Unlock()
+
+	if closeNow {
+		return true
+	}
+
+	s.logger.Debug("CONNECT target finished sending, half-closing", "id", id)
+	env := protocol.Envelope{Type: "connect_half_close", Payload: &protocol.ConnectHalfClose{ID: id}}
+	mu.Lock()
+	_ = encoder.Encode(env)
+	mu.Unlock()
+	return false
+}
+
+// handleConnectHalfClose closes the write side of the target connection once the agent has finished
+// sending, and closes the tunnel entirely when the target has already finished too
+func (s *Server) handleConnectHalfClose(half *protocol.ConnectHalfClose, encoder *json.Encoder, mu *sync.Mutex) {
+	s.tcpMutex.Lock()
+	targetConn := s.tcpConns[half.ID]
+	if targetConn == nil {
+		s.tcpMutex.Unlock()
+		s.logger.Debug("CONNECT half-close received for unknown connection", "id", half.ID)
+		return
+	}
+	state := s.tcpHalfClosed[half.ID]
+	if state == nil {
+		state = &halfCloseState{}
+		s.tcpHalfClosed[half.ID] = state
+	}
+	state.agentClosed = true
+	closeNow := state.targetEOF
+	if closeNow {
+		delete(s.tcpConns, half.ID)
+		delete(s.tcpHalfClosed, half.ID)
+	}
+	s.tcpMutex.Unlock()
+
+	if closeNow {
+		targetConn.closeAfterWrites()
+		env := protocol.Envelope{Type: "connect_close", Payload: &protocol.ConnectClose{ID: half.ID}}
+		mu.Lock()
+		_ = encoder.Encode(env)
+		mu.Unlock()
+		return
+	}
+
+	// The write side closes behind the data the agent sent before finishing
+	closeWrite := func() {
+		s.logger.Debug("CONNECT agent finished sending, closing target write side", "id", half.ID)
+		if cw, ok := targetConn.Conn.(interface{ CloseWrite() error }); ok {
+			if err := cw.CloseWrite(); err != nil {
+				s.logger.Debug("CONNECT target CloseWrite failed", "id", half.ID, "error", err)
+			}
+		}
+	}
+	if err := targetConn.queueWrite(targetWrite{then: closeWrite}); err != nil {
+		s.logger.Error("Failed to half-close target conn", err, "id", half.ID)
+		s.closeConnect(half.ID)
+	}
+}
+
+// handleWebSocketOpen establishes a WebSocket connection to the target, holding slot until it closes
+func (s *Server) handleWebSocketOpen(open *protocol.WebSocketOpen, slot *streamSlot, encoder *json.Encoder, mu *sync.Mutex) {
+	s.logger.Info("WebSocket open request", "id", open.ID, "domain", requestDomain(open.URL))
+	if s.logFullURL {
+		s.logger.Debug("WebSocket open request URL", "id", open.ID, "url", s.logURL(open.URL))
+	}
+
+	if !s.admit(open.Headers) {
+		s.logger.Warn("Rejecting WebSocket without the required header", "id", open.ID)
+		slot.release()
+		reason := errGateRejected.Error()
+		mu.Lock()
+		_ = encoder.Encode(protocol.Envelope{Type: "ws_ack", Payload: &protocol.WebSocketAck{ID: open.ID, Ok: false, Error: reason, ErrorCode: protocol.ErrCodeForbidden}})
+		_ = encoder.Encode(protocol.Envelope{Type: "ws_close", Payload: &protocol.WebSocketClose{ID: open.ID, Code: websocket.ClosePolicyViolation, Error: reason}})
+		mu.Unlock()
+		return
+	}
+
+	// The WebSocket's read and write buffers count against the in-flight budget until it closes
+	if !s.budget.reserve(2 * webSocketBufferSize) {
+		s.logger.Warn("Memory budget exhausted, shedding WebSocket", "id", open.ID, "inflight", s.InflightBytes())
+		slot.release()
+		reason := errMemoryBudget.Error()
+		mu.Lock()
+		_ = encoder.Encode(protocol.Envelope{Type: "ws_ack", Payload: &protocol.WebSocketAck{ID: open.ID, Ok: false, Error: reason, ErrorCode: protocol.ErrCodeLoadShed}})
+		_ = encoder.Encode(protocol.Envelope{Type: "ws_close", Payload: &protocol.WebSocketClose{ID: open.ID, Code: websocket.CloseTryAgainLater, Error: reason}})
+		mu.Unlock()
+		return
+	}
 
 	// Create WebSocket dialer
 	dialer := websocket.Dialer{
 		HandshakeTimeout: 10 * time.Second,
+		ReadBufferSize:   webSocketBufferSize,
+		WriteBufferSize:  webSocketBufferSize,
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: false, // We should verify in production
 		},
@@ -710,6 +1832,10 @@ func (s *Server) handleWebSocketOpen(open *protocol.WebSocketOpen, encoder *json
 	// Convert headers
 	headers := http.Header{}
 	for name, values := range open.Headers {
+		// The dialer would send a Host header in place of the URL's host
+		if isHostHeader(name) {
+			continue
+		}
 		for _, value := range values {
 			headers.Add(name, value)
 		}
@@ -718,7 +1844,10 @@ func (s *Server) handleWebSocketOpen(open *protocol.WebSocketOpen, encoder *json
 	// Dial the WebSocket
 	wsConn, _, err := dialer.Dial(open.URL, headers)
 	if err != nil {
-		s.logger.Error("WebSocket dial failed", err, "id", open.ID, "url", open.URL)
+		s.logger.Error("WebSocket dial failed", err, "id", open.ID, "domain", requestDomain(open.URL))
+		s.recordError("WebSocket dial failed", err)
+		slot.release()
+		s.budget.release(2 * webSocketBufferSize)
 		// Send error via ws_close
 		env := protocol.Envelope{Type: "ws_close", Payload: &protocol.WebSocketClose{ID: open.ID, Code: websocket.CloseInternalServerErr, Error: err.Error()}}
 		mu.Lock()
@@ -727,11 +1856,13 @@ func (s *Server) handleWebSocketOpen(open *protocol.WebSocketOpen, encoder *json
 		return
 	}
 
-	s.logger.Debug("WebSocket dial successful", "id", open.ID, "url", open.URL)
+	s.logger.Debug("WebSocket dial successful", "id", open.ID, "url", s.logURL(open.URL))
 
 	// Store connection
+	tracked := newTrackedWSConn(wsConn, slot)
+	tracked.onClose = func() { s.budget.release(2 * webSocketBufferSize) }
 	s.wsMutex.Lock()
-	s.wsConns[open.ID] = wsConn
+	s.wsConns[open.ID] = tracked
 	s.wsMutex.Unlock()
 
 	// Send ack
@@ -741,7 +1872,7 @@ func (s *Server) handleWebSocketOpen(open *protocol.WebSocketOpen, encoder *json
 	mu.Unlock()
 	if encErr != nil {
 		s.logger.Error("Failed to send ws_ack", encErr, "id", open.ID)
-		wsConn.Close()
+		tracked.Close()
 		s.wsMutex.Lock()
 		delete(s.wsConns, open.ID)
 		s.wsMutex.Unlock()
@@ -749,14 +1880,19 @@ func (s *Server) handleWebSocketOpen(open *protocol.WebSocketOpen, encoder *json
 	}
 	s.logger.Debug("Sent ws_ack", "id", open.ID)
 
+	// Ping the target so idle tunnels survive intermediaries and a dead target is noticed
+	stopKeepalive := make(chan struct{})
+	keepalive.WebSocket(wsConn, s.wsKeepalive, stopKeepalive)
+
 	// Start reader goroutine: read from target WebSocket and send to agent
 	go func() {
 		defer func() {
+			close(stopKeepalive)
 			s.logger.Debug("WebSocket reader goroutine exiting", "id", open.ID)
 			s.wsMutex.Lock()
 			delete(s.wsConns, open.ID)
 			s.wsMutex.Unlock()
-			wsConn.Close()
+			tracked.Close()
 			// Send close
 			closeEnv := protocol.Envelope{Type: "ws_close", Payload: &protocol.WebSocketClose{ID: open.ID}}
 			mu.Lock()
@@ -768,13 +1904,16 @@ func (s *Server) handleWebSocketOpen(open *protocol.WebSocketOpen, encoder *json
 		for {
 			messageType, data, err := wsConn.ReadMessage()
 			if err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				if keepalive.IsTimeout(err) {
+					s.logger.Warn("Target WebSocket stopped answering pings, closing", "id", open.ID)
+				} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 					s.logger.Error("WebSocket read error", err, "id", open.ID)
 				}
 				return
 			}
 
 			s.logger.Debug("WebSocket read message from target", "id", open.ID, "type", messageType, "bytes", len(data))
+			tracked.touch()
 			msgEnv := protocol.Envelope{Type: "ws_message", Payload: &protocol.WebSocketMessage{
 				ID:          open.ID,
 				MessageType: messageType,
@@ -804,6 +1943,7 @@ func (s *Server) handleWebSocketMessage(msg *protocol.WebSocketMessage) {
 	}
 
 	s.logger.Debug("WebSocket writing message to target", "id", msg.ID, "type", msg.MessageType, "bytes", len(msg.Data))
+	wsConn.touch()
 	if err := wsConn.WriteMessage(msg.MessageType, msg.Data); err != nil {
 		s.logger.Error("Failed to write to target WebSocket", err, "id", msg.ID)
 		s.handleWebSocketClose(&protocol.WebSocketClose{ID: msg.ID})
@@ -830,6 +1970,43 @@ func (s *Server) handleWebSocketClose(cls *protocol.WebSocketClose) {
 	}
 }
 
+// handleHello replies with this build's hello and checks the agent's protocol compatibility.
+// It returns false when the agent must be disconnected.
+func (s *Server) handleHello(peer *protocol.Hello, client string, encoder *json.Encoder, mu *sync.Mutex) bool {
+	local := protocol.LocalHello()
+
+	// Always reply so the agent can report the server's build, even when refusing it
+	mu.Lock()
+	err := encoder.Encode(protocol.Envelope{Type: "hello", Payload: local})
+	mu.Unlock()
+	if err != nil {
+		s.logger.Error("Failed to send hello", err, "client", client)
+		return false
+	}
+
+	compat, reason := protocol.CheckCompatibility(local, *peer)
+	fields := []interface{}{
+		"client", client,
+		"agent_version", peer.BuildVersion,
+		"agent_commit", peer.BuildCommit,
+		"agent_protocol", peer.ProtocolVersion,
+	}
+
+	switch compat {
+	case protocol.Compatible:
+		s.logger.Debug("Agent build is compatible", fields...)
+	case protocol.CompatibleWithDrift:
+		s.logger.Warn("Agent build differs from server: "+reason, fields...)
+	case protocol.Incompatible:
+		if s.strictCompat {
+			s.logger.Error("Refusing agent with incompatible protocol", fmt.Errorf("%s", reason), fields...)
+			return false
+		}
+		s.logger.Warn("Agent protocol is incompatible, continuing: "+reason, fields...)
+	}
+	return true
+}
+
 // performIAMAuthentication handles the IAM authentication handshake
 func (s *Server) performIAMAuthentication(decoder *json.Decoder, encoder *json.Encoder) error {
 	s.logger.Info("Waiting for IAM authentication request")
@@ -891,7 +2068,7 @@ func (s *Server) performIAMAuthentication(decoder *json.Decoder, encoder *json.E
 		Type:    "iam_auth_response",
 		Payload: authResp,
 	}
-	
+
 	if err := encoder.Encode(respEnv); err != nil {
 		s.logger.Error("Failed to send IAM auth response", err)
 		return fmt.Errorf("failed to send IAM auth response: %w", err)
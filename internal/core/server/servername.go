@@ -0,0 +1,94 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// serverNameList is the set of SNI server names the server completes handshakes for
+type serverNameList struct {
+	exact     map[string]bool
+	wildcards []string // Parent domains of "*.example.com" entries, with their leading dot
+}
+
+// SetAllowedServerNames refuses TLS handshakes whose SNI server name is not in names, so the server only
+// presents its certificate for the DNS names and addresses it is deployed under. Entries are exact
+// names, IP addresses or "*.example.com" for any subdomain. Handshakes without SNI, which is what
+// clients connecting by IP address send, are still accepted. Empty names accepts any server name (call
+// before Start).
+func (s *Server) SetAllowedServerNames(names []string) error {
+	list := &serverNameList{exact: make(map[string]bool)}
+	for _, name := range names {
+		name = normalizeServerName(name)
+		switch {
+		case name == "":
+			continue
+		case strings.HasPrefix(name, "*."):
+			if len(name) == 2 {
+				return fmt.Errorf("invalid allowed server name %q", name)
+			}
+			list.wildcards = append(list.wildcards, name[1:])
+		default:
+			if strings.Contains(name, "*") {
+				return fmt.Errorf("invalid allowed server name %q: only a leading *. wildcard is supported", name)
+			}
+			list.exact[name] = true
+		}
+	}
+	if len(list.exact) == 0 && len(list.wildcards) == 0 {
+		s.serverNames = nil
+		return nil
+	}
+	s.serverNames = list
+
+	next := s.tlsConfig.GetConfigForClient
+	s.tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if err := s.checkServerName(hello); err != nil {
+			return nil, err
+		}
+		if next != nil {
+			return next(hello)
+		}
+		return nil, nil
+	}
+	return nil
+}
+
+// checkServerName refuses a handshake for a server name outside the allowed set
+func (s *Server) checkServerName(hello *tls.ClientHelloInfo) error {
+	list := s.serverNames
+	if list == nil || hello.ServerName == "" || list.allows(hello.ServerName) {
+		return nil
+	}
+	remote := ""
+	if hello.Conn != nil {
+		remote = hello.Conn.RemoteAddr().String()
+	}
+	s.logger.Warn("Refusing TLS handshake for unexpected server name", "server_name", hello.ServerName, "remote_addr", remote)
+	return fmt.Errorf("server name %q is not served here", hello.ServerName)
+}
+
+// allows reports whether name is one of the allowed server names
+func (l *serverNameList) allows(name string) bool {
+	name = normalizeServerName(name)
+	if l.exact[name] {
+		return true
+	}
+	if net.ParseIP(name) != nil {
+		return false
+	}
+	for _, parent := range l.wildcards {
+		if strings.HasSuffix(name, parent) && len(name) > len(parent) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeServerName lower-cases a server name and strips a trailing dot, and the brackets of an IPv6 address
+func normalizeServerName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.TrimSuffix(strings.Trim(name, "[]"), ".")
+}
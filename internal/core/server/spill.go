@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// spilledBody is a request body held in a temp file instead of memory
+type spilledBody struct {
+	file *os.File
+	size int64
+}
+
+// SetBodySpill enables spilling request bodies larger than threshold bytes to temp files in dir
+// (threshold 0 disables; an empty dir uses the OS temp dir; call before Start). A body streamed in
+// http_request_chunk messages with a declared length over the threshold is written to disk as its chunks
+// arrive, so it is never held in memory whole. A body sent inside its request envelope is spilled once
+// the envelope has been decoded, which frees it for the upstream request and its retries, but not while
+// it is received; agents stream large bodies to avoid that.
+func (s *Server) SetBodySpill(threshold int64, dir string) {
+	s.spillThreshold = threshold
+	s.spillDir = dir
+}
+
+// spillBody writes the request body to a temp file and releases the in-memory copy
+func (s *Server) spillBody(req *protocol.Request) (*spilledBody, error) {
+	spilled, err := s.spill(bytes.NewReader(req.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Body = nil
+	return spilled, nil
+}
+
+// spillUpload writes a streamed request body to a temp file as it is read from upload, failing unless
+// it comes to the size the agent declared
+func (s *Server) spillUpload(upload io.Reader, size int64) (*spilledBody, error) {
+	spilled, err := s.spill(upload)
+	if err != nil {
+		return nil, err
+	}
+	if spilled.size != size {
+		spilled.remove()
+		return nil, fmt.Errorf("%w: received %d bytes, declared %d", protocol.ErrChunkLength, spilled.size, size)
+	}
+	return spilled, nil
+}
+
+// spill copies body to a new temp file
+func (s *Server) spill(body io.Reader) (*spilledBody, error) {
+	file, err := os.CreateTemp(s.spillDir, "fluidity-body-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spill file: %w", err)
+	}
+
+	size, err := io.Copy(file, body)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		if uploadFailed(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to write spill file: %w", err)
+	}
+
+	return &spilledBody{file: file, size: size}, nil
+}
+
+// reader returns a fresh reader over the whole spilled body
+func (b *spilledBody) reader() io.Reader {
+	return io.NewSectionReader(b.file, 0, b.size)
+}
+
+// remove closes and deletes the temp file
+func (b *spilledBody) remove() {
+	b.file.Close()
+	os.Remove(b.file.Name())
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// streamReadSize is the largest body chunk relayed per http_response_chunk message
+const streamReadSize = 32 * 1024
+
+// errStreamStalled ends a streamed response whose agent has stopped granting credit
+var errStreamStalled = errors.New("agent stopped reading the stream")
+
+// isEventStream reports whether a response is a Server-Sent Events stream
+func isEventStream(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// streamStallTimeout ends a streamed response when the agent grants no credit for this long
+const streamStallTimeout = 30 * time.Second
+
+// trackedRequest is a request in flight, which the agent may cancel and whose response may be streamed
+type trackedRequest struct {
+	cancel  context.CancelFunc
+	credits chan int // Credit the agent grants for more chunks
+}
+
+// expectsEventStream reports whether the agent can take a streamed response and its client asked for an
+// event stream, which is expected to stay open. Whatever was asked for, a response is streamed when it
+// turns out to be an event stream; this only settles what must be decided before the response arrives.
+func expectsEventStream(req *protocol.Request) bool {
+	if !req.Stream {
+		return false
+	}
+	for _, accept := range http.Header(req.Headers).Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediaType == "text/event-stream" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// trackRequest returns a context for a request that the agent can cancel with http_cancel.
+// The returned cancel function must be called once the request finishes.
+func (s *Server) trackRequest(id string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(s.ctx)
+
+	s.streamMutex.Lock()
+	s.streams[id] = &trackedRequest{cancel: cancel, credits: make(chan int, protocol.ChunkWindow)}
+	s.streamMutex.Unlock()
+
+	return ctx, func() {
+		s.streamMutex.Lock()
+		delete(s.streams, id)
+		s.streamMutex.Unlock()
+		cancel()
+	}
+}
+
+// cancelRequest stops a request at the agent's request
+func (s *Server) cancelRequest(id string) {
+	s.streamMutex.Lock()
+	tracked := s.streams[id]
+	s.streamMutex.Unlock()
+
+	if tracked != nil {
+		s.logger.Debug("Agent cancelled request", "id", id)
+		tracked.cancel()
+	}
+}
+
+// grantStreamCredit hands credit from the agent to a streamed response
+func (s *Server) grantStreamCredit(credit *protocol.ChunkCredit) {
+	s.streamMutex.Lock()
+	stream := s.streams[credit.ID]
+	s.streamMutex.Unlock()
+	if stream == nil {
+		return
+	}
+	select {
+	case stream.credits <- credit.Chunks:
+	default:
+		// More grants than chunks sent; the agent is not keeping count
+		s.logger.Debug("Stream credit channel full", "id", credit.ID)
+	}
+}
+
+// streamCredits returns the credit channel of a tracked request's streamed response
+func (s *Server) streamCredits(id string) <-chan int {
+	s.streamMutex.Lock()
+	defer s.streamMutex.Unlock()
+	if stream := s.streams[id]; stream != nil {
+		return stream.credits
+	}
+	return nil
+}
+
+// streamResponse relays an event stream as it arrives: the status and headers first, then each read
+// of the body as an http_response_chunk, ending with a final chunk when either side closes. Each chunk
+// spends one of the credits the agent grants as its client consumes them, starting from a full window,
+// so a slow client slows the upstream read instead of piling chunks up on the agent.
+func (s *Server) streamResponse(ctx context.Context, req *protocol.Request, httpResp *http.Response, encoder *json.Encoder, mu *sync.Mutex) (int, error) {
+	send := func(msgType string, payload any) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return encoder.Encode(protocol.Envelope{Type: msgType, Payload: payload})
+	}
+
+	credits := s.streamCredits(req.ID)
+	credit := protocol.ChunkWindow
+	// spend takes the credit for one chunk, waiting for the agent to grant more once the window is spent
+	spend := func() error {
+		for {
+			select {
+			case granted := <-credits:
+				credit += granted
+				continue
+			default:
+			}
+			if credit > 0 {
+				credit--
+				return nil
+			}
+			select {
+			case granted := <-credits:
+				credit += granted
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(streamStallTimeout):
+				return errStreamStalled
+			}
+		}
+	}
+
+	resp := &protocol.Response{
+		ID:         req.ID,
+		StatusCode: httpResp.StatusCode,
+		Headers:    convertHeaders(httpResp.Header),
+		Stream:     true,
+	}
+	if err := send("http_response", resp); err != nil {
+		s.logger.Error("Failed to send response", err, "id", req.ID)
+		return httpResp.StatusCode, err
+	}
+	s.logger.Debug("Streaming response", "id", req.ID, "status", httpResp.StatusCode)
+
+	buf := make([]byte, streamReadSize)
+	var seq uint64
+	var total int64
+	var failed bool
+	for {
+		n, readErr := httpResp.Body.Read(buf)
+		if n > 0 {
+			if err := spend(); err != nil {
+				// The agent has stopped reading, so there is no one left to send the end of the stream to
+				s.logger.Warn("Agent stopped reading the stream, ending it", "id", req.ID, "error", err.Error())
+				return httpResp.StatusCode, nil
+			}
+			if err := send("http_response_chunk", &protocol.Chunk{ID: req.ID, Seq: seq, Data: buf[:n]}); err != nil {
+				s.logger.Error("Failed to send response chunk", err, "id", req.ID)
+				return httpResp.StatusCode, err
+			}
+			seq++
+			total += int64(n)
+		}
+		if readErr != nil {
+			if !errors.Is(readErr, io.EOF) {
+				failed = true
+				if ctx.Err() == nil {
+					s.logger.Warn("Upstream stream ended with error", "id", req.ID, "error", readErr.Error())
+				}
+			}
+			break
+		}
+	}
+
+	if err := spend(); err != nil {
+		s.logger.Warn("Agent stopped reading the stream, ending it", "id", req.ID, "error", err.Error())
+		return httpResp.StatusCode, nil
+	}
+	final := &protocol.Chunk{ID: req.ID, Seq: seq, Final: true, TotalBytes: total}
+	if failed {
+		// A final chunk that disagrees with the bytes sent makes the agent abort the stream
+		final.TotalBytes = -1
+	}
+	if err := send("http_response_chunk", final); err != nil {
+		s.logger.Error("Failed to send final response chunk", err, "id", req.ID)
+		return httpResp.StatusCode, err
+	}
+
+	s.logger.Debug("Stream finished", "id", req.ID, "chunks", seq, "size", total)
+	return httpResp.StatusCode, nil
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// SetMaxStreamsPerAgent caps the CONNECT tunnels and WebSockets a single agent connection may have open
+// at once, so one agent cannot exhaust the server's file descriptors. New streams beyond a cap are
+// refused while the agent's existing streams carry on (0 disables a cap; call before Start).
+func (s *Server) SetMaxStreamsPerAgent(connect, webSocket int) {
+	s.connectLimit = connect
+	s.wsLimit = webSocket
+}
+
+// streamSlot is a stream's place under its agent's limit, given back exactly once when the stream closes
+type streamSlot struct {
+	once  sync.Once
+	count *atomic.Int32
+}
+
+// acquireStream takes a slot from count, reporting false when the agent is already at limit
+func acquireStream(count *atomic.Int32, limit int) (*streamSlot, bool) {
+	if n := count.Add(1); limit > 0 && int(n) > limit {
+		count.Add(-1)
+		return nil, false
+	}
+	return &streamSlot{count: count}, true
+}
+
+// release gives the slot back; it is safe to call more than once and on a nil slot
+func (slot *streamSlot) release() {
+	if slot == nil {
+		return
+	}
+	slot.once.Do(func() {
+		slot.count.Add(-1)
+	})
+}
+
+// rejectConnectOpen refuses a CONNECT tunnel over the agent's stream limit
+func (s *Server) rejectConnectOpen(open *protocol.ConnectOpen, client string, encoder *json.Encoder, mu *sync.Mutex) {
+	reason := fmt.Sprintf("stream limit reached: agent already has %d CONNECT tunnels open", s.connectLimit)
+	s.logger.Warn("Per-agent CONNECT limit reached, rejecting tunnel", "id", open.ID, "client", client, "limit", s.connectLimit)
+
+	mu.Lock()
+	defer mu.Unlock()
+	_ = encoder.Encode(protocol.Envelope{Type: "connect_ack", Payload: &protocol.ConnectAck{ID: open.ID, Ok: false, Error: reason}})
+	_ = encoder.Encode(protocol.Envelope{Type: "connect_close", Payload: &protocol.ConnectClose{ID: open.ID, Error: reason}})
+}
+
+// rejectWebSocketOpen refuses a WebSocket over the agent's stream limit
+func (s *Server) rejectWebSocketOpen(open *protocol.WebSocketOpen, client string, encoder *json.Encoder, mu *sync.Mutex) {
+	reason := fmt.Sprintf("stream limit reached: agent already has %d WebSockets open", s.wsLimit)
+	s.logger.Warn("Per-agent WebSocket limit reached, rejecting tunnel", "id", open.ID, "client", client, "limit", s.wsLimit)
+
+	mu.Lock()
+	defer mu.Unlock()
+	_ = encoder.Encode(protocol.Envelope{Type: "ws_ack", Payload: &protocol.WebSocketAck{ID: open.ID, Ok: false, Error: reason}})
+	_ = encoder.Encode(protocol.Envelope{Type: "ws_close", Payload: &protocol.WebSocketClose{ID: open.ID, Code: websocket.CloseTryAgainLater, Error: reason}})
+}
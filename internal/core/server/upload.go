@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// uploadBufferSize is the number of request body chunks buffered per streamed upload, which is the
+// window the agent may send without credit
+const uploadBufferSize = protocol.ChunkWindow
+
+// uploadCreditBatch is how many consumed chunks are acknowledged to the agent in one credit message
+const uploadCreditBatch = protocol.ChunkWindow / 4
+
+// uploadIdleTimeout fails a streamed upload when no chunk arrives for this long
+const uploadIdleTimeout = 30 * time.Second
+
+// requestUpload receives the body chunks of a request whose body is streamed from the agent
+type requestUpload struct {
+	chunks chan *protocol.Chunk
+	done   chan struct{}    // Closed when the request stops reading
+	grant  func(chunks int) // Gives the agent credit to send more chunks
+	budget *memoryBudget
+
+	mu     sync.Mutex
+	held   int64 // Bytes of buffered chunks reserved from the budget
+	closed bool
+}
+
+// openUpload registers an upload for a request whose body follows in http_request_chunk messages. It is
+// called from the connection's read loop before the request is dispatched, so no chunk is missed.
+func (s *Server) openUpload(id string, encoder *json.Encoder, mu *sync.Mutex) {
+	grant := func(chunks int) {
+		env := protocol.Envelope{Type: "http_request_credit", Payload: &protocol.ChunkCredit{ID: id, Chunks: chunks}}
+		mu.Lock()
+		_ = encoder.Encode(env)
+		mu.Unlock()
+	}
+
+	s.uploadMutex.Lock()
+	s.uploads[id] = &requestUpload{
+		chunks: make(chan *protocol.Chunk, uploadBufferSize),
+		done:   make(chan struct{}),
+		grant:  grant,
+		budget: s.budget,
+	}
+	s.uploadMutex.Unlock()
+}
+
+// deliverUploadChunk hands a request body chunk to its upload without blocking the read loop. The agent
+// only sends chunks it has credit for, so one that does not fit overran the window and aborts the upload.
+// Chunks for requests that have already finished, such as ones refused before their body was read, are dropped.
+// Buffered chunks count against the memory budget until they are read, and one that does not fit aborts the upload.
+func (s *Server) deliverUploadChunk(chunk *protocol.Chunk) {
+	s.uploadMutex.Lock()
+	upload := s.uploads[chunk.ID]
+	s.uploadMutex.Unlock()
+	if upload == nil {
+		return
+	}
+
+	upload.mu.Lock()
+	if upload.closed {
+		upload.mu.Unlock()
+		return
+	}
+	if !upload.budget.reserve(int64(len(chunk.Data))) {
+		upload.mu.Unlock()
+		s.logger.Warn("Memory budget exhausted, aborting request upload", "id", chunk.ID, "inflight", s.InflightBytes())
+		s.closeUpload(chunk.ID)
+		return
+	}
+	upload.held += int64(len(chunk.Data))
+	upload.mu.Unlock()
+
+	select {
+	case upload.chunks <- chunk:
+	case <-upload.done:
+	default:
+		s.logger.Error("Request upload overran its credit window, aborting", nil, "id", chunk.ID, "seq", chunk.Seq)
+		s.closeUpload(chunk.ID)
+	}
+}
+
+// uploadBody returns a reader of the request body streamed for id, which fails if the chunks arrive out
+// of order, stall or add up to a length other than the agent declared. The agent is granted credit as the
+// body is read, and the bytes read are added to received.
+func (s *Server) uploadBody(id string, received *atomic.Int64) io.ReadCloser {
+	s.uploadMutex.Lock()
+	upload := s.uploads[id]
+	s.uploadMutex.Unlock()
+
+	reader, writer := io.Pipe()
+	if upload == nil {
+		writer.CloseWithError(protocol.ErrChunkTruncated)
+		return reader
+	}
+	go func() {
+		w := &creditWriter{w: &countingWriter{Writer: writer, count: received}, grant: upload.grant, release: upload.release}
+		_, err := protocol.ReassembleChunksUntil(upload.chunks, w, uploadIdleTimeout, upload.done)
+		writer.CloseWithError(err)
+	}()
+	return reader
+}
+
+// creditWriter grants credit for chunks, and releases their budget, once they have been written, one Write
+// per chunk. Written through a pipe, a chunk has then been read by the upstream request.
+type creditWriter struct {
+	w       io.Writer
+	grant   func(chunks int)
+	release func(n int64)
+	pending int
+}
+
+func (c *creditWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.release(int64(len(p)))
+	if err != nil {
+		return n, err
+	}
+	c.pending++
+	if c.pending >= uploadCreditBatch {
+		c.grant(c.pending)
+		c.pending = 0
+	}
+	return n, nil
+}
+
+// release returns the budget held for n bytes of chunks that have been read
+func (u *requestUpload) release(n int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.closed {
+		u.held -= n
+		u.budget.release(n)
+	}
+}
+
+// closeUpload unregisters the upload for id once its request has finished, releasing the budget held
+// by any chunks still buffered
+func (s *Server) closeUpload(id string) {
+	s.uploadMutex.Lock()
+	upload := s.uploads[id]
+	delete(s.uploads, id)
+	s.uploadMutex.Unlock()
+	if upload == nil {
+		return
+	}
+
+	upload.mu.Lock()
+	upload.closed = true
+	upload.budget.release(upload.held)
+	upload.held = 0
+	upload.mu.Unlock()
+	close(upload.done)
+}
+
+// uploadFailed reports whether err is a streamed request body arriving broken, rather than a local failure
+func uploadFailed(err error) bool {
+	return errors.Is(err, protocol.ErrChunkGap) || errors.Is(err, protocol.ErrChunkTruncated) || errors.Is(err, protocol.ErrChunkLength)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"fluidity/internal/shared/protocol"
+)
+
+// requestJob is an http_request waiting for a pool worker
+type requestJob struct {
+	req     *protocol.Request
+	client  string
+	encoder *json.Encoder
+	mu      *sync.Mutex
+}
+
+// SetWorkerPool processes requests on a fixed pool of workers draining a bounded queue instead of
+// a goroutine per request. Requests arriving while the queue is full are rejected with 503.
+// A worker count of 0 restores goroutine-per-request dispatch (call before Start).
+func (s *Server) SetWorkerPool(workers, queueDepth int) {
+	if workers <= 0 {
+		s.workers = 0
+		s.requestQueue = nil
+		return
+	}
+	if queueDepth < 0 {
+		queueDepth = 0
+	}
+	s.workers = workers
+	s.requestQueue = make(chan requestJob, queueDepth)
+}
+
+// startWorkers launches the request pool workers, which exit when the server stops
+func (s *Server) startWorkers() {
+	if s.requestQueue == nil {
+		return
+	}
+
+	for i := 0; i < s.workers; i++ {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for {
+				select {
+				case <-s.ctx.Done():
+					return
+				case job := <-s.requestQueue:
+					s.processRequest(job.req, job.client, job.encoder, job.mu)
+				}
+			}
+		}()
+	}
+
+	s.logger.Info("Request worker pool started", "workers", s.workers, "queue_depth", cap(s.requestQueue))
+}
+
+// dispatchRequest hands a request to the worker pool, or to its own goroutine when no pool is configured
+// or the client asked for an event stream
+func (s *Server) dispatchRequest(req *protocol.Request, client string, encoder *json.Encoder, mu *sync.Mutex) {
+	// Event streams and uploads would hold a worker for as long as the stream stays open
+	if s.requestQueue == nil || expectsEventStream(req) || req.BodyStream {
+		go s.processRequest(req, client, encoder, mu)
+		return
+	}
+
+	select {
+	case s.requestQueue <- requestJob{req: req, client: client, encoder: encoder, mu: mu}:
+	default:
+		s.logger.Warn("Request queue full, rejecting request", "id", req.ID, "queue_depth", cap(s.requestQueue))
+		s.sendErrorResponseWithStatus(req.ID, http.StatusServiceUnavailable, protocol.ErrCodeLoadShed,
+			fmt.Errorf("server busy (request queue full)"), encoder, mu)
+	}
+}
@@ -2,9 +2,10 @@ package kill
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"net/http"
 
+	"fluidity/internal/shared/lambdaevent"
 	"fluidity/internal/shared/logger"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -26,11 +27,7 @@ type KillResponse struct {
 }
 
 // FunctionURLResponse wraps the response for Lambda Function URL format
-type FunctionURLResponse struct {
-	StatusCode int               `json:"statusCode"`
-	Headers    map[string]string `json:"headers"`
-	Body       string            `json:"body"`
-}
+type FunctionURLResponse = lambdaevent.Response
 
 // ECSClient interface for testing
 type ECSClient interface {
@@ -96,41 +93,9 @@ func (h *Handler) HandleRequest(ctx context.Context, event interface{}) (interfa
 	var request KillRequest
 
 	// Parse the event - could be direct JSON or wrapped in Function URL event
-	switch e := event.(type) {
-	case map[string]interface{}:
-		// Try to unmarshal as request body first
-		if body, ok := e["body"]; ok {
-			// Lambda Function URL passes raw JSON body
-			if bodyStr, ok := body.(string); ok {
-				if err := json.Unmarshal([]byte(bodyStr), &request); err != nil {
-					h.logger.Error("Failed to unmarshal body from event", err)
-					return h.errorResponse(400, "Invalid JSON in request body"), nil
-				}
-			}
-		} else {
-			// Direct JSON invocation
-			data, err := json.Marshal(e)
-			if err != nil {
-				h.logger.Error("Failed to marshal event", err)
-				return h.errorResponse(400, "Invalid request format"), nil
-			}
-			if err := json.Unmarshal(data, &request); err != nil {
-				h.logger.Error("Failed to unmarshal event", err)
-				return h.errorResponse(400, "Invalid request format"), nil
-			}
-		}
-	case string:
-		// Raw JSON string
-		if err := json.Unmarshal([]byte(e), &request); err != nil {
-			h.logger.Error("Failed to unmarshal JSON string", err)
-			return h.errorResponse(400, "Invalid JSON in request body"), nil
-		}
-	case []byte:
-		// Raw bytes
-		if err := json.Unmarshal(e, &request); err != nil {
-			h.logger.Error("Failed to unmarshal bytes", err)
-			return h.errorResponse(400, "Invalid JSON in request body"), nil
-		}
+	if err := lambdaevent.Decode(event, &request, lambdaevent.DefaultMaxBodyBytes); err != nil {
+		h.logger.Error("Rejecting invalid request", err)
+		return h.errorResponse(lambdaevent.StatusCode(err), err.Error()), nil
 	}
 
 	response, err := h.handleKillRequest(ctx, request)
@@ -195,25 +160,10 @@ func (h *Handler) handleKillRequest(ctx context.Context, request KillRequest) (*
 
 // successResponse wraps the kill response in Function URL format
 func (h *Handler) successResponse(data *KillResponse) FunctionURLResponse {
-	body, _ := json.Marshal(data)
-	return FunctionURLResponse{
-		StatusCode: 200,
-		Headers: map[string]string{
-			"Content-Type": "application/json",
-		},
-		Body: string(body),
-	}
+	return lambdaevent.JSONResponse(h.logger, http.StatusOK, data)
 }
 
 // errorResponse returns an error response in Function URL format
 func (h *Handler) errorResponse(statusCode int, message string) FunctionURLResponse {
-	body := map[string]string{"error": message}
-	bodyBytes, _ := json.Marshal(body)
-	return FunctionURLResponse{
-		StatusCode: statusCode,
-		Headers: map[string]string{
-			"Content-Type": "application/json",
-		},
-		Body: string(bodyBytes),
-	}
+	return lambdaevent.ErrorResponse(h.logger, statusCode, message)
 }
@@ -2,10 +2,11 @@ package query
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"net/http"
 	"strings"
 
+	"fluidity/internal/shared/lambdaevent"
 	"fluidity/internal/shared/logger"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -19,6 +20,14 @@ type QueryRequest struct {
 	InstanceID string `json:"instance_id"`
 }
 
+// Validate checks the request names an instance to query
+func (r *QueryRequest) Validate() error {
+	if r.InstanceID == "" {
+		return fmt.Errorf("instance_id is required")
+	}
+	return nil
+}
+
 // QueryResponse represents the direct JSON response from Query Lambda
 type QueryResponse struct {
 	Status   string `json:"status"` // "negative", "pending", "ready"
@@ -27,11 +36,7 @@ type QueryResponse struct {
 }
 
 // FunctionURLResponse wraps the response for Lambda Function URL format
-type FunctionURLResponse struct {
-	StatusCode int               `json:"statusCode"`
-	Headers    map[string]string `json:"headers"`
-	Body       string            `json:"body"`
-}
+type FunctionURLResponse = lambdaevent.Response
 
 // ECSClient interface for testing
 type ECSClient interface {
@@ -107,41 +112,9 @@ func (h *Handler) HandleRequest(ctx context.Context, event interface{}) (interfa
 	var request QueryRequest
 
 	// Parse the event - could be direct JSON or wrapped in Function URL event
-	switch e := event.(type) {
-	case map[string]interface{}:
-		// Try to unmarshal as request body first
-		if body, ok := e["body"]; ok {
-			// Lambda Function URL passes raw JSON body
-			if bodyStr, ok := body.(string); ok {
-				if err := json.Unmarshal([]byte(bodyStr), &request); err != nil {
-					h.logger.Error("Failed to unmarshal body from event", err)
-					return h.errorResponse(400, "Invalid JSON in request body"), nil
-				}
-			}
-		} else {
-			// Direct JSON invocation
-			data, err := json.Marshal(e)
-			if err != nil {
-				h.logger.Error("Failed to marshal event", err)
-				return h.errorResponse(400, "Invalid request format"), nil
-			}
-			if err := json.Unmarshal(data, &request); err != nil {
-				h.logger.Error("Failed to unmarshal event", err)
-				return h.errorResponse(400, "Invalid request format"), nil
-			}
-		}
-	case string:
-		// Raw JSON string
-		if err := json.Unmarshal([]byte(e), &request); err != nil {
-			h.logger.Error("Failed to unmarshal JSON string", err)
-			return h.errorResponse(400, "Invalid JSON in request body"), nil
-		}
-	case []byte:
-		// Raw bytes
-		if err := json.Unmarshal(e, &request); err != nil {
-			h.logger.Error("Failed to unmarshal bytes", err)
-			return h.errorResponse(400, "Invalid JSON in request body"), nil
-		}
+	if err := lambdaevent.Decode(event, &request, lambdaevent.DefaultMaxBodyBytes); err != nil {
+		h.logger.Error("Rejecting invalid request", err)
+		return h.errorResponse(lambdaevent.StatusCode(err), err.Error()), nil
 	}
 
 	response, err := h.handleQueryRequest(ctx, request)
@@ -372,25 +345,10 @@ func (h *Handler) getPublicIPForService(ctx context.Context, clusterName, servic
 
 // successResponse wraps the response in Function URL format
 func (h *Handler) successResponse(data *QueryResponse) FunctionURLResponse {
-	body, _ := json.Marshal(data)
-	return FunctionURLResponse{
-		StatusCode: 200,
-		Headers: map[string]string{
-			"Content-Type": "application/json",
-		},
-		Body: string(body),
-	}
+	return lambdaevent.JSONResponse(h.logger, http.StatusOK, data)
 }
 
 // errorResponse creates an error response in Function URL format
 func (h *Handler) errorResponse(statusCode int, message string) FunctionURLResponse {
-	errorResp := map[string]string{"error": message}
-	body, _ := json.Marshal(errorResp)
-	return FunctionURLResponse{
-		StatusCode: statusCode,
-		Headers: map[string]string{
-			"Content-Type": "application/json",
-		},
-		Body: string(body),
-	}
+	return lambdaevent.ErrorResponse(h.logger, statusCode, message)
 }
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"testing"
 
+	"fluidity/internal/shared/lambdaevent"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
@@ -244,6 +246,20 @@ func TestQueryHandler_MissingInstanceID(t *testing.T) {
 	if err.Error() != expectedError {
 		t.Errorf("Expected error '%s', got '%s'", expectedError, err.Error())
 	}
+
+	// Through the Function URL it is refused as an invalid request
+	result, err := handler.HandleRequest(context.Background(), map[string]interface{}{"body": `{}`})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	response := result.(FunctionURLResponse)
+	var body map[string]string
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	if response.StatusCode != 400 || body["code"] != lambdaevent.CodeInvalidRequest {
+		t.Errorf("Expected 400 %q, got %d %v", lambdaevent.CodeInvalidRequest, response.StatusCode, body)
+	}
 }
 
 func TestQueryHandler_FunctionURL(t *testing.T) {
@@ -2,10 +2,12 @@ package sleep
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"net/http"
 	"time"
 
+	"fluidity/internal/shared/clock"
+	"fluidity/internal/shared/lambdaevent"
 	"fluidity/internal/shared/logger"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -13,6 +15,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	cloudwatchtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
 )
 
 // SleepRequest represents the input to the Sleep Lambda
@@ -21,6 +24,15 @@ type SleepRequest struct {
 	ServiceName        string `json:"service_name,omitempty"`
 	IdleThresholdMins  int    `json:"idle_threshold_mins,omitempty"`
 	LookbackPeriodMins int    `json:"lookback_period_mins,omitempty"`
+	MinUptimeMins      *int   `json:"min_uptime_mins,omitempty"` // 0 disables the startup grace period
+}
+
+// Validate rejects negative durations, which would otherwise be silently replaced by the defaults
+func (r *SleepRequest) Validate() error {
+	if r.IdleThresholdMins < 0 || r.LookbackPeriodMins < 0 || (r.MinUptimeMins != nil && *r.MinUptimeMins < 0) {
+		return fmt.Errorf("idle_threshold_mins, lookback_period_mins and min_uptime_mins must not be negative")
+	}
+	return nil
 }
 
 // SleepResponse represents the output from the Sleep Lambda
@@ -34,16 +46,14 @@ type SleepResponse struct {
 }
 
 // FunctionURLResponse wraps the response for Lambda Function URL format
-type FunctionURLResponse struct {
-	StatusCode int               `json:"statusCode"`
-	Headers    map[string]string `json:"headers"`
-	Body       string            `json:"body"`
-}
+type FunctionURLResponse = lambdaevent.Response
 
 // ECSClient interface for testing
 type ECSClient interface {
 	DescribeServices(ctx context.Context, params *ecs.DescribeServicesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeServicesOutput, error)
 	UpdateService(ctx context.Context, params *ecs.UpdateServiceInput, optFns ...func(*ecs.Options)) (*ecs.UpdateServiceOutput, error)
+	ListTasks(ctx context.Context, params *ecs.ListTasksInput, optFns ...func(*ecs.Options)) (*ecs.ListTasksOutput, error)
+	DescribeTasks(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error)
 }
 
 // CloudWatchClient interface for testing
@@ -59,9 +69,15 @@ type Handler struct {
 	serviceName        string
 	idleThresholdMins  int
 	lookbackPeriodMins int
+	minUptime          time.Duration
+	window             *ScaleDownWindow
+	clock              clock.Clock
 	logger             *logger.Logger
 }
 
+// DefaultMinUptimeBeforeSleep is how long a service must have been running before it may be scaled down
+const DefaultMinUptimeBeforeSleep = 10 * time.Minute
+
 // NewHandler creates a new sleep handler with AWS SDK clients
 func NewHandler(ctx context.Context, clusterName, serviceName string, idleThresholdMins, lookbackPeriodMins int) (*Handler, error) {
 	log := logger.NewFromEnv()
@@ -108,6 +124,8 @@ func NewHandler(ctx context.Context, clusterName, serviceName string, idleThresh
 		serviceName:        serviceName,
 		idleThresholdMins:  idleThresholdMins,
 		lookbackPeriodMins: lookbackPeriodMins,
+		minUptime:          DefaultMinUptimeBeforeSleep,
+		clock:              clock.Real{},
 		logger:             log,
 	}, nil
 }
@@ -128,51 +146,38 @@ func NewHandlerWithClients(ecsClient ECSClient, cloudWatchClient CloudWatchClien
 		serviceName:        serviceName,
 		idleThresholdMins:  idleThresholdMins,
 		lookbackPeriodMins: lookbackPeriodMins,
+		minUptime:          DefaultMinUptimeBeforeSleep,
+		clock:              clock.Real{},
 		logger:             logger.New("info"),
 	}
 }
 
+// SetMinUptimeBeforeSleep sets how long a service must have been running before it may be scaled down,
+// so a freshly woken service is not put back to sleep before any agent connects (0 disables the check)
+func (h *Handler) SetMinUptimeBeforeSleep(d time.Duration) {
+	h.minUptime = d
+}
+
+// SetScaleDownWindow restricts scaling down to the times of day in window, so idle services stay up
+// through busy hours and the next user does not wait for a cold start (nil allows scaling down at any time)
+func (h *Handler) SetScaleDownWindow(window *ScaleDownWindow) {
+	h.window = window
+}
+
+// SetClock replaces the clock used for idle, startup grace period and scale-down window checks (for testing)
+func (h *Handler) SetClock(c clock.Clock) {
+	h.clock = c
+}
+
 // HandleRequest processes the sleep request for Lambda Function URL
 // Event can be either direct invocation from EventBridge or Function URL format
 func (h *Handler) HandleRequest(ctx context.Context, event interface{}) (interface{}, error) {
 	var request SleepRequest
 
 	// Parse the event - could be direct JSON or wrapped in Function URL event
-	switch e := event.(type) {
-	case map[string]interface{}:
-		// Try to unmarshal as request body first
-		if body, ok := e["body"]; ok {
-			// Lambda Function URL passes raw JSON body
-			if bodyStr, ok := body.(string); ok {
-				if err := json.Unmarshal([]byte(bodyStr), &request); err != nil {
-					h.logger.Error("Failed to unmarshal body from event", err)
-					return h.errorResponse(400, "Invalid JSON in request body"), nil
-				}
-			}
-		} else {
-			// Direct JSON invocation
-			data, err := json.Marshal(e)
-			if err != nil {
-				h.logger.Error("Failed to marshal event", err)
-				return h.errorResponse(400, "Invalid request format"), nil
-			}
-			if err := json.Unmarshal(data, &request); err != nil {
-				h.logger.Error("Failed to unmarshal event", err)
-				return h.errorResponse(400, "Invalid request format"), nil
-			}
-		}
-	case string:
-		// Raw JSON string
-		if err := json.Unmarshal([]byte(e), &request); err != nil {
-			h.logger.Error("Failed to unmarshal JSON string", err)
-			return h.errorResponse(400, "Invalid JSON in request body"), nil
-		}
-	case []byte:
-		// Raw bytes
-		if err := json.Unmarshal(e, &request); err != nil {
-			h.logger.Error("Failed to unmarshal bytes", err)
-			return h.errorResponse(400, "Invalid JSON in request body"), nil
-		}
+	if err := lambdaevent.Decode(event, &request, lambdaevent.DefaultMaxBodyBytes); err != nil {
+		h.logger.Error("Rejecting invalid request", err)
+		return h.errorResponse(lambdaevent.StatusCode(err), err.Error()), nil
 	}
 
 	response, err := h.handleSleepRequest(ctx, request)
@@ -218,11 +223,17 @@ func (h *Handler) handleSleepRequest(ctx context.Context, request SleepRequest)
 		lookbackPeriodMins = request.LookbackPeriodMins
 	}
 
+	minUptime := h.minUptime
+	if request.MinUptimeMins != nil {
+		minUptime = time.Duration(*request.MinUptimeMins) * time.Minute
+	}
+
 	h.logger.Info("Processing sleep request", map[string]interface{}{
 		"clusterName":        clusterName,
 		"serviceName":        serviceName,
 		"idleThresholdMins":  idleThresholdMins,
 		"lookbackPeriodMins": lookbackPeriodMins,
+		"minUptimeSeconds":   int64(minUptime.Seconds()),
 	})
 
 	// Step 1: Check current service state
@@ -274,7 +285,7 @@ func (h *Handler) handleSleepRequest(ctx context.Context, request SleepRequest)
 		"lookbackPeriodMins": lookbackPeriodMins,
 	})
 
-	now := time.Now()
+	now := h.clock.Now()
 	startTime := now.Add(-time.Duration(lookbackPeriodMins) * time.Minute)
 	endTime := now
 
@@ -303,7 +314,55 @@ func (h *Handler) handleSleepRequest(ctx context.Context, request SleepRequest)
 	idleThresholdSeconds := int64(idleThresholdMins * 60)
 	isIdle := avgActiveConnections <= 0 && idleDurationSeconds >= idleThresholdSeconds
 
-	// Step 6: If idle and running, scale down by 1 (supporting multiple instances)
+	// Step 6: A recently started service has no metric history yet, so give agents time to connect (with no
+	// grace period the task lookup is skipped entirely)
+	if isIdle && minUptime > 0 {
+		startedAt, err := h.getServiceStartTime(ctx, clusterName, serviceName)
+		if err != nil {
+			h.logger.Error("Failed to determine service start time", err, map[string]interface{}{
+				"clusterName": clusterName,
+				"serviceName": serviceName,
+			})
+			return nil, fmt.Errorf("failed to determine service start time: %w", err)
+		}
+
+		if !startedAt.IsZero() {
+			if uptime := now.Sub(startedAt); uptime < minUptime {
+				h.logger.Info("Service is idle but within startup grace period, not scaling down", map[string]interface{}{
+					"uptimeSeconds":    int64(uptime.Seconds()),
+					"minUptimeSeconds": int64(minUptime.Seconds()),
+				})
+
+				return &SleepResponse{
+					Action:               "no_change",
+					DesiredCount:         desiredCount,
+					RunningCount:         runningCount,
+					AvgActiveConnections: avgActiveConnections,
+					IdleDurationSeconds:  idleDurationSeconds,
+					Message:              fmt.Sprintf("Service started %d seconds ago, within the %d second startup grace period", int64(uptime.Seconds()), int64(minUptime.Seconds())),
+				}, nil
+			}
+		}
+	}
+
+	// Step 7: Outside the allowed window an idle service is left running
+	if isIdle && h.window != nil && !h.window.Contains(now) {
+		h.logger.Info("Service is idle but outside the scale-down window, not scaling down", map[string]interface{}{
+			"window":              h.window.String(),
+			"idleDurationSeconds": idleDurationSeconds,
+		})
+
+		return &SleepResponse{
+			Action:               "no_change",
+			DesiredCount:         desiredCount,
+			RunningCount:         runningCount,
+			AvgActiveConnections: avgActiveConnections,
+			IdleDurationSeconds:  idleDurationSeconds,
+			Message:              fmt.Sprintf("Service is idle but outside the allowed scale-down window (%s)", h.window),
+		}, nil
+	}
+
+	// Step 8: If idle and running, scale down by 1 (supporting multiple instances)
 	if isIdle {
 		newDesiredCount := desiredCount - 1
 		if newDesiredCount < 0 {
@@ -365,7 +424,7 @@ func (h *Handler) handleSleepRequest(ctx context.Context, request SleepRequest)
 		}
 	}
 
-	// Step 7: Service is active, no action
+	// Step 9: Service is active, no action
 	h.logger.Info("Service is active, no action needed", map[string]interface{}{
 		"avgActiveConnections": avgActiveConnections,
 		"idleDurationSeconds":  idleDurationSeconds,
@@ -383,6 +442,48 @@ func (h *Handler) handleSleepRequest(ctx context.Context, request SleepRequest)
 	}, nil
 }
 
+// getServiceStartTime returns when the longest-running task of the service started (zero if no task has started)
+func (h *Handler) getServiceStartTime(ctx context.Context, clusterName, serviceName string) (time.Time, error) {
+	listTasksInput := &ecs.ListTasksInput{
+		Cluster:       aws.String(clusterName),
+		ServiceName:   aws.String(serviceName),
+		DesiredStatus: ecstypes.DesiredStatusRunning,
+	}
+
+	h.logger.Debug("Listing tasks for service")
+	listTasksOutput, err := h.ecsClient.ListTasks(ctx, listTasksInput)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to list tasks: %w", err)
+	}
+
+	if len(listTasksOutput.TaskArns) == 0 {
+		return time.Time{}, nil
+	}
+
+	describeTasksInput := &ecs.DescribeTasksInput{
+		Cluster: aws.String(clusterName),
+		Tasks:   listTasksOutput.TaskArns,
+	}
+
+	h.logger.Debug("Describing tasks")
+	describeTasksOutput, err := h.ecsClient.DescribeTasks(ctx, describeTasksInput)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to describe tasks: %w", err)
+	}
+
+	var startedAt time.Time
+	for _, task := range describeTasksOutput.Tasks {
+		if task.StartedAt == nil {
+			continue
+		}
+		if startedAt.IsZero() || task.StartedAt.Before(startedAt) {
+			startedAt = *task.StartedAt
+		}
+	}
+
+	return startedAt, nil
+}
+
 // getMetrics queries CloudWatch for active connections and last activity metrics
 func (h *Handler) getMetrics(ctx context.Context, startTime, endTime time.Time) (avgActiveConnections float64, lastActivityTime time.Time, err error) {
 	input := &cloudwatch.GetMetricDataInput{
@@ -470,25 +571,10 @@ func (h *Handler) getMetrics(ctx context.Context, startTime, endTime time.Time)
 
 // successResponse wraps the sleep response in Function URL format
 func (h *Handler) successResponse(data *SleepResponse) FunctionURLResponse {
-	body, _ := json.Marshal(data)
-	return FunctionURLResponse{
-		StatusCode: 200,
-		Headers: map[string]string{
-			"Content-Type": "application/json",
-		},
-		Body: string(body),
-	}
+	return lambdaevent.JSONResponse(h.logger, http.StatusOK, data)
 }
 
 // errorResponse returns an error response in Function URL format
 func (h *Handler) errorResponse(statusCode int, message string) FunctionURLResponse {
-	body := map[string]string{"error": message}
-	bodyBytes, _ := json.Marshal(body)
-	return FunctionURLResponse{
-		StatusCode: statusCode,
-		Headers: map[string]string{
-			"Content-Type": "application/json",
-		},
-		Body: string(bodyBytes),
-	}
+	return lambdaevent.ErrorResponse(h.logger, statusCode, message)
 }
@@ -4,9 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	"fluidity/internal/shared/clock"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	cloudwatchtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
@@ -18,6 +21,8 @@ import (
 type mockECSClient struct {
 	describeServicesFunc func(ctx context.Context, params *ecs.DescribeServicesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeServicesOutput, error)
 	updateServiceFunc    func(ctx context.Context, params *ecs.UpdateServiceInput, optFns ...func(*ecs.Options)) (*ecs.UpdateServiceOutput, error)
+	listTasksFunc        func(ctx context.Context, params *ecs.ListTasksInput, optFns ...func(*ecs.Options)) (*ecs.ListTasksOutput, error)
+	describeTasksFunc    func(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error)
 }
 
 func (m *mockECSClient) DescribeServices(ctx context.Context, params *ecs.DescribeServicesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeServicesOutput, error) {
@@ -28,6 +33,20 @@ func (m *mockECSClient) UpdateService(ctx context.Context, params *ecs.UpdateSer
 	return m.updateServiceFunc(ctx, params, optFns...)
 }
 
+func (m *mockECSClient) ListTasks(ctx context.Context, params *ecs.ListTasksInput, optFns ...func(*ecs.Options)) (*ecs.ListTasksOutput, error) {
+	if m.listTasksFunc != nil {
+		return m.listTasksFunc(ctx, params, optFns...)
+	}
+	return &ecs.ListTasksOutput{}, nil
+}
+
+func (m *mockECSClient) DescribeTasks(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+	if m.describeTasksFunc != nil {
+		return m.describeTasksFunc(ctx, params, optFns...)
+	}
+	return &ecs.DescribeTasksOutput{}, nil
+}
+
 // Mock CloudWatch client
 type mockCloudWatchClient struct {
 	getMetricDataFunc func(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error)
@@ -369,6 +388,15 @@ func TestSleepWithRequestOverrides(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
 	}
+
+	// A negative override is refused before any AWS call
+	response, err := handler.HandleRequest(context.Background(), map[string]interface{}{"idle_threshold_mins": -5})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if status := response.(FunctionURLResponse).StatusCode; status != 400 {
+		t.Errorf("Expected status 400 for a negative override, got %d", status)
+	}
 }
 
 // TestSleepCloudWatchError tests handling of CloudWatch API errors
@@ -469,3 +497,277 @@ func TestSleepECSUpdateError(t *testing.T) {
 		t.Errorf("Expected error status 500, got %d", functionURLResp.StatusCode)
 	}
 }
+
+// TestSleepStartupGracePeriod tests that a recently started idle service is not scaled down
+func TestSleepStartupGracePeriod(t *testing.T) {
+	disabled := 0
+
+	tests := []struct {
+		name          string
+		startedAgo    time.Duration
+		minUptime     time.Duration
+		request       SleepRequest
+		wantAction    string
+		wantScaleDown bool
+		wantLookup    bool
+	}{
+		{name: "just started", startedAgo: 2 * time.Minute, minUptime: 10 * time.Minute, wantAction: "no_change", wantLookup: true},
+		{name: "started long ago", startedAgo: time.Hour, minUptime: 10 * time.Minute, wantAction: "scaled_down", wantScaleDown: true, wantLookup: true},
+		{name: "grace period disabled", startedAgo: 2 * time.Minute, minUptime: 0, wantAction: "scaled_down", wantScaleDown: true},
+		{name: "grace period disabled by request", startedAgo: 2 * time.Minute, minUptime: 10 * time.Minute, request: SleepRequest{MinUptimeMins: &disabled}, wantAction: "scaled_down", wantScaleDown: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			updateCalled := false
+			lookupCalled := false
+
+			mockECS := &mockECSClient{
+				describeServicesFunc: func(ctx context.Context, params *ecs.DescribeServicesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeServicesOutput, error) {
+					return &ecs.DescribeServicesOutput{
+						Services: []ecstypes.Service{
+							{
+								DesiredCount: 1,
+								RunningCount: 1,
+							},
+						},
+					}, nil
+				},
+				updateServiceFunc: func(ctx context.Context, params *ecs.UpdateServiceInput, optFns ...func(*ecs.Options)) (*ecs.UpdateServiceOutput, error) {
+					updateCalled = true
+					return &ecs.UpdateServiceOutput{}, nil
+				},
+				listTasksFunc: func(ctx context.Context, params *ecs.ListTasksInput, optFns ...func(*ecs.Options)) (*ecs.ListTasksOutput, error) {
+					lookupCalled = true
+					return &ecs.ListTasksOutput{TaskArns: []string{"task-1"}}, nil
+				},
+				describeTasksFunc: func(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+					return &ecs.DescribeTasksOutput{
+						Tasks: []ecstypes.Task{
+							{StartedAt: aws.Time(now.Add(-tt.startedAgo))},
+						},
+					}, nil
+				},
+			}
+
+			// Last activity predates the wake, so the metrics alone look idle
+			mockCW := &mockCloudWatchClient{
+				getMetricDataFunc: func(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+					return &cloudwatch.GetMetricDataOutput{
+						MetricDataResults: []cloudwatchtypes.MetricDataResult{
+							{
+								Id:     aws.String("active_connections"),
+								Values: []float64{0.0},
+							},
+							{
+								Id:     aws.String("last_activity"),
+								Values: []float64{float64(now.Add(-2 * time.Hour).Unix())},
+							},
+						},
+					}, nil
+				},
+			}
+
+			handler := NewHandlerWithClients(mockECS, mockCW, "test-cluster", "test-service", 15, 10)
+			handler.SetMinUptimeBeforeSleep(tt.minUptime)
+
+			response, err := handler.HandleRequest(context.Background(), tt.request)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+
+			var sleepResp SleepResponse
+			funcURLResp, ok := response.(FunctionURLResponse)
+			if !ok {
+				t.Fatalf("Expected FunctionURLResponse, got %T", response)
+			}
+			if err := json.Unmarshal([]byte(funcURLResp.Body), &sleepResp); err != nil {
+				t.Fatalf("Failed to parse response body: %v", err)
+			}
+
+			if sleepResp.Action != tt.wantAction {
+				t.Errorf("Expected action '%s', got: %s (%s)", tt.wantAction, sleepResp.Action, sleepResp.Message)
+			}
+			if updateCalled != tt.wantScaleDown {
+				t.Errorf("Expected UpdateService called=%v, got %v", tt.wantScaleDown, updateCalled)
+			}
+			if lookupCalled != tt.wantLookup {
+				t.Errorf("Expected ListTasks called=%v, got %v", tt.wantLookup, lookupCalled)
+			}
+		})
+	}
+}
+
+// TestSleepIdleThresholdBoundary tests that the idle threshold is met exactly at, and not just before, it
+func TestSleepIdleThresholdBoundary(t *testing.T) {
+	lastActivity := time.Date(2026, 3, 4, 10, 0, 0, 0, time.UTC)
+	threshold := 15 * time.Minute
+
+	tests := []struct {
+		name          string
+		idle          time.Duration
+		wantScaleDown bool
+	}{
+		{name: "just under", idle: threshold - time.Second, wantScaleDown: false},
+		{name: "at threshold", idle: threshold, wantScaleDown: true},
+		{name: "just over", idle: threshold + time.Second, wantScaleDown: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updateCalled := false
+			mockECS := &mockECSClient{
+				describeServicesFunc: func(ctx context.Context, params *ecs.DescribeServicesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeServicesOutput, error) {
+					return &ecs.DescribeServicesOutput{
+						Services: []ecstypes.Service{{DesiredCount: 1, RunningCount: 1}},
+					}, nil
+				},
+				updateServiceFunc: func(ctx context.Context, params *ecs.UpdateServiceInput, optFns ...func(*ecs.Options)) (*ecs.UpdateServiceOutput, error) {
+					updateCalled = true
+					return &ecs.UpdateServiceOutput{}, nil
+				},
+			}
+			mockCW := &mockCloudWatchClient{
+				getMetricDataFunc: func(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+					return &cloudwatch.GetMetricDataOutput{
+						MetricDataResults: []cloudwatchtypes.MetricDataResult{
+							{Id: aws.String("active_connections"), Values: []float64{0.0}},
+							{Id: aws.String("last_activity"), Values: []float64{float64(lastActivity.Unix())}},
+						},
+					}, nil
+				},
+			}
+
+			fake := clock.NewFake(lastActivity)
+			fake.Advance(tt.idle)
+			handler := NewHandlerWithClients(mockECS, mockCW, "test-cluster", "test-service", int(threshold.Minutes()), 10)
+			handler.SetMinUptimeBeforeSleep(0)
+			handler.SetClock(fake)
+
+			response, err := handler.HandleRequest(context.Background(), SleepRequest{})
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+
+			var sleepResp SleepResponse
+			if err := json.Unmarshal([]byte(response.(FunctionURLResponse).Body), &sleepResp); err != nil {
+				t.Fatalf("Failed to parse response body: %v", err)
+			}
+
+			if sleepResp.IdleDurationSeconds != int64(tt.idle.Seconds()) {
+				t.Errorf("Expected idle duration %d seconds, got %d", int64(tt.idle.Seconds()), sleepResp.IdleDurationSeconds)
+			}
+			if updateCalled != tt.wantScaleDown {
+				t.Errorf("Expected UpdateService called=%v, got %v (%s)", tt.wantScaleDown, updateCalled, sleepResp.Message)
+			}
+		})
+	}
+}
+
+// TestSleepScaleDownWindow tests that an idle service is only scaled down inside the allowed window
+func TestSleepScaleDownWindow(t *testing.T) {
+	window, err := ParseScaleDownWindow("19:00-07:00", "Europe/London")
+	if err != nil {
+		t.Fatalf("ParseScaleDownWindow() error = %v", err)
+	}
+	london, _ := time.LoadLocation("Europe/London")
+
+	tests := []struct {
+		name          string
+		now           time.Time
+		window        *ScaleDownWindow
+		wantAction    string
+		wantScaleDown bool
+	}{
+		{name: "business hours", now: time.Date(2026, 6, 10, 14, 0, 0, 0, london), window: window, wantAction: "no_change"},
+		{name: "evening", now: time.Date(2026, 6, 10, 21, 30, 0, 0, london), window: window, wantAction: "scaled_down", wantScaleDown: true},
+		{name: "after midnight", now: time.Date(2026, 6, 11, 3, 0, 0, 0, london), window: window, wantAction: "scaled_down", wantScaleDown: true},
+		{name: "window end is excluded", now: time.Date(2026, 6, 11, 7, 0, 0, 0, london), window: window, wantAction: "no_change"},
+		{name: "window in another timezone", now: time.Date(2026, 6, 10, 18, 30, 0, 0, time.UTC), window: window, wantAction: "scaled_down", wantScaleDown: true},
+		{name: "no window", now: time.Date(2026, 6, 10, 14, 0, 0, 0, london), wantAction: "scaled_down", wantScaleDown: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updateCalled := false
+			mockECS := &mockECSClient{
+				describeServicesFunc: func(ctx context.Context, params *ecs.DescribeServicesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeServicesOutput, error) {
+					return &ecs.DescribeServicesOutput{
+						Services: []ecstypes.Service{{DesiredCount: 1, RunningCount: 1}},
+					}, nil
+				},
+				updateServiceFunc: func(ctx context.Context, params *ecs.UpdateServiceInput, optFns ...func(*ecs.Options)) (*ecs.UpdateServiceOutput, error) {
+					updateCalled = true
+					return &ecs.UpdateServiceOutput{}, nil
+				},
+			}
+
+			// Idle for two hours before the injected time
+			mockCW := &mockCloudWatchClient{
+				getMetricDataFunc: func(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+					return &cloudwatch.GetMetricDataOutput{
+						MetricDataResults: []cloudwatchtypes.MetricDataResult{
+							{Id: aws.String("active_connections"), Values: []float64{0.0}},
+							{Id: aws.String("last_activity"), Values: []float64{float64(tt.now.Add(-2 * time.Hour).Unix())}},
+						},
+					}, nil
+				},
+			}
+
+			handler := NewHandlerWithClients(mockECS, mockCW, "test-cluster", "test-service", 15, 10)
+			handler.SetMinUptimeBeforeSleep(0)
+			handler.SetScaleDownWindow(tt.window)
+			handler.SetClock(clock.NewFake(tt.now))
+
+			response, err := handler.HandleRequest(context.Background(), SleepRequest{})
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+
+			var sleepResp SleepResponse
+			if err := json.Unmarshal([]byte(response.(FunctionURLResponse).Body), &sleepResp); err != nil {
+				t.Fatalf("Failed to parse response body: %v", err)
+			}
+
+			if sleepResp.Action != tt.wantAction {
+				t.Errorf("Expected action '%s', got: %s (%s)", tt.wantAction, sleepResp.Action, sleepResp.Message)
+			}
+			if !tt.wantScaleDown && !strings.Contains(sleepResp.Message, "scale-down window") {
+				t.Errorf("Expected the message to give the window as the reason, got: %s", sleepResp.Message)
+			}
+			if updateCalled != tt.wantScaleDown {
+				t.Errorf("Expected UpdateService called=%v, got %v", tt.wantScaleDown, updateCalled)
+			}
+		})
+	}
+}
+
+// TestParseScaleDownWindow tests that malformed windows are rejected
+func TestParseScaleDownWindow(t *testing.T) {
+	invalid := []struct {
+		spec, timezone string
+	}{
+		{"", ""},
+		{"19:00", ""},
+		{"25:00-07:00", ""},
+		{"19:00-19:00", ""},
+		{"19:00-07:00", "Mars/Olympus"},
+	}
+	for _, tt := range invalid {
+		if _, err := ParseScaleDownWindow(tt.spec, tt.timezone); err == nil {
+			t.Errorf("ParseScaleDownWindow(%q, %q) expected an error", tt.spec, tt.timezone)
+		}
+	}
+
+	window, err := ParseScaleDownWindow("12:00-13:00, 22:00-24:00", "")
+	if err != nil {
+		t.Fatalf("ParseScaleDownWindow() error = %v", err)
+	}
+	for clock, want := range map[string]bool{"12:30": true, "13:00": false, "23:59": true, "00:00": false} {
+		at, _ := time.Parse("15:04", clock)
+		if got := window.Contains(at); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", clock, got, want)
+		}
+	}
+}
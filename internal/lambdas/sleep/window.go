@@ -0,0 +1,96 @@
+package sleep
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// clockRange is a daily time range in minutes after midnight; an end before the start wraps past midnight
+type clockRange struct {
+	start, end int
+}
+
+// ScaleDownWindow holds the times of day, in a configured timezone, during which an idle service may be
+// scaled down
+type ScaleDownWindow struct {
+	spec     string
+	ranges   []clockRange
+	location *time.Location
+}
+
+// ParseScaleDownWindow parses comma-separated daily ranges such as "19:00-07:00,12:00-13:00" in the named
+// IANA timezone (empty uses UTC). Ranges include their start and exclude their end, and a range ending
+// before it starts runs past midnight.
+func ParseScaleDownWindow(spec, timezone string) (*ScaleDownWindow, error) {
+	location := time.UTC
+	if timezone != "" {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scale-down timezone %q: %w", timezone, err)
+		}
+		location = loc
+	}
+
+	window := &ScaleDownWindow{spec: spec, location: location}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid scale-down range %q: expected HH:MM-HH:MM", part)
+		}
+		start, err := parseClock(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scale-down range %q: %w", part, err)
+		}
+		end, err := parseClock(to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scale-down range %q: %w", part, err)
+		}
+		if start == end {
+			return nil, fmt.Errorf("invalid scale-down range %q: start and end are the same", part)
+		}
+		window.ranges = append(window.ranges, clockRange{start: start, end: end})
+	}
+	if len(window.ranges) == 0 {
+		return nil, fmt.Errorf("scale-down window %q has no ranges", spec)
+	}
+	return window, nil
+}
+
+// parseClock parses HH:MM (24:00 is accepted as the end of the day) into minutes after midnight
+func parseClock(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a HH:MM time", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains reports whether t falls inside the window
+func (w *ScaleDownWindow) Contains(t time.Time) bool {
+	local := t.In(w.location)
+	minute := local.Hour()*60 + local.Minute()
+	for _, r := range w.ranges {
+		if r.start < r.end {
+			if minute >= r.start && minute < r.end {
+				return true
+			}
+		} else if minute >= r.start || minute < r.end {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the window as configured, with its timezone
+func (w *ScaleDownWindow) String() string {
+	return fmt.Sprintf("%s %s", w.spec, w.location)
+}
@@ -2,10 +2,12 @@ package wake
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"net/http"
 	"time"
 
+	"fluidity/internal/shared/clock"
+	"fluidity/internal/shared/lambdaevent"
 	"fluidity/internal/shared/logger"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -31,11 +33,7 @@ type WakeResponse struct {
 }
 
 // FunctionURLResponse wraps the response for Lambda Function URL format
-type FunctionURLResponse struct {
-	StatusCode int               `json:"statusCode"`
-	Headers    map[string]string `json:"headers"`
-	Body       string            `json:"body"`
-}
+type FunctionURLResponse = lambdaevent.Response
 
 // ECSClient interface for testing
 type ECSClient interface {
@@ -48,9 +46,13 @@ type Handler struct {
 	ecsClient   ECSClient
 	clusterName string
 	serviceName string
+	clock       clock.Clock
 	logger      *logger.Logger
 }
 
+// EstimatedColdStart is the typical time for a stopped service's Fargate task to start (60-90 seconds)
+const EstimatedColdStart = 75 * time.Second
+
 // NewHandler creates a new wake handler with AWS SDK clients
 func NewHandler(ctx context.Context, clusterName, serviceName string) (*Handler, error) {
 	log := logger.NewFromEnv()
@@ -82,6 +84,7 @@ func NewHandler(ctx context.Context, clusterName, serviceName string) (*Handler,
 		ecsClient:   ecs.NewFromConfig(cfg),
 		clusterName: clusterName,
 		serviceName: serviceName,
+		clock:       clock.Real{},
 		logger:      log,
 	}, nil
 }
@@ -92,51 +95,25 @@ func NewHandlerWithClient(ecsClient ECSClient, clusterName, serviceName string)
 		ecsClient:   ecsClient,
 		clusterName: clusterName,
 		serviceName: serviceName,
+		clock:       clock.Real{},
 		logger:      logger.New("info"),
 	}
 }
 
+// SetClock replaces the clock used for instance IDs and estimated start times (for testing)
+func (h *Handler) SetClock(c clock.Clock) {
+	h.clock = c
+}
+
 // HandleRequest processes the wake request
 // Receives direct JSON from Lambda Function URL or direct invocation
 func (h *Handler) HandleRequest(ctx context.Context, event interface{}) (interface{}, error) {
 	var request WakeRequest
 
 	// Parse the event - could be direct JSON or wrapped in Function URL event
-	switch e := event.(type) {
-	case map[string]interface{}:
-		// Try to unmarshal as request body first
-		if body, ok := e["body"]; ok {
-			// Lambda Function URL passes raw JSON body
-			if bodyStr, ok := body.(string); ok {
-				if err := json.Unmarshal([]byte(bodyStr), &request); err != nil {
-					h.logger.Error("Failed to unmarshal body from event", err)
-					return h.errorResponse(400, "Invalid JSON in request body"), nil
-				}
-			}
-		} else {
-			// Direct JSON invocation
-			data, err := json.Marshal(e)
-			if err != nil {
-				h.logger.Error("Failed to marshal event", err)
-				return h.errorResponse(400, "Invalid request format"), nil
-			}
-			if err := json.Unmarshal(data, &request); err != nil {
-				h.logger.Error("Failed to unmarshal event", err)
-				return h.errorResponse(400, "Invalid request format"), nil
-			}
-		}
-	case string:
-		// Raw JSON string
-		if err := json.Unmarshal([]byte(e), &request); err != nil {
-			h.logger.Error("Failed to unmarshal JSON string", err)
-			return h.errorResponse(400, "Invalid JSON in request body"), nil
-		}
-	case []byte:
-		// Raw bytes
-		if err := json.Unmarshal(e, &request); err != nil {
-			h.logger.Error("Failed to unmarshal bytes", err)
-			return h.errorResponse(400, "Invalid JSON in request body"), nil
-		}
+	if err := lambdaevent.Decode(event, &request, lambdaevent.DefaultMaxBodyBytes); err != nil {
+		h.logger.Error("Rejecting invalid request", err)
+		return h.errorResponse(lambdaevent.StatusCode(err), err.Error()), nil
 	}
 
 	response, err := h.handleWakeRequest(ctx, request)
@@ -253,7 +230,7 @@ func (h *Handler) handleWakeRequest(ctx context.Context, request WakeRequest) (*
 		})
 	} else {
 		// Estimate start time based on Fargate cold start (typically 60-90 seconds)
-		estimatedStartTime = time.Now().Add(75 * time.Second).Format(time.RFC3339)
+		estimatedStartTime = h.clock.Now().Add(EstimatedColdStart).Format(time.RFC3339)
 		message = "Service wake initiated. ECS task starting (estimated 60-90 seconds)"
 		h.logger.Info("Service wake initiated successfully", map[string]interface{}{
 			"instanceID":         instanceID,
@@ -275,31 +252,16 @@ func (h *Handler) handleWakeRequest(ctx context.Context, request WakeRequest) (*
 // generateInstanceID creates a unique identifier for this service instance
 func (h *Handler) generateInstanceID(clusterName, serviceName string) string {
 	// Use timestamp + cluster + service to create a unique instance ID
-	timestamp := time.Now().Unix()
+	timestamp := h.clock.Now().Unix()
 	return fmt.Sprintf("%s-%s-%d", clusterName, serviceName, timestamp)
 }
 
 // successResponse wraps the response in Function URL format
 func (h *Handler) successResponse(data *WakeResponse) FunctionURLResponse {
-	body, _ := json.Marshal(data)
-	return FunctionURLResponse{
-		StatusCode: 200,
-		Headers: map[string]string{
-			"Content-Type": "application/json",
-		},
-		Body: string(body),
-	}
+	return lambdaevent.JSONResponse(h.logger, http.StatusOK, data)
 }
 
 // errorResponse creates an error response in Function URL format
 func (h *Handler) errorResponse(statusCode int, message string) FunctionURLResponse {
-	errorResp := map[string]string{"error": message}
-	body, _ := json.Marshal(errorResp)
-	return FunctionURLResponse{
-		StatusCode: statusCode,
-		Headers: map[string]string{
-			"Content-Type": "application/json",
-		},
-		Body: string(body),
-	}
+	return lambdaevent.ErrorResponse(h.logger, statusCode, message)
 }
@@ -3,7 +3,11 @@ package wake
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
+
+	"fluidity/internal/shared/clock"
 
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
@@ -83,6 +87,41 @@ func TestWakeWhenServiceStopped(t *testing.T) {
 	}
 }
 
+// TestWakeUsesClock verifies the estimated start time and instance ID are taken from the injected clock
+func TestWakeUsesClock(t *testing.T) {
+	mockECS := &MockECSClient{
+		DescribeServicesFunc: func(ctx context.Context, params *ecs.DescribeServicesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeServicesOutput, error) {
+			return &ecs.DescribeServicesOutput{
+				Services: []types.Service{{ServiceName: stringPtr("fluidity-server")}},
+			}, nil
+		},
+		UpdateServiceFunc: func(ctx context.Context, params *ecs.UpdateServiceInput, optFns ...func(*ecs.Options)) (*ecs.UpdateServiceOutput, error) {
+			return &ecs.UpdateServiceOutput{}, nil
+		},
+	}
+
+	now := time.Date(2026, 3, 4, 10, 0, 0, 0, time.UTC)
+	handler := NewHandlerWithClient(mockECS, "test-cluster", "fluidity-server")
+	handler.SetClock(clock.NewFake(now))
+
+	response, err := handler.HandleRequest(context.Background(), map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var wakeResp WakeResponse
+	if err := json.Unmarshal([]byte(response.(FunctionURLResponse).Body), &wakeResp); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+
+	if want := "2026-03-04T10:01:15Z"; wakeResp.EstimatedStartTime != want {
+		t.Errorf("Expected EstimatedStartTime %s, got %s", want, wakeResp.EstimatedStartTime)
+	}
+	if want := fmt.Sprintf("test-cluster-fluidity-server-%d", now.Unix()); wakeResp.InstanceID != want {
+		t.Errorf("Expected InstanceID %s, got %s", want, wakeResp.InstanceID)
+	}
+}
+
 // TestWakeWhenServiceAlreadyRunning verifies scaling behavior when service is running
 func TestWakeWhenServiceAlreadyRunning(t *testing.T) {
 	mockECS := &MockECSClient{
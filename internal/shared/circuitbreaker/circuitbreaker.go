@@ -187,6 +187,16 @@ func (cb *CircuitBreaker) GetState() State {
 	return cb.state
 }
 
+// RetryAfter returns how long until an open circuit admits a trial request (0 when not open)
+func (cb *CircuitBreaker) RetryAfter() time.Duration {
+	cb.mu.RLock()
+	defer cb.mu.RUnlock()
+	if cb.state != StateOpen {
+		return 0
+	}
+	return max(cb.resetTimeout-time.Since(cb.lastStateChange), 0)
+}
+
 // GetFailures returns the current failure count
 func (cb *CircuitBreaker) GetFailures() int {
 	cb.mu.RLock()
@@ -242,3 +242,31 @@ func TestCircuitBreaker_TooManyRequests(t *testing.T) {
 			config.MaxHalfOpenReqs, cb.GetState())
 	}
 }
+
+func TestCircuitBreaker_RetryAfter(t *testing.T) {
+	cb := New(Config{
+		MaxFailures:     2,
+		ResetTimeout:    10 * time.Second,
+		HalfOpenTimeout: time.Second,
+		MaxHalfOpenReqs: 1,
+	})
+
+	if got := cb.RetryAfter(); got != 0 {
+		t.Errorf("Expected no RetryAfter while closed, got %v", got)
+	}
+
+	testErr := errors.New("test error")
+	for i := 0; i < 2; i++ {
+		_ = cb.Execute(func() error { return testErr })
+	}
+
+	got := cb.RetryAfter()
+	if got <= 9*time.Second || got > 10*time.Second {
+		t.Errorf("Expected RetryAfter just under the 10s reset timeout, got %v", got)
+	}
+
+	cb.Reset()
+	if got := cb.RetryAfter(); got != 0 {
+		t.Errorf("Expected no RetryAfter after reset, got %v", got)
+	}
+}
@@ -0,0 +1,72 @@
+package coalesce
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// DefaultMaxBytes is the buffered size at which a coalesced read returns without waiting out the delay
+const DefaultMaxBytes = 16 * 1024
+
+// Config controls Nagle-like coalescing of small reads so that each returned chunk can be sent as one
+// tunnel envelope
+type Config struct {
+	Delay    time.Duration // How long to keep gathering after a short read (0 disables coalescing, like TCP_NODELAY)
+	MaxBytes int           // Return as soon as this many bytes are gathered (0 uses DefaultMaxBytes)
+}
+
+// Enabled reports whether the config coalesces reads
+func (c Config) Enabled() bool {
+	return c.Delay > 0
+}
+
+// Reader reads from a connection, gathering the small reads that arrive within the configured delay of
+// each other into one chunk
+type Reader struct {
+	conn   net.Conn
+	config Config
+}
+
+// NewReader wraps conn; with coalescing disabled every read is passed through unchanged
+func NewReader(conn net.Conn, config Config) *Reader {
+	return &Reader{conn: conn, config: config}
+}
+
+// Read blocks for the first data as conn.Read does, then keeps reading into p until the delay elapses,
+// MaxBytes are gathered or p is full. It changes conn's read deadline while gathering and clears it
+// afterwards, so callers relying on a read deadline must set it again after each read.
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.conn.Read(p)
+	if err != nil || !r.config.Enabled() {
+		return n, err
+	}
+
+	limit := r.config.MaxBytes
+	if limit <= 0 {
+		limit = DefaultMaxBytes
+	}
+	if limit > len(p) {
+		limit = len(p)
+	}
+	if n >= limit {
+		return n, nil
+	}
+
+	_ = r.conn.SetReadDeadline(time.Now().Add(r.config.Delay))
+	defer r.conn.SetReadDeadline(time.Time{})
+
+	for n < limit {
+		m, err := r.conn.Read(p[n:limit])
+		n += m
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				// The window closed; send what has been gathered
+				return n, nil
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
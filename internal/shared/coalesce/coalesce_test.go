@@ -0,0 +1,147 @@
+package coalesce
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipe returns both ends of a loopback TCP connection
+func pipe(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("Accept failed")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestReaderCoalescesSmallWritesWithinDelay(t *testing.T) {
+	writer, conn := pipe(t)
+	reader := NewReader(conn, Config{Delay: 200 * time.Millisecond})
+
+	go func() {
+		for i := 0; i < 20; i++ {
+			writer.Write([]byte{'x'})
+			time.Sleep(time.Millisecond)
+		}
+		writer.Close()
+	}()
+
+	buf := make([]byte, 1024)
+	reads, total := 0, 0
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			reads++
+			total += n
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+
+	if total != 20 {
+		t.Fatalf("Expected 20 bytes, got %d", total)
+	}
+	if reads > 2 {
+		t.Errorf("Expected 20 small writes to be coalesced into at most 2 reads, got %d", reads)
+	}
+}
+
+func TestReaderReturnsAtMaxBytes(t *testing.T) {
+	writer, conn := pipe(t)
+	reader := NewReader(conn, Config{Delay: 5 * time.Second, MaxBytes: 4})
+
+	go func() {
+		writer.Write([]byte("ab"))
+		time.Sleep(20 * time.Millisecond)
+		writer.Write([]byte("cdef"))
+	}()
+
+	start := time.Now()
+	buf := make([]byte, 1024)
+	n, err := reader.Read(buf)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if n != 4 {
+		t.Errorf("Expected read to stop at 4 bytes, got %d", n)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected read to return without waiting out the delay, took %v", elapsed)
+	}
+}
+
+func TestReaderDisabledReturnsImmediately(t *testing.T) {
+	writer, conn := pipe(t)
+	reader := NewReader(conn, Config{})
+
+	if _, err := writer.Write([]byte{'x'}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// Nothing more is written, so a coalescing read would wait for more data or a deadline
+	done := make(chan int, 1)
+	go func() {
+		n, _ := reader.Read(make([]byte, 1024))
+		done <- n
+	}()
+
+	select {
+	case n := <-done:
+		if n != 1 {
+			t.Errorf("Expected 1 byte, got %d", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected disabled reader to return the first write immediately")
+	}
+}
+
+func TestReaderClearsDeadlineAfterWindow(t *testing.T) {
+	writer, conn := pipe(t)
+	reader := NewReader(conn, Config{Delay: 10 * time.Millisecond})
+
+	writer.Write([]byte{'x'})
+	if _, err := reader.Read(make([]byte, 1024)); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	// A later write well after the window must still be readable
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		writer.Write([]byte{'y'})
+	}()
+	n, err := reader.Read(make([]byte, 1024))
+	if err != nil || n != 1 {
+		t.Fatalf("Expected second read to return 1 byte, got %d, %v", n, err)
+	}
+}
@@ -5,12 +5,19 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 	"gopkg.in/yaml.v3"
 )
 
-// LoadConfig loads configuration with CLI override support
+// EnvPrefix prefixes the environment variables that override config fields, e.g. FLUIDITY_LISTEN_PORT
+const EnvPrefix = "FLUIDITY"
+
+// LoadConfig loads configuration with CLI override support.
+// Precedence is CLI overrides > FLUIDITY_* environment variables > config file > defaults.
 func LoadConfig[T any](configFile string, overrides map[string]interface{}) (*T, error) {
 	// Initialize viper
 	v := viper.New()
@@ -57,11 +64,13 @@ func LoadConfig[T any](configFile string, overrides map[string]interface{}) (*T,
 		}
 	}
 
-	// Environment variable support
-	v.AutomaticEnv()
-	v.SetEnvPrefix("FLUIDITY")
-
+	// Environment variable support. Every field is bound explicitly because viper only consults the
+	// environment during Unmarshal for keys it already knows from defaults or the config file.
 	var config T
+	if err := bindEnv(v, reflect.TypeOf(config), ""); err != nil {
+		return nil, fmt.Errorf("failed to bind environment variables: %w", err)
+	}
+
 	if err := v.Unmarshal(&config); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
@@ -69,6 +78,72 @@ func LoadConfig[T any](configFile string, overrides map[string]interface{}) (*T,
 	return &config, nil
 }
 
+// bindEnv binds each field of t to an environment variable named after its config key,
+// e.g. "agent.log_level" to FLUIDITY_AGENT_LOG_LEVEL
+func bindEnv(v *viper.Viper, t reflect.Type, prefix string) error {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, squash := fieldKey(field)
+		if name == "-" {
+			continue
+		}
+
+		key := prefix
+		if !squash {
+			if key != "" {
+				key += "."
+			}
+			key += name
+		}
+
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() == reflect.Struct && fieldType != reflect.TypeOf(time.Time{}) {
+			if err := bindEnv(v, fieldType, key); err != nil {
+				return err
+			}
+			continue
+		}
+
+		envName := EnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+		if err := v.BindEnv(key, envName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fieldKey returns the config key of a struct field from its mapstructure, yaml or json tag,
+// and whether the field's own fields are squashed into its parent
+func fieldKey(field reflect.StructField) (string, bool) {
+	for _, tagName := range []string{"mapstructure", "yaml", "json"} {
+		tag, ok := field.Tag.Lookup(tagName)
+		if !ok {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		squash := strings.Contains(opts, "squash") || strings.Contains(opts, "inline")
+		if name == "" && !squash {
+			name = strings.ToLower(field.Name)
+		}
+		return name, squash
+	}
+	return strings.ToLower(field.Name), false
+}
+
 // SaveConfig saves updated configuration
 func SaveConfig(configFile string, config interface{}) error {
 	// Create directory if it doesn't exist
@@ -107,4 +182,7 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("server.key_file", "./certs/server.key")
 	v.SetDefault("server.ca_cert_file", "./certs/ca.crt")
 	v.SetDefault("server.max_connections", 100)
+
+	// Health port is read at the top level; 0 is meaningful (disabled) so the default must come from here
+	v.SetDefault("health_port", 8080)
 }
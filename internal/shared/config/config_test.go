@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -275,3 +276,87 @@ agent:
 		t.Errorf("Expected log_level 'warn', got '%s'", config.Agent.LogLevel)
 	}
 }
+
+// TestFlatConfig mirrors the flat agent and server configs
+type TestFlatConfig struct {
+	ListenPort     int           `mapstructure:"listen_port" yaml:"listen_port"`
+	LogLevel       string        `mapstructure:"log_level" yaml:"log_level"`
+	AllowedMethods []string      `mapstructure:"allowed_methods" yaml:"allowed_methods"`
+	ReaperMaxIdle  time.Duration `mapstructure:"reaper_max_idle" yaml:"reaper_max_idle"`
+	CertFile       string        `mapstructure:"cert_file" yaml:"cert_file"`
+}
+
+func TestLoadConfigEnvPrecedence(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "config.yaml")
+
+	configData := `
+agent:
+  local_proxy_port: 7070
+  server_addr: "file.example.com"
+  log_level: "info"
+`
+	if err := os.WriteFile(configFile, []byte(configData), 0644); err != nil {
+		t.Fatalf("Failed to write test config file: %v", err)
+	}
+
+	t.Setenv("FLUIDITY_AGENT_SERVER_ADDR", "env.example.com")
+	t.Setenv("FLUIDITY_AGENT_LOG_LEVEL", "debug")
+	t.Setenv("FLUIDITY_AGENT_KEY_FILE", "/env/client.key")
+
+	overrides := map[string]interface{}{
+		"agent.log_level": "error",
+	}
+
+	config, err := LoadConfig[TestAgentConfig](configFile, overrides)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{name: "flag beats env", got: config.Agent.LogLevel, want: "error"},
+		{name: "env beats file", got: config.Agent.ServerAddr, want: "env.example.com"},
+		{name: "env beats default", got: config.Agent.KeyFile, want: "/env/client.key"},
+		{name: "file beats default", got: config.Agent.LocalProxyPort, want: 7070},
+		{name: "default remains", got: config.Agent.CertFile, want: "./certs/client.crt"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigEnvWithoutFileOrDefault(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte("log_level: info\n"), 0644); err != nil {
+		t.Fatalf("Failed to write test config file: %v", err)
+	}
+
+	// None of these keys appear in the file or the defaults
+	t.Setenv("FLUIDITY_LISTEN_PORT", "9443")
+	t.Setenv("FLUIDITY_ALLOWED_METHODS", "GET,HEAD")
+	t.Setenv("FLUIDITY_REAPER_MAX_IDLE", "90s")
+
+	config, err := LoadConfig[TestFlatConfig](configFile, nil)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if config.ListenPort != 9443 {
+		t.Errorf("Expected listen_port 9443 from env, got %d", config.ListenPort)
+	}
+	if len(config.AllowedMethods) != 2 || config.AllowedMethods[0] != "GET" || config.AllowedMethods[1] != "HEAD" {
+		t.Errorf("Expected allowed_methods [GET HEAD] from env, got %v", config.AllowedMethods)
+	}
+	if config.ReaperMaxIdle != 90*time.Second {
+		t.Errorf("Expected reaper_max_idle 90s from env, got %v", config.ReaperMaxIdle)
+	}
+	if config.LogLevel != "info" {
+		t.Errorf("Expected log_level 'info' from file, got '%s'", config.LogLevel)
+	}
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Redacted replaces the value of non-empty fields tagged secret:"true" in dumped configs
+const Redacted = "[REDACTED]"
+
+// Dump writes cfg in the given format ("yaml" or "json") keyed by config key, as LoadConfig reads it.
+// Fields tagged secret:"true" are written as Redacted when set, so the output is safe to share.
+func Dump(w io.Writer, cfg interface{}, format string) error {
+	node, err := dumpNode(reflect.ValueOf(cfg))
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	switch format {
+	case "", "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(node); err != nil {
+			return fmt.Errorf("failed to marshal config: %w", err)
+		}
+		return enc.Close()
+	case "json":
+		var values map[string]interface{}
+		if err := node.Decode(&values); err != nil {
+			return fmt.Errorf("failed to marshal config: %w", err)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(values)
+	default:
+		return fmt.Errorf("unsupported config format %q (use yaml or json)", format)
+	}
+}
+
+// dumpNode builds a YAML mapping of v's fields, recursing into nested structs and redacting secrets
+func dumpNode(v reflect.Value) (*yaml.Node, error) {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return &yaml.Node{Kind: yaml.MappingNode}, nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("config must be a struct, got %s", v.Kind())
+	}
+
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	if err := appendFields(node, v); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// appendFields adds v's fields to the mapping node, flattening squashed fields into it
+func appendFields(node *yaml.Node, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, squash := fieldKey(field)
+		if name == "-" {
+			continue
+		}
+
+		fieldValue := v.Field(i)
+		if fieldValue.Kind() == reflect.Pointer && !fieldValue.IsNil() {
+			fieldValue = fieldValue.Elem()
+		}
+
+		isStruct := fieldValue.Kind() == reflect.Struct && fieldValue.Type() != reflect.TypeOf(time.Time{})
+		if squash && isStruct {
+			if err := appendFields(node, fieldValue); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value := &yaml.Node{}
+		switch {
+		case field.Tag.Get("secret") == "true" && !fieldValue.IsZero():
+			value = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: Redacted}
+		case isStruct:
+			nested, err := dumpNode(fieldValue)
+			if err != nil {
+				return err
+			}
+			value = nested
+		default:
+			if err := value.Encode(fieldValue.Interface()); err != nil {
+				return fmt.Errorf("field %s: %w", name, err)
+			}
+		}
+
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name}, value)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// testDumpConfig is a flat config with a secret field, like the agent's
+type testDumpConfig struct {
+	ServerAddr    string        `mapstructure:"server_addr" yaml:"server_addr"`
+	LogLevel      string        `mapstructure:"log_level" yaml:"log_level"`
+	Timeout       time.Duration `mapstructure:"timeout" yaml:"timeout"`
+	ProxyPassword string        `mapstructure:"proxy_password" yaml:"proxy_password" secret:"true"`
+	ProxyHash     string        `mapstructure:"proxy_hash" yaml:"proxy_hash" secret:"true"`
+}
+
+func TestDumpAppliesOverridesAndRedactsSecrets(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "config.yaml")
+
+	configData := `
+server_addr: "original.example.com"
+log_level: "info"
+timeout: 30s
+proxy_password: "hunter2"
+`
+	if err := os.WriteFile(configFile, []byte(configData), 0644); err != nil {
+		t.Fatalf("Failed to write test config file: %v", err)
+	}
+
+	cfg, err := LoadConfig[testDumpConfig](configFile, map[string]interface{}{"log_level": "debug"})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := Dump(&out, cfg, "yaml"); err != nil {
+		t.Fatalf("Failed to dump config as YAML: %v", err)
+	}
+	if strings.Contains(out.String(), "hunter2") {
+		t.Errorf("Dumped config leaks the secret:\n%s", out.String())
+	}
+
+	var dumped map[string]string
+	if err := yaml.Unmarshal(out.Bytes(), &dumped); err != nil {
+		t.Fatalf("Failed to parse dumped YAML: %v", err)
+	}
+	expected := map[string]string{
+		"server_addr":    "original.example.com",
+		"log_level":      "debug",
+		"timeout":        "30s",
+		"proxy_password": Redacted,
+		"proxy_hash":     "",
+	}
+	for key, want := range expected {
+		if dumped[key] != want {
+			t.Errorf("Expected %s %q in YAML dump, got %q", key, want, dumped[key])
+		}
+	}
+
+	out.Reset()
+	if err := Dump(&out, cfg, "json"); err != nil {
+		t.Fatalf("Failed to dump config as JSON: %v", err)
+	}
+	dumped = nil
+	if err := json.Unmarshal(out.Bytes(), &dumped); err != nil {
+		t.Fatalf("Failed to parse dumped JSON: %v", err)
+	}
+	for key, want := range expected {
+		if dumped[key] != want {
+			t.Errorf("Expected %s %q in JSON dump, got %q", key, want, dumped[key])
+		}
+	}
+}
+
+func TestDumpUnsupportedFormat(t *testing.T) {
+	if err := Dump(&bytes.Buffer{}, &testDumpConfig{}, "toml"); err == nil {
+		t.Error("Expected error for unsupported format, got nil")
+	}
+}
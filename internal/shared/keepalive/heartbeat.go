@@ -0,0 +1,87 @@
+package keepalive
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultHeartbeatInterval keeps idle tunnels well inside the 350s idle timeout of AWS Network Load Balancers
+const DefaultHeartbeatInterval = 60 * time.Second
+
+// ResolveHeartbeat returns the heartbeat interval for a configured value, where 0 keeps the default and
+// a negative value disables heartbeats
+func ResolveHeartbeat(interval time.Duration) time.Duration {
+	switch {
+	case interval < 0:
+		return 0
+	case interval == 0:
+		return DefaultHeartbeatInterval
+	}
+	return interval
+}
+
+// Activity records when a connection last carried outgoing data
+type Activity struct {
+	last atomic.Int64 // Unix nanoseconds
+}
+
+// Touch marks the connection as having written now
+func (a *Activity) Touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+// idleFor returns how long nothing has been written
+func (a *Activity) idleFor() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+// Writer returns a writer that touches the activity on every write through w
+func (a *Activity) Writer(w io.Writer) io.Writer {
+	return &activityWriter{Writer: w, activity: a}
+}
+
+// activityWriter touches its activity whenever something is written through it
+type activityWriter struct {
+	io.Writer
+	activity *Activity
+}
+
+func (w *activityWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if n > 0 {
+		w.activity.Touch()
+	}
+	return n, err
+}
+
+// Heartbeat calls ping whenever nothing has been written through activity for interval, so that load
+// balancers never see the connection idle for longer than that. Connections with traffic of their own
+// are never pinged. It returns when stop is closed or ping fails; ping is expected to write through
+// activity. An interval of 0 returns at once.
+func Heartbeat(activity *Activity, interval time.Duration, stop <-chan struct{}, ping func() error) {
+	if interval <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+
+		// Wait out the rest of the interval when something was written since the last check
+		if idle := activity.idleFor(); idle < interval {
+			timer.Reset(interval - idle)
+			continue
+		}
+		if err := ping(); err != nil {
+			return
+		}
+		activity.Touch()
+		timer.Reset(interval)
+	}
+}
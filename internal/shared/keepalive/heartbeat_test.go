@@ -0,0 +1,101 @@
+package keepalive
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat_PingsIdleConnection(t *testing.T) {
+	var activity Activity
+	activity.Touch()
+	w := activity.Writer(io.Discard)
+
+	var pings atomic.Int32
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		Heartbeat(&activity, 20*time.Millisecond, stop, func() error {
+			pings.Add(1)
+			_, err := w.Write([]byte("ping"))
+			return err
+		})
+		close(done)
+	}()
+
+	time.Sleep(150 * time.Millisecond)
+	close(stop)
+	<-done
+
+	if n := pings.Load(); n < 3 {
+		t.Errorf("Expected an idle connection to be pinged repeatedly, got %d pings", n)
+	}
+}
+
+func TestHeartbeat_SuppressedByTraffic(t *testing.T) {
+	var activity Activity
+	activity.Touch()
+	w := activity.Writer(io.Discard)
+
+	var pings atomic.Int32
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		Heartbeat(&activity, 50*time.Millisecond, stop, func() error {
+			pings.Add(1)
+			return nil
+		})
+		close(done)
+	}()
+
+	// Traffic more frequent than the interval leaves nothing idle to ping
+	for i := 0; i < 30; i++ {
+		w.Write([]byte("data"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-done
+
+	if n := pings.Load(); n != 0 {
+		t.Errorf("Expected no pings while traffic flows, got %d", n)
+	}
+}
+
+func TestHeartbeat_StopsWhenPingFails(t *testing.T) {
+	var activity Activity
+	var pings atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		Heartbeat(&activity, 10*time.Millisecond, make(chan struct{}), func() error {
+			pings.Add(1)
+			return errors.New("connection closed")
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Heartbeat did not return after a failed ping")
+	}
+	if n := pings.Load(); n != 1 {
+		t.Errorf("Expected a single ping before stopping, got %d", n)
+	}
+}
+
+func TestResolveHeartbeat(t *testing.T) {
+	tests := []struct {
+		in, want time.Duration
+	}{
+		{0, DefaultHeartbeatInterval},
+		{-1, 0},
+		{5 * time.Second, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := ResolveHeartbeat(tt.in); got != tt.want {
+			t.Errorf("ResolveHeartbeat(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package keepalive
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Config holds WebSocket keepalive settings
+type Config struct {
+	Interval time.Duration // Time between pings (0 disables keepalive)
+	Timeout  time.Duration // Time allowed for a pong after a ping before the peer is considered gone
+}
+
+// DefaultConfig returns keepalive settings below the common 60s load balancer idle timeouts
+func DefaultConfig() Config {
+	return Config{
+		Interval: 30 * time.Second,
+		Timeout:  10 * time.Second,
+	}
+}
+
+// Resolve builds a config from configured values, where 0 keeps the default and a negative interval
+// disables keepalive
+func Resolve(interval, timeout time.Duration) Config {
+	config := DefaultConfig()
+	if interval < 0 {
+		config.Interval = 0
+	} else if interval > 0 {
+		config.Interval = interval
+	}
+	if timeout > 0 {
+		config.Timeout = timeout
+	}
+	return config
+}
+
+// Enabled reports whether the config sends pings
+func (c Config) Enabled() bool {
+	return c.Interval > 0
+}
+
+// WebSocket pings conn every interval until stop is closed, and arms the connection's read deadline
+// so that a read fails when no pong arrives within the timeout. It must be called before the
+// connection's reader starts, as pongs are only processed while a read is in progress.
+func WebSocket(conn *websocket.Conn, config Config, stop <-chan struct{}) {
+	if !config.Enabled() {
+		return
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = config.Interval
+	}
+
+	// Every pong moves the deadline past the next ping's reply window
+	extend := func() {
+		conn.SetReadDeadline(time.Now().Add(config.Interval + config.Timeout))
+	}
+	extend()
+	conn.SetPongHandler(func(string) error {
+		extend()
+		return nil
+	})
+
+	go func() {
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// WriteControl may run concurrently with the connection's other writers
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(config.Timeout)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// IsTimeout reports whether a read failed because the peer stopped answering pings
+func IsTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,104 @@
+package keepalive
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dial starts a WebSocket server running handle and returns a client connection to it
+func dial(t *testing.T, handle func(*websocket.Conn)) *websocket.Conn {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handle(conn)
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestWebSocket_PingsKeepIdleConnectionOpen(t *testing.T) {
+	var pings atomic.Int32
+	conn := dial(t, func(conn *websocket.Conn) {
+		conn.SetPingHandler(func(data string) error {
+			pings.Add(1)
+			return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	WebSocket(conn, Config{Interval: 50 * time.Millisecond, Timeout: 100 * time.Millisecond}, stop)
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadMessage()
+		readErr <- err
+	}()
+
+	// Well past interval+timeout, the answered pings keep the read alive
+	select {
+	case err := <-readErr:
+		t.Fatalf("read ended on an answered connection: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if n := pings.Load(); n < 3 {
+		t.Errorf("expected at least 3 pings, got %d", n)
+	}
+}
+
+func TestWebSocket_MissingPongFailsRead(t *testing.T) {
+	// The peer never reads, so it never answers pings
+	conn := dial(t, func(conn *websocket.Conn) {
+		time.Sleep(2 * time.Second)
+	})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	WebSocket(conn, Config{Interval: 50 * time.Millisecond, Timeout: 100 * time.Millisecond}, stop)
+
+	start := time.Now()
+	_, _, err := conn.ReadMessage()
+	if err == nil || !IsTimeout(err) {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("read took %v to fail", elapsed)
+	}
+}
+
+func TestWebSocket_Disabled(t *testing.T) {
+	conn := dial(t, func(conn *websocket.Conn) {
+		time.Sleep(300 * time.Millisecond)
+	})
+
+	WebSocket(conn, Config{}, nil)
+
+	// Without keepalive the read waits for the peer to close
+	start := time.Now()
+	conn.ReadMessage()
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("read ended after %v with keepalive disabled", elapsed)
+	}
+}
@@ -0,0 +1,29 @@
+package keepalive
+
+import (
+	"net"
+	"time"
+)
+
+// TCPConfig returns TCP keepalive settings that probe a connection after idle without traffic and then
+// every interval (0 uses Go's default for either)
+func TCPConfig(idle, interval time.Duration) net.KeepAliveConfig {
+	return net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     idle,
+		Interval: interval,
+	}
+}
+
+// TCP applies config to conn when it is a TCP connection and config enables keepalive; otherwise the
+// connection keeps the defaults it was created with
+func TCP(conn net.Conn, config net.KeepAliveConfig) error {
+	if !config.Enable {
+		return nil
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	return tcpConn.SetKeepAliveConfig(config)
+}
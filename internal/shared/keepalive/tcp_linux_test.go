@@ -0,0 +1,112 @@
+package keepalive
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// socketOption reads an integer socket option from conn
+func socketOption(t *testing.T, conn net.Conn, level, option int) int {
+	t.Helper()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn failed: %v", err)
+	}
+	var value int
+	var optErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), level, option)
+	}); err != nil {
+		t.Fatalf("Control failed: %v", err)
+	}
+	if optErr != nil {
+		t.Fatalf("getsockopt failed: %v", optErr)
+	}
+	return value
+}
+
+// assertKeepalive checks that conn probes after idle and then every interval
+func assertKeepalive(t *testing.T, conn net.Conn, idle, interval time.Duration) {
+	t.Helper()
+	if got := socketOption(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); got != 1 {
+		t.Errorf("SO_KEEPALIVE = %d, want 1", got)
+	}
+	if got := socketOption(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); got != int(idle.Seconds()) {
+		t.Errorf("TCP_KEEPIDLE = %d, want %d", got, int(idle.Seconds()))
+	}
+	if got := socketOption(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL); got != int(interval.Seconds()) {
+		t.Errorf("TCP_KEEPINTVL = %d, want %d", got, int(interval.Seconds()))
+	}
+}
+
+func TestTCP_AcceptedConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer conn.Close()
+
+	if err := TCP(conn, TCPConfig(42*time.Second, 7*time.Second)); err != nil {
+		t.Fatalf("TCP failed: %v", err)
+	}
+	assertKeepalive(t, conn, 42*time.Second, 7*time.Second)
+}
+
+func TestTCP_DisabledLeavesDefaults(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer conn.Close()
+
+	before := socketOption(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	if err := TCP(conn, net.KeepAliveConfig{Idle: 42 * time.Second}); err != nil {
+		t.Fatalf("TCP failed: %v", err)
+	}
+	if got := socketOption(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); got != before {
+		t.Errorf("TCP_KEEPIDLE changed from %d to %d with keepalive disabled", before, got)
+	}
+}
+
+func TestTCPConfig_Dialer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	dialer := net.Dialer{KeepAliveConfig: TCPConfig(42*time.Second, 7*time.Second)}
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	assertKeepalive(t, conn, 42*time.Second, 7*time.Second)
+}
@@ -0,0 +1,159 @@
+package lambdaevent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"fluidity/internal/shared/logger"
+)
+
+// DefaultMaxBodyBytes bounds lifecycle request payloads, which are a few small fields
+const DefaultMaxBodyBytes = 64 * 1024
+
+// Error codes returned in the "code" field of Lambda error responses
+const (
+	CodeInvalidRequest   = "invalid_request"
+	CodeRequestTooLarge  = "request_too_large"
+	CodeProcessingFailed = "processing_failed"
+)
+
+// Validator is implemented by requests that check their own fields after decoding
+type Validator interface {
+	Validate() error
+}
+
+// Error is a request the handler refuses before processing it, with the HTTP status to report
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Decode parses a Lambda event into v. The event may be a Function URL event with a JSON "body", a
+// direct invocation's JSON object, a typed request, or raw JSON as a string or bytes. Payloads over
+// maxBytes (0 uses DefaultMaxBodyBytes) fail with a 413 Error, and malformed JSON and failed validation
+// with a 400 Error. A missing body leaves v unchanged, so defaults and validation still apply.
+func Decode(event interface{}, v interface{}, maxBytes int) error {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBodyBytes
+	}
+
+	var data []byte
+	switch e := event.(type) {
+	case nil:
+	case map[string]interface{}:
+		body, ok := e["body"]
+		if !ok {
+			// Direct JSON invocation arrives already decoded, so re-encode it for the request's field tags
+			return decodeValue(e, v, maxBytes)
+		}
+		// Lambda Function URL passes raw JSON body
+		bodyStr, ok := body.(string)
+		if !ok && body != nil {
+			return &Error{StatusCode: http.StatusBadRequest, Message: "Request body must be a JSON string"}
+		}
+		data = []byte(bodyStr)
+	case string:
+		data = []byte(e)
+	case []byte:
+		data = e
+	default:
+		// Typed requests from in-process callers
+		return decodeValue(e, v, maxBytes)
+	}
+
+	return decodeJSON(data, v, maxBytes)
+}
+
+// decodeValue re-encodes an already decoded event and decodes it into v
+func decodeValue(event interface{}, v interface{}, maxBytes int) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return &Error{StatusCode: http.StatusBadRequest, Message: "Invalid request format"}
+	}
+	return decodeJSON(data, v, maxBytes)
+}
+
+// decodeJSON bounds, decodes and validates a JSON payload
+func decodeJSON(data []byte, v interface{}, maxBytes int) error {
+	if len(data) > maxBytes {
+		return &Error{StatusCode: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("Request body of %d bytes exceeds the %d byte limit", len(data), maxBytes)}
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, v); err != nil {
+			return &Error{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("Invalid JSON in request body: %v", err)}
+		}
+	}
+
+	if validator, ok := v.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return &Error{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		}
+	}
+	return nil
+}
+
+// EncodeFailureBody is the response body sent when a handler's response cannot be encoded
+const EncodeFailureBody = `{"error":"Failed to encode response","code":"` + CodeProcessingFailed + `"}`
+
+// EncodeBody encodes a response as the JSON body to send with statusCode. When v cannot be encoded it
+// returns a 500 with EncodeFailureBody and the error instead, so a caller never receives an empty body.
+func EncodeBody(statusCode int, v interface{}) (int, string, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return http.StatusInternalServerError, EncodeFailureBody, fmt.Errorf("failed to encode response: %w", err)
+	}
+	return statusCode, string(body), nil
+}
+
+// Response is a Lambda Function URL response
+type Response struct {
+	StatusCode int               `json:"statusCode"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+}
+
+// JSONResponse encodes v as a JSON Function URL response. When v cannot be encoded the failure is logged
+// to log and the response is a 500 with EncodeFailureBody.
+func JSONResponse(log *logger.Logger, statusCode int, v interface{}) Response {
+	statusCode, body, err := EncodeBody(statusCode, v)
+	if err != nil {
+		log.Error("Failed to encode response", err)
+	}
+	return Response{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: body,
+	}
+}
+
+// ErrorResponse returns a JSON error response carrying message and the status's error code
+func ErrorResponse(log *logger.Logger, statusCode int, message string) Response {
+	return JSONResponse(log, statusCode, map[string]string{"error": message, "code": ErrorCode(statusCode)})
+}
+
+// ErrorCode returns the error response code for an HTTP status
+func ErrorCode(statusCode int) string {
+	switch {
+	case statusCode == http.StatusRequestEntityTooLarge:
+		return CodeRequestTooLarge
+	case statusCode >= 400 && statusCode < 500:
+		return CodeInvalidRequest
+	default:
+		return CodeProcessingFailed
+	}
+}
+
+// StatusCode returns the HTTP status for a Decode error
+func StatusCode(err error) int {
+	if e, ok := err.(*Error); ok {
+		return e.StatusCode
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,141 @@
+package lambdaevent
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"fluidity/internal/shared/logger"
+)
+
+type testRequest struct {
+	Name  string `json:"name"`
+	Count int    `json:"count,omitempty"`
+}
+
+func (r *testRequest) Validate() error {
+	if r.Count < 0 {
+		return errors.New("count must not be negative")
+	}
+	return nil
+}
+
+func TestDecode_EventShapes(t *testing.T) {
+	tests := []struct {
+		name  string
+		event interface{}
+	}{
+		{"function URL body", map[string]interface{}{"body": `{"name":"a","count":2}`, "headers": map[string]interface{}{}}},
+		{"direct invocation", map[string]interface{}{"name": "a", "count": 2}},
+		{"string", `{"name":"a","count":2}`},
+		{"bytes", []byte(`{"name":"a","count":2}`)},
+		{"typed request", testRequest{Name: "a", Count: 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req testRequest
+			if err := Decode(tt.event, &req, 0); err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			if req.Name != "a" || req.Count != 2 {
+				t.Errorf("Decoded %+v, want name a and count 2", req)
+			}
+		})
+	}
+}
+
+func TestDecode_EmptyEventKeepsDefaults(t *testing.T) {
+	for _, event := range []interface{}{nil, "", map[string]interface{}{"body": nil}} {
+		req := testRequest{Name: "default"}
+		if err := Decode(event, &req, 0); err != nil {
+			t.Errorf("Decode(%#v) failed: %v", event, err)
+		}
+		if req.Name != "default" {
+			t.Errorf("Decode(%#v) replaced the default with %q", event, req.Name)
+		}
+	}
+}
+
+func TestDecode_Rejections(t *testing.T) {
+	tests := []struct {
+		name       string
+		event      interface{}
+		maxBytes   int
+		wantStatus int
+	}{
+		{"oversized body", map[string]interface{}{"body": `{"name":"` + strings.Repeat("a", 100) + `"}`}, 64, 413},
+		{"oversized direct invocation", map[string]interface{}{"name": strings.Repeat("a", 100)}, 64, 413},
+		{"malformed JSON", `{"name":`, 0, 400},
+		{"trailing garbage", `{"name":"a"} extra`, 0, 400},
+		{"wrong field type", `{"count":"two"}`, 0, 400},
+		{"non-string body", map[string]interface{}{"body": 42}, 0, 400},
+		{"failed validation", `{"count":-1}`, 0, 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req testRequest
+			err := Decode(tt.event, &req, tt.maxBytes)
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if got := StatusCode(err); got != tt.wantStatus {
+				t.Errorf("StatusCode = %d, want %d (%v)", got, tt.wantStatus, err)
+			}
+		})
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	tests := map[int]string{
+		400: CodeInvalidRequest,
+		413: CodeRequestTooLarge,
+		500: CodeProcessingFailed,
+	}
+	for status, want := range tests {
+		if got := ErrorCode(status); got != want {
+			t.Errorf("ErrorCode(%d) = %q, want %q", status, got, want)
+		}
+	}
+}
+
+func TestEncodeBody(t *testing.T) {
+	status, body, err := EncodeBody(http.StatusOK, map[string]string{"status": "ok"})
+	if err != nil || status != http.StatusOK || body != `{"status":"ok"}` {
+		t.Errorf("EncodeBody() = %d %q %v, want 200 with the encoded value", status, body, err)
+	}
+
+	// A channel cannot be encoded as JSON
+	status, body, err = EncodeBody(http.StatusOK, map[string]interface{}{"status": make(chan int)})
+	if err == nil {
+		t.Fatal("EncodeBody() error = nil for an unencodable value")
+	}
+	if status != http.StatusInternalServerError || body != EncodeFailureBody {
+		t.Errorf("EncodeBody() = %d %q, want 500 %q", status, body, EncodeFailureBody)
+	}
+	var decoded map[string]string
+	if err := json.Unmarshal([]byte(body), &decoded); err != nil || decoded["code"] != CodeProcessingFailed {
+		t.Errorf("failure body %q is not a JSON error with code %q", body, CodeProcessingFailed)
+	}
+}
+
+func TestJSONResponse(t *testing.T) {
+	log := logger.New("error")
+
+	resp := ErrorResponse(log, http.StatusBadRequest, "bad input")
+	if resp.StatusCode != http.StatusBadRequest || resp.Headers["Content-Type"] != "application/json" {
+		t.Errorf("ErrorResponse() = %d %v, want 400 with a JSON content type", resp.StatusCode, resp.Headers)
+	}
+	if resp.Body != `{"code":"invalid_request","error":"bad input"}` {
+		t.Errorf("ErrorResponse() body = %q", resp.Body)
+	}
+
+	// A channel cannot be encoded, standing in for a response field that fails to marshal
+	resp = JSONResponse(log, http.StatusOK, map[string]interface{}{"status": make(chan int)})
+	if resp.StatusCode != http.StatusInternalServerError || resp.Body != EncodeFailureBody {
+		t.Errorf("JSONResponse() = %d %q, want 500 %q", resp.StatusCode, resp.Body, EncodeFailureBody)
+	}
+}
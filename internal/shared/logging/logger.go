@@ -5,14 +5,23 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
+	"sync/atomic"
 
 	"github.com/sirupsen/logrus"
 )
 
+// StreamIDKey is the field carrying the request, tunnel or WebSocket ID on every stream-scoped log line
+const StreamIDKey = "id"
+
+// componentLevels holds the per-component level overrides set by SetComponentLevels
+var componentLevels atomic.Value // map[string]logrus.Level
+
 // Logger wraps logrus with structured logging
 type Logger struct {
 	*logrus.Logger
-	component string
+	component    string
+	streamFilter atomic.Value // string: the only stream ID whose debug lines are logged (empty logs all)
 }
 
 // OrderedJSONFormatter formats logs as JSON with consistent field ordering
@@ -86,31 +95,74 @@ func NewLogger(component string) *Logger {
 	// Output to stdout
 	logger.SetOutput(os.Stdout)
 
-	return &Logger{
+	l := &Logger{
 		Logger:    logger,
 		component: component,
 	}
+	if level, ok := componentLevel(component); ok {
+		logger.SetLevel(level)
+	}
+	return l
 }
 
-// WithComponent creates a logger entry with component field
-func (l *Logger) WithComponent() *logrus.Entry {
-	return l.WithField("component", l.component)
+// SetComponentLevels overrides the log level of individual components, keyed by the name given to
+// NewLogger, so that one subsystem can log verbosely without the rest. Loggers created afterwards start
+// at their component's level and keep it when SetLevel applies the general level. Levels must be debug,
+// info, warn or error; a nil or empty map removes all overrides.
+func SetComponentLevels(levels map[string]string) error {
+	parsed := make(map[string]logrus.Level, len(levels))
+	names := make([]string, 0, len(levels))
+	for name := range levels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		level, ok := parseLevel(levels[name])
+		if !ok {
+			return fmt.Errorf("invalid log level %q for component %q", levels[name], name)
+		}
+		parsed[name] = level
+	}
+	componentLevels.Store(parsed)
+	return nil
 }
 
-// SetLevel sets the logging level
-func (l *Logger) SetLevel(level string) {
+// componentLevel returns the level override of a component, if one is set
+func componentLevel(component string) (logrus.Level, bool) {
+	levels, _ := componentLevels.Load().(map[string]logrus.Level)
+	level, ok := levels[component]
+	return level, ok
+}
+
+// parseLevel converts a configured level name to a logrus level
+func parseLevel(level string) (logrus.Level, bool) {
 	switch level {
 	case "debug":
-		l.Logger.SetLevel(logrus.DebugLevel)
+		return logrus.DebugLevel, true
 	case "info":
-		l.Logger.SetLevel(logrus.InfoLevel)
+		return logrus.InfoLevel, true
 	case "warn":
-		l.Logger.SetLevel(logrus.WarnLevel)
+		return logrus.WarnLevel, true
 	case "error":
-		l.Logger.SetLevel(logrus.ErrorLevel)
-	default:
-		l.Logger.SetLevel(logrus.InfoLevel)
+		return logrus.ErrorLevel, true
 	}
+	return logrus.InfoLevel, false
+}
+
+// WithComponent creates a logger entry with component field
+func (l *Logger) WithComponent() *logrus.Entry {
+	return l.WithField("component", l.component)
+}
+
+// SetLevel sets the logging level, defaulting to info for unknown names. A level set for the
+// logger's component with SetComponentLevels takes precedence.
+func (l *Logger) SetLevel(level string) {
+	if override, ok := componentLevel(l.component); ok {
+		l.Logger.SetLevel(override)
+		return
+	}
+	parsed, _ := parseLevel(level)
+	l.Logger.SetLevel(parsed)
 }
 
 // Info logs an info message with component context
@@ -140,8 +192,32 @@ func (l *Logger) Warn(msg string, fields ...interface{}) {
 	entry.Warn(msg)
 }
 
+// SetStreamFilter limits debug output to lines about one stream: debug lines whose StreamIDKey field
+// names another stream are dropped, while lines without one and those above debug level are kept.
+// An empty id logs every stream again. It is safe to change while logging.
+func (l *Logger) SetStreamFilter(id string) {
+	l.streamFilter.Store(id)
+}
+
+// filteredOut reports whether the stream filter drops a debug line with these fields
+func (l *Logger) filteredOut(fields []interface{}) bool {
+	filter, _ := l.streamFilter.Load().(string)
+	if filter == "" {
+		return false
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		if key, ok := fields[i].(string); ok && key == StreamIDKey {
+			return fmt.Sprint(fields[i+1]) != filter
+		}
+	}
+	return false
+}
+
 // Debug logs a debug message with component context
 func (l *Logger) Debug(msg string, fields ...interface{}) {
+	if !l.IsLevelEnabled(logrus.DebugLevel) || l.filteredOut(fields) {
+		return
+	}
 	entry := l.WithComponent()
 	if len(fields) > 0 {
 		entry = l.addFields(entry, fields...)
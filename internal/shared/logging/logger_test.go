@@ -319,3 +319,90 @@ func TestOrderedJSONFormatterFieldOrder(t *testing.T) {
 		t.Error("Fields are not in correct order: t (timestamp), l (level), c (component), m (message)")
 	}
 }
+
+func TestLoggerStreamFilter(t *testing.T) {
+	logger := NewLogger("test")
+	logger.SetLevel("debug")
+
+	var buf bytes.Buffer
+	logger.Logger.SetOutput(&buf)
+
+	logger.SetStreamFilter("stream-a")
+	logger.Debug("Stream A data", StreamIDKey, "stream-a", "bytes", 10)
+	logger.Debug("Stream B data", StreamIDKey, "stream-b", "bytes", 20)
+	logger.Debug("Connection state check")
+	logger.Warn("Stream B failed", StreamIDKey, "stream-b")
+
+	output := buf.String()
+	if !strings.Contains(output, `"m":"Stream A data"`) || !strings.Contains(output, `"id":"stream-a"`) {
+		t.Errorf("Filtered stream's debug line should be logged with its ID: %s", output)
+	}
+	if strings.Contains(output, "Stream B data") {
+		t.Error("Other streams' debug lines should be suppressed")
+	}
+	if !strings.Contains(output, "Connection state check") {
+		t.Error("Debug lines without a stream ID should be kept")
+	}
+	if !strings.Contains(output, "Stream B failed") {
+		t.Error("Lines above debug level should be kept for every stream")
+	}
+
+	buf.Reset()
+	logger.SetStreamFilter("")
+	logger.Debug("Stream B data", StreamIDKey, "stream-b")
+	if !strings.Contains(buf.String(), `"id":"stream-b"`) {
+		t.Error("Clearing the filter should log every stream again")
+	}
+}
+
+func TestComponentLevels(t *testing.T) {
+	if err := SetComponentLevels(map[string]string{"tunnel-client": "debug", "proxy-server": "error"}); err != nil {
+		t.Fatalf("SetComponentLevels failed: %v", err)
+	}
+	t.Cleanup(func() { SetComponentLevels(nil) })
+
+	client := NewLogger("tunnel-client")
+	proxy := NewLogger("proxy-server")
+	other := NewLogger("tunnel-pool")
+
+	// The general level applies only to components without an override
+	for _, logger := range []*Logger{client, proxy, other} {
+		logger.SetLevel("info")
+	}
+	if client.Logger.Level != logrus.DebugLevel {
+		t.Errorf("Expected tunnel-client at debug, got %v", client.Logger.Level)
+	}
+	if proxy.Logger.Level != logrus.ErrorLevel {
+		t.Errorf("Expected proxy-server at error, got %v", proxy.Logger.Level)
+	}
+	if other.Logger.Level != logrus.InfoLevel {
+		t.Errorf("Expected tunnel-pool at the general info level, got %v", other.Logger.Level)
+	}
+
+	var clientOut, proxyOut bytes.Buffer
+	client.SetOutput(&clientOut)
+	proxy.SetOutput(&proxyOut)
+	client.Debug("client debug")
+	proxy.Warn("proxy warning")
+	proxy.Error("proxy error", errors.New("boom"))
+	if !strings.Contains(clientOut.String(), "client debug") {
+		t.Errorf("Expected tunnel-client to log debug lines, got %q", clientOut.String())
+	}
+	if strings.Contains(proxyOut.String(), "proxy warning") || !strings.Contains(proxyOut.String(), "proxy error") {
+		t.Errorf("Expected proxy-server to log errors only, got %q", proxyOut.String())
+	}
+}
+
+func TestComponentLevelsInvalid(t *testing.T) {
+	t.Cleanup(func() { SetComponentLevels(nil) })
+
+	if err := SetComponentLevels(map[string]string{"tunnel-client": "verbose"}); err == nil {
+		t.Error("Expected an invalid level to be rejected")
+	}
+	if err := SetComponentLevels(nil); err != nil {
+		t.Errorf("Expected clearing overrides to succeed, got %v", err)
+	}
+	if logger := NewLogger("tunnel-client"); logger.Logger.Level != logrus.InfoLevel {
+		t.Errorf("Expected the default level without overrides, got %v", logger.Logger.Level)
+	}
+}
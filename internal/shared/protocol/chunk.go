@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Chunk is one piece of a chunked HTTP request or response body, carried in
+// "http_request_chunk" and "http_response_chunk" envelopes
+type Chunk struct {
+	ID         string `json:"id"`
+	Seq        uint64 `json:"seq"` // Starts at 0 and increases by one per chunk
+	Data       []byte `json:"data,omitempty"`
+	Final      bool   `json:"final,omitempty"`       // Marks the last chunk of the body
+	TotalBytes int64  `json:"total_bytes,omitempty"` // Body length, set on the final chunk
+}
+
+// ChunkWindow is how many chunks of a streamed body may be in flight before the receiver grants credit
+// for more, and so how many the receiver must be able to buffer
+const ChunkWindow = 64
+
+// ChunkCredit lets the sender of a streamed body send Chunks more chunks, carried in
+// "http_request_credit" and "http_response_credit" envelopes as the receiver consumes them
+type ChunkCredit struct {
+	ID     string `json:"id"`
+	Chunks int    `json:"chunks"`
+}
+
+var (
+	// ErrChunkGap is returned when a chunk arrives out of sequence
+	ErrChunkGap = errors.New("chunk sequence gap")
+	// ErrChunkLength is returned when the reassembled body length differs from the final chunk's total
+	ErrChunkLength = errors.New("chunked body length mismatch")
+	// ErrChunkTruncated is returned when the stream ends or stalls before the final chunk
+	ErrChunkTruncated = errors.New("chunked transfer truncated")
+)
+
+// SplitChunks splits body into chunks of at most size bytes, the last of which is marked final.
+// An empty body yields a single empty final chunk.
+func SplitChunks(id string, body []byte, size int) []*Chunk {
+	if size <= 0 {
+		size = len(body)
+	}
+
+	var chunks []*Chunk
+	for seq := uint64(0); ; seq++ {
+		n := min(size, len(body))
+		chunk := &Chunk{ID: id, Seq: seq, Data: body[:n]}
+		body = body[n:]
+		chunks = append(chunks, chunk)
+		if len(body) == 0 {
+			break
+		}
+	}
+
+	last := chunks[len(chunks)-1]
+	last.Final = true
+	for _, c := range chunks {
+		last.TotalBytes += int64(len(c.Data))
+	}
+	return chunks
+}
+
+// ReassembleChunks writes the chunks received on ch to w in order until the final chunk, and
+// returns the number of bytes written. It fails on a sequence gap, a length mismatch, or when
+// no chunk arrives within timeout or ch closes before the final chunk.
+func ReassembleChunks(ch <-chan *Chunk, w io.Writer, timeout time.Duration) (int64, error) {
+	return ReassembleChunksUntil(ch, w, timeout, nil)
+}
+
+// ReassembleChunksUntil is ReassembleChunks that also gives up, as truncated, once done is closed
+func ReassembleChunksUntil(ch <-chan *Chunk, w io.Writer, timeout time.Duration, done <-chan struct{}) (int64, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var next uint64
+	var written int64
+	for {
+		var chunk *Chunk
+		var ok bool
+		select {
+		case chunk, ok = <-ch:
+			if !ok {
+				return written, fmt.Errorf("%w: stream closed after %d bytes without a final chunk", ErrChunkTruncated, written)
+			}
+		case <-timer.C:
+			return written, fmt.Errorf("%w: no chunk within %v after %d bytes", ErrChunkTruncated, timeout, written)
+		case <-done:
+			return written, fmt.Errorf("%w: stopped after %d bytes", ErrChunkTruncated, written)
+		}
+
+		if chunk.Seq != next {
+			return written, fmt.Errorf("%w: expected seq %d, got %d", ErrChunkGap, next, chunk.Seq)
+		}
+		next++
+
+		n, err := w.Write(chunk.Data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+
+		if chunk.Final {
+			if written != chunk.TotalBytes {
+				return written, fmt.Errorf("%w: received %d bytes, expected %d", ErrChunkLength, written, chunk.TotalBytes)
+			}
+			return written, nil
+		}
+
+		if !timer.Stop() {
+			<-timer.C
+		}
+		timer.Reset(timeout)
+	}
+}
@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func feedChunks(chunks []*Chunk) <-chan *Chunk {
+	ch := make(chan *Chunk, len(chunks))
+	for _, c := range chunks {
+		ch <- c
+	}
+	return ch
+}
+
+func TestReassembleChunks(t *testing.T) {
+	body := []byte("the quick brown fox jumps over the lazy dog")
+
+	t.Run("in order", func(t *testing.T) {
+		chunks := SplitChunks("req-1", body, 8)
+		if len(chunks) != 6 || !chunks[5].Final || chunks[5].TotalBytes != int64(len(body)) {
+			t.Fatalf("unexpected split: %d chunks, final=%v total=%d", len(chunks), chunks[len(chunks)-1].Final, chunks[len(chunks)-1].TotalBytes)
+		}
+
+		var out bytes.Buffer
+		n, err := ReassembleChunks(feedChunks(chunks), &out, time.Second)
+		if err != nil {
+			t.Fatalf("ReassembleChunks() error = %v", err)
+		}
+		if n != int64(len(body)) || !bytes.Equal(out.Bytes(), body) {
+			t.Errorf("ReassembleChunks() = %d %q, want %q", n, out.String(), body)
+		}
+	})
+
+	t.Run("empty body", func(t *testing.T) {
+		chunks := SplitChunks("req-2", nil, 8)
+		if len(chunks) != 1 || !chunks[0].Final {
+			t.Fatalf("expected a single final chunk, got %d", len(chunks))
+		}
+		if _, err := ReassembleChunks(feedChunks(chunks), &bytes.Buffer{}, time.Second); err != nil {
+			t.Errorf("ReassembleChunks() error = %v", err)
+		}
+	})
+
+	t.Run("gap", func(t *testing.T) {
+		chunks := SplitChunks("req-3", body, 8)
+		chunks = append(chunks[:2], chunks[3:]...)
+		_, err := ReassembleChunks(feedChunks(chunks), &bytes.Buffer{}, time.Second)
+		if !errors.Is(err, ErrChunkGap) {
+			t.Errorf("ReassembleChunks() error = %v, want ErrChunkGap", err)
+		}
+	})
+
+	t.Run("length mismatch", func(t *testing.T) {
+		chunks := SplitChunks("req-4", body, 8)
+		chunks[len(chunks)-1].TotalBytes++
+		_, err := ReassembleChunks(feedChunks(chunks), &bytes.Buffer{}, time.Second)
+		if !errors.Is(err, ErrChunkLength) {
+			t.Errorf("ReassembleChunks() error = %v, want ErrChunkLength", err)
+		}
+	})
+
+	t.Run("missing final times out", func(t *testing.T) {
+		chunks := SplitChunks("req-5", body, 8)
+		_, err := ReassembleChunks(feedChunks(chunks[:len(chunks)-1]), &bytes.Buffer{}, 50*time.Millisecond)
+		if !errors.Is(err, ErrChunkTruncated) {
+			t.Errorf("ReassembleChunks() error = %v, want ErrChunkTruncated", err)
+		}
+	})
+
+	t.Run("stream closed before final", func(t *testing.T) {
+		chunks := SplitChunks("req-6", body, 8)
+		ch := make(chan *Chunk, len(chunks))
+		for _, c := range chunks[:len(chunks)-1] {
+			ch <- c
+		}
+		close(ch)
+		_, err := ReassembleChunks(ch, &bytes.Buffer{}, time.Second)
+		if !errors.Is(err, ErrChunkTruncated) {
+			t.Errorf("ReassembleChunks() error = %v, want ErrChunkTruncated", err)
+		}
+	})
+
+	t.Run("stopped before final", func(t *testing.T) {
+		done := make(chan struct{})
+		close(done)
+		start := time.Now()
+		_, err := ReassembleChunksUntil(make(chan *Chunk), &bytes.Buffer{}, time.Minute, done)
+		if !errors.Is(err, ErrChunkTruncated) {
+			t.Errorf("ReassembleChunksUntil() error = %v, want ErrChunkTruncated", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("ReassembleChunksUntil() took %v to stop", elapsed)
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+)
+
+// CompressionGzip compresses each connect_data chunk of a CONNECT tunnel with gzip
+const CompressionGzip = "gzip"
+
+// maxDecompressedChunk bounds a decompressed connect_data chunk, far above the 32KB chunks peers send,
+// so a small compressed chunk cannot expand without limit
+const maxDecompressedChunk = 1 << 20
+
+// ErrChunkTooLarge is returned when a compressed chunk expands beyond the size any peer sends
+var ErrChunkTooLarge = errors.New("decompressed chunk too large")
+
+var gzipWriters = sync.Pool{
+	New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return w
+	},
+}
+
+// CompressChunk gzips a connect_data chunk. It returns chunk itself and false when compression does not
+// make it smaller, as for TLS and other data that is already compressed or encrypted.
+func CompressChunk(chunk []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	zw := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(zw)
+	zw.Reset(&buf)
+
+	if _, err := zw.Write(chunk); err != nil {
+		return chunk, false
+	}
+	if err := zw.Close(); err != nil || buf.Len() >= len(chunk) {
+		return chunk, false
+	}
+	return buf.Bytes(), true
+}
+
+// DecompressChunk reverses CompressChunk
+func DecompressChunk(chunk []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(chunk))
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(zr, maxDecompressedChunk+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxDecompressedChunk {
+		return nil, ErrChunkTooLarge
+	}
+	return data, nil
+}
@@ -0,0 +1,52 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCompressChunk(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		chunk := []byte(strings.Repeat("SET key value\r\n", 200))
+		compressed, ok := CompressChunk(chunk)
+		if !ok || len(compressed) >= len(chunk) {
+			t.Fatalf("CompressChunk() = %d bytes, %v; want fewer than %d", len(compressed), ok, len(chunk))
+		}
+
+		got, err := DecompressChunk(compressed)
+		if err != nil {
+			t.Fatalf("DecompressChunk() error = %v", err)
+		}
+		if !bytes.Equal(got, chunk) {
+			t.Errorf("DecompressChunk() = %q, want %q", got, chunk)
+		}
+	})
+
+	t.Run("incompressible", func(t *testing.T) {
+		chunk := make([]byte, 4096)
+		rand.Read(chunk)
+		got, ok := CompressChunk(chunk)
+		if ok || !bytes.Equal(got, chunk) {
+			t.Errorf("CompressChunk() compressed random data (ok=%v, %d bytes)", ok, len(got))
+		}
+	})
+
+	t.Run("expands too far", func(t *testing.T) {
+		compressed, ok := CompressChunk(make([]byte, 2*maxDecompressedChunk))
+		if !ok {
+			t.Fatal("CompressChunk() did not compress zeros")
+		}
+		if _, err := DecompressChunk(compressed); !errors.Is(err, ErrChunkTooLarge) {
+			t.Errorf("DecompressChunk() error = %v, want %v", err, ErrChunkTooLarge)
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		if _, err := DecompressChunk([]byte("not gzip")); err == nil {
+			t.Error("DecompressChunk() accepted data that is not gzip")
+		}
+	})
+}
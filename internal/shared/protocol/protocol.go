@@ -2,17 +2,35 @@ package protocol
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"strings"
 	"time"
 )
 
+var (
+	ErrChecksumMismatch = errors.New("body checksum mismatch")
+)
+
 // Request represents an HTTP request through the tunnel
 type Request struct {
-	ID      string              `json:"id"`
-	Method  string              `json:"method"`
-	URL     string              `json:"url"`
-	Headers map[string][]string `json:"headers"`
-	Body    []byte              `json:"body,omitempty"`
+	ID       string              `json:"id"`
+	Method   string              `json:"method"`
+	URL      string              `json:"url"`
+	Headers  map[string][]string `json:"headers"`
+	Body     []byte              `json:"body,omitempty"`
+	Checksum string              `json:"checksum,omitempty"` // Optional SHA-256 of Body (hex)
+
+	HostHeader  string `json:"host_header,omitempty"`  // Optional upstream Host header override
+	ServerName  string `json:"server_name,omitempty"`  // Optional upstream TLS server name (SNI) override
+	AffinityKey string `json:"affinity_key,omitempty"` // Optional key pinning related requests to one upstream connection
+
+	Stream     bool  `json:"stream,omitempty"`      // Agent accepts an event stream response body as http_response_chunk messages
+	BodyStream bool  `json:"body_stream,omitempty"` // Body follows in http_request_chunk messages
+	BodyLength int64 `json:"body_length,omitempty"` // Length of a streamed body, when the agent knows it
+
+	MaxResponseBytes int64 `json:"max_response_bytes,omitempty"` // Optional limit on a buffered response body, refused by the server
 }
 
 // Response represents an HTTP response through the tunnel
@@ -22,8 +40,38 @@ type Response struct {
 	Headers    map[string][]string `json:"headers"`
 	Body       []byte              `json:"body,omitempty"`
 	Error      string              `json:"error,omitempty"`
+	ErrorCode  string              `json:"error_code,omitempty"` // Optional machine-readable code for tunnel-generated errors
+	Checksum   string              `json:"checksum,omitempty"`   // Optional SHA-256 of Body (hex)
+	Stream     bool                `json:"stream,omitempty"`     // Body follows in http_response_chunk messages
+	Trailers   map[string][]string `json:"trailers,omitempty"`   // Optional trailers sent by the upstream after the body
+	BodyBytes  int64               `json:"body_bytes,omitempty"` // Size of the upstream body (streams report it on the final chunk)
 }
 
+// ErrCodeCircuitOpen marks a response refused because the server's circuit breaker is open
+const ErrCodeCircuitOpen = "circuit_open"
+
+// ErrCodeLoadShed marks a response refused because the server is shedding load
+const ErrCodeLoadShed = "load_shed"
+
+// ErrCodeHostBusy marks a response refused because too many requests to the upstream host are in flight
+const ErrCodeHostBusy = "host_busy"
+
+// Codes for other tunnel-generated errors, so clients can tell them apart from upstream responses
+const (
+	ErrCodeBadRequest       = "bad_request"
+	ErrCodeForbidden        = "forbidden"
+	ErrCodeMethodNotAllowed = "method_not_allowed"
+	ErrCodeInvalidScheme    = "invalid_scheme" // The request URL's scheme is not on the allow-list
+	ErrCodeIntegrity        = "integrity_check_failed"
+	ErrCodeInternal         = "internal_error"
+	ErrCodeUpstreamFailed   = "upstream_failed"    // The server could not reach the upstream or read its response
+	ErrCodeTimeout          = "timeout"            // The request took longer than the time allowed for it
+	ErrCodeResponseTooLarge = "response_too_large" // The response was larger than the tunnel could hold
+)
+
+// DefaultAllowedSchemes are the request URL schemes forwarded when no allow-list is configured
+var DefaultAllowedSchemes = []string{"http", "https"}
+
 // ConnectionInfo represents tunnel connection metadata
 type ConnectionInfo struct {
 	ClientID    string    `json:"client_id"`
@@ -40,29 +88,66 @@ type HealthCheck struct {
 
 // Envelope wraps different message kinds for the tunnel
 // Types: "http_request", "http_response", "connect_open", "connect_ack", "connect_data", "connect_close",
-// "ws_open", "ws_ack", "ws_message", "ws_close", "iam_auth_request", "iam_auth_response"
+// "connect_half_close", "ws_open", "ws_ack", "ws_message", "ws_close", "iam_auth_request", "iam_auth_response", "hello",
+// "http_request_chunk", "http_request_credit", "http_response_chunk", "http_response_credit", "http_cancel",
+// "server_shutting_down", "server_busy", "cert_expiring"
 type Envelope struct {
 	Type    string `json:"type"`
 	Payload any    `json:"payload"`
 }
 
+// HTTPCancel tells the server the agent no longer wants a response, streamed or not
+type HTTPCancel struct {
+	ID string `json:"id"`
+}
+
+// ServerShutdown tells agents the server is stopping; in-flight work may finish within the grace period
+type ServerShutdown struct {
+	GracePeriodMs int64 `json:"grace_period_ms"`
+}
+
+// ServerBusy tells an agent the server is not taking on new connections right now; the server closes the
+// connection after sending it and the agent should reconnect after RetryAfterMs
+type ServerBusy struct {
+	RetryAfterMs int64 `json:"retry_after_ms"`
+}
+
+// CertExpiring advises an agent that its client certificate expires soon, so it can renew it and reconnect
+// before the connection is lost; the connection itself is still accepted
+type CertExpiring struct {
+	NotAfter    time.Time `json:"not_after"`
+	RemainingMs int64     `json:"remaining_ms"`
+}
+
+// FlowControl asks an agent to pause or resume sending new requests, tunnels and WebSockets; work already
+// in flight carries on. A pause lifts by itself after MaxPauseMs so a lost resume cannot stall the agent.
+type FlowControl struct {
+	Pause      bool  `json:"pause"`
+	MaxPauseMs int64 `json:"max_pause_ms,omitempty"`
+}
+
 // ConnectOpen requests the server to open a TCP connection to Address (host:port)
 type ConnectOpen struct {
-	ID      string `json:"id"`
-	Address string `json:"address"`
+	ID          string              `json:"id"`
+	Address     string              `json:"address"`
+	Compression string              `json:"compression,omitempty"` // Optional compression requested for the tunnel's connect_data chunks
+	Headers     map[string][]string `json:"headers,omitempty"`     // Headers of the client's CONNECT request, checked by the server and never sent upstream
 }
 
 // ConnectAck acknowledges a ConnectOpen
 type ConnectAck struct {
-	ID    string `json:"id"`
-	Ok    bool   `json:"ok"`
-	Error string `json:"error,omitempty"`
+	ID          string `json:"id"`
+	Ok          bool   `json:"ok"`
+	Error       string `json:"error,omitempty"`
+	ErrorCode   string `json:"error_code,omitempty"`  // Optional machine-readable code when the tunnel was refused
+	Compression string `json:"compression,omitempty"` // Compression the server agreed to (empty leaves chunks uncompressed)
 }
 
 // ConnectData carries a chunk of bytes for a TCP tunnel
 type ConnectData struct {
-	ID    string `json:"id"`
-	Chunk []byte `json:"chunk"`
+	ID         string `json:"id"`
+	Chunk      []byte `json:"chunk"`
+	Compressed bool   `json:"compressed,omitempty"` // Chunk is compressed with the tunnel's negotiated compression
 }
 
 // ConnectClose signals closing a TCP tunnel
@@ -71,6 +156,12 @@ type ConnectClose struct {
 	Error string `json:"error,omitempty"`
 }
 
+// ConnectHalfClose signals that the sender has finished writing to a TCP tunnel (EOF in one direction);
+// the other direction stays open until its own EOF
+type ConnectHalfClose struct {
+	ID string `json:"id"`
+}
+
 // WebSocketOpen requests the server to establish a WebSocket connection
 type WebSocketOpen struct {
 	ID      string              `json:"id"`
@@ -80,9 +171,10 @@ type WebSocketOpen struct {
 
 // WebSocketAck acknowledges a WebSocketOpen
 type WebSocketAck struct {
-	ID    string `json:"id"`
-	Ok    bool   `json:"ok"`
-	Error string `json:"error,omitempty"`
+	ID        string `json:"id"`
+	Ok        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"` // Optional machine-readable code when the WebSocket was refused
 }
 
 // WebSocketMessage carries a WebSocket message frame
@@ -124,3 +216,122 @@ func GenerateID() string {
 	rand.Read(b)
 	return hex.EncodeToString(b)
 }
+
+// Checksum returns the hex-encoded SHA-256 of a message body
+func Checksum(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyChecksum checks a body against an expected checksum (an empty checksum always passes)
+func VerifyChecksum(body []byte, checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+	if Checksum(body) != checksum {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// BodyAllowedForStatus reports whether a response with the given status may carry a body (RFC 7230 section 3.3)
+func BodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == 204:
+		return false
+	case status == 304:
+		return false
+	}
+	return true
+}
+
+// IsValidMethod reports whether method is a valid HTTP token (RFC 7230 section 3.2.6)
+func IsValidMethod(method string) bool {
+	if method == "" {
+		return false
+	}
+	for i := 0; i < len(method); i++ {
+		if !isTokenChar(method[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isTokenChar reports whether c is a tchar as defined by RFC 7230
+func isTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// Errors returned by CheckFraming
+var (
+	ErrLengthWithTransferEncoding = errors.New("both Content-Length and Transfer-Encoding headers are present")
+	ErrDuplicateContentLength     = errors.New("more than one Content-Length is present")
+	ErrInvalidContentLength       = errors.New("malformed Content-Length header")
+)
+
+// CheckFraming reports headers that make the length of a request body ambiguous, the usual request
+// smuggling vectors: Content-Length together with Transfer-Encoding, more than one Content-Length (as
+// repeated headers or a comma-separated list, even with equal values) or a malformed Content-Length.
+// Header names are matched case-insensitively, as headers from an agent need not be canonical.
+func CheckFraming(headers map[string][]string) error {
+	lengths, transferEncoding := 0, false
+	for name, values := range headers {
+		switch {
+		case strings.EqualFold(name, "Content-Length"):
+			for _, value := range values {
+				for _, length := range strings.Split(value, ",") {
+					if !isDecimal(strings.TrimSpace(length)) {
+						return ErrInvalidContentLength
+					}
+					lengths++
+				}
+			}
+		case strings.EqualFold(name, "Transfer-Encoding"):
+			transferEncoding = transferEncoding || len(values) > 0
+		}
+	}
+	if lengths > 0 && transferEncoding {
+		return ErrLengthWithTransferEncoding
+	}
+	if lengths > 1 {
+		return ErrDuplicateContentLength
+	}
+	return nil
+}
+
+// SanitizeFraming removes the Content-Length and Transfer-Encoding headers, leaving whoever sends the
+// body on to frame it from the bytes it actually has
+func SanitizeFraming(headers map[string][]string) {
+	for name := range headers {
+		if strings.EqualFold(name, "Content-Length") || strings.EqualFold(name, "Transfer-Encoding") {
+			delete(headers, name)
+		}
+	}
+}
+
+// isDecimal reports whether value is a non-empty string of ASCII digits
+func isDecimal(value string) bool {
+	if value == "" {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] < '0' || value[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// IsGRPCContentType reports whether contentType is gRPC's, whose requests need HTTP/2 end to end and
+// whose status arrives in trailers. gRPC-Web is not included, as it is designed to work over HTTP/1.1.
+func IsGRPCContentType(contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+") || strings.HasPrefix(contentType, "application/grpc;")
+}
@@ -349,3 +349,146 @@ func TestHealthCheck(t *testing.T) {
 		t.Errorf("Expected message 'are you there?', got %s", decoded.Message)
 	}
 }
+
+func TestVerifyChecksum(t *testing.T) {
+	body := []byte(`{"key":"value"}`)
+
+	tests := []struct {
+		name     string
+		body     []byte
+		checksum string
+		wantErr  bool
+	}{
+		{name: "matching checksum", body: body, checksum: Checksum(body), wantErr: false},
+		{name: "no checksum", body: body, checksum: "", wantErr: false},
+		{name: "corrupted body", body: []byte(`{"key":"valuf"}`), checksum: Checksum(body), wantErr: true},
+		{name: "corrupted checksum", body: body, checksum: Checksum([]byte("other")), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyChecksum(tt.body, tt.checksum)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifyChecksum() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && err != ErrChecksumMismatch {
+				t.Errorf("Expected ErrChecksumMismatch, got %v", err)
+			}
+		})
+	}
+}
+
+func TestChecksumSurvivesSerialization(t *testing.T) {
+	body := []byte("binary\x00\xffpayload")
+	resp := &Response{ID: "test-id", StatusCode: 200, Body: body, Checksum: Checksum(body)}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("Failed to marshal response: %v", err)
+	}
+
+	var decoded Response
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	if err := VerifyChecksum(decoded.Body, decoded.Checksum); err != nil {
+		t.Errorf("Checksum should verify after round-trip: %v", err)
+	}
+}
+
+func TestIsValidMethod(t *testing.T) {
+	tests := []struct {
+		method string
+		want   bool
+	}{
+		{"GET", true},
+		{"PROPFIND", true},
+		{"M-SEARCH", true},
+		{"", false},
+		{"GET /", false},
+		{"GET\r\nX-Injected: 1", false},
+		{"GE(T", false},
+		{"GET\x00", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsValidMethod(tt.method); got != tt.want {
+			t.Errorf("IsValidMethod(%q) = %v, want %v", tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestCheckFraming(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string][]string
+		want    error
+	}{
+		{"no framing headers", map[string][]string{"Accept": {"*/*"}}, nil},
+		{"content length", map[string][]string{"Content-Length": {"5"}}, nil},
+		{"transfer encoding", map[string][]string{"Transfer-Encoding": {"chunked"}}, nil},
+		{"both", map[string][]string{"Content-Length": {"5"}, "Transfer-Encoding": {"chunked"}}, ErrLengthWithTransferEncoding},
+		{"both, non-canonical names", map[string][]string{"content-length": {"5"}, "TRANSFER-ENCODING": {"chunked"}}, ErrLengthWithTransferEncoding},
+		{"repeated content length", map[string][]string{"Content-Length": {"5", "5"}}, ErrDuplicateContentLength},
+		{"content length list", map[string][]string{"Content-Length": {"5, 6"}}, ErrDuplicateContentLength},
+		{"content length in two spellings", map[string][]string{"Content-Length": {"5"}, "content-length": {"5"}}, ErrDuplicateContentLength},
+		{"malformed content length", map[string][]string{"Content-Length": {"-5"}}, ErrInvalidContentLength},
+		{"empty content length", map[string][]string{"Content-Length": {""}}, ErrInvalidContentLength},
+	}
+
+	for _, tt := range tests {
+		if got := CheckFraming(tt.headers); got != tt.want {
+			t.Errorf("%s: CheckFraming() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	headers := map[string][]string{"content-length": {"5"}, "Transfer-Encoding": {"chunked"}, "Accept": {"*/*"}}
+	SanitizeFraming(headers)
+	if len(headers) != 1 || headers["Accept"] == nil {
+		t.Errorf("SanitizeFraming left %v, want only Accept", headers)
+	}
+}
+
+func TestIsGRPCContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/grpc", true},
+		{"application/grpc+proto", true},
+		{"Application/GRPC; charset=utf-8", true},
+		{"application/grpc-web+proto", false},
+		{"application/grpcx", false},
+		{"application/json", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsGRPCContentType(tt.contentType); got != tt.want {
+			t.Errorf("IsGRPCContentType(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestBodyAllowedForStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{100, false},
+		{101, false},
+		{200, true},
+		{204, false},
+		{206, true},
+		{304, false},
+		{404, true},
+		{500, true},
+	}
+
+	for _, tt := range tests {
+		if got := BodyAllowedForStatus(tt.status); got != tt.want {
+			t.Errorf("BodyAllowedForStatus(%d) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package protocol
+
+import (
+	"fmt"
+
+	"fluidity/internal/shared/version"
+)
+
+// ProtocolVersion is the tunnel wire protocol version spoken by this build.
+// Bump it for changes an older peer cannot safely ignore.
+const ProtocolVersion = 1
+
+// MinProtocolVersion is the oldest peer protocol version this build interoperates with
+const MinProtocolVersion = 1
+
+// Optional protocol features advertised in the hello handshake
+const (
+	// FeatureChecksums indicates support for SHA-256 body checksums on requests and responses
+	FeatureChecksums uint64 = 1 << iota
+	// FeatureHalfClose indicates support for connect_half_close on CONNECT tunnels
+	FeatureHalfClose
+	// FeatureHeartbeat indicates support for idle "ping" keepalive messages
+	FeatureHeartbeat
+	// FeatureRequestStreaming indicates support for request bodies streamed in http_request_chunk messages
+	FeatureRequestStreaming
+)
+
+// SupportedFeatures is the feature bitmap of this build
+const SupportedFeatures = FeatureChecksums | FeatureHalfClose | FeatureHeartbeat | FeatureRequestStreaming
+
+// featureNames names the feature bits for reports such as the server's /features endpoint
+var featureNames = map[uint64]string{
+	FeatureChecksums:        "checksums",
+	FeatureHalfClose:        "half_close",
+	FeatureHeartbeat:        "heartbeat",
+	FeatureRequestStreaming: "request_streaming",
+}
+
+// FeatureNames returns the names of the features set in features, in bit order. Bits this build
+// does not know are reported as "bit_N".
+func FeatureNames(features uint64) []string {
+	names := []string{}
+	for bit := 0; bit < 64; bit++ {
+		mask := uint64(1) << bit
+		if features&mask == 0 {
+			continue
+		}
+		if name, ok := featureNames[mask]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, fmt.Sprintf("bit_%d", bit))
+		}
+	}
+	return names
+}
+
+// Hello is exchanged by agent and server after authentication to detect version drift
+type Hello struct {
+	ProtocolVersion    int    `json:"protocol_version"`
+	MinProtocolVersion int    `json:"min_protocol_version"`
+	BuildVersion       string `json:"build_version"`
+	BuildCommit        string `json:"build_commit"`
+	BuildTime          string `json:"build_time,omitempty"`
+	GoVersion          string `json:"go_version,omitempty"`
+	Features           uint64 `json:"features"`
+}
+
+// LocalHello returns the hello describing this build
+func LocalHello() Hello {
+	build := version.Get()
+	return Hello{
+		ProtocolVersion:    ProtocolVersion,
+		MinProtocolVersion: MinProtocolVersion,
+		BuildVersion:       build.Version,
+		BuildCommit:        build.Commit,
+		BuildTime:          build.BuildTime,
+		GoVersion:          build.GoVersion,
+		Features:           SupportedFeatures,
+	}
+}
+
+// Compatibility describes how well two builds can interoperate
+type Compatibility int
+
+const (
+	// Compatible builds speak the same protocol with the same features
+	Compatible Compatibility = iota
+	// CompatibleWithDrift builds interoperate but differ in version or features
+	CompatibleWithDrift
+	// Incompatible builds cannot safely exchange traffic
+	Incompatible
+)
+
+// String returns a human-readable compatibility level
+func (c Compatibility) String() string {
+	switch c {
+	case Compatible:
+		return "compatible"
+	case CompatibleWithDrift:
+		return "compatible with drift"
+	case Incompatible:
+		return "incompatible"
+	default:
+		return "unknown"
+	}
+}
+
+// CheckCompatibility compares the local hello against a peer's and explains any difference
+func CheckCompatibility(local, peer Hello) (Compatibility, string) {
+	if peer.ProtocolVersion < local.MinProtocolVersion {
+		return Incompatible, fmt.Sprintf("peer protocol version %d is older than the minimum supported %d",
+			peer.ProtocolVersion, local.MinProtocolVersion)
+	}
+	if local.ProtocolVersion < peer.MinProtocolVersion {
+		return Incompatible, fmt.Sprintf("peer requires protocol version %d or newer, local is %d",
+			peer.MinProtocolVersion, local.ProtocolVersion)
+	}
+
+	if peer.ProtocolVersion != local.ProtocolVersion {
+		return CompatibleWithDrift, fmt.Sprintf("protocol versions differ (local %d, peer %d)",
+			local.ProtocolVersion, peer.ProtocolVersion)
+	}
+	if peer.Features != local.Features {
+		return CompatibleWithDrift, fmt.Sprintf("feature sets differ (local %#x, peer %#x)",
+			local.Features, peer.Features)
+	}
+	if peer.BuildVersion != local.BuildVersion || peer.BuildCommit != local.BuildCommit {
+		return CompatibleWithDrift, fmt.Sprintf("builds differ (local %s/%s, peer %s/%s)",
+			local.BuildVersion, local.BuildCommit, peer.BuildVersion, peer.BuildCommit)
+	}
+
+	return Compatible, ""
+}
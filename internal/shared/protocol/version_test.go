@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCheckCompatibility(t *testing.T) {
+	local := Hello{
+		ProtocolVersion:    2,
+		MinProtocolVersion: 1,
+		BuildVersion:       "1.4.0",
+		BuildCommit:        "abc123",
+		Features:           FeatureChecksums,
+	}
+
+	tests := []struct {
+		name string
+		peer Hello
+		want Compatibility
+	}{
+		{
+			name: "identical build",
+			peer: local,
+			want: Compatible,
+		},
+		{
+			name: "different build same protocol",
+			peer: Hello{ProtocolVersion: 2, MinProtocolVersion: 1, BuildVersion: "1.4.1", BuildCommit: "def456", Features: FeatureChecksums},
+			want: CompatibleWithDrift,
+		},
+		{
+			name: "missing feature",
+			peer: Hello{ProtocolVersion: 2, MinProtocolVersion: 1, BuildVersion: "1.4.0", BuildCommit: "abc123"},
+			want: CompatibleWithDrift,
+		},
+		{
+			name: "older peer within supported range",
+			peer: Hello{ProtocolVersion: 1, MinProtocolVersion: 1, BuildVersion: "1.0.0", Features: FeatureChecksums},
+			want: CompatibleWithDrift,
+		},
+		{
+			name: "newer peer that still accepts us",
+			peer: Hello{ProtocolVersion: 3, MinProtocolVersion: 2, BuildVersion: "2.0.0", Features: FeatureChecksums},
+			want: CompatibleWithDrift,
+		},
+		{
+			name: "peer older than our minimum",
+			peer: Hello{ProtocolVersion: 0, MinProtocolVersion: 0},
+			want: Incompatible,
+		},
+		{
+			name: "peer requires newer protocol",
+			peer: Hello{ProtocolVersion: 4, MinProtocolVersion: 3, BuildVersion: "3.0.0"},
+			want: Incompatible,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := CheckCompatibility(local, tt.peer)
+			if got != tt.want {
+				t.Errorf("CheckCompatibility() = %v (%s), want %v", got, reason, tt.want)
+			}
+			if got != Compatible && reason == "" {
+				t.Error("expected a reason for a non-compatible result")
+			}
+		})
+	}
+}
+
+func TestLocalHelloSelfCompatible(t *testing.T) {
+	hello := LocalHello()
+
+	data, err := json.Marshal(Envelope{Type: "hello", Payload: hello})
+	if err != nil {
+		t.Fatalf("Failed to marshal hello: %v", err)
+	}
+
+	var env struct {
+		Type    string `json:"type"`
+		Payload Hello  `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &env); err != nil {
+		t.Fatalf("Failed to unmarshal hello: %v", err)
+	}
+
+	if got, reason := CheckCompatibility(hello, env.Payload); got != Compatible {
+		t.Errorf("Expected local hello to be compatible with itself, got %v (%s)", got, reason)
+	}
+}
+
+func TestFeatureNames(t *testing.T) {
+	if got := FeatureNames(0); len(got) != 0 {
+		t.Errorf("FeatureNames(0) = %v, want none", got)
+	}
+
+	got := FeatureNames(FeatureChecksums | FeatureHalfClose | 1<<10)
+	want := []string{"checksums", "half_close", "bit_10"}
+	if len(got) != len(want) {
+		t.Fatalf("FeatureNames = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("FeatureNames[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
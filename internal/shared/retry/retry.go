@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"math"
+	"math/rand/v2"
+	"sync"
 	"time"
 )
 
@@ -18,6 +20,7 @@ type Config struct {
 	MaxDelay        time.Duration // Maximum delay between retries
 	Multiplier      float64       // Multiplier for exponential backoff
 	RetryableErrors []error       // Specific errors that should trigger retry
+	Budget          *Budget       // Optional retry budget shared across calls (nil allows every retry)
 }
 
 // DefaultConfig returns default retry configuration
@@ -50,6 +53,7 @@ func Execute(ctx context.Context, config Config, shouldRetry ShouldRetry, fn fun
 
 	var lastErr error
 	delay := config.InitialDelay
+	config.Budget.Deposit()
 
 	for attempt := 1; attempt <= config.MaxAttempts; attempt++ {
 		// Execute the function
@@ -70,6 +74,11 @@ func Execute(ctx context.Context, config Config, shouldRetry ShouldRetry, fn fun
 			return err
 		}
 
+		// Fail fast rather than add load once retries exceed their share of calls
+		if !config.Budget.Withdraw() {
+			return err
+		}
+
 		// Wait before retrying
 		select {
 		case <-ctx.Done():
@@ -104,6 +113,7 @@ func ExecuteWithResult[T any](ctx context.Context, config Config, shouldRetry Sh
 	var lastErr error
 	var zeroValue T
 	delay := config.InitialDelay
+	config.Budget.Deposit()
 
 	for attempt := 1; attempt <= config.MaxAttempts; attempt++ {
 		// Execute the function
@@ -124,6 +134,11 @@ func ExecuteWithResult[T any](ctx context.Context, config Config, shouldRetry Sh
 			return zeroValue, err
 		}
 
+		// Fail fast rather than add load once retries exceed their share of calls
+		if !config.Budget.Withdraw() {
+			return zeroValue, err
+		}
+
 		// Wait before retrying
 		select {
 		case <-ctx.Done():
@@ -140,6 +155,52 @@ func ExecuteWithResult[T any](ctx context.Context, config Config, shouldRetry Sh
 	return zeroValue, lastErr
 }
 
+// Budget is a token bucket of retry allowances shared across calls. Each call earns ratio tokens
+// and each retry spends one, so over time retries are at most ratio of calls, plus a burst of
+// saved allowances. This keeps retries from multiplying load during a broad outage.
+type Budget struct {
+	mu        sync.Mutex
+	ratio     float64
+	tokens    float64
+	maxTokens float64
+}
+
+// NewBudget returns a budget allowing retries for up to ratio of calls (e.g. 0.1 for 10%).
+// Up to burst allowances are saved for retries, and the budget starts with all of them.
+func NewBudget(ratio float64, burst int) *Budget {
+	if ratio < 0 {
+		ratio = 0
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Budget{ratio: ratio, tokens: float64(burst), maxTokens: float64(burst)}
+}
+
+// Deposit earns the allowance of a new call
+func (b *Budget) Deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+b.ratio, b.maxTokens)
+}
+
+// Withdraw spends an allowance for a retry, reporting false when none is left
+func (b *Budget) Withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
 // IsRetryable returns a ShouldRetry function that checks for specific error types
 func IsRetryable(retryableErrors ...error) ShouldRetry {
 	return func(err error) bool {
@@ -180,3 +241,16 @@ func CalculateBackoff(attempt int, initialDelay time.Duration, multiplier float6
 	}
 	return time.Duration(delay)
 }
+
+// Jitter randomizes d by up to ±fraction of its value so that many clients backing off
+// at once do not retry in lockstep (fraction is clamped to [0, 1])
+func Jitter(d time.Duration, fraction float64) time.Duration {
+	if d <= 0 || fraction <= 0 {
+		return d
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	spread := float64(d) * fraction
+	return time.Duration(float64(d) - spread + rand.Float64()*2*spread)
+}
@@ -208,6 +208,39 @@ func TestCalculateBackoff(t *testing.T) {
 	}
 }
 
+func TestJitter(t *testing.T) {
+	base := 1 * time.Second
+
+	tests := []struct {
+		name     string
+		fraction float64
+		min      time.Duration
+		max      time.Duration
+	}{
+		{"no jitter", 0, base, base},
+		{"negative fraction", -0.5, base, base},
+		{"quarter", 0.25, 750 * time.Millisecond, 1250 * time.Millisecond},
+		{"full", 1, 0, 2 * time.Second},
+		{"clamped above one", 3, 0, 2 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			distinct := make(map[time.Duration]bool)
+			for i := 0; i < 200; i++ {
+				d := Jitter(base, tt.fraction)
+				if d < tt.min || d > tt.max {
+					t.Fatalf("Jitter(%v, %v) = %v, want within [%v, %v]", base, tt.fraction, d, tt.min, tt.max)
+				}
+				distinct[d] = true
+			}
+			if tt.min != tt.max && len(distinct) < 10 {
+				t.Errorf("Expected jittered values to vary, got %d distinct values", len(distinct))
+			}
+		})
+	}
+}
+
 func TestExecute_ExponentialBackoff(t *testing.T) {
 	config := Config{
 		MaxAttempts:  3,
@@ -259,3 +292,65 @@ func TestIsRetryable(t *testing.T) {
 		t.Error("Expected err3 to not be retryable")
 	}
 }
+
+func TestExecute_RetryBudget(t *testing.T) {
+	const calls = 1000
+	const ratio = 0.1
+	const burst = 10
+
+	config := Config{
+		MaxAttempts:  3,
+		InitialDelay: time.Microsecond,
+		MaxDelay:     time.Microsecond,
+		Budget:       NewBudget(ratio, burst),
+	}
+
+	// Every call fails, as during a broad upstream outage
+	testErr := errors.New("upstream unavailable")
+	attempts := 0
+	for i := 0; i < calls; i++ {
+		err := Execute(context.Background(), config, AlwaysRetry(), func() error {
+			attempts++
+			return testErr
+		})
+		if err != testErr {
+			t.Fatalf("Expected the call's error, got %v", err)
+		}
+	}
+
+	retries := attempts - calls
+	maxRetries := int(calls*ratio) + burst
+	if retries > maxRetries {
+		t.Errorf("Expected at most %d retries within budget, got %d", maxRetries, retries)
+	}
+	if retries < calls*ratio {
+		t.Errorf("Expected the budget to allow about %d retries, got %d", int(calls*ratio), retries)
+	}
+	t.Logf("%d calls made %d retries (%.1f%%)", calls, retries, float64(retries)/calls*100)
+}
+
+func TestExecute_RetryBudgetExhausted(t *testing.T) {
+	config := Config{
+		MaxAttempts:  3,
+		InitialDelay: time.Microsecond,
+		Budget:       NewBudget(0, 1),
+	}
+
+	attempts := 0
+	fail := func() error {
+		attempts++
+		return errors.New("fail")
+	}
+
+	// The single saved allowance covers one retry, after which calls fail on their first attempt
+	Execute(context.Background(), config, AlwaysRetry(), fail)
+	if attempts != 2 {
+		t.Errorf("Expected 2 attempts using the saved allowance, got %d", attempts)
+	}
+
+	attempts = 0
+	Execute(context.Background(), config, AlwaysRetry(), fail)
+	if attempts != 1 {
+		t.Errorf("Expected 1 attempt with the budget exhausted, got %d", attempts)
+	}
+}
@@ -0,0 +1,38 @@
+// Package version holds the build information stamped into the agent and server binaries
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Build information, set at link time with
+// -ldflags "-X fluidity/internal/shared/version.Version=... -X fluidity/internal/shared/version.Commit=... -X fluidity/internal/shared/version.BuildTime=..."
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildTime = "unknown"
+)
+
+// Info describes the running build
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the running build's information
+func Get() Info {
+	return Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// String formats the build information on one line, as printed by --version
+func (i Info) String() string {
+	return fmt.Sprintf("%s (commit %s, built %s, %s)", i.Version, i.Commit, i.BuildTime, i.GoVersion)
+}
@@ -2,12 +2,20 @@ package tests
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
+	agentpkg "fluidity/internal/core/agent"
 	"fluidity/internal/shared/protocol"
 )
 
@@ -632,3 +640,238 @@ func TestAgentSendRequest_EmptyResponse(t *testing.T) {
 		t.Errorf("expected empty body, got %q", string(resp.Body))
 	}
 }
+
+// TestAgentSendRequest_DuplicateIDRejected tests that reusing an in-flight request ID is rejected
+// without stealing the first request's response
+func TestAgentSendRequest_DuplicateIDRejected(t *testing.T) {
+	certs := GenerateTestCerts(t)
+	server := StartTestServer(t, certs)
+	defer server.Stop()
+
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+
+	held := make(chan struct{}, 1)
+	release := make(chan struct{})
+	mockHandler := func(w http.ResponseWriter, r *http.Request) {
+		held <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "first response")
+	}
+	httpServer := MockHTTPServer(t, mockHandler)
+	defer httpServer.Close()
+
+	id := protocol.GenerateID()
+	type result struct {
+		resp *protocol.Response
+		err  error
+	}
+	first := make(chan result, 1)
+	go func() {
+		resp, err := client.Client.SendRequest(&protocol.Request{ID: id, Method: "GET", URL: httpServer.URL + "/slow"})
+		first <- result{resp, err}
+	}()
+
+	// Wait until the first request is in flight and held by the target
+	select {
+	case <-held:
+	case <-time.After(10 * time.Second):
+		t.Fatal("first request never reached the target")
+	}
+
+	_, err := client.Client.SendRequest(&protocol.Request{ID: id, Method: "GET", URL: httpServer.URL + "/dup"})
+	if !errors.Is(err, agentpkg.ErrDuplicateID) {
+		t.Fatalf("expected duplicate ID to be rejected, got %v", err)
+	}
+	close(release)
+
+	select {
+	case res := <-first:
+		if res.err != nil {
+			t.Fatalf("first request failed: %v", res.err)
+		}
+		if string(res.resp.Body) != "first response" {
+			t.Errorf("expected the first request's own response, got %q", string(res.resp.Body))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("first request did not complete")
+	}
+}
+
+// TestAgentConnectOpen_DuplicateIDRejected tests that opening a tunnel with the ID of an open one is
+// rejected and leaves the open tunnel working
+func TestAgentConnectOpen_DuplicateIDRejected(t *testing.T) {
+	certs := GenerateTestCerts(t)
+	server := StartTestServer(t, certs)
+	defer server.Stop()
+
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+
+	httpServer := MockHTTPServer(t, nil)
+	defer httpServer.Close()
+	target := httpServer.Listener.Addr().String()
+
+	ack, err := client.Client.ConnectOpen("dup-tunnel", target)
+	if err != nil || !ack.Ok {
+		t.Fatalf("ConnectOpen failed: %v %+v", err, ack)
+	}
+	dataCh := client.Client.ConnectDataChannel("dup-tunnel")
+
+	if _, err := client.Client.ConnectOpen("dup-tunnel", target); !errors.Is(err, agentpkg.ErrDuplicateID) {
+		t.Fatalf("expected duplicate tunnel ID to be rejected, got %v", err)
+	}
+
+	request := "GET / HTTP/1.1\r\nHost: " + target + "\r\nConnection: close\r\n\r\n"
+	if err := client.Client.ConnectSend("dup-tunnel", []byte(request)); err != nil {
+		t.Fatalf("ConnectSend failed: %v", err)
+	}
+
+	var received bytes.Buffer
+	timeout := time.After(10 * time.Second)
+	for !bytes.Contains(received.Bytes(), []byte("200 OK")) {
+		select {
+		case data, ok := <-dataCh:
+			if !ok {
+				t.Fatalf("tunnel closed before response, got %q", received.String())
+			}
+			received.Write(data.Chunk)
+		case <-timeout:
+			t.Fatalf("no response through the original tunnel, got %q", received.String())
+		}
+	}
+	client.Client.ConnectClose("dup-tunnel", "")
+}
+
+// TestAgentStateNotifications tests that connection state changes reach a webhook and an external command,
+// and that a notifier overrunning its timeout does not hold up the tunnel
+func TestAgentStateNotifications(t *testing.T) {
+	t.Parallel()
+
+	waitEvent := func(t *testing.T, events <-chan agentpkg.StateEvent, state string) agentpkg.StateEvent {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event.State != state {
+				t.Fatalf("state = %q, want %q (event %+v)", event.State, state, event)
+			}
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s notification", state)
+		}
+		return agentpkg.StateEvent{}
+	}
+
+	t.Run("webhook on server disconnect", func(t *testing.T) {
+		t.Parallel()
+
+		events := make(chan agentpkg.StateEvent, 10)
+		webhook := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+			var event agentpkg.StateEvent
+			if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+				t.Errorf("decode state event: %v", err)
+			}
+			events <- event
+			w.WriteHeader(http.StatusNoContent)
+		})
+		defer webhook.Close()
+		notifier, err := agentpkg.NewWebhookNotifier(webhook.URL)
+		AssertNoError(t, err, "NewWebhookNotifier")
+
+		certs := GenerateTestCerts(t)
+		server := StartTestServer(t, certs)
+		defer server.Stop()
+
+		client := agentpkg.NewClientWithTestMode(certs.ClientTLS.Clone(), server.Addr, "error", true)
+		client.SetStateNotifier(notifier, time.Second)
+		AssertNoError(t, client.Connect(), "Connect should not fail")
+		defer client.Disconnect()
+
+		event := waitEvent(t, events, agentpkg.StateConnected)
+		AssertEqual(t, server.Addr, event.Server, "connected event server")
+
+		// Simulate losing the server
+		server.Stop()
+		event = waitEvent(t, events, agentpkg.StateDisconnected)
+		AssertEqual(t, server.Addr, event.Server, "disconnected event server")
+		if event.Detail == "" || event.Time.IsZero() {
+			t.Errorf("disconnected event lacks detail or time: %+v", event)
+		}
+	})
+
+	t.Run("command on agent disconnect", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("notify scripts need a POSIX shell")
+		}
+		t.Parallel()
+
+		dir := t.TempDir()
+		script := filepath.Join(dir, "notify.sh")
+		out := filepath.Join(dir, "states.log")
+		AssertNoError(t, os.WriteFile(script, []byte("#!/bin/sh\nprintf '%s ' \"$1\" >>"+out+"\ncat >>"+out+"\necho >>"+out+"\n"), 0o755), "write notify script")
+		notifier, err := agentpkg.NewCommandNotifier([]string{script})
+		AssertNoError(t, err, "NewCommandNotifier")
+
+		certs := GenerateTestCerts(t)
+		server := StartTestServer(t, certs)
+		defer server.Stop()
+
+		client := agentpkg.NewClientWithTestMode(certs.ClientTLS.Clone(), server.Addr, "error", true)
+		client.SetStateNotifier(notifier, 2*time.Second)
+		AssertNoError(t, client.Connect(), "Connect should not fail")
+		AssertNoError(t, client.Disconnect(), "Disconnect should not fail")
+		client.FlushStateNotifications(5 * time.Second)
+
+		data, err := os.ReadFile(out)
+		AssertNoError(t, err, "read notify output")
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("notify script ran %d times, want 2:\n%s", len(lines), data)
+		}
+		for i, state := range []string{agentpkg.StateConnected, agentpkg.StateDisconnected} {
+			arg, payload, _ := strings.Cut(lines[i], " ")
+			var event agentpkg.StateEvent
+			AssertNoError(t, json.Unmarshal([]byte(payload), &event), "decode state event from stdin")
+			if arg != state || event.State != state {
+				t.Errorf("notification %d: argument %q, event state %q, want %q", i, arg, event.State, state)
+			}
+		}
+	})
+
+	t.Run("slow notifier", func(t *testing.T) {
+		t.Parallel()
+
+		results := make(chan error, 10)
+		notifier := agentpkg.StateNotifierFunc(func(ctx context.Context, event *agentpkg.StateEvent) error {
+			<-ctx.Done()
+			results <- ctx.Err()
+			return ctx.Err()
+		})
+
+		certs := GenerateTestCerts(t)
+		server := StartTestServer(t, certs)
+		defer server.Stop()
+
+		client := agentpkg.NewClientWithTestMode(certs.ClientTLS.Clone(), server.Addr, "error", true)
+		client.SetStateNotifier(notifier, time.Second)
+		start := time.Now()
+		AssertNoError(t, client.Connect(), "Connect should not fail")
+		AssertNoError(t, client.Disconnect(), "Disconnect should not fail")
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("connect and disconnect took %v with a blocked notifier", elapsed)
+		}
+
+		// Both notifications are still delivered, one after the other, each cut off at the timeout
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-results:
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("notifier context ended with %v, want deadline exceeded", err)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatalf("notification %d was not delivered", i+1)
+			}
+		}
+	})
+}
@@ -1,12 +1,18 @@
 package tests
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	serverpkg "fluidity/internal/core/server"
+	"fluidity/internal/shared/circuitbreaker"
 	"fluidity/internal/shared/protocol"
 )
 
@@ -341,3 +347,113 @@ func TestCircuitBreakerStateTransitions(t *testing.T) {
 
 	t.Log("Circuit breaker state transitions completed successfully")
 }
+
+func TestCircuitBreakerOpenRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	certs := GenerateTestCerts(t)
+
+	// Connections to a closed port fail fast; only such network errors count towards the breaker
+	unreachableURL := fmt.Sprintf("http://127.0.0.1:%d", GetFreePort(t))
+
+	server := StartTestServer(t, certs)
+	defer server.Stop()
+
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+
+	// Trip the breaker (5 failures) concurrently rather than waiting out each request's retries
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.Client.SendRequest(&protocol.Request{
+				ID:      protocol.GenerateID(),
+				Method:  "GET",
+				URL:     unreachableURL,
+				Headers: map[string][]string{},
+			})
+		}()
+	}
+	wg.Wait()
+
+	proxyURL, _ := url.Parse(fmt.Sprintf("http://localhost:%d", client.ProxyPort))
+	httpClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	req, err := http.NewRequest("GET", unreachableURL, nil)
+	AssertNoError(t, err, "NewRequest should not fail")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := httpClient.Do(req)
+	AssertNoError(t, err, "Proxy request should not fail")
+	defer resp.Body.Close()
+
+	AssertEqual(t, http.StatusServiceUnavailable, resp.StatusCode, "status code")
+
+	// The default breaker reopens for a trial request 30 seconds after tripping
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	AssertNoError(t, err, "Retry-After should be a number of seconds")
+	if retryAfter < 1 || retryAfter > 30 {
+		t.Errorf("Retry-After = %d, want between 1 and 30 seconds", retryAfter)
+	}
+
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	AssertNoError(t, json.NewDecoder(resp.Body).Decode(&body), "error body should be JSON")
+	AssertEqual(t, "circuit_open", body.Error.Code, "error code")
+}
+
+func TestCircuitBreakerDomainOverride(t *testing.T) {
+	t.Parallel()
+
+	certs := GenerateTestCerts(t)
+
+	// Both names reach the same closed port, but only localhost has its own breaker
+	port := GetFreePort(t)
+	overriddenURL := fmt.Sprintf("http://localhost:%d", port)
+	defaultURL := fmt.Sprintf("http://127.0.0.1:%d", port)
+
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetCircuitBreakerOverrides(map[string]circuitbreaker.Config{
+			"localhost": {MaxFailures: 1, ResetTimeout: time.Minute},
+		})
+	})
+	defer server.Stop()
+
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+
+	circuitOpen := func(targetURL string) bool {
+		resp, err := client.Client.SendRequest(&protocol.Request{
+			ID:      protocol.GenerateID(),
+			Method:  "GET",
+			URL:     targetURL,
+			Headers: map[string][]string{},
+		})
+		AssertNoError(t, err, "SendRequest should not fail")
+		return resp.Error == "service temporarily unavailable (circuit open)"
+	}
+
+	// The overridden domain trips after its single allowed failure
+	if circuitOpen(overriddenURL) {
+		t.Fatal("overridden breaker open before any failure")
+	}
+	if !circuitOpen(overriddenURL) {
+		t.Fatal("expected the overridden breaker to trip after 1 failure")
+	}
+
+	// Other domains keep the default threshold of 5 failures, unaffected by the overridden domain
+	for i := 1; i <= 5; i++ {
+		if circuitOpen(defaultURL) {
+			t.Fatalf("default breaker open after %d failures, want 5", i-1)
+		}
+	}
+	if !circuitOpen(defaultURL) {
+		t.Fatal("expected the default breaker to trip after 5 failures")
+	}
+}
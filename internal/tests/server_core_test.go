@@ -1,14 +1,43 @@
 package tests
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
+
+	agentpkg "fluidity/internal/core/agent"
+	serverpkg "fluidity/internal/core/server"
+	sharedconfig "fluidity/internal/shared/config"
 	"fluidity/internal/shared/protocol"
+	"fluidity/internal/shared/version"
 )
 
 // ============================================================================
@@ -299,6 +328,143 @@ func TestServerForwardRequest_LargeRequestBody(t *testing.T) {
 	}
 }
 
+// TestServerForwardRequest_SpillToDisk tests that bodies over the spill threshold are streamed from a temp file
+func TestServerForwardRequest_SpillToDisk(t *testing.T) {
+	certs := GenerateTestCerts(t)
+	spillDir := t.TempDir()
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetBodySpill(1024*1024, spillDir)
+	})
+	defer server.Stop()
+
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+
+	// 3MB of non-repeating data so any corruption or truncation is detected
+	largeBody := make([]byte, 3*1024*1024)
+	for i := range largeBody {
+		largeBody[i] = byte(i * 7 % 251)
+	}
+
+	var receivedBody []byte
+	var spillFiles int
+	httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// The spill file exists while the upstream request is in flight
+		entries, _ := os.ReadDir(spillDir)
+		spillFiles = len(entries)
+		receivedBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name      string
+		body      []byte
+		wantSpill int
+	}{
+		{name: "below threshold", body: largeBody[:1024], wantSpill: 0},
+		{name: "above threshold", body: largeBody, wantSpill: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &protocol.Request{
+				ID:     protocol.GenerateID(),
+				Method: "POST",
+				URL:    httpServer.URL + "/upload",
+				Body:   tt.body,
+			}
+
+			resp, err := client.Client.SendRequest(req)
+			AssertNoError(t, err, "SendRequest should not fail")
+			AssertEqual(t, http.StatusOK, resp.StatusCode, "status code")
+
+			AssertEqual(t, tt.wantSpill, spillFiles, "spill files during upload")
+			if !bytes.Equal(tt.body, receivedBody) {
+				t.Errorf("upstream body differs from sent body (got %d bytes, want %d)", len(receivedBody), len(tt.body))
+			}
+
+			// Spill files are removed once the request completes
+			time.Sleep(50 * time.Millisecond)
+			entries, err := os.ReadDir(spillDir)
+			AssertNoError(t, err, "ReadDir should not fail")
+			AssertEqual(t, 0, len(entries), "spill files after upload")
+		})
+	}
+}
+
+// TestServerForwardRequest_SpillStreamedBody tests that a large body the agent streams is written to disk as
+// it arrives, so the server never holds it in memory whole, unlike one sent inside its request envelope
+func TestServerForwardRequest_SpillStreamedBody(t *testing.T) {
+	// 8MB of non-repeating data so any corruption or truncation is detected
+	largeBody := make([]byte, 8*1024*1024)
+	for i := range largeBody {
+		largeBody[i] = byte(i * 7 % 251)
+	}
+
+	tests := []struct {
+		name      string
+		threshold int64 // Agent stream threshold
+		streamed  bool
+	}{
+		{name: "streamed", threshold: 0, streamed: true},
+		{name: "enveloped", threshold: -1, streamed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certs := GenerateTestCerts(t)
+			spillDir := t.TempDir()
+			server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+				s.SetBodySpill(1024*1024, spillDir)
+				s.SetMemoryBudget(64 * 1024 * 1024)
+			})
+			defer server.Stop()
+
+			client := StartTestClientWith(t, server.Addr, certs, func(p *agentpkg.Server) {
+				p.SetStreamBodyThreshold(tt.threshold)
+			})
+			defer client.Stop()
+
+			var receivedBody []byte
+			var contentLength int64
+			var spillFiles int
+			httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+				entries, _ := os.ReadDir(spillDir)
+				spillFiles = len(entries)
+				contentLength = r.ContentLength
+				receivedBody, _ = io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusOK)
+			})
+
+			proxyURL, _ := url.Parse(fmt.Sprintf("http://localhost:%d", client.ProxyPort))
+			httpClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+			resp, err := httpClient.Post(httpServer.URL+"/upload", "application/octet-stream", bytes.NewReader(largeBody))
+			AssertNoError(t, err, "Proxy request should not fail")
+			resp.Body.Close()
+			AssertEqual(t, http.StatusOK, resp.StatusCode, "status code")
+
+			AssertEqual(t, 1, spillFiles, "spill files during upload")
+			AssertEqual(t, int64(len(largeBody)), contentLength, "upstream Content-Length")
+			if !bytes.Equal(largeBody, receivedBody) {
+				t.Errorf("upstream body differs from sent body (got %d bytes, want %d)", len(receivedBody), len(largeBody))
+			}
+
+			// A streamed body only ever has its credit window of chunks in memory
+			peak := server.Server.PeakInflightBytes()
+			if tt.streamed && peak >= int64(len(largeBody))/2 {
+				t.Errorf("streamed body peaked at %d bytes in flight, want under %d", peak, len(largeBody)/2)
+			}
+			if !tt.streamed && peak < int64(len(largeBody)) {
+				t.Errorf("enveloped body peaked at %d bytes in flight, want at least %d", peak, len(largeBody))
+			}
+
+			// The budget is released once the request completes
+			time.Sleep(50 * time.Millisecond)
+			AssertEqual(t, int64(0), server.Server.InflightBytes(), "bytes in flight after upload")
+		})
+	}
+}
+
 // TestServerForwardRequest_PreservesHeaders tests that headers are forwarded
 func TestServerForwardRequest_PreservesHeaders(t *testing.T) {
 	certs := GenerateTestCerts(t)
@@ -601,6 +767,370 @@ func TestServerConcurrentRequests_MultipleAgents(t *testing.T) {
 	}
 }
 
+// TestServerForwardRequest_Checksums tests request and response body checksum verification
+func TestServerForwardRequest_Checksums(t *testing.T) {
+	certs := GenerateTestCerts(t)
+	server := StartTestServer(t, certs)
+	defer server.Stop()
+
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+
+	var targetHit atomic.Bool
+	httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		targetHit.Store(true)
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	})
+
+	body := []byte("integrity-checked payload")
+
+	t.Run("matching checksum", func(t *testing.T) {
+		req := &protocol.Request{
+			ID:       protocol.GenerateID(),
+			Method:   "POST",
+			URL:      httpServer.URL + "/echo",
+			Body:     body,
+			Checksum: protocol.Checksum(body),
+		}
+
+		resp, err := client.Client.SendRequest(req)
+		AssertNoError(t, err, "SendRequest should not fail")
+		AssertEqual(t, http.StatusOK, resp.StatusCode, "status code")
+
+		if resp.Checksum == "" {
+			t.Fatal("expected response checksum when request carried one")
+		}
+		if err := protocol.VerifyChecksum(resp.Body, resp.Checksum); err != nil {
+			t.Errorf("response checksum should verify: %v", err)
+		}
+	})
+
+	t.Run("corrupted checksum", func(t *testing.T) {
+		targetHit.Store(false)
+		req := &protocol.Request{
+			ID:       protocol.GenerateID(),
+			Method:   "POST",
+			URL:      httpServer.URL + "/echo",
+			Body:     body,
+			Checksum: protocol.Checksum([]byte("something else")),
+		}
+
+		resp, err := client.Client.SendRequest(req)
+		AssertNoError(t, err, "SendRequest should not fail")
+		AssertEqual(t, http.StatusBadGateway, resp.StatusCode, "status code")
+
+		if !strings.Contains(resp.Error, "checksum mismatch") {
+			t.Errorf("expected checksum mismatch error, got %q", resp.Error)
+		}
+		if targetHit.Load() {
+			t.Error("request with corrupted checksum should not be forwarded")
+		}
+	})
+}
+
+// TestServerForwardRequest_AllowedMethods tests the server-side method allowlist and method validation
+func TestServerForwardRequest_AllowedMethods(t *testing.T) {
+	certs := GenerateTestCerts(t)
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetAllowedMethods([]string{"GET", "post"})
+	})
+	defer server.Stop()
+
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+
+	httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name       string
+		method     string
+		wantStatus int
+	}{
+		{name: "allowed", method: "GET", wantStatus: http.StatusOK},
+		{name: "allowed case-insensitive config", method: "POST", wantStatus: http.StatusOK},
+		{name: "disallowed", method: "TRACE", wantStatus: http.StatusMethodNotAllowed},
+		{name: "disallowed custom verb", method: "PURGE", wantStatus: http.StatusMethodNotAllowed},
+		{name: "malformed with space", method: "GET /admin", wantStatus: http.StatusBadRequest},
+		{name: "malformed with CRLF", method: "GET\r\nX-Smuggled: 1", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &protocol.Request{
+				ID:     protocol.GenerateID(),
+				Method: tt.method,
+				URL:    httpServer.URL + "/test",
+			}
+
+			resp, err := client.Client.SendRequest(req)
+			AssertNoError(t, err, "SendRequest should not fail")
+			AssertEqual(t, tt.wantStatus, resp.StatusCode, "status code")
+		})
+	}
+}
+
+// TestServerForwardRequest_Hook tests that the server's hook can rewrite request headers and response
+// bodies, and reject requests before they reach the upstream
+func TestServerForwardRequest_Hook(t *testing.T) {
+	certs := GenerateTestCerts(t)
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetHook(serverpkg.HookFunc(func(ctx context.Context, msg *serverpkg.HookMessage) (*serverpkg.HookVerdict, error) {
+			switch {
+			case msg.Phase == serverpkg.HookPhaseRequest && strings.HasSuffix(msg.URL, "/blocked"):
+				return &serverpkg.HookVerdict{Reject: true, Status: http.StatusUnavailableForLegalReasons, Reason: "blocked path"}, nil
+			case msg.Phase == serverpkg.HookPhaseRequest:
+				headers := map[string][]string{"X-Hooked": {"request"}}
+				for name, values := range msg.Headers {
+					headers[name] = values
+				}
+				return &serverpkg.HookVerdict{Headers: headers}, nil
+			case string(msg.Body) == "secret":
+				return &serverpkg.HookVerdict{Body: []byte("redacted")}, nil
+			}
+			return nil, nil
+		}), serverpkg.HookOptions{Bodies: true})
+	})
+	defer server.Stop()
+
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+
+	var hits atomic.Int32
+	var hooked atomic.Value
+	httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		hooked.Store(r.Header.Get("X-Hooked"))
+		w.Write([]byte("secret"))
+	})
+	defer httpServer.Close()
+
+	resp, err := client.Client.SendRequest(&protocol.Request{
+		ID:      protocol.GenerateID(),
+		Method:  "GET",
+		URL:     httpServer.URL + "/allowed",
+		Headers: map[string][]string{"X-Original": {"kept"}},
+	})
+	AssertNoError(t, err, "SendRequest should not fail")
+	AssertEqual(t, http.StatusOK, resp.StatusCode, "status code")
+	AssertEqual(t, "request", hooked.Load(), "header added by the hook")
+	AssertEqual(t, "redacted", string(resp.Body), "response body rewritten by the hook")
+	AssertEqual(t, "8", resp.Headers["Content-Length"][0], "content length of the rewritten body")
+
+	resp, err = client.Client.SendRequest(&protocol.Request{ID: protocol.GenerateID(), Method: "GET", URL: httpServer.URL + "/blocked"})
+	AssertNoError(t, err, "SendRequest should not fail")
+	AssertEqual(t, http.StatusUnavailableForLegalReasons, resp.StatusCode, "status of a rejected request")
+	AssertEqual(t, protocol.ErrCodeForbidden, resp.ErrorCode, "error code of a rejected request")
+	if !strings.Contains(string(resp.Body), "blocked path") {
+		t.Errorf("rejected response body %q does not give the hook's reason", resp.Body)
+	}
+	AssertEqual(t, int32(1), hits.Load(), "upstream requests (the rejected one never reaches it)")
+}
+
+// TestServerForwardRequest_CommandHook tests that an external hook program can reject requests, and that
+// a hook overrunning its timeout fails the request closed or lets it through when configured to fail open
+func TestServerForwardRequest_CommandHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook scripts need a POSIX shell")
+	}
+	t.Parallel()
+
+	dir := t.TempDir()
+	writeScript := func(name, body string) []string {
+		path := filepath.Join(dir, name)
+		AssertNoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0o755), "write hook script")
+		return []string{path}
+	}
+	reject := writeScript("reject.sh", `cat >/dev/null
+echo '{"reject":true,"reason":"denied by policy"}'
+`)
+	slow := writeScript("slow.sh", "exec sleep 5\n")
+
+	httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	defer httpServer.Close()
+
+	tests := []struct {
+		name       string
+		command    []string
+		failOpen   bool
+		wantStatus int
+	}{
+		{name: "reject", command: reject, wantStatus: http.StatusForbidden},
+		{name: "timeout fails closed", command: slow, wantStatus: http.StatusBadGateway},
+		{name: "timeout fails open", command: slow, failOpen: true, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook, err := serverpkg.NewCommandHook(tt.command)
+			AssertNoError(t, err, "NewCommandHook")
+
+			certs := GenerateTestCerts(t)
+			server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+				s.SetHook(hook, serverpkg.HookOptions{Timeout: 200 * time.Millisecond, FailOpen: tt.failOpen})
+			})
+			defer server.Stop()
+			client := StartTestClient(t, server.Addr, certs)
+			defer client.Stop()
+
+			start := time.Now()
+			resp, err := client.Client.SendRequest(&protocol.Request{ID: protocol.GenerateID(), Method: "GET", URL: httpServer.URL})
+			AssertNoError(t, err, "SendRequest should not fail")
+			AssertEqual(t, tt.wantStatus, resp.StatusCode, "status code")
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("request took %v, want the hook cut off at its timeout", elapsed)
+			}
+		})
+	}
+
+	if _, err := serverpkg.NewCommandHook([]string{filepath.Join(dir, "missing")}); err == nil {
+		t.Error("NewCommandHook accepted a program that does not exist")
+	}
+}
+
+// TestServerForwardRequest_AllowedSchemes tests that requests for schemes off the allow-list, such as
+// file and gopher, are refused with invalid_scheme, while http and https are forwarded by default
+func TestServerForwardRequest_AllowedSchemes(t *testing.T) {
+	certs := GenerateTestCerts(t)
+	server := StartTestServer(t, certs)
+	defer server.Stop()
+	restricted := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetAllowedSchemes([]string{"HTTPS"})
+	})
+	defer restricted.Stop()
+
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+	restrictedClient := StartTestClient(t, restricted.Addr, certs)
+	defer restrictedClient.Stop()
+
+	httpServer := MockHTTPServer(t, nil)
+	defer httpServer.Close()
+
+	// The upstream certificate is not trusted by the server, so a forwarded https request is seen as a
+	// connection reaching the upstream rather than a response from it
+	var tlsConns atomic.Int32
+	httpsServer := httptest.NewUnstartedServer(http.NotFoundHandler())
+	httpsServer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			tlsConns.Add(1)
+		}
+	}
+	httpsServer.Config.ErrorLog = log.New(io.Discard, "", 0)
+	httpsServer.StartTLS()
+	defer httpsServer.Close()
+
+	send := func(client *TestClient, url string) *protocol.Response {
+		resp, err := client.Client.SendRequest(&protocol.Request{ID: protocol.GenerateID(), Method: "GET", URL: url})
+		AssertNoError(t, err, "SendRequest should not fail")
+		return resp
+	}
+
+	for _, url := range []string{"file:///etc/passwd", "gopher://" + strings.TrimPrefix(httpServer.URL, "http://") + "/1"} {
+		resp := send(client, url)
+		AssertEqual(t, http.StatusBadRequest, resp.StatusCode, "status for "+url)
+		AssertEqual(t, protocol.ErrCodeInvalidScheme, resp.ErrorCode, "error code for "+url)
+	}
+
+	resp := send(client, httpServer.URL)
+	AssertEqual(t, http.StatusOK, resp.StatusCode, "status for http")
+
+	resp = send(client, httpsServer.URL)
+	if resp.ErrorCode == protocol.ErrCodeInvalidScheme {
+		t.Fatalf("https request was refused: %s", resp.Body)
+	}
+	if tlsConns.Load() == 0 {
+		t.Error("https request did not reach the upstream")
+	}
+
+	// A configured allow-list replaces the default one
+	resp = send(restrictedClient, httpServer.URL)
+	AssertEqual(t, http.StatusBadRequest, resp.StatusCode, "status for http off the allow-list")
+	AssertEqual(t, protocol.ErrCodeInvalidScheme, resp.ErrorCode, "error code for http off the allow-list")
+}
+
+// TestServerForwardRequest_AmbiguousFraming tests that framing headers a crafted agent request could use
+// for smuggling are removed by default and refused with 400 in strict mode, while clean requests pass
+func TestServerForwardRequest_AmbiguousFraming(t *testing.T) {
+	certs := GenerateTestCerts(t)
+	lenient := StartTestServer(t, certs)
+	defer lenient.Stop()
+	strict := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetStrictFraming(true)
+	})
+	defer strict.Stop()
+
+	lenientClient := StartTestClient(t, lenient.Addr, certs)
+	defer lenientClient.Stop()
+	strictClient := StartTestClient(t, strict.Addr, certs)
+	defer strictClient.Stop()
+
+	var hits atomic.Int32
+	var gotLength atomic.Int64
+	var gotBody atomic.Value
+	httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		gotLength.Store(r.ContentLength)
+		gotBody.Store(string(body))
+		w.WriteHeader(http.StatusOK)
+	})
+	defer httpServer.Close()
+
+	tests := []struct {
+		name       string
+		headers    map[string][]string
+		wantStrict int
+	}{
+		{name: "clean", headers: map[string][]string{"Content-Length": {"5"}}, wantStrict: http.StatusOK},
+		{name: "Content-Length with Transfer-Encoding", headers: map[string][]string{"Content-Length": {"3"}, "Transfer-Encoding": {"chunked"}}, wantStrict: http.StatusBadRequest},
+		{name: "duplicate Content-Length", headers: map[string][]string{"Content-Length": {"5", "44"}}, wantStrict: http.StatusBadRequest},
+		{name: "Content-Length in two spellings", headers: map[string][]string{"Content-Length": {"5"}, "content-length": {"5"}}, wantStrict: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			send := func(client *TestClient) *protocol.Response {
+				headers := make(map[string][]string, len(tt.headers))
+				for name, values := range tt.headers {
+					headers[name] = values
+				}
+				resp, err := client.Client.SendRequest(&protocol.Request{
+					ID:      protocol.GenerateID(),
+					Method:  "POST",
+					URL:     httpServer.URL + "/upload",
+					Headers: headers,
+					Body:    []byte("hello"),
+				})
+				AssertNoError(t, err, "SendRequest should not fail")
+				return resp
+			}
+
+			// By default the headers are dropped and the upstream receives the body's actual length
+			before := hits.Load()
+			resp := send(lenientClient)
+			AssertEqual(t, http.StatusOK, resp.StatusCode, "lenient status code")
+			AssertEqual(t, before+1, hits.Load(), "upstream requests")
+			AssertEqual(t, int64(5), gotLength.Load(), "upstream content length")
+			AssertEqual(t, "hello", gotBody.Load(), "upstream body")
+
+			before = hits.Load()
+			resp = send(strictClient)
+			AssertEqual(t, tt.wantStrict, resp.StatusCode, "strict status code")
+			if tt.wantStrict == http.StatusOK {
+				AssertEqual(t, before+1, hits.Load(), "upstream requests")
+				return
+			}
+			AssertEqual(t, protocol.ErrCodeBadRequest, resp.ErrorCode, "strict error code")
+			AssertEqual(t, before, hits.Load(), "upstream requests (a refused request never reaches it)")
+		})
+	}
+}
+
 // ============================================================================
 // SERVER ERROR HANDLING TESTS
 // ============================================================================
@@ -689,3 +1219,2217 @@ func TestServerHandleError_MissingMethod(t *testing.T) {
 		}
 	}
 }
+
+// ============================================================================
+// SERVER HEALTH ENDPOINT TESTS
+// ============================================================================
+
+// TestServerHealth_ConfigurablePort tests that the health server listens on the configured port
+func TestServerHealth_ConfigurablePort(t *testing.T) {
+	certs := GenerateTestCerts(t)
+	server := StartTestServer(t, certs)
+	defer server.Stop()
+
+	port := GetFreePort(t)
+	health, err := serverpkg.StartHealthServer(server.Server, port, true)
+	AssertNoError(t, err, "StartHealthServer should not fail")
+	if health == nil {
+		t.Fatal("expected health server to be started")
+	}
+	defer health.Shutdown(context.Background())
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/health", port))
+	AssertNoError(t, err, "Health request should not fail")
+	defer resp.Body.Close()
+
+	AssertEqual(t, http.StatusOK, resp.StatusCode, "health status code")
+
+	var status serverpkg.HealthStatus
+	AssertNoError(t, json.NewDecoder(resp.Body).Decode(&status), "Decode health response")
+	AssertEqual(t, "healthy", status.Status, "health status")
+}
+
+// TestServerHealth_Features tests that the features endpoint reports the hello capabilities and
+// reflects which optional features are configured
+func TestServerHealth_Features(t *testing.T) {
+	certs := GenerateTestCerts(t)
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetMaxConnectionsPerIP(3)
+		s.SetMaxStreamsPerAgent(10, 0)
+		s.SetRetryBudget(-1)
+	})
+	defer server.Stop()
+
+	port := GetFreePort(t)
+	health, err := serverpkg.StartHealthServer(server.Server, port, true)
+	AssertNoError(t, err, "StartHealthServer should not fail")
+	defer health.Shutdown(context.Background())
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/features", port))
+	AssertNoError(t, err, "Features request should not fail")
+	defer resp.Body.Close()
+	AssertEqual(t, http.StatusOK, resp.StatusCode, "features status code")
+
+	var report serverpkg.FeatureReport
+	AssertNoError(t, json.NewDecoder(resp.Body).Decode(&report), "Decode features response")
+
+	AssertEqual(t, protocol.ProtocolVersion, report.ProtocolVersion, "protocol version")
+	AssertEqual(t, strings.Join(protocol.FeatureNames(protocol.SupportedFeatures), ","), strings.Join(report.Capabilities, ","), "capabilities")
+
+	expected := map[string]bool{
+		"per_ip_connection_limit": true,
+		"per_agent_stream_limit":  true,
+		"retry_budget":            false,
+		"handshake_timeout":       true,
+		"iam_auth":                false,
+		"proxy_protocol":          false,
+		"load_shedding":           false,
+	}
+	for name, want := range expected {
+		got, ok := report.Features[name]
+		if !ok {
+			t.Errorf("feature %q missing from report", name)
+			continue
+		}
+		if got != want {
+			t.Errorf("feature %q = %v, want %v", name, got, want)
+		}
+	}
+}
+
+// TestServerHealth_Version tests that the version endpoint reports the build information stamped at link time
+func TestServerHealth_Version(t *testing.T) {
+	// Not parallel: stands in for the -ldflags values, restored before parallel tests run
+	saved := version.Get()
+	version.Version, version.Commit, version.BuildTime = "1.2.3", "abc1234", "2026-01-02T03:04:05Z"
+	defer func() {
+		version.Version, version.Commit, version.BuildTime = saved.Version, saved.Commit, saved.BuildTime
+	}()
+
+	certs := GenerateTestCerts(t)
+	server := StartTestServer(t, certs)
+	defer server.Stop()
+
+	port := GetFreePort(t)
+	health, err := serverpkg.StartHealthServer(server.Server, port, true)
+	AssertNoError(t, err, "StartHealthServer should not fail")
+	defer health.Shutdown(context.Background())
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/version", port))
+	AssertNoError(t, err, "Version request should not fail")
+	defer resp.Body.Close()
+	AssertEqual(t, http.StatusOK, resp.StatusCode, "version status code")
+
+	var info version.Info
+	AssertNoError(t, json.NewDecoder(resp.Body).Decode(&info), "Decode version response")
+	AssertEqual(t, "1.2.3", info.Version, "version")
+	AssertEqual(t, "abc1234", info.Commit, "commit")
+	AssertEqual(t, "2026-01-02T03:04:05Z", info.BuildTime, "build time")
+	AssertEqual(t, runtime.Version(), info.GoVersion, "Go version")
+
+	// The hello handshake carries the same build
+	hello := protocol.LocalHello()
+	AssertEqual(t, "1.2.3", hello.BuildVersion, "hello build version")
+	AssertEqual(t, "abc1234", hello.BuildCommit, "hello build commit")
+	AssertEqual(t, "2026-01-02T03:04:05Z", hello.BuildTime, "hello build time")
+}
+
+// TestServerHealth_Details tests that the health status reports open streams, the certificate's expiry and
+// the last significant error
+func TestServerHealth_Details(t *testing.T) {
+	t.Parallel()
+
+	certs := GenerateTestCerts(t)
+	server := StartTestServer(t, certs)
+	defer server.Stop()
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+
+	status := server.Server.GetHealth()
+	AssertEqual(t, "healthy", status.Status, "health status")
+	AssertEqual(t, "", status.LastError, "last error before any failure")
+	if !status.LastErrorAt.IsZero() {
+		t.Errorf("last error time = %v before any failure, want zero", status.LastErrorAt)
+	}
+	leaf, err := x509.ParseCertificate(certs.ServerTLS.Certificates[0].Certificate[0])
+	AssertNoError(t, err, "Parse server certificate")
+	if !status.CertValidUntil.Equal(leaf.NotAfter) {
+		t.Errorf("cert valid until %v, want %v", status.CertValidUntil, leaf.NotAfter)
+	}
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	AssertNoError(t, err, "Listen should not fail")
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ack, err := client.Client.ConnectOpen("health-tunnel", target.Addr().String())
+	AssertNoError(t, err, "ConnectOpen should not fail")
+	if !ack.Ok {
+		t.Fatalf("CONNECT was refused: %s", ack.Error)
+	}
+	AssertEqual(t, serverpkg.StreamCounts{Connect: 1}, server.Server.GetHealth().ActiveStreams, "active streams")
+
+	// A dial to a closed port is recorded as the last error
+	closed := fmt.Sprintf("127.0.0.1:%d", GetFreePort(t))
+	before := time.Now()
+	go client.Client.ConnectOpen("health-closed", closed) // A failed dial is answered with connect_close only
+	deadline := time.Now().Add(2 * time.Second)
+	for status = server.Server.GetHealth(); status.LastError == ""; status = server.Server.GetHealth() {
+		if time.Now().After(deadline) {
+			t.Fatal("failed CONNECT dial was not recorded")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !strings.HasPrefix(status.LastError, "CONNECT dial failed") {
+		t.Errorf("last error = %q, want the CONNECT dial failure", status.LastError)
+	}
+	if status.LastErrorAt.Before(before) {
+		t.Errorf("last error time %v is before the failure at %v", status.LastErrorAt, before)
+	}
+
+	client.Client.ConnectClose("health-tunnel", "")
+	deadline = time.Now().Add(2 * time.Second)
+	for server.Server.GetHealth().ActiveStreams.Connect != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed CONNECT tunnel is still counted")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestServerHealth_Disabled tests that a zero health port disables the health server
+func TestServerHealth_Disabled(t *testing.T) {
+	certs := GenerateTestCerts(t)
+	server := StartTestServer(t, certs)
+	defer server.Stop()
+
+	health, err := serverpkg.StartHealthServer(server.Server, 0, true)
+	AssertNoError(t, err, "StartHealthServer should not fail when disabled")
+	if health != nil {
+		t.Error("expected no health server when port is 0")
+	}
+}
+
+// TestServerHealth_PortInUse tests that a health port conflict does not stop the tunnel server
+func TestServerHealth_PortInUse(t *testing.T) {
+	certs := GenerateTestCerts(t)
+	server := StartTestServer(t, certs)
+	defer server.Stop()
+
+	// Occupy the health port
+	blocker, err := net.Listen("tcp", ":0")
+	AssertNoError(t, err, "Listen should not fail")
+	defer blocker.Close()
+	port := blocker.Addr().(*net.TCPAddr).Port
+
+	t.Run("optional", func(t *testing.T) {
+		health, err := serverpkg.StartHealthServer(server.Server, port, false)
+		AssertNoError(t, err, "bind conflict should not be fatal when health is optional")
+		if health != nil {
+			t.Error("expected health server to be disabled after bind conflict")
+		}
+
+		// The tunnel must keep serving requests
+		client := StartTestClient(t, server.Addr, certs)
+		defer client.Stop()
+
+		httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+
+		resp, err := client.Client.SendRequest(&protocol.Request{
+			ID:     protocol.GenerateID(),
+			Method: "GET",
+			URL:    httpServer.URL,
+		})
+		AssertNoError(t, err, "SendRequest should not fail")
+		AssertEqual(t, http.StatusOK, resp.StatusCode, "status code")
+	})
+
+	t.Run("required", func(t *testing.T) {
+		_, err := serverpkg.StartHealthServer(server.Server, port, true)
+		AssertError(t, err, "bind conflict should fail when health is required")
+	})
+}
+
+// TestServerForwardResponse_NotModified tests that a 304 is relayed with validators and no body
+func TestServerForwardResponse_NotModified(t *testing.T) {
+	certs := GenerateTestCerts(t)
+	server := StartTestServer(t, certs)
+	defer server.Stop()
+
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+
+	const etag = `"abc"`
+
+	httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("full body"))
+	})
+
+	req := &protocol.Request{
+		ID:      protocol.GenerateID(),
+		Method:  "GET",
+		URL:     httpServer.URL,
+		Headers: map[string][]string{"If-None-Match": {etag}},
+	}
+
+	resp, err := client.Client.SendRequest(req)
+	AssertNoError(t, err, "SendRequest should not fail")
+
+	AssertEqual(t, http.StatusNotModified, resp.StatusCode, "status code")
+	AssertEqual(t, 0, len(resp.Body), "body length")
+	if got := resp.Headers["Etag"]; len(got) != 1 || got[0] != etag {
+		t.Errorf("expected ETag %s, got %v", etag, got)
+	}
+}
+
+// ============================================================================
+// SLOW REQUEST LOGGING TESTS
+// ============================================================================
+
+// logBuffer is a goroutine-safe log sink
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestServerSlowRequestLogging tests that only requests above the threshold are logged as slow
+func TestServerSlowRequestLogging(t *testing.T) {
+	certs := GenerateTestCerts(t)
+	logs := &logBuffer{}
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetSlowRequestThreshold(200 * time.Millisecond)
+		s.Logger().SetLevel("warn")
+		s.Logger().Logger.SetOutput(logs)
+	})
+	defer server.Stop()
+
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+
+	httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(400 * time.Millisecond)
+		}
+		w.Write([]byte("ok"))
+	})
+
+	send := func(path string) string {
+		req := &protocol.Request{
+			ID:     protocol.GenerateID(),
+			Method: "GET",
+			URL:    httpServer.URL + path,
+		}
+		resp, err := client.Client.SendRequest(req)
+		AssertNoError(t, err, "SendRequest should not fail")
+		AssertEqual(t, http.StatusOK, resp.StatusCode, "status code")
+		return req.ID
+	}
+
+	fastID := send("/fast")
+	slowID := send("/slow")
+
+	output := logs.String()
+	if !strings.Contains(output, "Slow request") || !strings.Contains(output, slowID) {
+		t.Errorf("expected slow request warning for %s, got logs:\n%s", slowID, output)
+	}
+	if strings.Contains(output, fastID) {
+		t.Errorf("fast request %s should not be logged as slow, got logs:\n%s", fastID, output)
+	}
+}
+
+// ============================================================================
+// WORKER POOL TESTS
+// ============================================================================
+
+// TestServerWorkerPool_QueueFull tests that requests beyond the pool's queue are rejected with 503
+func TestServerWorkerPool_QueueFull(t *testing.T) {
+	certs := GenerateTestCerts(t)
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetWorkerPool(1, 1)
+	})
+	defer server.Stop()
+
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("ok"))
+	})
+
+	type result struct {
+		resp *protocol.Response
+		err  error
+	}
+	send := func() <-chan result {
+		ch := make(chan result, 1)
+		go func() {
+			resp, err := client.Client.SendRequest(&protocol.Request{
+				ID:     protocol.GenerateID(),
+				Method: "GET",
+				URL:    httpServer.URL,
+			})
+			ch <- result{resp, err}
+		}()
+		return ch
+	}
+
+	// The first request occupies the only worker, the second waits in the queue
+	first := send()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first request did not reach the upstream")
+	}
+	second := send()
+	time.Sleep(200 * time.Millisecond)
+
+	// The third request finds the queue full
+	rejected := <-send()
+	AssertNoError(t, rejected.err, "SendRequest should not fail")
+	AssertEqual(t, http.StatusServiceUnavailable, rejected.resp.StatusCode, "status code when queue is full")
+
+	close(release)
+	for i, ch := range []<-chan result{first, second} {
+		r := <-ch
+		AssertNoError(t, r.err, "SendRequest should not fail")
+		AssertEqual(t, http.StatusOK, r.resp.StatusCode, fmt.Sprintf("status code of queued request %d", i+1))
+	}
+}
+
+// TestServerLoadShedding tests that requests arriving while the server is over its load threshold are
+// shed with 503 while requests already in flight complete
+func TestServerLoadShedding(t *testing.T) {
+	const admitted = 3
+
+	certs := GenerateTestCerts(t)
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		load, err := s.LoadSignal(serverpkg.LoadSignalActiveRequests)
+		AssertNoError(t, err, "LoadSignal should not fail")
+		s.SetLoadShedding(load, admitted-1, 1)
+	})
+	defer server.Stop()
+
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+
+	started := make(chan struct{}, admitted)
+	release := make(chan struct{})
+	httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("ok"))
+	})
+
+	type result struct {
+		resp *protocol.Response
+		err  error
+	}
+	send := func() <-chan result {
+		ch := make(chan result, 1)
+		go func() {
+			resp, err := client.Client.SendRequest(&protocol.Request{
+				ID:     protocol.GenerateID(),
+				Method: "GET",
+				URL:    httpServer.URL,
+			})
+			ch <- result{resp, err}
+		}()
+		return ch
+	}
+
+	// Fill the server up to the threshold with requests that stay in flight
+	var inFlight []<-chan result
+	for i := 0; i < admitted; i++ {
+		inFlight = append(inFlight, send())
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("request %d did not reach the upstream", i+1)
+		}
+	}
+
+	// Everything arriving now is over the threshold
+	for i := 0; i < 5; i++ {
+		r := <-send()
+		AssertNoError(t, r.err, "SendRequest should not fail")
+		AssertEqual(t, http.StatusServiceUnavailable, r.resp.StatusCode, "status code of shed request")
+		AssertEqual(t, protocol.ErrCodeLoadShed, r.resp.ErrorCode, "error code of shed request")
+		AssertEqual(t, "1", http.Header(r.resp.Headers).Get("Retry-After"), "Retry-After of shed request")
+	}
+
+	close(release)
+	for i, ch := range inFlight {
+		r := <-ch
+		AssertNoError(t, r.err, "SendRequest should not fail")
+		AssertEqual(t, http.StatusOK, r.resp.StatusCode, fmt.Sprintf("status code of in-flight request %d", i+1))
+	}
+
+	// Once load drops, requests are accepted again
+	go func() { <-started }()
+	r := <-send()
+	AssertNoError(t, r.err, "SendRequest should not fail")
+	AssertEqual(t, http.StatusOK, r.resp.StatusCode, "status code after load drops")
+}
+
+// BenchmarkServerRequestBurst compares goroutine-per-request dispatch with the worker pool under a burst
+func BenchmarkServerRequestBurst(b *testing.B) {
+	const burst = 10000
+
+	modes := []struct {
+		name    string
+		workers int
+	}{
+		{"goroutine-per-request", 0},
+		{"worker-pool", 64},
+	}
+
+	for _, mode := range modes {
+		b.Run(mode.name, func(b *testing.B) {
+			certs := GenerateTestCerts(b)
+			server := StartTestServerWith(b, certs, func(s *serverpkg.Server) {
+				s.SetWorkerPool(mode.workers, burst)
+			})
+			defer server.Stop()
+
+			client := StartTestClient(b, server.Addr, certs)
+			defer client.Stop()
+
+			httpServer := MockHTTPServer(b, func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			})
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				var failed atomic.Int64
+				for j := 0; j < burst; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						resp, err := client.Client.SendRequest(&protocol.Request{
+							ID:     protocol.GenerateID(),
+							Method: "GET",
+							URL:    httpServer.URL,
+						})
+						if err != nil || resp.StatusCode != http.StatusOK {
+							failed.Add(1)
+						}
+					}()
+				}
+				wg.Wait()
+				b.ReportMetric(float64(failed.Load()), "failed/burst")
+			}
+		})
+	}
+}
+
+// ============================================================================
+// PROXY PROTOCOL TESTS
+// ============================================================================
+
+// proxyV2Header builds a PROXY protocol v2 header for a TCP source address
+func proxyV2Header(src, dst *net.TCPAddr) []byte {
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	var addrs []byte
+	if ip4 := src.IP.To4(); ip4 != nil {
+		header = append(header, 0x21, 0x11)
+		addrs = append(append(addrs, ip4...), dst.IP.To4()...)
+	} else {
+		header = append(header, 0x21, 0x21)
+		addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(dst.Port))
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+// TestServerProxyProtocol tests that the client address is taken from PROXY protocol headers
+func TestServerProxyProtocol(t *testing.T) {
+	certs := GenerateTestCerts(t)
+	logs := &logBuffer{}
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetProxyProtocol(true)
+		s.Logger().SetLevel("info")
+		s.Logger().Logger.SetOutput(logs)
+	})
+	defer server.Stop()
+
+	clientTLS := certs.ClientTLS.Clone()
+	clientTLS.ServerName = "localhost"
+
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8443}
+	tests := []struct {
+		name     string
+		header   []byte
+		wantIP   string
+		wantPort int
+	}{
+		{
+			name:     "v1 tcp4",
+			header:   []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 8443\r\n"),
+			wantIP:   "203.0.113.7",
+			wantPort: 51234,
+		},
+		{
+			name:     "v1 tcp6",
+			header:   []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51235 8443\r\n"),
+			wantIP:   "2001:db8::7",
+			wantPort: 51235,
+		},
+		{
+			name:     "v2 tcp4",
+			header:   proxyV2Header(&net.TCPAddr{IP: net.ParseIP("198.51.100.9"), Port: 40000}, dst),
+			wantIP:   "198.51.100.9",
+			wantPort: 40000,
+		},
+		{
+			name: "v2 tcp6",
+			header: proxyV2Header(&net.TCPAddr{IP: net.ParseIP("2001:db8::9"), Port: 40001},
+				&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 8443}),
+			wantIP:   "2001:db8::9",
+			wantPort: 40001,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", server.Addr)
+			AssertNoError(t, err, "Dial should not fail")
+			defer conn.Close()
+
+			_, err = conn.Write(tt.header)
+			AssertNoError(t, err, "Write PROXY header should not fail")
+
+			tlsConn := tls.Client(conn, clientTLS)
+			tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+			AssertNoError(t, tlsConn.Handshake(), "TLS handshake after PROXY header should succeed")
+
+			want := fmt.Sprintf(`"remote_addr":{"IP":%q,"Port":%d`, tt.wantIP, tt.wantPort)
+			deadline := time.Now().Add(2 * time.Second)
+			for !strings.Contains(logs.String(), want) {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected server to report remote address %s:%d, got logs:\n%s", tt.wantIP, tt.wantPort, logs.String())
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		})
+	}
+
+	t.Run("missing header", func(t *testing.T) {
+		conn, err := net.Dial("tcp", server.Addr)
+		AssertNoError(t, err, "Dial should not fail")
+		defer conn.Close()
+
+		tlsConn := tls.Client(conn, clientTLS)
+		tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+		AssertError(t, tlsConn.Handshake(), "TLS handshake without PROXY header should fail")
+	})
+}
+
+// TestServerMaxConnectionsPerIP tests that one source IP cannot exceed its connection limit while
+// other sources still connect, both directly and behind a PROXY protocol load balancer
+func TestServerMaxConnectionsPerIP(t *testing.T) {
+	const limit = 2
+
+	certs := GenerateTestCerts(t)
+	clientTLS := certs.ClientTLS.Clone()
+	clientTLS.ServerName = "localhost"
+
+	// open connects from localIP, optionally sending a PROXY header for proxyIP, and completes the
+	// hello exchange; it fails when the server refuses the connection
+	open := func(addr, localIP, proxyIP string) (net.Conn, error) {
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(localIP)}}
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if proxyIP != "" {
+			fmt.Fprintf(conn, "PROXY TCP4 %s 10.0.0.1 51234 8443\r\n", proxyIP)
+		}
+		tlsConn := tls.Client(conn, clientTLS)
+		tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := json.NewEncoder(tlsConn).Encode(protocol.Envelope{Type: "hello", Payload: protocol.LocalHello()}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		var env protocol.Envelope
+		if err := json.NewDecoder(tlsConn).Decode(&env); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+
+	tests := []struct {
+		name          string
+		proxyProtocol bool
+		source        func(i int) (localIP, proxyIP string)
+		other         func() (localIP, proxyIP string)
+	}{
+		{
+			name:   "direct",
+			source: func(int) (string, string) { return "127.0.0.1", "" },
+			other:  func() (string, string) { return "127.0.0.2", "" },
+		},
+		{
+			// Every connection arrives from the load balancer; only the PROXY header differs
+			name:          "proxy protocol",
+			proxyProtocol: true,
+			source:        func(int) (string, string) { return "127.0.0.1", "203.0.113.7" },
+			other:         func() (string, string) { return "127.0.0.1", "198.51.100.9" },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+				s.SetMaxConnectionsPerIP(limit)
+				s.SetProxyProtocol(tt.proxyProtocol)
+			})
+			defer server.Stop()
+
+			var conns []net.Conn
+			for i := 0; i < limit; i++ {
+				localIP, proxyIP := tt.source(i)
+				conn, err := open(server.Addr, localIP, proxyIP)
+				AssertNoError(t, err, "connection within the per-IP limit should be accepted")
+				conns = append(conns, conn)
+			}
+
+			localIP, proxyIP := tt.source(limit)
+			if conn, err := open(server.Addr, localIP, proxyIP); err == nil {
+				conn.Close()
+				t.Fatal("connection over the per-IP limit should be refused")
+			}
+
+			localIP, proxyIP = tt.other()
+			other, err := open(server.Addr, localIP, proxyIP)
+			AssertNoError(t, err, "connection from another IP should be accepted")
+			other.Close()
+
+			// Closing a connection frees its slot
+			conns[0].Close()
+			localIP, proxyIP = tt.source(0)
+			deadline := time.Now().Add(2 * time.Second)
+			for {
+				conn, err := open(server.Addr, localIP, proxyIP)
+				if err == nil {
+					conns[0] = conn
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("slot was not released after disconnect: %v", err)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			for _, conn := range conns {
+				conn.Close()
+			}
+		})
+	}
+}
+
+// ============================================================================
+// CONNECTION LIFECYCLE EVENT TESTS
+// ============================================================================
+
+// TestServerConnectionEvents tests that a connect, request and disconnect produce ordered lifecycle events
+func TestServerConnectionEvents(t *testing.T) {
+	certs := GenerateTestCerts(t)
+	var mu sync.Mutex
+	var events []serverpkg.ConnectionEvent
+	logs := &logBuffer{}
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.Logger().SetLevel("info")
+		s.Logger().Logger.SetOutput(logs)
+		s.SetEventHandler(func(ev serverpkg.ConnectionEvent) {
+			mu.Lock()
+			events = append(events, ev)
+			mu.Unlock()
+		})
+	})
+	defer server.Stop()
+
+	httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	client := StartTestClient(t, server.Addr, certs)
+	for i := 0; i < 2; i++ {
+		resp, err := client.Client.SendRequest(&protocol.Request{ID: protocol.GenerateID(), Method: "GET", URL: httpServer.URL})
+		AssertNoError(t, err, "SendRequest should not fail")
+		AssertEqual(t, http.StatusOK, resp.StatusCode, "status code")
+	}
+	client.Stop()
+
+	// The disconnect is seen once the server reads the closed connection
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(events)
+		mu.Unlock()
+		if n >= 4 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var names []string
+	for _, ev := range events {
+		names = append(names, ev.Event)
+	}
+	want := []string{
+		serverpkg.EventConnectionAccepted,
+		serverpkg.EventAuthSucceeded,
+		serverpkg.EventFirstRequest,
+		serverpkg.EventDisconnected,
+	}
+	AssertEqual(t, strings.Join(want, ","), strings.Join(names, ","), "event sequence")
+	if len(events) != len(want) {
+		return
+	}
+
+	AssertEqual(t, serverpkg.AuthMethodMTLS, events[1].Method, "auth method")
+	AssertEqual(t, "test-client", events[1].Client, "authenticated client")
+	disconnected := events[3]
+	AssertEqual(t, serverpkg.DisconnectAgentClosed, disconnected.Reason, "disconnect reason")
+	AssertEqual(t, int64(2), disconnected.Requests, "requests")
+	if disconnected.BytesIn == 0 || disconnected.BytesOut == 0 {
+		t.Errorf("expected tunnel bytes in both directions, got in=%d out=%d", disconnected.BytesIn, disconnected.BytesOut)
+	}
+	if disconnected.Elapsed < events[2].Elapsed {
+		t.Errorf("session duration %v is shorter than time to first request %v", disconnected.Elapsed, events[2].Elapsed)
+	}
+	for _, ev := range events {
+		if ev.RemoteAddr == "" {
+			t.Errorf("%s event has no remote address", ev.Event)
+		}
+	}
+
+	if !strings.Contains(logs.String(), `"event":"disconnected"`) {
+		t.Errorf("expected the disconnect event in the logs, got:\n%s", logs.String())
+	}
+}
+
+func TestServerPrewarmUpstreamPool(t *testing.T) {
+	t.Parallel()
+
+	var newConns, heads atomic.Int32
+	idle := make(chan struct{}, 10)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+		}
+		w.Write([]byte("warm"))
+	}))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			newConns.Add(1)
+		case http.StateIdle:
+			select {
+			case idle <- struct{}{}:
+			default:
+			}
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	certs := GenerateTestCerts(t)
+	testServer := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetPrewarmHosts([]string{upstream.URL}, -1)
+	})
+	defer testServer.Stop()
+
+	// The prewarm request leaves its connection idle in the pool before any agent request
+	select {
+	case <-idle:
+	case <-time.After(5 * time.Second):
+		t.Fatal("prewarmed connection never went idle")
+	}
+	AssertEqual(t, int32(1), heads.Load(), "Prewarm requests")
+	AssertEqual(t, int32(1), newConns.Load(), "Upstream connections after prewarm")
+
+	client := StartTestClient(t, testServer.Addr, certs)
+	defer client.Stop()
+
+	resp, err := client.Client.SendRequest(&protocol.Request{
+		ID:      "prewarmed-req",
+		Method:  "GET",
+		URL:     upstream.URL,
+		Headers: map[string][]string{},
+		Body:    []byte{},
+	})
+	AssertNoError(t, err, "Request should not fail")
+	AssertEqual(t, 200, resp.StatusCode, "HTTP status code")
+	AssertEqual(t, "warm", string(resp.Body), "Response body")
+
+	// The first real request reused the pooled connection instead of dialling
+	AssertEqual(t, int32(1), newConns.Load(), "Upstream connections after first request")
+}
+
+// TestServerHandshakeTimeout tests that a connection which stalls before completing the TLS handshake is closed
+// within the handshake timeout, freeing its connection slot
+func TestServerHandshakeTimeout(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		proxyProtocol bool
+		prefix        string // Sent before stalling
+	}{
+		{"no ClientHello", false, ""},
+		// The PROXY header is read inside the handshake, which must keep its deadline once the header is read
+		{"PROXY header then stall", true, "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			certs := GenerateTestCerts(t)
+			server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+				s.SetHandshakeTimeout(500 * time.Millisecond)
+				s.SetProxyProtocol(tt.proxyProtocol)
+			})
+			defer server.Stop()
+
+			// Complete the TCP connect but never send a ClientHello
+			conn, err := net.Dial("tcp", server.Addr)
+			AssertNoError(t, err, "Dial should not fail")
+			defer conn.Close()
+			if tt.prefix != "" {
+				_, err = conn.Write([]byte(tt.prefix))
+				AssertNoError(t, err, "Write should not fail")
+			}
+
+			deadline := time.Now().Add(2 * time.Second)
+			for server.Server.GetHealth().ActiveConnections != 1 {
+				if time.Now().After(deadline) {
+					t.Fatal("stalled connection was never counted as active")
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+
+			start := time.Now()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err = conn.Read(make([]byte, 1))
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Fatal("server did not close the stalled handshake")
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("stalled handshake closed after %v, want about 500ms", elapsed)
+			}
+
+			deadline = time.Now().Add(2 * time.Second)
+			for server.Server.GetHealth().ActiveConnections != 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("connection slot was not freed after the handshake timeout")
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		})
+	}
+}
+
+// TestServerClientKeyPolicy tests that client certificates with keys below the configured minimum are
+// rejected even though the CA signed them, while strong keys are accepted
+func TestServerClientKeyPolicy(t *testing.T) {
+	t.Parallel()
+
+	certs := GenerateTestCerts(t)
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetClientKeyPolicy(serverpkg.ClientKeyPolicy{MinRSABits: 2048, MinECDSABits: 256})
+	})
+	defer server.Stop()
+
+	rsa1024, err := rsa.GenerateKey(rand.Reader, 1024)
+	AssertNoError(t, err, "Generate RSA-1024 key")
+	rsa2048, err := rsa.GenerateKey(rand.Reader, 2048)
+	AssertNoError(t, err, "Generate RSA-2048 key")
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	AssertNoError(t, err, "Generate ECDSA P-256 key")
+
+	tests := []struct {
+		name   string
+		key    crypto.Signer
+		accept bool
+	}{
+		{name: "rsa-1024", key: rsa1024, accept: false},
+		{name: "rsa-2048", key: rsa2048, accept: true},
+		{name: "ecdsa-p256", key: p256, accept: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientTLS := certs.ClientTLS.Clone()
+			clientTLS.ServerName = "localhost"
+			clientTLS.Certificates = []tls.Certificate{IssueClientCert(t, certs, tt.key)}
+
+			conn, err := tls.Dial("tcp", server.Addr, clientTLS)
+			AssertNoError(t, err, "TLS dial should not fail")
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// The server answers the hello only when it kept the connection
+			err = json.NewEncoder(conn).Encode(protocol.Envelope{Type: "hello", Payload: protocol.LocalHello()})
+			if err == nil {
+				var env protocol.Envelope
+				err = json.NewDecoder(conn).Decode(&env)
+			}
+			if tt.accept {
+				AssertNoError(t, err, "hello exchange with an accepted key")
+			} else {
+				AssertError(t, err, "connection with a weak key should be closed")
+			}
+		})
+	}
+}
+
+// TestServerCertValidationStats tests that rejected client certificates are counted by reason and accepted
+// ones as successes
+func TestServerCertValidationStats(t *testing.T) {
+	t.Parallel()
+
+	certs := GenerateTestCerts(t)
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetClientKeyPolicy(serverpkg.ClientKeyPolicy{MinRSABits: 2048})
+	})
+	defer server.Stop()
+
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	AssertNoError(t, err, "Generate ECDSA P-256 key")
+	rsa1024, err := rsa.GenerateKey(rand.Reader, 1024)
+	AssertNoError(t, err, "Generate RSA-1024 key")
+	otherCA := GenerateTestCerts(t)
+
+	tests := []struct {
+		name   string
+		cert   tls.Certificate
+		reason string
+	}{
+		{name: "untrusted-ca", cert: otherCA.ClientTLS.Certificates[0], reason: serverpkg.CertFailureUntrustedCA},
+		{name: "expired", cert: IssueClientCertUntil(t, certs, p256, time.Now().Add(-time.Minute)), reason: serverpkg.CertFailureExpired},
+		{name: "key-policy", cert: IssueClientCert(t, certs, rsa1024), reason: serverpkg.CertFailureKeyPolicy},
+		{name: "valid", cert: IssueClientCert(t, certs, p256)},
+	}
+
+	for _, tt := range tests {
+		clientTLS := certs.ClientTLS.Clone()
+		clientTLS.ServerName = "localhost"
+		clientTLS.Certificates = []tls.Certificate{tt.cert}
+
+		// With TLS 1.3 the client may finish its side of the handshake before the server rejects it
+		conn, err := tls.Dial("tcp", server.Addr, clientTLS)
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			json.NewEncoder(conn).Encode(protocol.Envelope{Type: "hello", Payload: protocol.LocalHello()})
+			var env protocol.Envelope
+			json.NewDecoder(conn).Decode(&env)
+			conn.Close()
+		}
+	}
+
+	want := map[string]int64{}
+	for _, tt := range tests {
+		if tt.reason != "" {
+			want[tt.reason]++
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	var stats serverpkg.CertValidationStats
+	for {
+		stats = server.Server.CertValidationStats()
+		if stats.Successes == 1 && len(stats.Failures) == len(want) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if stats.Successes != 1 {
+		t.Errorf("successes = %d, want 1", stats.Successes)
+	}
+	for reason, count := range want {
+		if stats.Failures[reason] != count {
+			t.Errorf("failures[%s] = %d, want %d (all failures: %v)", reason, stats.Failures[reason], count, stats.Failures)
+		}
+	}
+	if len(stats.Failures) != len(want) {
+		t.Errorf("failures = %v, want %v", stats.Failures, want)
+	}
+	if health := server.Server.GetHealth(); health.CertValidation.Successes != stats.Successes {
+		t.Errorf("health cert_validation successes = %d, want %d", health.CertValidation.Successes, stats.Successes)
+	}
+}
+
+// TestServerCertExpiryAdvisory tests that an agent connecting with a client certificate close to expiry is
+// kept but sent a cert_expiring advisory, while agents with longer-lived certificates are not
+func TestServerCertExpiryAdvisory(t *testing.T) {
+	t.Parallel()
+
+	certs := GenerateTestCerts(t)
+	server := StartTestServer(t, certs)
+	defer server.Stop()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	AssertNoError(t, err, "Generate client key")
+	notAfter := time.Now().Add(5 * time.Minute).Truncate(time.Second)
+	clientTLS := certs.ClientTLS.Clone()
+	clientTLS.Certificates = []tls.Certificate{IssueClientCertUntil(t, certs, key, notAfter)}
+
+	expiring := agentpkg.NewClientWithTestMode(clientTLS, server.Addr, "error", true)
+	AssertNoError(t, expiring.Connect(), "Connect with a near-expiry certificate should not fail")
+	defer expiring.Disconnect()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for expiring.CertExpiring() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("agent did not receive a cert_expiring advisory")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	notice := expiring.CertExpiring()
+	if !notice.NotAfter.Equal(notAfter) {
+		t.Errorf("advisory not_after = %v, want %v", notice.NotAfter, notAfter)
+	}
+	if remaining := time.Duration(notice.RemainingMs) * time.Millisecond; remaining <= 0 || remaining > 5*time.Minute {
+		t.Errorf("advisory remaining = %v, want up to 5m", remaining)
+	}
+	if !expiring.IsConnected() {
+		t.Error("agent with a near-expiry certificate was disconnected")
+	}
+
+	// The 24 hour certificate is well outside the default threshold
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+	time.Sleep(200 * time.Millisecond)
+	if notice := client.Client.CertExpiring(); notice != nil {
+		t.Errorf("agent with a long-lived certificate was advised of expiry at %v", notice.NotAfter)
+	}
+}
+
+// TestServerListenOptions tests that a restarted server can rebind its port straight after the previous one
+// closed an agent connection, and that SO_REUSEPORT lets two servers share a port
+func TestServerListenOptions(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" && runtime.GOOS != "freebsd" {
+		t.Skip("listen socket options are not supported on " + runtime.GOOS)
+	}
+
+	certs := GenerateTestCerts(t)
+	start := func(addr string, opts serverpkg.ListenOptions) *serverpkg.Server {
+		t.Helper()
+		srv, err := serverpkg.NewServerWithListenOptions(certs.ServerTLS, addr, 10, "error", opts)
+		AssertNoError(t, err, "Create server on "+addr)
+		go srv.Start()
+		return srv
+	}
+
+	t.Run("restart", func(t *testing.T) {
+		addr := fmt.Sprintf("127.0.0.1:%d", GetFreePort(t))
+		opts := serverpkg.ListenOptions{ReuseAddr: true, Backlog: 16}
+		first := start(addr, opts)
+		time.Sleep(100 * time.Millisecond)
+
+		// The server closing an established connection leaves its side of it in TIME_WAIT
+		clientTLS := certs.ClientTLS.Clone()
+		clientTLS.ServerName = "localhost"
+		conn, err := tls.Dial("tcp", addr, clientTLS)
+		AssertNoError(t, err, "TLS dial should not fail")
+		defer conn.Close()
+		time.Sleep(100 * time.Millisecond)
+		first.Stop()
+
+		second := start(addr, opts)
+		defer second.Stop()
+		time.Sleep(100 * time.Millisecond)
+
+		conn, err = tls.Dial("tcp", addr, clientTLS)
+		AssertNoError(t, err, "TLS dial to the restarted server should not fail")
+		conn.Close()
+	})
+
+	t.Run("reuse port", func(t *testing.T) {
+		addr := fmt.Sprintf("127.0.0.1:%d", GetFreePort(t))
+		opts := serverpkg.ListenOptions{ReusePort: true}
+		first := start(addr, opts)
+		defer first.Stop()
+		second := start(addr, opts)
+		defer second.Stop()
+
+		if !second.GetFeatures().Features["listen_reuse_port"] {
+			t.Error("features do not report listen_reuse_port")
+		}
+	})
+
+	t.Run("negative backlog", func(t *testing.T) {
+		_, err := serverpkg.NewServerWithListenOptions(certs.ServerTLS, "127.0.0.1:0", 10, "error", serverpkg.ListenOptions{Backlog: -1})
+		AssertError(t, err, "a negative backlog should be rejected")
+	})
+}
+
+// TestServerAllowedServerNames tests that handshakes are refused for SNI server names outside the allowlist
+// and accepted for listed names and for clients sending no SNI
+func TestServerAllowedServerNames(t *testing.T) {
+	t.Parallel()
+
+	certs := GenerateTestCerts(t)
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		AssertNoError(t, s.SetAllowedServerNames([]string{"localhost", "*.tunnel.example.com"}), "SetAllowedServerNames")
+	})
+	defer server.Stop()
+
+	tests := []struct {
+		name       string
+		serverName string
+		accept     bool
+	}{
+		{"listed name", "localhost", true},
+		{"wildcard subdomain", "eu.tunnel.example.com", true},
+		{"no SNI", "", true},
+		{"unexpected name", "attacker.example.net", false},
+		{"wildcard parent", "tunnel.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientTLS := certs.ClientTLS.Clone()
+			clientTLS.ServerName = tt.serverName
+			clientTLS.InsecureSkipVerify = true // The server certificate only names localhost
+
+			conn, err := tls.Dial("tcp", server.Addr, clientTLS)
+			if err == nil {
+				conn.Close()
+			}
+			if tt.accept {
+				AssertNoError(t, err, "handshake with an allowed server name")
+			} else if err == nil || !strings.Contains(err.Error(), "remote error") {
+				t.Errorf("handshake for %q: got %v, want it refused by the server", tt.serverName, err)
+			}
+		})
+	}
+}
+
+// TestServerForwardRequest_MaxRequestDuration tests that a request whose upstream trickles its body
+// forever is cancelled at the request duration cap, including one that expected an event stream
+func TestServerForwardRequest_MaxRequestDuration(t *testing.T) {
+	t.Parallel()
+
+	certs := GenerateTestCerts(t)
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetMaxRequestDuration(time.Second)
+	})
+	defer server.Stop()
+
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+
+	// Each byte arrives well within any read timeout, but the body never completes
+	httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1048576")
+		w.WriteHeader(http.StatusOK)
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+			w.Write([]byte("x"))
+			w.(http.Flusher).Flush()
+		}
+	})
+	defer httpServer.Close()
+
+	tests := []struct {
+		name    string
+		stream  bool
+		headers map[string][]string
+	}{
+		{"buffered", false, nil},
+		// Asked for an event stream but got an ordinary body, so the cap replaces the wait for headers
+		{"event stream expected", true, map[string][]string{"Accept": {"text/event-stream"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			resp, err := client.Client.SendRequest(&protocol.Request{
+				ID:      protocol.GenerateID(),
+				Method:  "GET",
+				URL:     httpServer.URL + "/trickle",
+				Headers: tt.headers,
+				Stream:  tt.stream,
+			})
+			elapsed := time.Since(start)
+			if err != nil {
+				t.Fatalf("SendRequest failed: %v", err)
+			}
+
+			if resp.StatusCode != http.StatusGatewayTimeout {
+				t.Errorf("expected status 504, got %d", resp.StatusCode)
+			}
+			if resp.ErrorCode != protocol.ErrCodeTimeout {
+				t.Errorf("expected error code %q, got %q", protocol.ErrCodeTimeout, resp.ErrorCode)
+			}
+			if elapsed < time.Second || elapsed > 5*time.Second {
+				t.Errorf("expected the request to end at the 1s cap, took %v", elapsed)
+			}
+		})
+	}
+}
+
+// TestServerForwardRequest_SlowHeadersWithinCap tests that a slow upstream is governed by the request
+// duration cap alone: a slow reply within the cap succeeds and one past it is a 504
+func TestServerForwardRequest_SlowHeadersWithinCap(t *testing.T) {
+	t.Parallel()
+
+	certs := GenerateTestCerts(t)
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetMaxRequestDuration(2 * time.Second)
+	})
+	defer server.Stop()
+
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+
+	httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		delay, _ := time.ParseDuration(r.URL.Query().Get("delay"))
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(delay):
+		}
+		w.Write([]byte("done"))
+	})
+	defer httpServer.Close()
+
+	tests := []struct {
+		delay      string
+		wantStatus int
+		wantCode   string
+	}{
+		{delay: "1s", wantStatus: http.StatusOK},
+		{delay: "10s", wantStatus: http.StatusGatewayTimeout, wantCode: protocol.ErrCodeTimeout},
+	}
+	for _, tt := range tests {
+		resp, err := client.Client.SendRequest(&protocol.Request{
+			ID:     protocol.GenerateID(),
+			Method: "GET",
+			URL:    httpServer.URL + "/slow?delay=" + tt.delay,
+		})
+		if err != nil {
+			t.Fatalf("SendRequest with delay %s failed: %v", tt.delay, err)
+		}
+		if resp.StatusCode != tt.wantStatus || resp.ErrorCode != tt.wantCode {
+			t.Errorf("delay %s: expected %d %q, got %d %q", tt.delay, tt.wantStatus, tt.wantCode, resp.StatusCode, resp.ErrorCode)
+		}
+	}
+}
+
+// TestServerAcceptRamp tests that a burst of agents reaching a freshly started server is taken on at the
+// configured rate, with the rest turned away with server_busy until their turn
+func TestServerAcceptRamp(t *testing.T) {
+	t.Parallel()
+
+	const rate = 5
+	var mu sync.Mutex
+	var accepted []time.Time
+
+	certs := GenerateTestCerts(t)
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetAcceptRamp(rate, 30*time.Second)
+		s.SetEventHandler(func(ev serverpkg.ConnectionEvent) {
+			if ev.Event == serverpkg.EventConnectionAccepted {
+				mu.Lock()
+				accepted = append(accepted, ev.Time)
+				mu.Unlock()
+			}
+		})
+	})
+	defer server.Stop()
+
+	// Every agent connects at once and, when turned away, tries again quickly regardless of the retry-after
+	const agents = 10
+	var busy atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < agents; i++ {
+		client := agentpkg.NewClientWithTestMode(certs.ClientTLS, server.Addr, "error", true)
+		defer client.Disconnect()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deadline := time.Now().Add(15 * time.Second)
+			for time.Now().Before(deadline) {
+				err := client.Connect()
+				if err == nil {
+					return
+				}
+				var busyErr *agentpkg.ServerBusyError
+				if !errors.As(err, &busyErr) {
+					t.Errorf("expected a server busy error, got %v", err)
+					return
+				}
+				if busyErr.RetryAfter < time.Second {
+					t.Errorf("expected a retry-after of at least 1s, got %v", busyErr.RetryAfter)
+				}
+				busy.Add(1)
+				time.Sleep(50 * time.Millisecond)
+			}
+			t.Error("agent was never accepted")
+		}()
+	}
+	wg.Wait()
+
+	if busy.Load() < agents-2 {
+		t.Errorf("expected most of the burst to be turned away at first, got %d busy responses", busy.Load())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(accepted) != agents {
+		t.Fatalf("expected %d accepted connections, got %d", agents, len(accepted))
+	}
+	// With a bucket of one, n connections need at least (n-1)/rate seconds
+	if spread := accepted[len(accepted)-1].Sub(accepted[0]); spread < time.Duration(agents-1)*time.Second/rate-200*time.Millisecond {
+		t.Errorf("expected accepts to be spread at %d/s, all %d were accepted within %v", rate, agents, spread)
+	}
+}
+
+// TestServerHedging tests that a slow idempotent request is hedged after the hedge delay, answered by the
+// fast hedged request with the slow one cancelled, while non-idempotent requests are never sent twice
+func TestServerHedging(t *testing.T) {
+	t.Parallel()
+
+	const slowDelay = 3 * time.Second
+	var calls atomic.Int32
+	slowCancelled := make(chan struct{}, 1)
+	httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		call := calls.Add(1)
+		if call%2 == 1 {
+			// Odd calls are slow, so each request's hedge is the fast one
+			select {
+			case <-r.Context().Done():
+				slowCancelled <- struct{}{}
+				return
+			case <-time.After(slowDelay):
+			}
+		}
+		fmt.Fprintf(w, "call %d", call)
+	})
+	defer httpServer.Close()
+
+	certs := GenerateTestCerts(t)
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetHedging(200*time.Millisecond, []string{"127.0.0.1"}, 1)
+	})
+	defer server.Stop()
+
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+
+	start := time.Now()
+	resp, err := client.Client.SendRequest(&protocol.Request{
+		ID:     protocol.GenerateID(),
+		Method: "GET",
+		URL:    httpServer.URL + "/hedged",
+	})
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("SendRequest failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || string(resp.Body) != "call 2" {
+		t.Fatalf("expected the hedged request's response, got %d %q", resp.StatusCode, string(resp.Body))
+	}
+	if elapsed > time.Second {
+		t.Errorf("expected the hedged request to answer near the hedge delay, took %v", elapsed)
+	}
+	select {
+	case <-slowCancelled:
+	case <-time.After(2 * time.Second):
+		t.Error("expected the slow request to be cancelled")
+	}
+
+	// POST is not idempotent, so it waits out the slow upstream
+	calls.Store(0)
+	start = time.Now()
+	resp, err = client.Client.SendRequest(&protocol.Request{
+		ID:     protocol.GenerateID(),
+		Method: "POST",
+		URL:    httpServer.URL + "/not-hedged",
+		Body:   []byte("data"),
+	})
+	if err != nil {
+		t.Fatalf("SendRequest failed: %v", err)
+	}
+	if string(resp.Body) != "call 1" || calls.Load() != 1 {
+		t.Errorf("expected a single upstream request, got %q after %d calls", string(resp.Body), calls.Load())
+	}
+	if elapsed := time.Since(start); elapsed < slowDelay {
+		t.Errorf("expected the POST to wait for the slow upstream, took %v", elapsed)
+	}
+}
+
+// TestServerRedirectPolicy tests that upstream redirects are followed, returned or limited to the request's
+// own host according to the redirect policy
+func TestServerRedirectPolicy(t *testing.T) {
+	t.Parallel()
+
+	// A different port makes this a different host, which the same-host policy must not reach
+	var otherHits atomic.Int32
+	otherHost := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		otherHits.Add(1)
+		io.WriteString(w, "other host")
+	})
+	defer otherHost.Close()
+
+	upstream := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/same":
+			http.Redirect(w, r, "/target", http.StatusFound)
+		case "/cross":
+			http.Redirect(w, r, otherHost.URL+"/target", http.StatusFound)
+		default:
+			io.WriteString(w, "same host")
+		}
+	})
+	defer upstream.Close()
+
+	tests := []struct {
+		policy     string
+		path       string
+		wantStatus int
+		wantBody   string
+		wantOther  bool
+	}{
+		{serverpkg.RedirectFollow, "/same", http.StatusOK, "same host", false},
+		{serverpkg.RedirectFollow, "/cross", http.StatusOK, "other host", true},
+		{serverpkg.RedirectNoFollow, "/same", http.StatusFound, "", false},
+		{serverpkg.RedirectNoFollow, "/cross", http.StatusFound, "", false},
+		{serverpkg.RedirectFollowSameHost, "/same", http.StatusOK, "same host", false},
+		{serverpkg.RedirectFollowSameHost, "/cross", http.StatusFound, "", false},
+	}
+
+	certs := GenerateTestCerts(t)
+	for _, tt := range tests {
+		t.Run(tt.policy+tt.path, func(t *testing.T) {
+			server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+				if err := s.SetRedirectPolicy(tt.policy); err != nil {
+					t.Fatalf("SetRedirectPolicy failed: %v", err)
+				}
+			})
+			defer server.Stop()
+
+			client := StartTestClient(t, server.Addr, certs)
+			defer client.Stop()
+
+			otherHits.Store(0)
+			resp, err := client.Client.SendRequest(&protocol.Request{
+				ID:     protocol.GenerateID(),
+				Method: "GET",
+				URL:    upstream.URL + tt.path,
+			})
+			if err != nil {
+				t.Fatalf("SendRequest failed: %v", err)
+			}
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+			if tt.wantBody != "" && string(resp.Body) != tt.wantBody {
+				t.Errorf("expected body %q, got %q", tt.wantBody, string(resp.Body))
+			}
+			if tt.wantStatus == http.StatusFound && len(resp.Headers["Location"]) == 0 {
+				t.Error("expected the redirect's Location header to reach the agent")
+			}
+			if got := otherHits.Load() > 0; got != tt.wantOther {
+				t.Errorf("expected other host reached = %v, got %v", tt.wantOther, got)
+			}
+		})
+	}
+}
+
+// TestServerRedirectPolicy_Invalid tests that an unknown redirect policy is refused
+func TestServerRedirectPolicy_Invalid(t *testing.T) {
+	certs := GenerateTestCerts(t)
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		if err := s.SetRedirectPolicy("sometimes"); err == nil {
+			t.Error("expected an unknown redirect policy to be refused")
+		}
+	})
+	defer server.Stop()
+}
+
+// TestServerMaxConnectionsPerHost tests that a burst of requests to one host never has more than the cap
+// in flight upstream, with requests beyond it waiting for a slot or refused when they may not wait
+func TestServerMaxConnectionsPerHost(t *testing.T) {
+	t.Parallel()
+
+	const limit = 3
+	var active, peak atomic.Int32
+	httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, "ok")
+	})
+	defer httpServer.Close()
+
+	hammer := func(client *TestClient, requests int) []*protocol.Response {
+		var wg sync.WaitGroup
+		responses := make([]*protocol.Response, requests)
+		for i := 0; i < requests; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				resp, err := client.Client.SendRequest(&protocol.Request{
+					ID:     protocol.GenerateID(),
+					Method: "GET",
+					URL:    httpServer.URL + "/hammer",
+				})
+				if err != nil {
+					t.Errorf("SendRequest failed: %v", err)
+					return
+				}
+				responses[i] = resp
+			}(i)
+		}
+		wg.Wait()
+		return responses
+	}
+
+	t.Run("queued", func(t *testing.T) {
+		certs := GenerateTestCerts(t)
+		server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+			s.SetMaxConnectionsPerHost(limit, 0)
+		})
+		defer server.Stop()
+
+		client := StartTestClient(t, server.Addr, certs)
+		defer client.Stop()
+
+		peak.Store(0)
+		for _, resp := range hammer(client, 20) {
+			if resp != nil && resp.StatusCode != http.StatusOK {
+				t.Errorf("expected queued requests to succeed, got %d", resp.StatusCode)
+			}
+		}
+		if got := peak.Load(); got > limit {
+			t.Errorf("expected at most %d concurrent upstream requests, got %d", limit, got)
+		}
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		certs := GenerateTestCerts(t)
+		server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+			s.SetMaxConnectionsPerHost(1, -1)
+		})
+		defer server.Stop()
+
+		client := StartTestClient(t, server.Addr, certs)
+		defer client.Stop()
+
+		refused := 0
+		for _, resp := range hammer(client, 5) {
+			if resp != nil && resp.StatusCode == http.StatusServiceUnavailable {
+				if resp.ErrorCode != protocol.ErrCodeHostBusy {
+					t.Errorf("expected error code %q, got %q", protocol.ErrCodeHostBusy, resp.ErrorCode)
+				}
+				refused++
+			}
+		}
+		if refused == 0 {
+			t.Error("expected requests beyond the cap to be refused")
+		}
+	})
+}
+
+// TestServerFlowControl tests that agents paused by the server hold new requests until they are resumed
+// or the pause lapses, and that agents connecting during a pause are paused too
+func TestServerFlowControl(t *testing.T) {
+	t.Parallel()
+
+	var hits atomic.Int32
+	httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, "ok")
+	})
+	defer httpServer.Close()
+
+	certs := GenerateTestCerts(t)
+	server := StartTestServer(t, certs)
+	defer server.Stop()
+
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+
+	waitPaused := func(c *agentpkg.Client, want bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for c.Paused() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected agent paused = %v", want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	send := func() <-chan *protocol.Response {
+		done := make(chan *protocol.Response, 1)
+		go func() {
+			resp, err := client.Client.SendRequest(&protocol.Request{
+				ID:     protocol.GenerateID(),
+				Method: "GET",
+				URL:    httpServer.URL + "/held",
+			})
+			if err != nil {
+				t.Errorf("SendRequest failed: %v", err)
+			}
+			done <- resp
+		}()
+		return done
+	}
+
+	// Held while paused, released on resume
+	server.Server.PauseAgents(30 * time.Second)
+	waitPaused(client.Client, true)
+
+	other := StartTestClient(t, server.Addr, certs)
+	defer other.Stop()
+	waitPaused(other.Client, true)
+
+	done := send()
+	select {
+	case <-done:
+		t.Fatal("expected the request to be held while the agent is paused")
+	case <-time.After(500 * time.Millisecond):
+	}
+	if hits.Load() != 0 {
+		t.Fatal("expected no upstream request while the agent is paused")
+	}
+
+	server.Server.ResumeAgents()
+	select {
+	case resp := <-done:
+		if resp == nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected the held request to succeed after resume, got %+v", resp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the held request to be released on resume")
+	}
+	waitPaused(other.Client, false)
+
+	// A pause whose resume never arrives lapses by itself
+	server.Server.PauseAgents(time.Second)
+	waitPaused(client.Client, true)
+	start := time.Now()
+	select {
+	case resp := <-send():
+		if resp == nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected the held request to succeed once the pause lapsed, got %+v", resp)
+		}
+		if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+			t.Errorf("expected the request to be held until the pause lapsed, took %v", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the pause to lapse without a resume")
+	}
+}
+
+// TestServerFlowControl_Triggers tests that agents are paused while the load shedding signal is over its
+// threshold and resumed once it recovers, and paused again when the server starts draining
+func TestServerFlowControl_Triggers(t *testing.T) {
+	t.Parallel()
+
+	var load atomic.Int64
+	certs := GenerateTestCerts(t)
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetLoadShedding(func() float64 { return float64(load.Load()) }, 10, 0.5)
+		s.SetOverloadPause(30 * time.Second)
+		s.SetDrainPause(true)
+		s.SetStopGracePeriod(2 * time.Second)
+	})
+	defer server.Stop()
+
+	client := StartTestClient(t, server.Addr, certs)
+	defer client.Stop()
+
+	waitPaused := func(want bool, within time.Duration) {
+		t.Helper()
+		deadline := time.Now().Add(within)
+		for client.Client.Paused() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected agent paused = %v", want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	load.Store(20)
+	waitPaused(true, 5*time.Second)
+
+	load.Store(0)
+	waitPaused(false, 5*time.Second)
+
+	go server.Stop()
+	waitPaused(true, time.Second)
+}
+
+// TestServerAuditLog tests that HTTP requests and CONNECT tunnels produce metadata-only audit records
+func TestServerAuditLog(t *testing.T) {
+	t.Parallel()
+
+	certs := GenerateTestCerts(t)
+	audit := &logBuffer{}
+	tunnelServer := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetAuditLog(audit, 0)
+		s.SetBodySpill(int64(len("private spilled request body"))-1, t.TempDir())
+	})
+	defer tunnelServer.Stop()
+
+	agent := StartTestClient(t, tunnelServer.Addr, certs)
+	defer agent.Stop()
+
+	targetServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "private response body")
+	})
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	AssertNoError(t, err, "Listen should not fail")
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	// records waits for n audit records and returns them with the raw log
+	records := func(n int) ([]serverpkg.AuditRecord, string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			raw := audit.String()
+			lines := strings.Split(strings.TrimSpace(raw), "\n")
+			if raw != "" && len(lines) >= n {
+				var recs []serverpkg.AuditRecord
+				for _, line := range lines {
+					var rec serverpkg.AuditRecord
+					AssertNoError(t, json.Unmarshal([]byte(line), &rec), "audit line should be JSON")
+					recs = append(recs, rec)
+				}
+				return recs, raw
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d audit records, got: %s", n, raw)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	resp, err := agent.Client.SendRequest(&protocol.Request{
+		ID:     protocol.GenerateID(),
+		Method: "POST",
+		URL:    targetServer.URL + "/accounts/42?token=secret-token",
+		Body:   []byte("private request body"),
+	})
+	AssertNoError(t, err, "SendRequest should not fail")
+	AssertEqual(t, http.StatusCreated, resp.StatusCode, "status code")
+
+	recs, raw := records(1)
+	httpRec := recs[0]
+	AssertEqual(t, serverpkg.AuditHTTP, httpRec.Type, "type")
+	AssertEqual(t, "test-client", httpRec.Client, "client")
+	AssertEqual(t, "POST", httpRec.Method, "method")
+	AssertEqual(t, "127.0.0.1", httpRec.Domain, "domain")
+	AssertEqual(t, http.StatusCreated, httpRec.Status, "status")
+	AssertEqual(t, int64(len("private request body")), httpRec.BytesIn, "bytes in")
+	AssertEqual(t, int64(len("private response body")), httpRec.BytesOut, "bytes out")
+	if httpRec.Time.IsZero() {
+		t.Error("expected the record to carry a timestamp")
+	}
+
+	conn := dialThroughProxy(t, agent.ProxyPort, echo.Addr().String())
+	_, err = conn.Write([]byte("ping"))
+	AssertNoError(t, err, "Write should not fail")
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	AssertNoError(t, err, "Read echo should not fail")
+	conn.Close()
+
+	recs, raw = records(2)
+	connectRec := recs[1]
+	AssertEqual(t, serverpkg.AuditConnect, connectRec.Type, "type")
+	AssertEqual(t, "test-client", connectRec.Client, "client")
+	AssertEqual(t, echo.Addr().String(), connectRec.Target, "target")
+	AssertEqual(t, int64(4), connectRec.BytesIn, "bytes in")
+	AssertEqual(t, int64(4), connectRec.BytesOut, "bytes out")
+
+	// A body spilled to disk is counted at its full size
+	resp, err = agent.Client.SendRequest(&protocol.Request{
+		ID:     protocol.GenerateID(),
+		Method: "POST",
+		URL:    targetServer.URL + "/accounts/42",
+		Body:   []byte("private spilled request body"),
+	})
+	AssertNoError(t, err, "SendRequest should not fail")
+	AssertEqual(t, http.StatusCreated, resp.StatusCode, "status code")
+
+	recs, raw = records(3)
+	AssertEqual(t, int64(len("private spilled request body")), recs[2].BytesIn, "spilled bytes in")
+
+	// A streamed body is counted as it is relayed
+	resp, err = agent.Client.SendRequestStream(&protocol.Request{
+		ID:     protocol.GenerateID(),
+		Method: "POST",
+		URL:    targetServer.URL + "/accounts/42",
+	}, strings.NewReader("private streamed body"))
+	AssertNoError(t, err, "SendRequestStream should not fail")
+	AssertEqual(t, http.StatusCreated, resp.StatusCode, "status code")
+
+	recs, raw = records(4)
+	AssertEqual(t, int64(len("private streamed body")), recs[3].BytesIn, "streamed bytes in")
+
+	// Bodies, paths and query strings never reach the audit log
+	for _, private := range []string{"private request body", "private spilled request body", "private streamed body", "private response body", "/accounts", "secret-token", "ping"} {
+		if strings.Contains(raw, private) {
+			t.Errorf("audit log contains %q: %s", private, raw)
+		}
+	}
+}
+
+// TestTunnelHeartbeat verifies that both ends ping an idle tunnel and stay quiet while it carries traffic
+func TestTunnelHeartbeat(t *testing.T) {
+	const interval = 300 * time.Millisecond
+
+	certs := GenerateTestCerts(t)
+	serverLogs := &logBuffer{}
+	server := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetHeartbeatInterval(interval)
+		s.Logger().SetLevel("debug")
+		s.Logger().Logger.SetOutput(serverLogs)
+	})
+	defer server.Stop()
+
+	agentLogs := &logBuffer{}
+	client := agentpkg.NewClientWithTestMode(certs.ClientTLS, server.Addr, "debug", true)
+	client.SetHeartbeatInterval(interval)
+	client.Logger().Logger.SetOutput(agentLogs)
+	AssertNoError(t, client.Connect(), "Connect should not fail")
+	defer client.Disconnect()
+
+	httpServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	send := func() {
+		t.Helper()
+		resp, err := client.SendRequest(&protocol.Request{
+			ID:     protocol.GenerateID(),
+			Method: "GET",
+			URL:    httpServer.URL,
+		})
+		AssertNoError(t, err, "SendRequest should not fail")
+		AssertEqual(t, http.StatusOK, resp.StatusCode, "status code")
+	}
+	// pings returns how many pings each side has received
+	pings := func() (toServer, toAgent int) {
+		return strings.Count(serverLogs.String(), "Heartbeat ping received from agent"),
+			strings.Count(agentLogs.String(), "Heartbeat ping received from server")
+	}
+
+	// An idle tunnel is pinged in both directions
+	time.Sleep(4 * interval)
+	toServer, toAgent := pings()
+	if toServer < 2 || toAgent < 2 {
+		t.Fatalf("expected an idle tunnel to be pinged both ways, got %d to the server and %d to the agent", toServer, toAgent)
+	}
+
+	// Requests well inside the interval keep both directions busy, so no pings are sent
+	send()
+	toServer, toAgent = pings()
+	for deadline := time.Now().Add(4 * interval); time.Now().Before(deadline); {
+		send()
+		time.Sleep(interval / 10)
+	}
+	afterServer, afterAgent := pings()
+	AssertEqual(t, toServer, afterServer, "pings to the server under traffic")
+	AssertEqual(t, toAgent, afterAgent, "pings to the agent under traffic")
+}
+
+// TestServerRequiredHeader verifies that requests and CONNECT tunnels are only admitted with an accepted
+// value of the required header, which never reaches the upstream
+func TestServerRequiredHeader(t *testing.T) {
+	t.Parallel()
+
+	const header = "X-Tunnel-Key"
+
+	certs := GenerateTestCerts(t)
+	tunnelServer := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		AssertNoError(t, s.SetRequiredHeader(header, []string{"secret-a", "secret-b"}), "SetRequiredHeader should not fail")
+	})
+	defer tunnelServer.Stop()
+
+	agent := StartTestClient(t, tunnelServer.Addr, certs)
+	defer agent.Stop()
+
+	var leaked atomic.Bool
+	targetServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(header) != "" {
+			leaked.Store(true)
+		}
+		w.Write([]byte("ok"))
+	})
+
+	proxyAddr := fmt.Sprintf("127.0.0.1:%d", agent.ProxyPort)
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	// get sends a proxied request with the header set to value (none when empty)
+	get := func(value string) int {
+		t.Helper()
+		req, err := http.NewRequest("GET", targetServer.URL, nil)
+		AssertNoError(t, err, "NewRequest should not fail")
+		if value != "" {
+			req.Header.Set(header, value)
+		}
+		resp, err := client.Do(req)
+		AssertNoError(t, err, "Proxy request should not fail")
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode
+	}
+
+	// connect opens a CONNECT tunnel to the target with the header set to value (none when empty)
+	connect := func(value string) int {
+		t.Helper()
+		conn, err := net.Dial("tcp", proxyAddr)
+		AssertNoError(t, err, "Dial proxy should not fail")
+		defer conn.Close()
+		target := strings.TrimPrefix(targetServer.URL, "http://")
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+		if value != "" {
+			fmt.Fprintf(conn, "%s: %s\r\n", header, value)
+		}
+		fmt.Fprint(conn, "\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		AssertNoError(t, err, "CONNECT response should be readable")
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	AssertEqual(t, http.StatusOK, get("secret-a"), "status with an accepted value")
+	AssertEqual(t, http.StatusOK, get("secret-b"), "status with another accepted value")
+	AssertEqual(t, http.StatusForbidden, get("secret-c"), "status with a wrong value")
+	AssertEqual(t, http.StatusForbidden, get(""), "status without the header")
+	if leaked.Load() {
+		t.Error("required header was forwarded to the upstream")
+	}
+
+	AssertEqual(t, http.StatusOK, connect("secret-a"), "CONNECT status with an accepted value")
+	AssertEqual(t, http.StatusForbidden, connect("secret-"), "CONNECT status with a wrong value")
+	AssertEqual(t, http.StatusForbidden, connect(""), "CONNECT status without the header")
+}
+
+func TestServerMemoryBudget(t *testing.T) {
+	t.Parallel()
+
+	const (
+		bodySize = 512 * 1024
+		budget   = 3 * bodySize / 2
+		requests = 8
+	)
+
+	certs := GenerateTestCerts(t)
+	tunnelServer := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetMemoryBudget(budget)
+	})
+	tunnelSrv := tunnelServer.Server
+	defer tunnelServer.Stop()
+
+	agent := StartTestClient(t, tunnelServer.Addr, certs)
+	defer agent.Stop()
+
+	// Large bodies written slowly, so many transfers are buffered on the server at once
+	chunk := bytes.Repeat([]byte("x"), 64*1024)
+	targetServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(bodySize))
+		for written := 0; written < bodySize; written += len(chunk) {
+			w.Write(chunk)
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+
+	proxyURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", agent.ProxyPort))
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 30 * time.Second}
+
+	var ok, failed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, targetServer.URL, nil)
+			req.Header.Set("Accept", "application/json")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Errorf("Proxy request failed: %v", err)
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			switch resp.StatusCode {
+			case http.StatusOK:
+				if len(body) != bodySize {
+					t.Errorf("Expected a complete %d byte body, got %d bytes", bodySize, len(body))
+				}
+				ok.Add(1)
+			case http.StatusBadGateway:
+				// The upstream already answered, so the failure must not invite a blind retry
+				if !strings.Contains(string(body), protocol.ErrCodeResponseTooLarge) || resp.Header.Get("Retry-After") != "" {
+					t.Errorf("Expected a final %s error, got Retry-After %q and body %s", protocol.ErrCodeResponseTooLarge, resp.Header.Get("Retry-After"), body)
+				}
+				failed.Add(1)
+			default:
+				t.Errorf("Unexpected status %d", resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ok.Load() == 0 {
+		t.Error("Expected some transfers to fit within the budget")
+	}
+	if failed.Load() == 0 {
+		t.Error("Expected responses beyond the budget to fail with a 502")
+	}
+	if peak := tunnelSrv.PeakInflightBytes(); peak > budget || peak == 0 {
+		t.Errorf("Expected peak in-flight bytes within the %d byte budget, got %d", budget, peak)
+	}
+
+	// Everything reserved is given back once the transfers finish
+	deadline := time.Now().Add(2 * time.Second)
+	for tunnelSrv.InflightBytes() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	AssertEqual(t, int64(0), tunnelSrv.InflightBytes(), "in-flight bytes after the transfers")
+}
+
+// TestServerMemoryBudget_WebSocket tests that WebSocket buffers are reserved from the memory budget while
+// the WebSocket is open, and that a WebSocket that does not fit is refused
+func TestServerMemoryBudget_WebSocket(t *testing.T) {
+	t.Parallel()
+
+	certs := GenerateTestCerts(t)
+	tunnelServer := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetMemoryBudget(12 * 1024)
+	})
+	defer tunnelServer.Stop()
+
+	client := StartTestClient(t, tunnelServer.Addr, certs)
+	defer client.Stop()
+
+	upgrader := websocket.Upgrader{}
+	wsServer := MockHTTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	wsURL := "ws" + strings.TrimPrefix(wsServer.URL, "http")
+
+	first := protocol.GenerateID()
+	ack, err := client.Client.WebSocketOpen(&protocol.WebSocketOpen{ID: first, URL: wsURL})
+	AssertNoError(t, err, "First WebSocket open should not fail")
+	AssertEqual(t, true, ack.Ok, "first WebSocket accepted")
+	if tunnelServer.Server.InflightBytes() == 0 {
+		t.Error("Expected an open WebSocket to hold bytes against the budget")
+	}
+
+	ack, err = client.Client.WebSocketOpen(&protocol.WebSocketOpen{ID: protocol.GenerateID(), URL: wsURL})
+	AssertNoError(t, err, "Second WebSocket open should not fail")
+	AssertEqual(t, false, ack.Ok, "second WebSocket accepted")
+	AssertEqual(t, protocol.ErrCodeLoadShed, ack.ErrorCode, "second WebSocket error code")
+
+	// Closing the WebSocket gives its buffers back
+	AssertNoError(t, client.Client.WebSocketClose(first, websocket.CloseNormalClosure, ""), "WebSocket close should not fail")
+	deadline := time.Now().Add(5 * time.Second)
+	for tunnelServer.Server.InflightBytes() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	AssertEqual(t, int64(0), tunnelServer.Server.InflightBytes(), "in-flight bytes after the WebSocket closed")
+}
+
+// TestServerConfigDumpRedactsSecrets tests that the required header values, which are shared secrets, are
+// redacted when the server config is dumped
+func TestServerConfigDumpRedactsSecrets(t *testing.T) {
+	cfg := &serverpkg.Config{
+		RequiredHeader:       "X-Fluidity-Key",
+		RequiredHeaderValues: []string{"s3cret-one", "s3cret-two"},
+	}
+
+	for _, format := range []string{"yaml", "json"} {
+		var out bytes.Buffer
+		AssertNoError(t, sharedconfig.Dump(&out, cfg, format), "Dump config as "+format)
+		if strings.Contains(out.String(), "s3cret") {
+			t.Errorf("%s dump leaks the required header values:\n%s", format, out.String())
+		}
+		if !strings.Contains(out.String(), sharedconfig.Redacted) {
+			t.Errorf("%s dump does not redact the required header values:\n%s", format, out.String())
+		}
+		if !strings.Contains(out.String(), "X-Fluidity-Key") {
+			t.Errorf("%s dump is missing the required header name:\n%s", format, out.String())
+		}
+	}
+}
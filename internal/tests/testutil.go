@@ -1,6 +1,9 @@
 package tests
 
 import (
+	"bufio"
+	"bytes"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -8,10 +11,12 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -30,7 +35,7 @@ type TestCerts struct {
 }
 
 // GenerateTestCerts creates test certificates for mTLS testing
-func GenerateTestCerts(t *testing.T) *TestCerts {
+func GenerateTestCerts(t testing.TB) *TestCerts {
 	t.Helper()
 
 	// Generate CA
@@ -149,15 +154,54 @@ func GenerateTestCerts(t *testing.T) *TestCerts {
 	}
 }
 
+// IssueClientCert signs a client certificate for key with the test CA, for testing key policies
+func IssueClientCert(t testing.TB, certs *TestCerts, key crypto.Signer) tls.Certificate {
+	t.Helper()
+	return IssueClientCertUntil(t, certs, key, time.Now().Add(24*time.Hour))
+}
+
+// IssueClientCertUntil signs a client certificate for key with the test CA that expires at notAfter
+func IssueClientCertUntil(t testing.TB, certs *TestCerts, key crypto.Signer, notAfter time.Time) tls.Certificate {
+	t.Helper()
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{
+			CommonName:   "test-client",
+			Organization: []string{"Fluidity Test"},
+		},
+		NotBefore:   time.Now(),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, certs.CACert, key.Public(), certs.CAKey)
+	if err != nil {
+		t.Fatalf("Failed to create client certificate: %v", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{certBytes},
+		PrivateKey:  key,
+	}
+}
+
 // TestServer wraps a test tunnel server
 type TestServer struct {
 	Server *server.Server
 	Addr   string
-	t      *testing.T
+	t      testing.TB
 }
 
 // StartTestServer creates and starts a test tunnel server
-func StartTestServer(t *testing.T, certs *TestCerts) *TestServer {
+func StartTestServer(t testing.TB, certs *TestCerts) *TestServer {
+	t.Helper()
+	return StartTestServerWith(t, certs, nil)
+}
+
+// StartTestServerWith creates a test tunnel server, applies configure before starting it
+func StartTestServerWith(t testing.TB, certs *TestCerts, configure func(*server.Server)) *TestServer {
 	t.Helper()
 
 	// Use port 0 to get a random free port
@@ -190,6 +234,9 @@ func StartTestServer(t *testing.T, certs *TestCerts) *TestServer {
 	if err != nil {
 		t.Fatalf("Failed to recreate test server: %v", err)
 	}
+	if configure != nil {
+		configure(srv)
+	}
 
 	// Start again
 	go func() {
@@ -222,11 +269,17 @@ type TestClient struct {
 	Client    *agent.Client
 	Proxy     *agent.Server
 	ProxyPort int
-	t         *testing.T
+	t         testing.TB
 }
 
 // StartTestClient creates and starts a test tunnel client with proxy
-func StartTestClient(t *testing.T, serverAddr string, certs *TestCerts) *TestClient {
+func StartTestClient(t testing.TB, serverAddr string, certs *TestCerts) *TestClient {
+	t.Helper()
+	return StartTestClientWith(t, serverAddr, certs, nil)
+}
+
+// StartTestClientWith creates a test tunnel client and proxy, applies configure to the proxy before starting it
+func StartTestClientWith(t testing.TB, serverAddr string, certs *TestCerts, configure func(*agent.Server)) *TestClient {
 	t.Helper()
 
 	client := agent.NewClientWithTestMode(certs.ClientTLS, serverAddr, "error", true)
@@ -241,6 +294,9 @@ func StartTestClient(t *testing.T, serverAddr string, certs *TestCerts) *TestCli
 
 	// Create and start proxy server
 	proxyServer := agent.NewServer(proxyPort, client, "error")
+	if configure != nil {
+		configure(proxyServer)
+	}
 	err = proxyServer.Start()
 	if err != nil {
 		client.Disconnect()
@@ -271,7 +327,7 @@ func (tc *TestClient) Stop() {
 }
 
 // MockHTTPServer creates a mock HTTP server for testing
-func MockHTTPServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+func MockHTTPServer(t testing.TB, handler http.HandlerFunc) *httptest.Server {
 	t.Helper()
 
 	if handler == nil {
@@ -289,7 +345,7 @@ func MockHTTPServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
 }
 
 // MockHTTPSServer creates a mock HTTPS server for testing
-func MockHTTPSServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+func MockHTTPSServer(t testing.TB, handler http.HandlerFunc) *httptest.Server {
 	t.Helper()
 
 	if handler == nil {
@@ -306,8 +362,58 @@ func MockHTTPSServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
 	return server
 }
 
+// dialThroughProxy opens a CONNECT tunnel to target through the agent proxy
+func dialThroughProxy(t testing.TB, proxyPort int, target string) *net.TCPConn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", proxyPort))
+	AssertNoError(t, err, "Connect to proxy should not fail")
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	AssertNoError(t, err, "CONNECT request should not fail")
+
+	// Read the response byte by byte so no tunnelled bytes are buffered away
+	var head []byte
+	buf := make([]byte, 1)
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		_, err := conn.Read(buf)
+		AssertNoError(t, err, "Read CONNECT response should not fail")
+		head = append(head, buf[0])
+	}
+	if !bytes.HasPrefix(head, []byte("HTTP/1.1 200")) {
+		t.Fatalf("CONNECT failed: %q", head)
+	}
+
+	return conn.(*net.TCPConn)
+}
+
+// sendRawRequest writes a GET for requestURI with the given Host and extra header lines straight to the
+// agent proxy, so malformed or unusual request lines reach it unchanged, and returns the response and its body
+func sendRawRequest(t testing.TB, proxyPort int, requestURI, host string, headers ...string) (*http.Response, []byte) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", proxyPort))
+	AssertNoError(t, err, "Dial proxy should not fail")
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	var extra strings.Builder
+	for _, header := range headers {
+		extra.WriteString(header + "\r\n")
+	}
+	_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n%sConnection: close\r\n\r\n", requestURI, host, extra.String())
+	AssertNoError(t, err, "Write request should not fail")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	AssertNoError(t, err, "Read response should not fail")
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, body
+}
+
 // AssertNoError fails the test if err is not nil
-func AssertNoError(t *testing.T, err error, msg string) {
+func AssertNoError(t testing.TB, err error, msg string) {
 	t.Helper()
 	if err != nil {
 		t.Fatalf("%s: %v", msg, err)
@@ -315,7 +421,7 @@ func AssertNoError(t *testing.T, err error, msg string) {
 }
 
 // AssertError fails the test if err is nil
-func AssertError(t *testing.T, err error, msg string) {
+func AssertError(t testing.TB, err error, msg string) {
 	t.Helper()
 	if err == nil {
 		t.Fatalf("%s: expected error but got nil", msg)
@@ -323,7 +429,7 @@ func AssertError(t *testing.T, err error, msg string) {
 }
 
 // AssertEqual fails the test if expected != actual
-func AssertEqual(t *testing.T, expected, actual interface{}, msg string) {
+func AssertEqual(t testing.TB, expected, actual interface{}, msg string) {
 	t.Helper()
 	if expected != actual {
 		t.Fatalf("%s: expected %v, got %v", msg, expected, actual)
@@ -331,7 +437,7 @@ func AssertEqual(t *testing.T, expected, actual interface{}, msg string) {
 }
 
 // GetFreePort finds an available port
-func GetFreePort(t *testing.T) int {
+func GetFreePort(t testing.TB) int {
 	t.Helper()
 
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
@@ -345,7 +451,7 @@ func GetFreePort(t *testing.T) int {
 }
 
 // WaitForPort waits for a port to be available or timeout
-func WaitForPort(t *testing.T, addr string, timeout time.Duration) error {
+func WaitForPort(t testing.TB, addr string, timeout time.Duration) error {
 	t.Helper()
 
 	deadline := time.Now().Add(timeout)
@@ -2,14 +2,19 @@ package tests
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	agentpkg "fluidity/internal/core/agent"
+	serverpkg "fluidity/internal/core/server"
+
 	"github.com/gorilla/websocket"
 )
 
@@ -489,3 +494,188 @@ func TestWebSocketCloseHandshake(t *testing.T) {
 
 	t.Log("WebSocket close handshake successful")
 }
+
+func TestWebSocketKeepalive(t *testing.T) {
+	t.Parallel()
+
+	certs := GenerateTestCerts(t)
+
+	// upstream starts a WebSocket server that counts pings, reading only when answer is set
+	upstream := func(answer bool) (*httptest.Server, *atomic.Int32, chan struct{}) {
+		var pings atomic.Int32
+		closed := make(chan struct{})
+		stop := make(chan struct{})
+		wsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			defer close(closed)
+			conn.SetPingHandler(func(data string) error {
+				pings.Add(1)
+				return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+			})
+			if !answer {
+				// Never read, so pings are never answered
+				<-stop
+				return
+			}
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}))
+		t.Cleanup(wsServer.Close)
+		t.Cleanup(func() { close(stop) })
+		return wsServer, &pings, closed
+	}
+
+	tunnelServer := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetWebSocketKeepalive(100*time.Millisecond, 200*time.Millisecond)
+	})
+	defer tunnelServer.Stop()
+
+	agent := StartTestClientWith(t, tunnelServer.Addr, certs, func(p *agentpkg.Server) {
+		p.SetWebSocketKeepalive(100*time.Millisecond, 200*time.Millisecond)
+	})
+	defer agent.Stop()
+
+	// Dial the proxy directly so it handles the upgrade itself rather than tunnelling a CONNECT
+	dialer := websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			return net.Dial(network, fmt.Sprintf("localhost:%d", agent.ProxyPort))
+		},
+	}
+
+	t.Run("pings both ends of an idle tunnel", func(t *testing.T) {
+		wsServer, upstreamPings, _ := upstream(true)
+
+		conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(wsServer.URL, "http"), nil)
+		AssertNoError(t, err, "WebSocket connection should not fail")
+		defer conn.Close()
+
+		var clientPings atomic.Int32
+		conn.SetPingHandler(func(data string) error {
+			clientPings.Add(1)
+			return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+		readErr := make(chan error, 1)
+		go func() {
+			_, _, err := conn.ReadMessage()
+			readErr <- err
+		}()
+
+		// Idle well past interval+timeout, the answered pings keep both legs open
+		select {
+		case err := <-readErr:
+			t.Fatalf("Idle tunnel closed: %v", err)
+		case <-time.After(time.Second):
+		}
+		if n := clientPings.Load(); n < 3 {
+			t.Errorf("Expected the proxy to ping the client at least 3 times, got %d", n)
+		}
+		if n := upstreamPings.Load(); n < 3 {
+			t.Errorf("Expected the server to ping the target at least 3 times, got %d", n)
+		}
+
+		// The tunnel still carries messages
+		AssertNoError(t, conn.WriteMessage(websocket.TextMessage, []byte("still here")), "Send after idle should not fail")
+	})
+
+	t.Run("target missing pongs closes the client", func(t *testing.T) {
+		wsServer, _, _ := upstream(false)
+
+		conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(wsServer.URL, "http"), nil)
+		AssertNoError(t, err, "WebSocket connection should not fail")
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		start := time.Now()
+		for {
+			if _, _, err = conn.ReadMessage(); err != nil {
+				break
+			}
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("Client closed after %v, expected the dead target to be noticed sooner", elapsed)
+		}
+	})
+
+	t.Run("client missing pongs closes the target", func(t *testing.T) {
+		wsServer, _, closed := upstream(true)
+
+		conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(wsServer.URL, "http"), nil)
+		AssertNoError(t, err, "WebSocket connection should not fail")
+		defer conn.Close()
+
+		// The client never reads, so it never answers the proxy's pings
+		select {
+		case <-closed:
+		case <-time.After(3 * time.Second):
+			t.Fatal("Target connection stayed open after the client stopped answering pings")
+		}
+	})
+}
+
+func TestWebSocketStreamLimitPerAgent(t *testing.T) {
+	t.Parallel()
+
+	certs := GenerateTestCerts(t)
+
+	wsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(messageType, message); err != nil {
+				return
+			}
+		}
+	}))
+	defer wsServer.Close()
+
+	tunnelServer := StartTestServerWith(t, certs, func(s *serverpkg.Server) {
+		s.SetMaxStreamsPerAgent(0, 1)
+	})
+	defer tunnelServer.Stop()
+
+	agent := StartTestClient(t, tunnelServer.Addr, certs)
+	defer agent.Stop()
+
+	// Dial the proxy directly so it opens a WebSocket stream rather than tunnelling a CONNECT
+	wsURL := "ws" + strings.TrimPrefix(wsServer.URL, "http")
+	dialer := websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			return net.Dial(network, fmt.Sprintf("localhost:%d", agent.ProxyPort))
+		},
+	}
+
+	conn, _, err := dialer.Dial(wsURL, nil)
+	AssertNoError(t, err, "First WebSocket should connect")
+	defer conn.Close()
+
+	// The second WebSocket is over the agent's limit
+	second, resp, err := dialer.Dial(wsURL, nil)
+	if err == nil {
+		second.Close()
+		t.Fatal("expected a WebSocket beyond the per-agent limit to be refused")
+	}
+	if resp != nil {
+		AssertEqual(t, http.StatusBadGateway, resp.StatusCode, "Refused WebSocket status")
+	}
+
+	// The existing WebSocket carries on
+	AssertNoError(t, conn.WriteMessage(websocket.TextMessage, []byte("still open")), "Send message should not fail")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, message, err := conn.ReadMessage()
+	AssertNoError(t, err, "Existing WebSocket should still echo")
+	AssertEqual(t, "still open", string(message), "Message content")
+}
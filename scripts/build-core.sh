@@ -42,6 +42,11 @@ BUILD_VERSION="${BUILD_VERSION:-$(date +%Y%m%d%H%M%S)}"
 mkdir -p "$BUILD_DIR"
 echo "$BUILD_VERSION" > "$BUILD_DIR/.build_version"
 
+# Stamp build version, commit and time into binaries for --version, /version and the compatibility handshake
+BUILD_COMMIT="$(git rev-parse --short HEAD 2>/dev/null || echo unknown)"
+BUILD_TIME="$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+VERSION_LDFLAGS="-X fluidity/internal/shared/version.Version=$BUILD_VERSION -X fluidity/internal/shared/version.Commit=$BUILD_COMMIT -X fluidity/internal/shared/version.BuildTime=$BUILD_TIME"
+
 # Default options
 BUILD_AGENT=false
 BUILD_SERVER=false
@@ -144,7 +149,7 @@ if [[ "$BUILD_SERVER" == true ]]; then
     
     cd "$SERVER_DIR"
     
-    BUILD_CMD="go build -ldflags='-s -w' -o $BUILD_DIR/$SERVER_BINARY ."
+    BUILD_CMD="go build -ldflags='-s -w $VERSION_LDFLAGS' -o $BUILD_DIR/$SERVER_BINARY ."
     
     if [[ -n "$GOOS" ]]; then
         BUILD_CMD="GOOS=$GOOS GOARCH=$GOARCH CGO_ENABLED=$CGO_ENABLED $BUILD_CMD"
@@ -178,7 +183,7 @@ if [[ "$BUILD_AGENT" == true ]]; then
     
     cd "$AGENT_DIR"
     
-    BUILD_CMD="go build -ldflags='-s -w' -o $BUILD_DIR/$AGENT_BINARY ."
+    BUILD_CMD="go build -ldflags='-s -w $VERSION_LDFLAGS' -o $BUILD_DIR/$AGENT_BINARY ."
     
     if [[ -n "$GOOS" ]]; then
         BUILD_CMD="GOOS=$GOOS GOARCH=$GOARCH CGO_ENABLED=$CGO_ENABLED $BUILD_CMD"